@@ -0,0 +1,517 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rhavar/bustapay/electrum"
+	"github.com/rhavar/bustapay/receive"
+	"github.com/rhavar/bustapay/rpc-client"
+	"github.com/rhavar/bustapay/wallet"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// options is every setting, from the flags, env variables or the config file (viper sorts out which wins). They're
+// loaded once by initConfig, so nothing else needs to know viper's keys
+type options struct {
+	Verbose   bool     `mapstructure:"verbose"`
+	LogLevel  string   `mapstructure:"log_level"`
+	LogFormat string   `mapstructure:"log_format"`
+	LogRedact []string `mapstructure:"log_redact"`
+	DataDir   string   `mapstructure:"data_dir"`
+
+	BitcoindHost     string `mapstructure:"bitcoind_host"`
+	BitcoindPort     string `mapstructure:"bitcoind_port"`
+	BitcoindUser     string `mapstructure:"bitcoind_user"`
+	BitcoindPass     string `mapstructure:"bitcoind_pass"`
+	BitcoindPassFile string `mapstructure:"bitcoind_pass_file"`
+	BitcoindCookie   string `mapstructure:"bitcoind_cookie"`
+	BitcoindDataDir  string `mapstructure:"bitcoind_datadir"`
+	BitcoindWallet   string `mapstructure:"bitcoind_wallet"`
+	BitcoindTLS      bool   `mapstructure:"bitcoind_tls"`
+	BitcoindTLSCert  string `mapstructure:"bitcoind_tls_cert"`
+
+	// receive
+	Port                  int             `mapstructure:"port"`
+	ShutdownTimeout       time.Duration   `mapstructure:"shutdown_timeout"`
+	DisableAutoRelay      bool            `mapstructure:"disable_auto_relay"`
+	RequireMatchingInputs bool            `mapstructure:"require_matching_inputs"`
+	WebhookUrl            []string        `mapstructure:"webhook_url"`
+	WebhookSecret         string          `mapstructure:"webhook_secret"`
+	WebhookSecretFile     string          `mapstructure:"webhook_secret_file"`
+	ZmqRawTx              string          `mapstructure:"zmq_rawtx"`
+	ZmqHashBlock          string          `mapstructure:"zmq_hashblock"`
+	FeeBumpAfter          time.Duration   `mapstructure:"fee_bump_after"`
+	FeeBumpConfTarget     int             `mapstructure:"fee_bump_conf_target"`
+	FeeBumpMaxFeeRate     float64         `mapstructure:"fee_bump_max_feerate"`
+	AdminAddr             string          `mapstructure:"admin_addr"`
+	AdminToken            string          `mapstructure:"admin_token"`
+	AdminTokenFile        string          `mapstructure:"admin_token_file"`
+	SignerUrl             string          `mapstructure:"signer_url"`
+	SignerDir             string          `mapstructure:"signer_dir"`
+	SignerKey             string          `mapstructure:"signer_key"`
+	SignerKeyFile         string          `mapstructure:"signer_key_file"`
+	SignerTimeout         time.Duration   `mapstructure:"signer_timeout"`
+	MinUnspents           int             `mapstructure:"min_unspents"`
+	WalletPassphrase      string          `mapstructure:"wallet_passphrase"`
+	WalletPassphraseFile  string          `mapstructure:"wallet_passphrase_file"`
+	Tenants               []tenantOptions `mapstructure:"tenants"`
+
+	// bustapay's own wallet, for send and receive
+	Descriptor           string `mapstructure:"descriptor"`
+	DescriptorFile       string `mapstructure:"descriptor_file"`
+	ChangeDescriptor     string `mapstructure:"change_descriptor"`
+	ChangeDescriptorFile string `mapstructure:"change_descriptor_file"`
+	WalletBirthday       int64  `mapstructure:"wallet_birthday"`
+	ElectrumServer       string `mapstructure:"electrum_server"`
+
+	// payments
+	Json   bool   `mapstructure:"json"`
+	Tenant string `mapstructure:"tenant"`
+}
+
+var opts options
+
+// loadOptions fills in opts, and checks the options every command uses
+func loadOptions() error {
+	if err := viper.Unmarshal(&opts); err != nil {
+		return errors.Wrap(err, "could not read options")
+	}
+
+	if port, err := strconv.Atoi(opts.BitcoindPort); err != nil || port < 1 || port > 65535 {
+		return errors.Errorf("bitcoind_port %q isn't a port number", opts.BitcoindPort)
+	}
+
+	credentials := 0
+	for _, set := range []bool{opts.BitcoindPass != "", opts.BitcoindPassFile != "", opts.BitcoindCookie != "", opts.BitcoindDataDir != ""} {
+		if set {
+			credentials++
+		}
+	}
+	if credentials > 1 {
+		return errors.New("only one of bitcoind_pass, bitcoind_pass_file, bitcoind_cookie and bitcoind_datadir can be used")
+	}
+	if opts.BitcoindPassFile != "" {
+		pass, err := readSecretFile("bitcoind_pass_file", opts.BitcoindPassFile)
+		if err != nil {
+			return err
+		}
+		opts.BitcoindPass = pass
+	}
+	if opts.BitcoindPass != "" && opts.BitcoindUser == "" {
+		return errors.New("bitcoind_user is needed with a password (or use bitcoind_cookie)")
+	}
+	if opts.BitcoindTLSCert != "" && !opts.BitcoindTLS {
+		return errors.New("bitcoind_tls_cert needs bitcoind_tls")
+	}
+
+	// the other secrets (and descriptors, which have the wallet's private keys) can come from files too, like
+	// bitcoind_pass
+	for _, secret := range []struct {
+		name  string
+		value *string
+		file  string
+	}{
+		{"webhook_secret", &opts.WebhookSecret, opts.WebhookSecretFile},
+		{"admin_token", &opts.AdminToken, opts.AdminTokenFile},
+		{"signer_key", &opts.SignerKey, opts.SignerKeyFile},
+		{"descriptor", &opts.Descriptor, opts.DescriptorFile},
+		{"change_descriptor", &opts.ChangeDescriptor, opts.ChangeDescriptorFile},
+	} {
+		if secret.file == "" {
+			continue
+		}
+		if *secret.value != "" {
+			return errors.Errorf("only one of %v and %v_file can be used", secret.name, secret.name)
+		}
+		value, err := readSecretFile(secret.name+"_file", secret.file)
+		if err != nil {
+			return err
+		}
+		*secret.value = value
+	}
+	return nil
+}
+
+// readSecretFile is the contents of file, which option says to read a password or key from
+func readSecretFile(option string, file string) (string, error) {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not read %v", option)
+	}
+	secret := strings.TrimSpace(string(contents))
+	if secret == "" {
+		return "", errors.Errorf("%v %v is empty", option, file)
+	}
+	return secret, nil
+}
+
+// dataDir is where the receive server keeps its payments
+func dataDir() string {
+	if opts.DataDir != "" {
+		return opts.DataDir
+	}
+	return receive.DefaultConfig().DataDir
+}
+
+// rpcConfig is the bitcoind connection details
+func rpcConfig() rpc_client.Config {
+	return rpc_client.Config{
+		Host:       opts.BitcoindHost + ":" + opts.BitcoindPort,
+		User:       opts.BitcoindUser,
+		Pass:       opts.BitcoindPass,
+		CookiePath: opts.BitcoindCookie,
+		DataDir:    opts.BitcoindDataDir,
+		Wallet:     opts.BitcoindWallet,
+		TLS:        opts.BitcoindTLS,
+		TLSCert:    opts.BitcoindTLSCert,
+	}
+}
+
+// receiveConfig is the receive server's config, checked
+func receiveConfig() (receive.Config, error) {
+	if opts.Port < 1 || opts.Port > 65535 {
+		return receive.Config{}, errors.Errorf("port %v isn't a port number", opts.Port)
+	}
+	if opts.ShutdownTimeout <= 0 {
+		return receive.Config{}, errors.New("shutdown_timeout needs to be more than 0")
+	}
+	if err := checkWalletOptions(); err != nil {
+		return receive.Config{}, err
+	}
+	// the wallet itself is only opened by receive (it has to scan the chain), so these are checked here rather than
+	// left to Validate
+	if opts.Descriptor != "" {
+		switch {
+		case len(opts.Tenants) > 0:
+			return receive.Config{}, errors.New("descriptor can't be used with tenants, each tenant has its own bitcoind wallet")
+		case opts.FeeBumpAfter > 0:
+			return receive.Config{}, errors.New("fee_bump_after needs bitcoind's wallet, it can't be used with descriptor")
+		case opts.WalletPassphrase != "" || opts.WalletPassphraseFile != "":
+			return receive.Config{}, errors.New("wallet_passphrase is for bitcoind's wallet, it can't be used with descriptor")
+		}
+	}
+
+	config := receive.DefaultConfig()
+	config.Addr = fmt.Sprintf(":%v", opts.Port)
+	config.DataDir = dataDir()
+	config.Rpc = rpcConfig()
+	config.DisableAutoRelay = opts.DisableAutoRelay
+	config.RequireMatchingInputs = opts.RequireMatchingInputs
+	config.Webhooks.Urls = opts.WebhookUrl
+	config.Webhooks.Secret = opts.WebhookSecret
+	config.ZmqRawTx = opts.ZmqRawTx
+	config.ZmqHashBlock = opts.ZmqHashBlock
+	config.FeeBump.After = opts.FeeBumpAfter
+	config.FeeBump.ConfTarget = opts.FeeBumpConfTarget
+	config.FeeBump.MaxFeeRate = opts.FeeBumpMaxFeeRate
+	config.AdminAddr = opts.AdminAddr
+	config.AdminToken = opts.AdminToken
+	config.SignerTimeout = opts.SignerTimeout
+	config.MinUnspents = opts.MinUnspents
+
+	externalSigner, err := newSigner(opts.SignerUrl, opts.SignerDir, opts.SignerKey)
+	if err != nil {
+		return receive.Config{}, err
+	}
+	if externalSigner != nil {
+		config.Signer = externalSigner
+	}
+
+	if config.WalletPassphrase, err = passphraseSource(opts.WalletPassphrase, opts.WalletPassphraseFile); err != nil {
+		return receive.Config{}, err
+	}
+
+	if config.Tenants, err = tenantConfigs(); err != nil {
+		return receive.Config{}, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return receive.Config{}, err
+	}
+	return config, nil
+}
+
+// checkWalletOptions checks the options for bustapay's own wallet
+func checkWalletOptions() error {
+	if opts.Descriptor == "" {
+		if opts.ChangeDescriptor != "" {
+			return errors.New("change_descriptor needs descriptor too")
+		}
+		if opts.ElectrumServer != "" {
+			return errors.New("electrum_server needs descriptor, as there's no bitcoind wallet to use")
+		}
+	}
+	if opts.WalletBirthday < 0 {
+		return errors.New("wallet_birthday can't be negative")
+	}
+	return nil
+}
+
+// newDescriptorWallet is bustapay's own wallet, on bitcoind or the electrum server. It scans the chain before
+// returning, so it can take a while. shutdown closes its connection
+func newDescriptorWallet() (w *wallet.Wallet, shutdown func(), err error) {
+	if err := checkWalletOptions(); err != nil {
+		return nil, nil, err
+	}
+
+	var chain wallet.Chain
+	if server := opts.ElectrumServer; server != "" {
+		// receive keeps the wallet for as long as it runs, so it has to survive the connection dropping
+		client, err := electrum.DialRedialing(server)
+		if err != nil {
+			return nil, nil, err
+		}
+		chain, shutdown = client, func() { client.Close() }
+	} else {
+		rpcClient, err := rpc_client.NewRpcClient(rpcConfig())
+		if err != nil {
+			return nil, nil, err
+		}
+		chain, shutdown = rpcClient, rpcClient.Shutdown
+	}
+
+	w, err = wallet.New(wallet.Config{
+		Descriptor:       opts.Descriptor,
+		ChangeDescriptor: opts.ChangeDescriptor,
+		Birthday:         opts.WalletBirthday,
+	}, chain)
+	if err != nil {
+		shutdown()
+		return nil, nil, err
+	}
+	return w, shutdown, nil
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Check bustapay's configuration",
+}
+
+var configCheckCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Check the options, and that bitcoind can do everything bustapay needs",
+	Long: `Checks every option makes sense, then connects to bitcoind (and the electrum server, if there is one) and
+checks each wallet that will be used. Exits with 1 if anything is wrong.
+
+usage: bustapay config check
+`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		failed := false
+		report := func(status string, format string, a ...interface{}) {
+			failed = failed || status == "FAIL"
+			fmt.Printf("%-4v  %v\n", status, fmt.Sprintf(format, a...))
+		}
+
+		if file := viper.ConfigFileUsed(); file != "" {
+			report("ok", "config file %v", file)
+		} else {
+			report("ok", "no config file, just flags and env variables")
+		}
+
+		config, err := receiveConfig()
+		if err != nil {
+			report("FAIL", "receive options: %v", err)
+			config = receive.DefaultConfig()
+			config.Rpc = rpcConfig()
+		} else {
+			report("ok", "receive options")
+		}
+		if err := checkWalletOptions(); err != nil {
+			report("FAIL", "wallet options: %v", err)
+		} else {
+			report("ok", "wallet options")
+		}
+
+		// every wallet the server would use (plain bitcoind's, or each tenant's)
+		walletConfigs := map[string]receive.Config{"": config}
+		if len(config.Tenants) > 0 {
+			walletConfigs = make(map[string]receive.Config)
+			for _, tc := range config.Tenants {
+				walletConfigs[tc.Name] = tc.Apply(config)
+			}
+		}
+		// with an electrum server, and no tenants with wallets of their own, there needn't be a bitcoind at all
+		if opts.ElectrumServer == "" || len(config.Tenants) > 0 {
+			for name, walletConfig := range walletConfigs {
+				checkBitcoind(report, name, walletConfig)
+			}
+		}
+
+		if opts.ElectrumServer != "" {
+			if client, err := electrum.Dial(opts.ElectrumServer); err != nil {
+				report("FAIL", "electrum server %v: %v", opts.ElectrumServer, err)
+			} else {
+				if params, err := client.GetChainParams(); err != nil {
+					report("FAIL", "electrum server %v: %v", opts.ElectrumServer, err)
+				} else if height, err := client.GetBlockCount(); err != nil {
+					report("FAIL", "electrum server %v: %v", opts.ElectrumServer, err)
+				} else {
+					report("ok", "electrum server %v is on %v at height %v", opts.ElectrumServer, params.Name, height)
+				}
+				client.Close()
+			}
+		}
+
+		if opts.Descriptor != "" {
+			checkDescriptorWallet(report, config)
+		}
+
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+// checkBitcoind reports on whether bitcoind, and the wallet config.Rpc points to, can do everything we need
+func checkBitcoind(report func(status string, format string, a ...interface{}), tenant string, config receive.Config) {
+	rpc := config.Rpc
+	what := "bitcoind"
+	if rpc.Wallet != "" {
+		what = fmt.Sprintf("bitcoind wallet %q", rpc.Wallet)
+	}
+	if tenant != "" {
+		what = fmt.Sprintf("tenant %v's wallet %q", tenant, rpc.Wallet)
+	}
+
+	if rpc.Pass == "" && rpc.CookiePath == "" && rpc.DataDir == "" {
+		report("FAIL", "%v: there's no bitcoind_pass, bitcoind_pass_file, bitcoind_cookie or bitcoind_datadir to log in with", what)
+		return
+	}
+
+	rpcClient, err := rpc_client.NewRpcClient(rpc)
+	if err != nil {
+		report("FAIL", "%v: %v", what, err)
+		return
+	}
+	defer rpcClient.Shutdown()
+
+	network, err := rpcClient.GetNetworkInfo()
+	if err != nil {
+		report("FAIL", "%v: %v", what, err)
+		return
+	}
+	if network.Version < 170000 {
+		report("FAIL", "%v: bitcoind %v is too old, 0.17 or newer is needed (for testmempoolaccept)", what, network.SubVersion)
+	} else {
+		report("ok", "%v: connected to %v", what, network.SubVersion)
+	}
+
+	chain, err := rpcClient.GetBlockchainInfo()
+	if err != nil {
+		report("FAIL", "%v: getblockchaininfo: %v", what, err)
+	} else if chain.InitialBlockDownload {
+		report("warn", "%v: still syncing (%v of %v blocks on %v)", what, chain.Blocks, chain.Headers, chain.Chain)
+	} else {
+		report("ok", "%v: synced to block %v on %v", what, chain.Blocks, chain.Chain)
+	}
+
+	if opts.Descriptor != "" {
+		return // bitcoind's wallet isn't used, checkDescriptorWallet checks ours
+	}
+
+	wallet, err := rpcClient.GetWalletInfo()
+	if err != nil {
+		// the error already says which wallet
+		if tenant != "" {
+			report("FAIL", "tenant %v: %v", tenant, err)
+		} else {
+			report("FAIL", "%v", err)
+		}
+		return
+	}
+	encrypted := wallet.UnlockedUntil != nil
+	switch {
+	case config.Signer != nil:
+		report("ok", "%v: wallet %q doesn't need to sign, the signer does", what, wallet.WalletName)
+	case !wallet.PrivateKeysEnabled:
+		report("FAIL", "%v: wallet %q is watch-only, so an external signer is needed", what, wallet.WalletName)
+	case !encrypted && config.WalletPassphrase != nil:
+		report("FAIL", "%v: wallet %q isn't encrypted, so there shouldn't be a passphrase", what, wallet.WalletName)
+	case encrypted && config.WalletPassphrase != nil:
+		if err := checkPassphrase(rpcClient, config.WalletPassphrase, *wallet.UnlockedUntil); err != nil {
+			report("FAIL", "%v: could not unlock wallet %q: %v", what, wallet.WalletName, err)
+		} else {
+			report("ok", "%v: wallet %q is encrypted, and unlocks with the passphrase", what, wallet.WalletName)
+		}
+	case encrypted && *wallet.UnlockedUntil == 0:
+		report("FAIL", "%v: wallet %q is encrypted and locked, so it can't sign (set wallet_passphrase_file)", what, wallet.WalletName)
+	case encrypted:
+		report("warn", "%v: wallet %q is unlocked for now, but it's encrypted and there's no passphrase to unlock it again", what, wallet.WalletName)
+	default:
+		report("ok", "%v: wallet %q can sign", what, wallet.WalletName)
+	}
+
+	unspents, err := rpcClient.ListUnspent()
+	if err != nil {
+		report("FAIL", "%v: listunspent: %v", what, err)
+	} else if len(unspents) < config.MinUnspents {
+		report("warn", "%v: wallet has %v unspents to contribute, proposals will be refused until it has %v", what, len(unspents), config.MinUnspents)
+	} else if len(unspents) == 0 {
+		report("warn", "%v: wallet has no unspents to contribute, every payment will fall back to the template", what)
+	} else {
+		report("ok", "%v: wallet has %v unspents to contribute", what, len(unspents))
+	}
+}
+
+// checkDescriptorWallet reports on whether bustapay's own wallet can be scanned for, and can sign proposals
+func checkDescriptorWallet(report func(status string, format string, a ...interface{}), config receive.Config) {
+	w, shutdown, err := newDescriptorWallet()
+	if err != nil {
+		report("FAIL", "descriptor wallet: %v", err)
+		return
+	}
+	defer shutdown()
+
+	unspents, err := w.ListUnspent()
+	if err != nil {
+		report("FAIL", "descriptor wallet: %v", err)
+		return
+	}
+	if w.WatchOnly() && config.Signer == nil {
+		report("warn", "descriptor wallet: watch-only, so receive needs an external signer (send can't sign at all)")
+	} else {
+		report("ok", "descriptor wallet: can sign")
+	}
+	if len(unspents) < config.MinUnspents {
+		report("warn", "descriptor wallet: has %v unspents to contribute, proposals will be refused until it has %v", len(unspents), config.MinUnspents)
+	} else {
+		report("ok", "descriptor wallet: has %v unspents", len(unspents))
+	}
+}
+
+// checkPassphrase unlocks the wallet for a moment, and locks it again if it was locked (unlockedUntil is 0). If
+// something else has it unlocked we leave it that way, and unlocked until the same time
+func checkPassphrase(rpcClient *rpc_client.RpcClient, source receive.PassphraseSource, unlockedUntil int64) error {
+	passphrase, err := source()
+	if err != nil {
+		return err
+	}
+
+	timeout := time.Second
+	if unlockedUntil != 0 {
+		if remaining := time.Until(time.Unix(unlockedUntil, 0)); remaining > timeout {
+			timeout = remaining
+		}
+	}
+	if err := rpcClient.WalletPassphrase(passphrase, timeout); err != nil {
+		return err
+	}
+
+	if unlockedUntil != 0 {
+		return nil
+	}
+	return rpcClient.WalletLock()
+}
+
+func init() {
+	configCmd.AddCommand(configCheckCmd)
+	rootCmd.AddCommand(configCmd)
+}
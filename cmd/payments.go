@@ -0,0 +1,331 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/pkg/errors"
+	"github.com/rhavar/bustapay/receive"
+	"github.com/rhavar/bustapay/rpc-client"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// Commands for looking at (and poking) the payments the receive server has stored, so nobody needs to go digging
+// around the data directory by hand.
+
+var paymentsCmd = &cobra.Command{
+	Use:   "payments",
+	Short: "Inspect the payments received by the bustapay server",
+	Long: `Reads the payments stored in the data directory (~/.bustapay/data by default)
+
+usage: bustapay payments list|show|status|rebroadcast|export
+`,
+}
+
+var paymentsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List received payments, newest first",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		payments, err := receive.ListPayments(storeConfig().DataDir)
+		if err != nil {
+			log.Fatalf("could not list payments: %v\n", err)
+		}
+
+		state, _ := cmd.Flags().GetString("state")
+		limit, _ := cmd.Flags().GetInt("limit")
+
+		results := []paymentJson{}
+		for _, payment := range payments {
+			if state != "" && payment.State != state {
+				continue
+			}
+			if limit > 0 && len(results) >= limit {
+				break
+			}
+			results = append(results, toPaymentJson(payment, nil))
+		}
+
+		if opts.Json {
+			printJson(results)
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "FINAL TXID\tAMOUNT\tSTATE\tCREATED")
+		for _, p := range results {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", p.FinalTxid, p.Amount, p.State, p.CreatedAt.Format(time.RFC3339))
+		}
+		w.Flush()
+	},
+}
+
+var paymentsShowCmd = &cobra.Command{
+	Use:   "show $FINAL_TXID",
+	Short: "Show a payment, with its transactions decoded",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		payment, err := receive.LoadPayment(storeConfig().DataDir, args[0])
+		if err != nil {
+			log.Fatalf("could not load payment: %v\n", err)
+		}
+
+		// addresses are nice to have, but we can still show the payment without bitcoind
+		var chainParams *chaincfg.Params
+		if rpcClient, err := rpc_client.NewRpcClient(storeConfig().Rpc); err == nil {
+			chainParams, _ = rpcClient.GetChainParams()
+			rpcClient.Shutdown()
+		}
+
+		p := toPaymentJson(payment, chainParams)
+		if opts.Json {
+			printJson(p)
+			return
+		}
+
+		fmt.Printf("final txid:     %v\n", p.FinalTxid)
+		fmt.Printf("template txid:  %v\n", p.TemplateTxid)
+		fmt.Printf("payment id:     %v\n", p.PaymentId)
+		fmt.Printf("amount:         %v\n", p.Amount)
+		fmt.Printf("state:          %v\n", p.State)
+		fmt.Printf("created:        %v\n", p.CreatedAt.Format(time.RFC3339))
+		if p.FeeBumpTxid != "" {
+			fmt.Printf("fee bumped by:  %v\n", p.FeeBumpTxid)
+		}
+		printDecodedTransaction("template transaction", p.Template)
+		printDecodedTransaction("partial transaction", p.Partial)
+	},
+}
+
+var paymentsStatusCmd = &cobra.Command{
+	Use:   "status $FINAL_TXID",
+	Short: "Ask bitcoind where a payment's transactions are at",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		payment, err := receive.LoadPayment(storeConfig().DataDir, args[0])
+		if err != nil {
+			log.Fatalf("could not load payment: %v\n", err)
+		}
+
+		rpcClient, err := rpc_client.NewRpcClient(storeConfig().Rpc)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		defer rpcClient.Shutdown()
+
+		status := paymentStatus{
+			FinalTxid:    payment.FinalTxid,
+			TemplateTxid: payment.TemplateTxid(),
+			State:        payment.State,
+		}
+		status.Final = transactionStatus(rpcClient, status.FinalTxid)
+		status.Template = transactionStatus(rpcClient, status.TemplateTxid)
+
+		if opts.Json {
+			printJson(status)
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "recorded state:\t%v\n", status.State)
+		fmt.Fprintln(w, "\t")
+		fmt.Fprintln(w, "TRANSACTION\tTXID\tIN MEMPOOL\tCONFIRMATIONS")
+		fmt.Fprintf(w, "final\t%v\t%v\t%v\n", status.FinalTxid, status.Final.InMempool, status.Final.Confirmations)
+		fmt.Fprintf(w, "template\t%v\t%v\t%v\n", status.TemplateTxid, status.Template.InMempool, status.Template.Confirmations)
+		w.Flush()
+	},
+}
+
+var paymentsRebroadcastCmd = &cobra.Command{
+	Use:   "rebroadcast $FINAL_TXID",
+	Short: "Broadcast a payment's template transaction",
+	Long: `Broadcasts the template transaction of a payment. Useful if the sender never broadcast the final transaction
+and the server isn't relaying (or you don't want to wait for it).
+
+usage: bustapay payments rebroadcast $FINAL_TXID
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		payment, err := receive.LoadPayment(storeConfig().DataDir, args[0])
+		if err != nil {
+			log.Fatalf("could not load payment: %v\n", err)
+		}
+
+		rpcClient, err := rpc_client.NewRpcClient(storeConfig().Rpc)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		defer rpcClient.Shutdown()
+
+		txid, err := rpcClient.SendRawTransaction(payment.Template)
+		if err != nil {
+			log.Fatalf("could not broadcast template transaction: %v\n", err)
+		}
+
+		fmt.Println(txid)
+	},
+}
+
+var paymentsExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export every payment as csv (or json, with the transactions)",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		payments, err := receive.ListPayments(storeConfig().DataDir)
+		if err != nil {
+			log.Fatalf("could not list payments: %v\n", err)
+		}
+
+		if opts.Json {
+			results := []paymentJson{}
+			for _, payment := range payments {
+				results = append(results, toPaymentJson(payment, nil))
+			}
+			printJson(results)
+			return
+		}
+
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"final_txid", "template_txid", "payment_id", "amount", "state", "created_at"})
+		for _, payment := range payments {
+			w.Write([]string{
+				payment.FinalTxid,
+				payment.TemplateTxid(),
+				payment.PaymentId,
+				strconv.FormatInt(payment.Amount, 10),
+				payment.State,
+				payment.CreatedAt.UTC().Format(time.RFC3339),
+			})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+	},
+}
+
+type paymentJson struct {
+	FinalTxid    string    `json:"final_txid"`
+	TemplateTxid string    `json:"template_txid"`
+	PaymentId    string    `json:"payment_id"`
+	Amount       int64     `json:"amount"`
+	State        string    `json:"state"`
+	CreatedAt    time.Time `json:"created_at"`
+	FeeBumpTxid  string    `json:"fee_bump_txid,omitempty"`
+
+	Template *receive.DecodedTransaction `json:"template"`
+	Partial  *receive.DecodedTransaction `json:"partial"`
+}
+
+func toPaymentJson(payment *receive.Payment, chainParams *chaincfg.Params) paymentJson {
+	template := receive.DecodeTransaction(payment.Template, chainParams)
+	partial := receive.DecodeTransaction(payment.Partial, chainParams)
+	return paymentJson{
+		FinalTxid:    payment.FinalTxid,
+		TemplateTxid: payment.TemplateTxid(),
+		PaymentId:    payment.PaymentId,
+		Amount:       payment.Amount,
+		State:        payment.State,
+		CreatedAt:    payment.CreatedAt,
+		FeeBumpTxid:  payment.FeeBumpTxid,
+		Template:     &template,
+		Partial:      &partial,
+	}
+}
+
+type paymentStatus struct {
+	FinalTxid    string   `json:"final_txid"`
+	TemplateTxid string   `json:"template_txid"`
+	State        string   `json:"state"`
+	Final        txStatus `json:"final"`
+	Template     txStatus `json:"template"`
+}
+
+type txStatus struct {
+	InMempool     bool  `json:"in_mempool"`
+	Confirmations int64 `json:"confirmations"`
+}
+
+func transactionStatus(rpcClient *rpc_client.RpcClient, txid string) txStatus {
+	inMempool, err := rpcClient.MempoolHasEntry(txid)
+	if err != nil {
+		log.Fatalf("could not check the mempool for %v: %v\n", txid, err)
+	}
+	status := txStatus{InMempool: inMempool}
+
+	tx, err := rpcClient.GetWalletTransaction(txid)
+	switch {
+	case err == nil:
+		status.Confirmations = tx.Confirmations
+	case errors.Cause(err) != rpc_client.ErrTxNotFound:
+		log.Fatalf("could not ask the wallet about %v: %v\n", txid, err)
+	}
+	return status
+}
+
+func printDecodedTransaction(name string, tx *receive.DecodedTransaction) {
+	fmt.Printf("\n%v %v (version %v, locktime %v)\n", name, tx.Txid, tx.Version, tx.LockTime)
+	for i, input := range tx.Inputs {
+		signed := "unsigned"
+		if len(input.Witness) > 0 || input.ScriptSig != "" {
+			signed = "signed"
+		}
+		fmt.Printf("  input %v:  %v:%v  sequence %v  %v\n", i, input.Txid, input.Vout, input.Sequence, signed)
+	}
+	for i, output := range tx.Outputs {
+		to := output.Address
+		if to == "" {
+			to = output.ScriptPubKey
+		}
+		fmt.Printf("  output %v: %v  %v\n", i, output.Value, to)
+	}
+}
+
+func printJson(v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	fmt.Println(string(b))
+}
+
+func init() {
+	paymentsCmd.PersistentFlags().Bool("json", false, "Print json instead of tables")
+	viper.BindPFlag("json", paymentsCmd.PersistentFlags().Lookup("json"))
+
+	paymentsCmd.PersistentFlags().String("tenant", "", "Which tenant's payments to look at, if the server has tenants")
+	viper.BindPFlag("tenant", paymentsCmd.PersistentFlags().Lookup("tenant"))
+
+	paymentsListCmd.Flags().String("state", "", "Only list payments in this state (e.g. pending, failed)")
+	paymentsListCmd.Flags().Int("limit", 0, "Only list this many payments (0 for all)")
+
+	paymentsCmd.AddCommand(paymentsListCmd, paymentsShowCmd, paymentsStatusCmd, paymentsRebroadcastCmd, paymentsExportCmd)
+	rootCmd.AddCommand(paymentsCmd)
+}
+
+// storeConfig is where the payments of --tenant (or the only store, without tenants) are kept, and its wallet
+func storeConfig() receive.Config {
+	config := receive.DefaultConfig()
+	config.DataDir = dataDir()
+	config.Rpc = rpcConfig()
+
+	name := opts.Tenant
+	if name == "" {
+		return config
+	}
+	for _, o := range opts.Tenants {
+		if o.Name == name {
+			return receive.TenantConfig{Name: o.Name, Wallet: o.Wallet, DataDir: o.DataDir}.Apply(config)
+		}
+	}
+	log.Fatalf("no tenant called %v in the config file\n", name)
+	return config
+}
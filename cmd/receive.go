@@ -1,7 +1,19 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
 	"github.com/rhavar/bustapay/receive"
+	"github.com/rhavar/bustapay/signer"
+	"github.com/rhavar/bustapay/util"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -14,13 +26,224 @@ var receiveCmd = &cobra.Command{
 usage: bustapay receive
 `,
 	Run: func(cmd *cobra.Command, args []string) {
+		for _, secret := range []string{"webhook_secret", "admin_token", "signer_key"} {
+			if cmd.Flags().Changed(secret) {
+				util.Logger.Warn(fmt.Sprintf("--%v can be seen by anyone who can run ps, use --%v_file or %v instead",
+					secret, secret, strings.ToUpper(secret)))
+			}
+		}
+
+		config, err := receiveConfig()
+		if err != nil {
+			util.Logger.Error("bad config", "err", err)
+			os.Exit(1)
+		}
+		if opts.Descriptor != "" {
+			util.Logger.Info("scanning for the descriptor wallet's unspents..", "birthday", opts.WalletBirthday)
+			descriptorWallet, shutdown, err := newDescriptorWallet()
+			if err != nil {
+				util.Logger.Error("could not open the wallet", "err", err)
+				os.Exit(1)
+			}
+			defer shutdown()
+			config.DescriptorWallet = descriptorWallet
+		}
+
+		server := receive.NewServer(config)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		if err := server.Start(ctx); err != nil {
+			util.Logger.Error("could not start server", "err", err)
+			os.Exit(1)
+		}
 
-		receive.StartServer(viper.GetInt32("port"))
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		sig := <-signals
+		util.Logger.Info("shutting down, waiting for pending proposals to finish..", "signal", sig.String())
+
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), opts.ShutdownTimeout)
+		defer shutdownCancel()
+
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			util.Logger.Error("unclean shutdown", "err", err)
+			os.Exit(1)
+		}
 	},
 }
 
 func init() {
 	receiveCmd.Flags().Int32P("port", "p", 8080, "Which port to listen to")
 	viper.BindPFlag("port", receiveCmd.Flags().Lookup("port"))
+
+	receiveCmd.Flags().Duration("shutdown_timeout", 30*time.Second, "How long to wait for pending proposals on shutdown")
+	viper.BindPFlag("shutdown_timeout", receiveCmd.Flags().Lookup("shutdown_timeout"))
+
+	receiveCmd.Flags().Bool("require_matching_inputs", false, "Refuse payjoins (and broadcast the template) unless we can contribute an input of the same type as the sender's")
+	viper.BindPFlag("require_matching_inputs", receiveCmd.Flags().Lookup("require_matching_inputs"))
+
+	receiveCmd.Flags().Bool("disable_auto_relay", false, "Don't broadcast a payment's template if the sender never broadcasts the payjoin")
+	viper.BindPFlag("disable_auto_relay", receiveCmd.Flags().Lookup("disable_auto_relay"))
+
+	receiveCmd.Flags().StringSlice("webhook_url", nil, "Url(s) to POST payment events to")
+	viper.BindPFlag("webhook_url", receiveCmd.Flags().Lookup("webhook_url"))
+
+	receiveCmd.Flags().String("webhook_secret", "", "Secret used to sign webhook requests (HMAC-SHA256) (anyone can see it in ps, prefer --webhook_secret_file or WEBHOOK_SECRET)")
+	viper.BindPFlag("webhook_secret", receiveCmd.Flags().Lookup("webhook_secret"))
+
+	receiveCmd.Flags().String("webhook_secret_file", "", "File containing the webhook secret")
+	viper.BindPFlag("webhook_secret_file", receiveCmd.Flags().Lookup("webhook_secret_file"))
+
+	receiveCmd.Flags().String("zmq_rawtx", "", "bitcoind's zmqpubrawtx endpoint, e.g. tcp://127.0.0.1:28332")
+	viper.BindPFlag("zmq_rawtx", receiveCmd.Flags().Lookup("zmq_rawtx"))
+
+	receiveCmd.Flags().String("zmq_hashblock", "", "bitcoind's zmqpubhashblock endpoint, e.g. tcp://127.0.0.1:28332")
+	viper.BindPFlag("zmq_hashblock", receiveCmd.Flags().Lookup("zmq_hashblock"))
+
+	receiveCmd.Flags().Duration("fee_bump_after", 0, "Bump the fee of final transactions still unconfirmed this long after the proposal, e.g. 6h (0 to never)")
+	viper.BindPFlag("fee_bump_after", receiveCmd.Flags().Lookup("fee_bump_after"))
+
+	receiveCmd.Flags().Int("fee_bump_conf_target", 6, "Confirmation target (in blocks) to ask estimatesmartfee for when bumping fees")
+	viper.BindPFlag("fee_bump_conf_target", receiveCmd.Flags().Lookup("fee_bump_conf_target"))
+
+	receiveCmd.Flags().Float64("fee_bump_max_feerate", 100, "Never bump fees above this feerate (sat/vbyte)")
+	viper.BindPFlag("fee_bump_max_feerate", receiveCmd.Flags().Lookup("fee_bump_max_feerate"))
+
+	receiveCmd.Flags().String("admin_addr", "", "Where to serve the admin api, /readyz and /metrics, e.g. 127.0.0.1:8081 (disabled if empty)")
+	viper.BindPFlag("admin_addr", receiveCmd.Flags().Lookup("admin_addr"))
+
+	receiveCmd.Flags().String("admin_token", "", "Bearer token required by the admin api (anyone can see it in ps, prefer --admin_token_file or ADMIN_TOKEN)")
+	viper.BindPFlag("admin_token", receiveCmd.Flags().Lookup("admin_token"))
+
+	receiveCmd.Flags().String("admin_token_file", "", "File containing the admin api's bearer token")
+	viper.BindPFlag("admin_token_file", receiveCmd.Flags().Lookup("admin_token_file"))
+
+	receiveCmd.Flags().String("signer_url", "", "Sign contributed inputs by POSTing a psbt to this url, instead of with the wallet")
+	viper.BindPFlag("signer_url", receiveCmd.Flags().Lookup("signer_url"))
+
+	receiveCmd.Flags().String("signer_dir", "", "Sign contributed inputs by dropping a psbt in this directory, and waiting for <txid>.signed.psbt")
+	viper.BindPFlag("signer_dir", receiveCmd.Flags().Lookup("signer_dir"))
+
+	receiveCmd.Flags().String("signer_key", "", "Sign contributed inputs with this WIF private key, for testing (anyone can see it in ps, prefer --signer_key_file or SIGNER_KEY)")
+	viper.BindPFlag("signer_key", receiveCmd.Flags().Lookup("signer_key"))
+
+	receiveCmd.Flags().String("signer_key_file", "", "File containing the WIF private key for signer_key")
+	viper.BindPFlag("signer_key_file", receiveCmd.Flags().Lookup("signer_key_file"))
+
+	receiveCmd.Flags().Duration("signer_timeout", 20*time.Second, "Reject the proposal if the signer takes longer than this")
+	viper.BindPFlag("signer_timeout", receiveCmd.Flags().Lookup("signer_timeout"))
+
+	receiveCmd.Flags().Int("min_unspents", 1, "Refuse proposals (and fail /readyz) while the wallet has fewer unspents than this to contribute")
+	viper.BindPFlag("min_unspents", receiveCmd.Flags().Lookup("min_unspents"))
+
+	receiveCmd.Flags().String("wallet_passphrase_file", "", "File containing the encrypted wallet's passphrase, it's read each time the wallet is unlocked to sign")
+	viper.BindPFlag("wallet_passphrase_file", receiveCmd.Flags().Lookup("wallet_passphrase_file"))
+
+	// not a flag, so it's never on the command line
+	viper.BindEnv("wallet_passphrase")
+
 	rootCmd.AddCommand(receiveCmd)
 }
+
+// passphraseSource is where the wallet passphrase comes from, if there is one
+func passphraseSource(passphrase string, file string) (receive.PassphraseSource, error) {
+	switch {
+	case passphrase != "" && file != "":
+		return nil, errors.New("only one of wallet_passphrase and wallet_passphrase_file can be used")
+	case passphrase != "":
+		return func() (string, error) { return passphrase, nil }, nil
+	case file != "":
+		return func() (string, error) {
+			contents, err := ioutil.ReadFile(file)
+			if err != nil {
+				return "", errors.WithStack(err)
+			}
+			return strings.TrimRight(string(contents), "\r\n"), nil
+		}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// newSigner is the external signer the signer_url, signer_dir or signer_key options ask for, or nil to sign with
+// the wallet
+func newSigner(url string, dir string, wif string) (receive.Signer, error) {
+	var signers []receive.Signer
+	if url != "" {
+		signers = append(signers, &signer.HttpSigner{Url: url})
+	}
+	if dir != "" {
+		signers = append(signers, &signer.FileSigner{Dir: dir})
+	}
+	if wif != "" {
+		keySigner, err := signer.NewKeySigner(wif)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, keySigner)
+	}
+
+	switch len(signers) {
+	case 0:
+		return nil, nil
+	case 1:
+		return signers[0], nil
+	default:
+		return nil, errors.New("only one of signer_url, signer_dir and signer_key can be used")
+	}
+}
+
+// tenantOptions is one entry of the tenants list in the config file (they can't be given on the command line), e.g.
+//
+//	tenants:
+//	  - name: store1
+//	    wallet: store1
+//	    host: pay.store1.com
+//	    webhook_url: [https://store1.com/bustapay]
+//	    webhook_secret: ...
+type tenantOptions struct {
+	Name                  string   `mapstructure:"name"`
+	Host                  string   `mapstructure:"host"`
+	Wallet                string   `mapstructure:"wallet"`
+	DataDir               string   `mapstructure:"data_dir"`
+	RequireMatchingInputs bool     `mapstructure:"require_matching_inputs"`
+	DisableAutoRelay      bool     `mapstructure:"disable_auto_relay"`
+	WebhookUrl            []string `mapstructure:"webhook_url"`
+	WebhookSecret         string   `mapstructure:"webhook_secret"`
+	SignerUrl             string   `mapstructure:"signer_url"`
+	SignerDir             string   `mapstructure:"signer_dir"`
+	SignerKey             string   `mapstructure:"signer_key"`
+	WalletPassphraseFile  string   `mapstructure:"wallet_passphrase_file"`
+}
+
+// tenantConfigs is the tenants from the config file, if any
+func tenantConfigs() ([]receive.TenantConfig, error) {
+	var tenants []receive.TenantConfig
+	for _, o := range opts.Tenants {
+		if len(o.WebhookUrl) > 0 && o.WebhookSecret == "" {
+			return nil, errors.Errorf("tenant %v needs a webhook_secret for its webhooks", o.Name)
+		}
+		tenantSigner, err := newSigner(o.SignerUrl, o.SignerDir, o.SignerKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "tenant %v", o.Name)
+		}
+		tenantPassphrase, err := passphraseSource("", o.WalletPassphraseFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "tenant %v", o.Name)
+		}
+		tenants = append(tenants, receive.TenantConfig{
+			Name:                  o.Name,
+			Host:                  o.Host,
+			Wallet:                o.Wallet,
+			DataDir:               o.DataDir,
+			RequireMatchingInputs: o.RequireMatchingInputs,
+			DisableAutoRelay:      o.DisableAutoRelay,
+			Signer:                tenantSigner,
+			WalletPassphrase:      tenantPassphrase,
+			Webhooks:              receive.WebhookConfig{Urls: o.WebhookUrl, Secret: o.WebhookSecret},
+		})
+	}
+	return tenants, nil
+}
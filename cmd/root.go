@@ -3,8 +3,10 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	homedir "github.com/mitchellh/go-homedir"
+	"github.com/rhavar/bustapay/util"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -32,9 +34,20 @@ func init() {
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.bustapay/config.yaml)")
 
-	rootCmd.PersistentFlags().BoolP("verbose", "v", false, "Enable verbose printing")
+	rootCmd.PersistentFlags().BoolP("verbose", "v", false, "Enable verbose printing (same as --log_level=debug)")
 	viper.BindPFlag("verbose", rootCmd.PersistentFlags().Lookup("verbose"))
 
+	rootCmd.PersistentFlags().String("log_level", "info", "Log level: debug, info, warn or error")
+	viper.BindPFlag("log_level", rootCmd.PersistentFlags().Lookup("log_level"))
+
+	rootCmd.PersistentFlags().String("log_format", "text", "Log format: text or json")
+	viper.BindPFlag("log_format", rootCmd.PersistentFlags().Lookup("log_format"))
+
+	rootCmd.PersistentFlags().StringSlice("log_redact", []string{util.RedactCredentials, util.RedactTransactions}, "What to redact from logs: any of tx, credentials, ips")
+	viper.BindPFlag("log_redact", rootCmd.PersistentFlags().Lookup("log_redact"))
+
+	rootCmd.PersistentFlags().String("data_dir", "", "Where received payments are stored (default is $HOME/.bustapay/data)")
+	viper.BindPFlag("data_dir", rootCmd.PersistentFlags().Lookup("data_dir"))
 
 	rootCmd.PersistentFlags().String("bitcoind_host", "localhost", "bitcoind host to connect to")
 	viper.BindPFlag("bitcoind_host", rootCmd.PersistentFlags().Lookup("bitcoind_host"))
@@ -45,8 +58,45 @@ func init() {
 	rootCmd.PersistentFlags().String("bitcoind_user", "", "bitcoind user to connect to")
 	viper.BindPFlag("bitcoind_user", rootCmd.PersistentFlags().Lookup("bitcoind_user"))
 
-	rootCmd.PersistentFlags().String("bitcoind_pass", "", "bitcoind pass to connect to")
+	rootCmd.PersistentFlags().String("bitcoind_pass", "", "bitcoind pass to connect to (anyone can see it in ps, prefer --bitcoind_pass_file or BITCOIND_PASS)")
 	viper.BindPFlag("bitcoind_pass", rootCmd.PersistentFlags().Lookup("bitcoind_pass"))
+
+	rootCmd.PersistentFlags().String("bitcoind_pass_file", "", "File containing the bitcoind pass")
+	viper.BindPFlag("bitcoind_pass_file", rootCmd.PersistentFlags().Lookup("bitcoind_pass_file"))
+
+	rootCmd.PersistentFlags().String("bitcoind_cookie", "", "bitcoind's .cookie file, to use instead of a user and pass")
+	viper.BindPFlag("bitcoind_cookie", rootCmd.PersistentFlags().Lookup("bitcoind_cookie"))
+
+	rootCmd.PersistentFlags().String("bitcoind_datadir", "", "bitcoind's -datadir, to find its .cookie in (for the chain bitcoind_port is for)")
+	viper.BindPFlag("bitcoind_datadir", rootCmd.PersistentFlags().Lookup("bitcoind_datadir"))
+
+	rootCmd.PersistentFlags().String("bitcoind_wallet", "", "Which bitcoind wallet to use, if it has more than one loaded")
+	viper.BindPFlag("bitcoind_wallet", rootCmd.PersistentFlags().Lookup("bitcoind_wallet"))
+
+	rootCmd.PersistentFlags().Bool("bitcoind_tls", false, "Connect to bitcoind with https (e.g. if it's behind a tls proxy)")
+	viper.BindPFlag("bitcoind_tls", rootCmd.PersistentFlags().Lookup("bitcoind_tls"))
+
+	rootCmd.PersistentFlags().String("bitcoind_tls_cert", "", "PEM certificate to trust for bitcoind_tls, if it's self-signed")
+	viper.BindPFlag("bitcoind_tls_cert", rootCmd.PersistentFlags().Lookup("bitcoind_tls_cert"))
+
+	// send and receive can both use bustapay's own wallet instead of bitcoind's
+	rootCmd.PersistentFlags().String("descriptor", "", "Use bustapay's own wallet with this descriptor, e.g. wpkh(xprv.../84h/0h/0h/0/*), instead of bitcoind's (anyone can see it in ps, prefer --descriptor_file or DESCRIPTOR)")
+	viper.BindPFlag("descriptor", rootCmd.PersistentFlags().Lookup("descriptor"))
+
+	rootCmd.PersistentFlags().String("descriptor_file", "", "File containing the descriptor")
+	viper.BindPFlag("descriptor_file", rootCmd.PersistentFlags().Lookup("descriptor_file"))
+
+	rootCmd.PersistentFlags().String("change_descriptor", "", "Descriptor for change, e.g. wpkh(xprv.../84h/0h/0h/1/*) (default is --descriptor) (anyone can see it in ps, prefer --change_descriptor_file or CHANGE_DESCRIPTOR)")
+	viper.BindPFlag("change_descriptor", rootCmd.PersistentFlags().Lookup("change_descriptor"))
+
+	rootCmd.PersistentFlags().String("change_descriptor_file", "", "File containing the change descriptor")
+	viper.BindPFlag("change_descriptor_file", rootCmd.PersistentFlags().Lookup("change_descriptor_file"))
+
+	rootCmd.PersistentFlags().Int64("wallet_birthday", 0, "Block height to start scanning for the descriptor wallet's unspents from")
+	viper.BindPFlag("wallet_birthday", rootCmd.PersistentFlags().Lookup("wallet_birthday"))
+
+	rootCmd.PersistentFlags().String("electrum_server", "", "Use this electrum server instead of bitcoind, e.g. ssl://electrum.example.com:50002 (needs --descriptor)")
+	viper.BindPFlag("electrum_server", rootCmd.PersistentFlags().Lookup("electrum_server"))
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -75,7 +125,33 @@ func initConfig() {
 		}
 	}
 
-	if viper.GetBool("verbose") {
-		fmt.Println("Verbose mode enabled!")
+	if err := loadOptions(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	logConfig := util.LogConfig{
+		Level:  opts.LogLevel,
+		JSON:   opts.LogFormat == "json",
+		Redact: opts.LogRedact,
+	}
+	if opts.Verbose {
+		logConfig.Level = "debug"
+	}
+
+	if err := util.ConfigureLogging(os.Stderr, logConfig); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	util.Logger.Debug("verbose mode enabled!")
+
+	if rootCmd.PersistentFlags().Changed("bitcoind_pass") {
+		util.Logger.Warn("--bitcoind_pass can be seen by anyone who can run ps, use --bitcoind_pass_file or BITCOIND_PASS instead")
+	}
+	for _, secret := range []string{"descriptor", "change_descriptor"} {
+		if rootCmd.PersistentFlags().Changed(secret) {
+			util.Logger.Warn(fmt.Sprintf("--%v has the wallet's private keys and can be seen by anyone who can run ps, use --%v_file or %v instead",
+				secret, secret, strings.ToUpper(secret)))
+		}
 	}
 }
@@ -2,11 +2,13 @@ package cmd
 
 import (
 	"errors"
-	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/rhavar/bustapay/rpc-client"
 	"github.com/rhavar/bustapay/send"
+	"github.com/rhavar/bustapay/util"
 	"github.com/spf13/cobra"
-	"log"
 	"math"
+	"os"
 	"strconv"
 )
 
@@ -24,10 +26,6 @@ usage: bustapay send $BITCOIN_ADDRESS $BUSTAPAY_URL $AMOUNT_IN_BITCOIN
 			return errors.New("Incorrect usage. Used like: bustapay send $BITCOIN_ADDRESS $BUSTAPAY_URL $AMOUNT_IN_BITCOIN")
 		}
 
-		if _, err := btcutil.DecodeAddress(args[0], nil); err != nil {
-			return errors.New("could not decode bitcoin address " + args[0])
-		}
-
 		if _, err := strconv.ParseFloat(args[2], 64); err != nil {
 			return errors.New("could not parse " + args[2] + " as a floating point number")
 		}
@@ -35,21 +33,66 @@ usage: bustapay send $BITCOIN_ADDRESS $BUSTAPAY_URL $AMOUNT_IN_BITCOIN
 		return nil
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-
 		bitcoinAddress := args[0]
 		bustapayUrl := args[1]
 		amountBtc, _ := strconv.ParseFloat(args[2], 64)
 
 		amount := int64(math.Round(amountBtc * 1e8))
 
-		err := send.Send(bitcoinAddress, bustapayUrl, amount)
+		senderWallet, shutdown, err := newSenderWallet()
+		if err != nil {
+			util.Logger.Error("could not open the wallet", "err", err)
+			os.Exit(1)
+		}
+		defer shutdown()
+
+		// The address needs to be for whichever chain we're on
+		chainParams, err := senderWallet.GetChainParams()
 		if err != nil {
-			log.Printf("%+v\n", err)
+			shutdown()
+			util.Logger.Error("could not get the chain", "err", err)
+			os.Exit(1)
+		}
+		address, err := util.DecodeAddress(bitcoinAddress, chainParams)
+		if err != nil || !address.IsForNet(chainParams) {
+			shutdown()
+			util.Logger.Error("not a valid address", "address", bitcoinAddress, "chain", chainParams.Name)
+			os.Exit(1)
 		}
 
+		txid, err := send.NewSender(senderWallet).Send(bitcoinAddress, bustapayUrl, amount)
+		if err != nil {
+			shutdown()
+			util.Logger.Error("could not send", "err", err)
+			os.Exit(1)
+		}
+
+		util.Logger.Info("sent", "txid", txid)
+
 	},
 }
 
+type senderWallet interface {
+	send.Wallet
+	GetChainParams() (*chaincfg.Params, error)
+}
+
+// newSenderWallet is whichever wallet the flags ask for: bitcoind's, or our own (see newDescriptorWallet). shutdown
+// closes whatever connection it uses
+func newSenderWallet() (w senderWallet, shutdown func(), err error) {
+	if opts.Descriptor != "" {
+		return newDescriptorWallet()
+	}
+	if err := checkWalletOptions(); err != nil {
+		return nil, nil, err
+	}
+	rpcClient, err := rpc_client.NewRpcClient(rpcConfig())
+	if err != nil {
+		return nil, nil, err
+	}
+	return rpcClient, rpcClient.Shutdown, nil
+}
+
 func init() {
 	rootCmd.AddCommand(sendCmd)
 }
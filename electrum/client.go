@@ -0,0 +1,442 @@
+package electrum
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+	"github.com/rhavar/bustapay/rpc-client"
+	"github.com/rhavar/bustapay/util"
+)
+
+const (
+	dialTimeout = 10 * time.Second
+	callTimeout = 30 * time.Second
+)
+
+// Client is a connection to an electrum server. It's safe to use from multiple goroutines, but doesn't reconnect:
+// once the connection drops every call fails, and you need to Dial again (or use a Redialer)
+type Client struct {
+	conn   net.Conn
+	params *chaincfg.Params
+
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	nextId   int64
+	pending  map[int64]chan *message
+	statuses map[string]string // scripthash -> its latest status, for everything we've subscribed to
+	height   int64             // from the headers subscription
+	err      error             // why the connection is dead, if it is
+	done     chan struct{}
+}
+
+// Dial connects to address, which is ssl://host:port for tls or tcp://host:port (or just host:port) for plain text.
+// It works out which chain the server is on, and subscribes to new blocks
+func Dial(address string) (*Client, error) {
+	var conn net.Conn
+	var err error
+	switch {
+	case strings.HasPrefix(address, "ssl://"):
+		dialer := &net.Dialer{Timeout: dialTimeout}
+		conn, err = tls.DialWithDialer(dialer, "tcp", strings.TrimPrefix(address, "ssl://"), nil)
+	default:
+		conn, err = net.DialTimeout("tcp", strings.TrimPrefix(address, "tcp://"), dialTimeout)
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	c := &Client{
+		conn:     conn,
+		pending:  make(map[int64]chan *message),
+		statuses: make(map[string]string),
+		done:     make(chan struct{}),
+	}
+	go c.readLoop()
+
+	if err := c.handshake(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Client) handshake() error {
+	var version []string
+	if err := c.call("server.version", &version, "bustapay", protocolVersion); err != nil {
+		return err
+	}
+	util.Logger.Debug("connected to electrum server", "addr", c.conn.RemoteAddr().String(), "version", version)
+
+	var features struct {
+		GenesisHash string `json:"genesis_hash"`
+	}
+	if err := c.call("server.features", &features); err != nil {
+		return err
+	}
+	params, err := paramsForGenesis(features.GenesisHash)
+	if err != nil {
+		return err
+	}
+	c.params = params
+
+	var header headerItem
+	if err := c.call("blockchain.headers.subscribe", &header); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.height = header.Height
+	c.mu.Unlock()
+	return nil
+}
+
+// paramsForGenesis is the chain electrum says it's on. All signets share a genesis block, but they also share
+// address formats, so SigNetParams is fine for custom ones too
+func paramsForGenesis(genesisHash string) (*chaincfg.Params, error) {
+	for _, params := range []*chaincfg.Params{&chaincfg.MainNetParams, &chaincfg.TestNet3Params,
+		&rpc_client.TestNet4Params, &chaincfg.RegressionNetParams, &chaincfg.SigNetParams} {
+		if params.GenesisHash.String() == genesisHash {
+			return params, nil
+		}
+	}
+	return nil, errors.Errorf("electrum server is on an unknown chain (genesis %v)", genesisHash)
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// dead is whether the connection has dropped (or been closed), so every call would fail
+func (c *Client) dead() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err != nil
+}
+
+func (c *Client) readLoop() {
+	reader := bufio.NewReader(c.conn)
+	var err error
+	for {
+		var line []byte
+		if line, err = reader.ReadBytes('\n'); err != nil {
+			break
+		}
+		var msg message
+		if err := json.Unmarshal(line, &msg); err != nil {
+			util.Logger.Warn("electrum server sent something that isn't json", "err", err)
+			continue
+		}
+
+		if msg.Id == nil {
+			c.notified(&msg)
+			continue
+		}
+		c.mu.Lock()
+		ch, ok := c.pending[*msg.Id]
+		delete(c.pending, *msg.Id)
+		c.mu.Unlock()
+		if ok {
+			ch <- &msg
+		}
+	}
+
+	c.mu.Lock()
+	c.err = errors.Wrap(err, "electrum connection closed")
+	c.mu.Unlock()
+	close(c.done)
+}
+
+func (c *Client) notified(msg *message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch msg.Method {
+	case "blockchain.scripthash.subscribe":
+		var scriptHash string
+		var status *string
+		if len(msg.Params) != 2 || json.Unmarshal(msg.Params[0], &scriptHash) != nil || json.Unmarshal(msg.Params[1], &status) != nil {
+			return
+		}
+		c.statuses[scriptHash] = stringOrEmpty(status)
+	case "blockchain.headers.subscribe":
+		var header headerItem
+		if len(msg.Params) != 1 || json.Unmarshal(msg.Params[0], &header) != nil {
+			return
+		}
+		c.height = header.Height
+	}
+}
+
+// call makes a request and unmarshals its result into result (unless it's nil)
+func (c *Client) call(method string, result interface{}, params ...interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+	c.nextId++
+	id := c.nextId
+	ch := make(chan *message, 1)
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	request, err := json.Marshal(struct {
+		JsonRpc string        `json:"jsonrpc"`
+		Id      int64         `json:"id"`
+		Method  string        `json:"method"`
+		Params  []interface{} `json:"params"`
+	}{"2.0", id, method, params})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	c.writeMu.Lock()
+	c.conn.SetWriteDeadline(time.Now().Add(callTimeout))
+	_, err = c.conn.Write(append(request, '\n'))
+	c.writeMu.Unlock()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	select {
+	case msg := <-ch:
+		if msg.Error != nil {
+			return errors.Wrap(msg.Error, method)
+		}
+		if result == nil {
+			return nil
+		}
+		return errors.WithStack(json.Unmarshal(msg.Result, result))
+	case <-c.done:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.err
+	case <-time.After(callTimeout):
+		return errors.Errorf("electrum server didn't answer %v in time", method)
+	}
+}
+
+func (c *Client) GetChainParams() (*chaincfg.Params, error) {
+	return c.params, nil
+}
+
+// GetBlockCount is the height of the server's tip, which it tells us about whenever it changes
+func (c *Client) GetBlockCount() (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.height, nil
+}
+
+func (c *Client) GetRawTransaction(txid *chainhash.Hash) (*wire.MsgTx, error) {
+	var txHex string
+	if err := c.call("blockchain.transaction.get", &txHex, txid.String()); err != nil {
+		return nil, err
+	}
+	txBytes, err := hex.DecodeString(txHex)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var tx wire.MsgTx
+	if err := tx.Deserialize(bytes.NewReader(txBytes)); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &tx, nil
+}
+
+// GetTxOut is like bitcoind's gettxout (including the mempool), so nil if the output is spent or never existed.
+// Electrum has no way to look up an output directly, so we get the transaction, then check it's still in the
+// unspents of its script
+func (c *Client) GetTxOut(txid *chainhash.Hash, vout uint32) (*btcjson.GetTxOutResult, error) {
+	tx, err := c.GetRawTransaction(txid)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if int(vout) >= len(tx.TxOut) {
+		return nil, nil
+	}
+	txOut := tx.TxOut[vout]
+
+	unspents, err := c.ListScriptUnspent(txOut.PkScript)
+	if err != nil {
+		return nil, err
+	}
+	for _, unspent := range unspents {
+		if unspent.TxID == txid.String() && unspent.Vout == vout {
+			return &btcjson.GetTxOutResult{
+				Confirmations: unspent.Confirmations,
+				Value:         unspent.Amount,
+				ScriptPubKey:  btcjson.ScriptPubKeyResult{Hex: hex.EncodeToString(txOut.PkScript)},
+			}, nil
+		}
+	}
+	return nil, nil
+}
+
+// Electrum has no error code for a transaction not existing, servers pass on bitcoind's message (ElectrumX, Fulcrum)
+// or have their own
+var notFoundMessages = []string{"no such mempool or blockchain transaction", "transaction not found", "tx not found"}
+
+// isNotFound is whether err is the server saying there's no such transaction, rather than it failing to look
+func isNotFound(err error) bool {
+	e, ok := errors.Cause(err).(*rpcError)
+	if !ok {
+		return false
+	}
+	message := strings.ToLower(e.Message)
+	for _, notFound := range notFoundMessages {
+		if strings.Contains(message, notFound) {
+			return true
+		}
+	}
+	return false
+}
+
+// TestMempoolAccept is as close as we can get to bitcoind's without a node: every input must spend an unspent
+// output with a valid signature, and the outputs can't be worth more than the inputs. It doesn't know about policy
+// (dust, minimum relay fee etc.), so SendRawTransaction can still fail
+func (c *Client) TestMempoolAccept(tx *wire.MsgTx) (bool, error) {
+	prevOuts, err := util.PrevOuts(tx, c.GetTxOut)
+	if errors.Cause(err) == util.ErrMissingPrevOut {
+		util.Logger.Debug("transaction rejected", "txid", tx.TxHash().String(), "reason", err)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var in, out int64
+	for i, txIn := range tx.TxIn {
+		if err := util.VerifyInput(tx, i, prevOuts); err != nil {
+			util.Logger.Debug("transaction rejected", "txid", tx.TxHash().String(), "input", i, "reason", err)
+			return false, nil
+		}
+		in += prevOuts.FetchPrevOutput(txIn.PreviousOutPoint).Value
+	}
+	for _, txOut := range tx.TxOut {
+		out += txOut.Value
+	}
+	if out > in {
+		util.Logger.Debug("transaction rejected", "txid", tx.TxHash().String(), "reason", "outputs worth more than inputs")
+		return false, nil
+	}
+	return true, nil
+}
+
+func (c *Client) SendRawTransaction(tx *wire.MsgTx) (*chainhash.Hash, error) {
+	var buf bytes.Buffer
+	if err := tx.Serialize(&buf); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var txid string
+	if err := c.call("blockchain.transaction.broadcast", &txid, hex.EncodeToString(buf.Bytes())); err != nil {
+		return nil, err
+	}
+	hash, err := chainhash.NewHashFromStr(txid)
+	return hash, errors.WithStack(err)
+}
+
+// EstimateSmartFee is in sat/vbyte, like *rpc_client.RpcClient's
+func (c *Client) EstimateSmartFee(confTarget int) (float64, error) {
+	var feeRate float64 // btc per kvB
+	if err := c.call("blockchain.estimatefee", &feeRate, confTarget); err != nil {
+		return 0, err
+	}
+	if feeRate <= 0 {
+		return 0, errors.New("electrum server could not estimate a fee")
+	}
+	return feeRate * 1e8 / 1000, nil
+}
+
+// ScriptStatus subscribes to pkScript (the first time), and returns its latest status: a hash of its history, which
+// changes whenever it's paid or spends. It's "" if the script has never been used
+func (c *Client) ScriptStatus(pkScript []byte) (string, error) {
+	scriptHash := ScriptHash(pkScript)
+
+	c.mu.Lock()
+	status, ok := c.statuses[scriptHash]
+	c.mu.Unlock()
+	if ok {
+		return status, nil
+	}
+
+	var result *string
+	if err := c.call("blockchain.scripthash.subscribe", &result, scriptHash); err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// a notification might have beaten us here, and it'd be newer
+	if status, ok := c.statuses[scriptHash]; ok {
+		return status, nil
+	}
+	c.statuses[scriptHash] = stringOrEmpty(result)
+	return c.statuses[scriptHash], nil
+}
+
+// ListScriptUnspent is everything paid to pkScript that's unspent, including in the mempool (with 0 confirmations)
+func (c *Client) ListScriptUnspent(pkScript []byte) ([]btcjson.ListUnspentResult, error) {
+	var unspents []unspentItem
+	if err := c.call("blockchain.scripthash.listunspent", &unspents, ScriptHash(pkScript)); err != nil {
+		return nil, err
+	}
+
+	tip, err := c.GetBlockCount()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]btcjson.ListUnspentResult, len(unspents))
+	for i, unspent := range unspents {
+		results[i] = btcjson.ListUnspentResult{
+			TxID:         unspent.TxHash,
+			Vout:         unspent.TxPos,
+			ScriptPubKey: hex.EncodeToString(pkScript),
+			Amount:       btcutil.Amount(unspent.Value).ToBTC(),
+		}
+		if unspent.Height > 0 {
+			// the block notification might not have reached us yet
+			results[i].Confirmations = tip - unspent.Height + 1
+			if results[i].Confirmations < 1 {
+				results[i].Confirmations = 1
+			}
+		}
+	}
+	return results, nil
+}
+
+func stringOrEmpty(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,203 @@
+package electrum
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+func testServer(t *testing.T) (*Server, *Client) {
+	t.Helper()
+	server, err := Listen("127.0.0.1:0", &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	client, err := Dial(server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return server, client
+}
+
+// eventually waits for check to be true, which notifications from the server should make it
+func eventually(t *testing.T, what string, check func() bool) {
+	t.Helper()
+	for start := time.Now(); !check(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal(what)
+		}
+	}
+}
+
+// testCoin is a p2wpkh output of a new key, out of thin air
+func testCoin(t *testing.T, value int64) (*btcec.PrivateKey, *wire.MsgTx) {
+	t.Helper()
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkScript := append([]byte{txscript.OP_0, txscript.OP_DATA_20}, btcutil.Hash160(key.PubKey().SerializeCompressed())...)
+
+	tx := wire.NewMsgTx(2)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{1}, 0), nil, nil))
+	tx.AddTxOut(wire.NewTxOut(value, pkScript))
+	return key, tx
+}
+
+// spend is coin's output sent (minus fee) to the same script, signed with key
+func spend(t *testing.T, key *btcec.PrivateKey, coin *wire.MsgTx, fee int64) *wire.MsgTx {
+	t.Helper()
+	prevOut := coin.TxOut[0]
+	coinHash := coin.TxHash()
+
+	tx := wire.NewMsgTx(2)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&coinHash, 0), nil, nil))
+	tx.AddTxOut(wire.NewTxOut(prevOut.Value-fee, prevOut.PkScript))
+	prevOuts := txscript.NewCannedPrevOutputFetcher(prevOut.PkScript, prevOut.Value)
+	witness, err := txscript.WitnessSignature(tx, txscript.NewTxSigHashes(tx, prevOuts), 0, prevOut.Value,
+		prevOut.PkScript, txscript.SigHashAll, key, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.TxIn[0].Witness = witness
+	return tx
+}
+
+func TestClientHandshake(t *testing.T) {
+	server, client := testServer(t)
+
+	params, err := client.GetChainParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params != &chaincfg.RegressionNetParams {
+		t.Fatalf("client thinks the server is on %v, want regtest", params.Name)
+	}
+	if height, err := client.GetBlockCount(); err != nil || height != 0 {
+		t.Fatalf("height is %v (%v), want 0", height, err)
+	}
+
+	server.Mine()
+	eventually(t, "never heard about the new block", func() bool {
+		height, _ := client.GetBlockCount()
+		return height == 1
+	})
+}
+
+func TestClientScriptStatus(t *testing.T) {
+	server, client := testServer(t)
+	_, coin := testCoin(t, 100000)
+	pkScript := coin.TxOut[0].PkScript
+
+	status, err := client.ScriptStatus(pkScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != "" {
+		t.Fatalf("unused script has status %q", status)
+	}
+
+	server.Mine(coin)
+	eventually(t, "script's status never changed after it was paid", func() bool {
+		status, _ = client.ScriptStatus(pkScript)
+		return status != ""
+	})
+
+	unspents, err := client.ListScriptUnspent(pkScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unspents) != 1 || unspents[0].TxID != coin.TxHash().String() || unspents[0].Vout != 0 ||
+		unspents[0].Amount != 0.001 || unspents[0].Confirmations != 1 {
+		t.Errorf("script's unspents are %+v", unspents)
+	}
+
+	coinHash := coin.TxHash()
+	txOut, err := client.GetTxOut(&coinHash, 0)
+	if err != nil || txOut == nil || txOut.Value != 0.001 {
+		t.Errorf("gettxout of the coin is %+v (%v)", txOut, err)
+	}
+	if txOut, err := client.GetTxOut(&chainhash.Hash{2}, 0); err != nil || txOut != nil {
+		t.Errorf("gettxout of a missing transaction is %+v (%v), want nil", txOut, err)
+	}
+
+	// the server not being able to look isn't the same as it not being there
+	server.mu.Lock()
+	server.failing["blockchain.transaction.get"] = true
+	server.mu.Unlock()
+	if txOut, err := client.GetTxOut(&coinHash, 0); err == nil {
+		t.Errorf("gettxout with the server failing is %+v, want an error", txOut)
+	}
+}
+
+func TestClientBroadcast(t *testing.T) {
+	server, client := testServer(t)
+	key, coin := testCoin(t, 100000)
+	server.Mine(coin)
+
+	tx := spend(t, key, coin, 1000)
+	if ok, err := client.TestMempoolAccept(tx); err != nil || !ok {
+		t.Fatalf("signed spend not accepted (%v)", err)
+	}
+
+	unsigned := tx.Copy()
+	unsigned.TxIn[0].Witness = nil
+	if ok, err := client.TestMempoolAccept(unsigned); err != nil || ok {
+		t.Errorf("unsigned spend accepted (%v)", err)
+	}
+	if ok, err := client.TestMempoolAccept(spend(t, key, coin, -1)); err != nil || ok {
+		t.Errorf("spend creating money accepted (%v)", err)
+	}
+	if _, err := client.SendRawTransaction(unsigned); err == nil {
+		t.Error("server took an unsigned spend")
+	}
+
+	txid, err := client.SendRawTransaction(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *txid != tx.TxHash() {
+		t.Errorf("broadcast txid is %v, want %v", txid, tx.TxHash())
+	}
+
+	coinHash := coin.TxHash()
+	if txOut, err := client.GetTxOut(&coinHash, 0); err != nil || txOut != nil {
+		t.Errorf("gettxout of the spent coin is %+v (%v), want nil", txOut, err)
+	}
+	if ok, err := client.TestMempoolAccept(tx); err != nil || ok {
+		t.Errorf("double spend accepted (%v)", err)
+	}
+	unspents, err := client.ListScriptUnspent(tx.TxOut[0].PkScript)
+	if err != nil || len(unspents) != 1 || unspents[0].TxID != txid.String() || unspents[0].Confirmations != 0 {
+		t.Errorf("after broadcasting, unspents are %+v (%v), want just the unconfirmed spend", unspents, err)
+	}
+}
+
+func TestClientEstimateFee(t *testing.T) {
+	server, client := testServer(t)
+
+	if _, err := client.EstimateSmartFee(6); err == nil {
+		t.Error("estimated a fee when the server couldn't")
+	}
+
+	server.mu.Lock()
+	server.FeeRate = 12.5
+	server.mu.Unlock()
+	feeRate, err := client.EstimateSmartFee(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(feeRate-12.5) > 1e-9 {
+		t.Errorf("fee estimate is %v sat/vbyte, want 12.5", feeRate)
+	}
+}
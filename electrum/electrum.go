@@ -0,0 +1,99 @@
+// Package electrum talks the electrum server protocol (json-rpc over tcp or tls, see
+// https://electrumx-spesmilo.readthedocs.io/en/latest/protocol.html), so bustapay can use a public electrum server
+// instead of running its own bitcoind. A *Client is a wallet.Chain: the built-in wallet finds its unspents with
+// scripthash subscriptions, and everything else it needs (transactions, broadcasting, fee estimates) maps onto
+// electrum methods. That covers sending, and receiving on the built-in wallet (a receive.Receiver, or a receive.Server
+// with a Config.DescriptorWallet), as long as nothing needs bitcoind's wallet. A server runs for a long time, so it
+// should use a Redialer, which dials again when the connection drops.
+//
+// Server is a stand-in electrum server, for testing without one.
+package electrum
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+const protocolVersion = "1.4"
+
+// ScriptHash is how electrum identifies a script: the sha256 of it, byte reversed, as hex
+func ScriptHash(pkScript []byte) string {
+	hash := sha256.Sum256(pkScript)
+	for i, j := 0, len(hash)-1; i < j; i, j = i+1, j-1 {
+		hash[i], hash[j] = hash[j], hash[i]
+	}
+	return hex.EncodeToString(hash[:])
+}
+
+// historyItem is one transaction that touched a scripthash. Height is 0 for the mempool
+type historyItem struct {
+	TxHash string `json:"tx_hash"`
+	Height int64  `json:"height"`
+}
+
+// status is the hash of a scripthash's history, which changes whenever anything happens to it. It's "" when the
+// scripthash has no history (which the protocol sends as null)
+func status(history []historyItem) string {
+	if len(history) == 0 {
+		return ""
+	}
+
+	// confirmed in block order, then the mempool
+	sort.SliceStable(history, func(i, j int) bool {
+		a, b := history[i].Height, history[j].Height
+		if a <= 0 || b <= 0 {
+			return a > 0 && b <= 0
+		}
+		return a < b
+	})
+
+	h := sha256.New()
+	for _, item := range history {
+		fmt.Fprintf(h, "%v:%v:", item.TxHash, item.Height)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type unspentItem struct {
+	TxHash string `json:"tx_hash"`
+	TxPos  uint32 `json:"tx_pos"`
+	Height int64  `json:"height"`
+	Value  int64  `json:"value"`
+}
+
+type headerItem struct {
+	Height int64  `json:"height"`
+	Hex    string `json:"hex"`
+}
+
+// message is any json-rpc message: a request, response or notification
+type message struct {
+	JsonRpc string            `json:"jsonrpc"`
+	Id      *int64            `json:"id,omitempty"`
+	Method  string            `json:"method,omitempty"`
+	Params  []json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage   `json:"result,omitempty"`
+	Error   *rpcError         `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("electrum error %v: %v", e.Code, e.Message)
+}
+
+func mustHash(s string) chainhash.Hash {
+	hash, err := chainhash.NewHashFromStr(s)
+	if err != nil {
+		return chainhash.Hash{}
+	}
+	return *hash
+}
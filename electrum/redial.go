@@ -0,0 +1,133 @@
+package electrum
+
+import (
+	"sync"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+)
+
+// Redialer is a Client for something that runs for a long time, like bustapay receive: if the connection has dropped
+// it dials the server again on the next call. The call that finds out the connection dropped still fails, callers
+// are expected to try again later anyway. Subscriptions start afresh on the new connection, which the wallet copes
+// with since it only cares whether a script's status is different from what it last saw
+type Redialer struct {
+	address string
+	params  *chaincfg.Params
+
+	mu     sync.Mutex
+	client *Client
+	closed bool
+}
+
+// DialRedialing connects to address (see Dial) straight away, so a bad address or server fails now rather than later
+func DialRedialing(address string) (*Redialer, error) {
+	client, err := Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	return &Redialer{address: address, params: client.params, client: client}, nil
+}
+
+// get is the current connection, dialing a new one if it's dead
+func (r *Redialer) get() (*Client, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil, errors.New("electrum connection closed")
+	}
+	if !r.client.dead() {
+		return r.client, nil
+	}
+
+	client, err := Dial(r.address)
+	if err != nil {
+		return nil, err
+	}
+	// a server that's been swapped for one on another chain would have us paying to the wrong addresses
+	if client.params != r.params {
+		client.Close()
+		return nil, errors.Errorf("electrum server %v is on %v now, not %v", r.address, client.params.Name, r.params.Name)
+	}
+	r.client = client
+	return client, nil
+}
+
+func (r *Redialer) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return r.client.Close()
+}
+
+func (r *Redialer) GetChainParams() (*chaincfg.Params, error) {
+	return r.params, nil
+}
+
+func (r *Redialer) GetBlockCount() (int64, error) {
+	client, err := r.get()
+	if err != nil {
+		return 0, err
+	}
+	return client.GetBlockCount()
+}
+
+func (r *Redialer) GetRawTransaction(txid *chainhash.Hash) (*wire.MsgTx, error) {
+	client, err := r.get()
+	if err != nil {
+		return nil, err
+	}
+	return client.GetRawTransaction(txid)
+}
+
+func (r *Redialer) GetTxOut(txid *chainhash.Hash, vout uint32) (*btcjson.GetTxOutResult, error) {
+	client, err := r.get()
+	if err != nil {
+		return nil, err
+	}
+	return client.GetTxOut(txid, vout)
+}
+
+func (r *Redialer) TestMempoolAccept(tx *wire.MsgTx) (bool, error) {
+	client, err := r.get()
+	if err != nil {
+		return false, err
+	}
+	return client.TestMempoolAccept(tx)
+}
+
+func (r *Redialer) SendRawTransaction(tx *wire.MsgTx) (*chainhash.Hash, error) {
+	client, err := r.get()
+	if err != nil {
+		return nil, err
+	}
+	return client.SendRawTransaction(tx)
+}
+
+func (r *Redialer) EstimateSmartFee(confTarget int) (float64, error) {
+	client, err := r.get()
+	if err != nil {
+		return 0, err
+	}
+	return client.EstimateSmartFee(confTarget)
+}
+
+func (r *Redialer) ScriptStatus(pkScript []byte) (string, error) {
+	client, err := r.get()
+	if err != nil {
+		return "", err
+	}
+	return client.ScriptStatus(pkScript)
+}
+
+func (r *Redialer) ListScriptUnspent(pkScript []byte) ([]btcjson.ListUnspentResult, error) {
+	client, err := r.get()
+	if err != nil {
+		return nil, err
+	}
+	return client.ListScriptUnspent(pkScript)
+}
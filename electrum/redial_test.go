@@ -0,0 +1,64 @@
+package electrum
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+func TestRedialer(t *testing.T) {
+	server, err := Listen("127.0.0.1:0", &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	r, err := DialRedialing(server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	key, coin := testCoin(t, 100000)
+	server.Mine(coin)
+	coinHash := coin.TxHash()
+	if txOut, err := r.GetTxOut(&coinHash, 0); err != nil || txOut == nil {
+		t.Fatalf("coin isn't unspent: %v", err)
+	}
+
+	// the connection drops, e.g. the server restarted
+	first := r.client
+	first.Close()
+	eventually(t, "client never noticed its connection closed", first.dead)
+
+	if height, err := r.GetBlockCount(); err != nil || height != 1 {
+		t.Fatalf("height is %v after redialing: %v", height, err)
+	}
+	if r.client == first {
+		t.Fatal("didn't dial again")
+	}
+	if status, err := r.ScriptStatus(coin.TxOut[0].PkScript); err != nil || status == "" {
+		t.Errorf("script's status is %q after redialing: %v", status, err)
+	}
+	if _, err := r.SendRawTransaction(spend(t, key, coin, 1000)); err != nil {
+		t.Error(err)
+	}
+
+	r.Close()
+	if _, err := r.GetBlockCount(); err == nil {
+		t.Error("redialed after being closed")
+	}
+}
+
+func TestDialRedialingFails(t *testing.T) {
+	server, err := Listen("127.0.0.1:0", &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := server.Addr()
+	server.Close()
+
+	if _, err := DialRedialing(address); err == nil {
+		t.Error("dialed a server that isn't there")
+	}
+}
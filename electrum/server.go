@@ -0,0 +1,369 @@
+package electrum
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+	"github.com/rhavar/bustapay/util"
+)
+
+// Server is a stand-in electrum server, for tests. It serves the methods Client uses from transactions it's given
+// with Mine, or that are broadcast to it. Like wallet.MemoryChain the only rules are signatures and amounts:
+// broadcast transactions sit in the mempool until the next Mine
+type Server struct {
+	Params  *chaincfg.Params
+	FeeRate float64 // sat/vbyte, what blockchain.estimatefee says (-1, i.e. no estimate, if 0)
+
+	listener net.Listener
+
+	mu     sync.Mutex
+	height int64
+	txs    map[chainhash.Hash]*serverTx
+	spent  map[wire.OutPoint]chainhash.Hash // -> the transaction spending it
+	conns  map[*serverConn]struct{}
+
+	failing map[string]bool // methods that fail like the server (or its node) is having trouble, for tests
+}
+
+type serverTx struct {
+	tx     *wire.MsgTx
+	height int64 // 0 if it's in the mempool
+}
+
+type serverConn struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+	// everything below is protected by Server.mu
+	subscribed map[string]string // scripthash -> the last status we told them
+	headers    bool
+}
+
+// Listen starts serving plain text json-rpc on addr, e.g. "127.0.0.1:0"
+func Listen(addr string, params *chaincfg.Params) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	s := &Server{
+		Params:   params,
+		listener: listener,
+		txs:      make(map[chainhash.Hash]*serverTx),
+		spent:    make(map[wire.OutPoint]chainhash.Hash),
+		conns:    make(map[*serverConn]struct{}),
+		failing:  make(map[string]bool),
+	}
+	go s.accept()
+	return s, nil
+}
+
+// Addr is what to Dial
+func (s *Server) Addr() string {
+	return "tcp://" + s.listener.Addr().String()
+}
+
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.conn.Close()
+	}
+	return errors.WithStack(err)
+}
+
+// Mine confirms the mempool, and txs, in a new block. txs aren't checked, so they can pay anyone out of thin air
+func (s *Server) Mine(txs ...*wire.MsgTx) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.height++
+	for _, stx := range s.txs {
+		if stx.height == 0 {
+			stx.height = s.height
+		}
+	}
+	for _, tx := range txs {
+		s.add(tx, s.height)
+	}
+	s.notify()
+}
+
+// add indexes tx. Must hold mu
+func (s *Server) add(tx *wire.MsgTx, height int64) {
+	txid := tx.TxHash()
+	s.txs[txid] = &serverTx{tx: tx, height: height}
+	for _, txIn := range tx.TxIn {
+		s.spent[txIn.PreviousOutPoint] = txid
+	}
+}
+
+// prevOut is the unspent output outpoint points to, or nil. Must hold mu
+func (s *Server) prevOut(outpoint wire.OutPoint) *wire.TxOut {
+	stx, ok := s.txs[outpoint.Hash]
+	if !ok || int(outpoint.Index) >= len(stx.tx.TxOut) {
+		return nil
+	}
+	if _, spent := s.spent[outpoint]; spent {
+		return nil
+	}
+	return stx.tx.TxOut[outpoint.Index]
+}
+
+// history is every transaction paying to, or spending from, scriptHash. Must hold mu
+func (s *Server) history(scriptHash string) []historyItem {
+	var history []historyItem
+	for txid, stx := range s.txs {
+		touches := false
+		for _, txOut := range stx.tx.TxOut {
+			touches = touches || ScriptHash(txOut.PkScript) == scriptHash
+		}
+		for _, txIn := range stx.tx.TxIn {
+			if prev, ok := s.txs[txIn.PreviousOutPoint.Hash]; ok && int(txIn.PreviousOutPoint.Index) < len(prev.tx.TxOut) {
+				touches = touches || ScriptHash(prev.tx.TxOut[txIn.PreviousOutPoint.Index].PkScript) == scriptHash
+			}
+		}
+		if touches {
+			history = append(history, historyItem{TxHash: txid.String(), Height: stx.height})
+		}
+	}
+	return history
+}
+
+// notify tells every connection about anything they've subscribed to that changed. Must hold mu
+func (s *Server) notify() {
+	for c := range s.conns {
+		if c.headers {
+			c.send("blockchain.headers.subscribe", s.header())
+		}
+		for scriptHash, last := range c.subscribed {
+			current := status(s.history(scriptHash))
+			if current == last {
+				continue
+			}
+			c.subscribed[scriptHash] = current
+			var param interface{}
+			if current != "" {
+				param = current
+			}
+			c.send("blockchain.scripthash.subscribe", scriptHash, param)
+		}
+	}
+}
+
+// header is a made up header for the tip, electrum clients usually check them but ours doesn't. Must hold mu
+func (s *Server) header() headerItem {
+	header := wire.NewBlockHeader(1, &chainhash.Hash{}, &chainhash.Hash{}, 0, uint32(s.height))
+	header.Timestamp = time.Unix(1231006505+600*s.height, 0)
+	var buf bytes.Buffer
+	header.Serialize(&buf)
+	return headerItem{Height: s.height, Hex: hex.EncodeToString(buf.Bytes())}
+}
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &serverConn{conn: conn, subscribed: make(map[string]string)}
+		s.mu.Lock()
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+		go s.serve(c)
+	}
+}
+
+func (s *Server) serve(c *serverConn) {
+	defer func() {
+		c.conn.Close()
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+	}()
+
+	reader := bufio.NewReader(c.conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		var request message
+		if err := json.Unmarshal(line, &request); err != nil || request.Id == nil {
+			return
+		}
+
+		response := message{JsonRpc: "2.0", Id: request.Id}
+		result, err := s.handle(c, request.Method, request.Params)
+		if e, ok := err.(*rpcError); ok {
+			response.Error = e
+		} else if err != nil {
+			response.Error = &rpcError{Code: 1, Message: err.Error()}
+		} else if response.Result, err = json.Marshal(result); err != nil {
+			return
+		}
+		if err := c.write(&response); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) handle(c *serverConn, method string, params []json.RawMessage) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stringParam := func() (string, error) {
+		var param string
+		if len(params) < 1 || json.Unmarshal(params[0], &param) != nil {
+			return "", errors.Errorf("%v needs a string parameter", method)
+		}
+		return param, nil
+	}
+
+	if s.failing[method] {
+		return nil, &rpcError{Code: 2, Message: "daemon error: connection refused"}
+	}
+
+	switch method {
+	case "server.version":
+		return []string{"bustapay stand-in", protocolVersion}, nil
+	case "server.features":
+		return map[string]string{"genesis_hash": s.Params.GenesisHash.String()}, nil
+	case "blockchain.headers.subscribe":
+		c.headers = true
+		return s.header(), nil
+	case "blockchain.estimatefee":
+		if s.FeeRate == 0 {
+			return -1, nil
+		}
+		return s.FeeRate * 1000 / 1e8, nil
+	case "blockchain.scripthash.subscribe":
+		scriptHash, err := stringParam()
+		if err != nil {
+			return nil, err
+		}
+		current := status(s.history(scriptHash))
+		c.subscribed[scriptHash] = current
+		if current == "" {
+			return nil, nil
+		}
+		return current, nil
+	case "blockchain.scripthash.get_history":
+		scriptHash, err := stringParam()
+		if err != nil {
+			return nil, err
+		}
+		return s.history(scriptHash), nil
+	case "blockchain.scripthash.listunspent":
+		scriptHash, err := stringParam()
+		if err != nil {
+			return nil, err
+		}
+		unspents := []unspentItem{}
+		for txid, stx := range s.txs {
+			for vout, txOut := range stx.tx.TxOut {
+				if ScriptHash(txOut.PkScript) != scriptHash || s.prevOut(*wire.NewOutPoint(&txid, uint32(vout))) == nil {
+					continue
+				}
+				unspents = append(unspents, unspentItem{TxHash: txid.String(), TxPos: uint32(vout), Height: stx.height, Value: txOut.Value})
+			}
+		}
+		return unspents, nil
+	case "blockchain.transaction.get":
+		txid, err := stringParam()
+		if err != nil {
+			return nil, err
+		}
+		stx, ok := s.txs[mustHash(txid)]
+		if !ok {
+			// what ElectrumX passes on from bitcoind
+			return nil, &rpcError{Code: 2, Message: "daemon error: DaemonError({'code': -5, 'message': " +
+				"'No such mempool or blockchain transaction. Use gettransaction for wallet transactions.'})"}
+		}
+		var buf bytes.Buffer
+		if err := stx.tx.Serialize(&buf); err != nil {
+			return nil, err
+		}
+		return hex.EncodeToString(buf.Bytes()), nil
+	case "blockchain.transaction.broadcast":
+		txHex, err := stringParam()
+		if err != nil {
+			return nil, err
+		}
+		txBytes, err := hex.DecodeString(txHex)
+		if err != nil {
+			return nil, err
+		}
+		var tx wire.MsgTx
+		if err := tx.Deserialize(bytes.NewReader(txBytes)); err != nil {
+			return nil, err
+		}
+		if err := s.check(&tx); err != nil {
+			return nil, err
+		}
+		s.add(&tx, 0)
+		s.notify()
+		return tx.TxHash().String(), nil
+	default:
+		return nil, errors.Errorf("unknown method %v", method)
+	}
+}
+
+// check is whether tx spends unspent outputs, with valid signatures, and doesn't create money. Must hold mu
+func (s *Server) check(tx *wire.MsgTx) error {
+	prevOuts := txscript.NewMultiPrevOutFetcher(nil)
+	for i, txIn := range tx.TxIn {
+		prevOut := s.prevOut(txIn.PreviousOutPoint)
+		if prevOut == nil {
+			return errors.Errorf("input %v spends a missing or spent output", i)
+		}
+		prevOuts.AddPrevOut(txIn.PreviousOutPoint, prevOut)
+	}
+
+	var in, out int64
+	for i, txIn := range tx.TxIn {
+		if err := util.VerifyInput(tx, i, prevOuts); err != nil {
+			return err
+		}
+		in += prevOuts.FetchPrevOutput(txIn.PreviousOutPoint).Value
+	}
+	for _, txOut := range tx.TxOut {
+		out += txOut.Value
+	}
+	if out > in {
+		return errors.New("outputs are worth more than the inputs")
+	}
+	return nil
+}
+
+func (c *serverConn) send(method string, params ...interface{}) {
+	notification := message{JsonRpc: "2.0", Method: method}
+	for _, param := range params {
+		raw, err := json.Marshal(param)
+		if err != nil {
+			return
+		}
+		notification.Params = append(notification.Params, raw)
+	}
+	c.write(&notification)
+}
+
+func (c *serverConn) write(msg *message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err = c.conn.Write(append(data, '\n'))
+	return errors.WithStack(err)
+}
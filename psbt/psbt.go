@@ -0,0 +1,356 @@
+// Package psbt is just enough of BIP174 (partially signed bitcoin transactions) to hand a transaction to a wallet
+// or signer, and get signatures back. Only the fields we use are decoded, everything else is kept as is, so
+// a packet survives a round trip through Decode and Encode unchanged.
+package psbt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+)
+
+var magic = []byte{'p', 's', 'b', 't', 0xff}
+
+// Key types, from BIP174
+const (
+	globalUnsignedTx = 0x00
+
+	inputNonWitnessUtxo     = 0x00
+	inputWitnessUtxo        = 0x01
+	inputRedeemScript       = 0x04
+	inputWitnessScript      = 0x05
+	inputFinalScriptSig     = 0x07
+	inputFinalScriptWitness = 0x08
+)
+
+var inputKeyTypes = []int{inputNonWitnessUtxo, inputWitnessUtxo, inputRedeemScript, inputWitnessScript,
+	inputFinalScriptSig, inputFinalScriptWitness}
+
+const unknownKey = -1
+
+const maxFieldSize = 4 * 1000 * 1000 // nothing in a psbt can be bigger than a block
+
+// KeyValue is a field we don't do anything with (e.g. partial signatures, derivation paths, taproot fields)
+type KeyValue struct {
+	Key   []byte // including the type
+	Value []byte
+}
+
+type Packet struct {
+	UnsignedTx *wire.MsgTx // without any signature scripts or witnesses
+	Inputs     []Input
+	Outputs    []Output
+	Unknowns   []KeyValue
+}
+
+type Input struct {
+	NonWitnessUtxo     *wire.MsgTx    // the whole transaction the input spends
+	WitnessUtxo        *wire.TxOut    // just the output it spends, enough for segwit
+	RedeemScript       []byte         // for p2sh
+	WitnessScript      []byte         // for p2wsh
+	FinalScriptSig     []byte         // once it's signed
+	FinalScriptWitness wire.TxWitness // once it's signed
+	Unknowns           []KeyValue
+}
+
+// IsFinalized is whether the input has been signed, and is ready to go in the transaction
+func (in *Input) IsFinalized() bool {
+	return len(in.FinalScriptSig) > 0 || len(in.FinalScriptWitness) > 0
+}
+
+type Output struct {
+	Unknowns []KeyValue
+}
+
+// New creates a packet for tx, with nothing known about its inputs. Any signatures in tx are left out
+func New(tx *wire.MsgTx) *Packet {
+	unsigned := tx.Copy()
+	for _, txIn := range unsigned.TxIn {
+		txIn.SignatureScript = nil
+		txIn.Witness = nil
+	}
+	return &Packet{
+		UnsignedTx: unsigned,
+		Inputs:     make([]Input, len(unsigned.TxIn)),
+		Outputs:    make([]Output, len(unsigned.TxOut)),
+	}
+}
+
+// Extract is the unsigned transaction with every finalized input's signatures filled in
+func (p *Packet) Extract() *wire.MsgTx {
+	tx := p.UnsignedTx.Copy()
+	for i, input := range p.Inputs {
+		tx.TxIn[i].SignatureScript = input.FinalScriptSig
+		tx.TxIn[i].Witness = input.FinalScriptWitness
+	}
+	return tx
+}
+
+// PrevOuts is the output every input spends, from its WitnessUtxo (or NonWitnessUtxo), for signing or verifying.
+// It fails if an input has neither: a taproot signature commits to all of them, so one missing means we can't
+func (p *Packet) PrevOuts() (*txscript.MultiPrevOutFetcher, error) {
+	prevOuts := txscript.NewMultiPrevOutFetcher(nil)
+	for i, input := range p.Inputs {
+		outpoint := p.UnsignedTx.TxIn[i].PreviousOutPoint
+		switch {
+		case input.WitnessUtxo != nil:
+			prevOuts.AddPrevOut(outpoint, input.WitnessUtxo)
+		case input.NonWitnessUtxo != nil && input.NonWitnessUtxo.TxHash() == outpoint.Hash &&
+			int(outpoint.Index) < len(input.NonWitnessUtxo.TxOut):
+			prevOuts.AddPrevOut(outpoint, input.NonWitnessUtxo.TxOut[outpoint.Index])
+		default:
+			return nil, errors.Errorf("psbt doesn't say what input %v spends", i)
+		}
+	}
+	return prevOuts, nil
+}
+
+// Decode parses a base64 psbt, the way bitcoind gives them out
+func Decode(s string) (*Packet, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return Parse(b)
+}
+
+// Encode is the packet as base64, the way bitcoind takes them
+func (p *Packet) Encode() (string, error) {
+	b, err := p.Serialize()
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// Parse reads a binary psbt
+func Parse(b []byte) (*Packet, error) {
+	r := bytes.NewReader(b)
+
+	prefix := make([]byte, len(magic))
+	if _, err := io.ReadFull(r, prefix); err != nil || !bytes.Equal(prefix, magic) {
+		return nil, errors.New("not a psbt")
+	}
+
+	p := &Packet{}
+	err := readMap(r, []int{globalUnsignedTx}, func(keyType int, key []byte, value []byte) error {
+		if keyType != globalUnsignedTx {
+			p.Unknowns = append(p.Unknowns, KeyValue{key, value})
+			return nil
+		}
+		if p.UnsignedTx != nil {
+			return errors.New("psbt has more than one unsigned transaction")
+		}
+		var tx wire.MsgTx
+		if err := tx.DeserializeNoWitness(bytes.NewReader(value)); err != nil {
+			return errors.WithStack(err)
+		}
+		for _, txIn := range tx.TxIn {
+			if len(txIn.SignatureScript) > 0 {
+				return errors.New("psbt's unsigned transaction has a signature script")
+			}
+		}
+		p.UnsignedTx = &tx
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p.UnsignedTx == nil {
+		return nil, errors.New("psbt has no unsigned transaction")
+	}
+
+	p.Inputs = make([]Input, len(p.UnsignedTx.TxIn))
+	for i := range p.Inputs {
+		input := &p.Inputs[i]
+		err := readMap(r, inputKeyTypes, func(keyType int, key []byte, value []byte) error {
+			var err error
+			switch keyType {
+			case inputNonWitnessUtxo:
+				input.NonWitnessUtxo = &wire.MsgTx{}
+				err = input.NonWitnessUtxo.Deserialize(bytes.NewReader(value))
+			case inputWitnessUtxo:
+				input.WitnessUtxo, err = parseTxOut(value)
+			case inputRedeemScript:
+				input.RedeemScript = value
+			case inputWitnessScript:
+				input.WitnessScript = value
+			case inputFinalScriptSig:
+				input.FinalScriptSig = value
+			case inputFinalScriptWitness:
+				input.FinalScriptWitness, err = parseWitness(value)
+			default:
+				input.Unknowns = append(input.Unknowns, KeyValue{key, value})
+			}
+			return errors.WithStack(err)
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "input %v", i)
+		}
+	}
+
+	p.Outputs = make([]Output, len(p.UnsignedTx.TxOut))
+	for i := range p.Outputs {
+		output := &p.Outputs[i]
+		err := readMap(r, nil, func(keyType int, key []byte, value []byte) error {
+			output.Unknowns = append(output.Unknowns, KeyValue{key, value})
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "output %v", i)
+		}
+	}
+
+	return p, nil
+}
+
+// Serialize is the packet as a binary psbt
+func (p *Packet) Serialize() ([]byte, error) {
+	var w bytes.Buffer
+	w.Write(magic)
+
+	var tx bytes.Buffer
+	if err := p.UnsignedTx.SerializeNoWitness(&tx); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	writeKeyValue(&w, []byte{globalUnsignedTx}, tx.Bytes())
+	writeUnknowns(&w, p.Unknowns)
+	w.WriteByte(0)
+
+	for _, input := range p.Inputs {
+		if input.NonWitnessUtxo != nil {
+			var utxo bytes.Buffer
+			if err := input.NonWitnessUtxo.Serialize(&utxo); err != nil {
+				return nil, errors.WithStack(err)
+			}
+			writeKeyValue(&w, []byte{inputNonWitnessUtxo}, utxo.Bytes())
+		}
+		if input.WitnessUtxo != nil {
+			writeKeyValue(&w, []byte{inputWitnessUtxo}, serializeTxOut(input.WitnessUtxo))
+		}
+		if input.RedeemScript != nil {
+			writeKeyValue(&w, []byte{inputRedeemScript}, input.RedeemScript)
+		}
+		if input.WitnessScript != nil {
+			writeKeyValue(&w, []byte{inputWitnessScript}, input.WitnessScript)
+		}
+		if input.FinalScriptSig != nil {
+			writeKeyValue(&w, []byte{inputFinalScriptSig}, input.FinalScriptSig)
+		}
+		if input.FinalScriptWitness != nil {
+			writeKeyValue(&w, []byte{inputFinalScriptWitness}, serializeWitness(input.FinalScriptWitness))
+		}
+		writeUnknowns(&w, input.Unknowns)
+		w.WriteByte(0)
+	}
+
+	for _, output := range p.Outputs {
+		writeUnknowns(&w, output.Unknowns)
+		w.WriteByte(0)
+	}
+
+	return w.Bytes(), nil
+}
+
+// readMap calls f with every key value pair, until the separator. keyType is unknownKey unless it's one of known
+func readMap(r *bytes.Reader, known []int, f func(keyType int, key []byte, value []byte) error) error {
+	seen := make(map[string]struct{})
+	for {
+		key, err := wire.ReadVarBytes(r, 0, maxFieldSize, "key")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if len(key) == 0 {
+			return nil // separator
+		}
+		if _, ok := seen[string(key)]; ok {
+			return errors.New("psbt has a duplicate key")
+		}
+		seen[string(key)] = struct{}{}
+
+		value, err := wire.ReadVarBytes(r, 0, maxFieldSize, "value")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		// The fields we understand all have a single byte key, one of them with more is invalid
+		keyType := unknownKey
+		for _, t := range known {
+			if int(key[0]) != t {
+				continue
+			}
+			if len(key) != 1 {
+				return errors.Errorf("psbt key type %v has key data", t)
+			}
+			keyType = t
+		}
+		if err := f(keyType, key, value); err != nil {
+			return err
+		}
+	}
+}
+
+func writeKeyValue(w *bytes.Buffer, key []byte, value []byte) {
+	wire.WriteVarBytes(w, 0, key)
+	wire.WriteVarBytes(w, 0, value)
+}
+
+func writeUnknowns(w *bytes.Buffer, unknowns []KeyValue) {
+	for _, kv := range unknowns {
+		writeKeyValue(w, kv.Key, kv.Value)
+	}
+}
+
+func parseTxOut(b []byte) (*wire.TxOut, error) {
+	if len(b) < 9 {
+		return nil, errors.New("witness utxo too short")
+	}
+	value := int64(binary.LittleEndian.Uint64(b[:8]))
+	pkScript, err := wire.ReadVarBytes(bytes.NewReader(b[8:]), 0, maxFieldSize, "pkScript")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return wire.NewTxOut(value, pkScript), nil
+}
+
+func serializeTxOut(txOut *wire.TxOut) []byte {
+	var w bytes.Buffer
+	var value [8]byte
+	binary.LittleEndian.PutUint64(value[:], uint64(txOut.Value))
+	w.Write(value[:])
+	wire.WriteVarBytes(&w, 0, txOut.PkScript)
+	return w.Bytes()
+}
+
+func parseWitness(b []byte) (wire.TxWitness, error) {
+	r := bytes.NewReader(b)
+	count, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if count > uint64(len(b)) {
+		return nil, errors.New("witness has too many items")
+	}
+	witness := make(wire.TxWitness, count)
+	for i := range witness {
+		witness[i], err = wire.ReadVarBytes(r, 0, maxFieldSize, "witness item")
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return witness, nil
+}
+
+func serializeWitness(witness wire.TxWitness) []byte {
+	var w bytes.Buffer
+	wire.WriteVarInt(&w, 0, uint64(len(witness)))
+	for _, item := range witness {
+		wire.WriteVarBytes(&w, 0, item)
+	}
+	return w.Bytes()
+}
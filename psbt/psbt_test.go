@@ -0,0 +1,114 @@
+package psbt
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// From BIP174's test vectors
+const (
+	// one p2pkh input, with the transaction it spends as its non-witness utxo
+	p2pkhInput = "cHNidP8BAHUCAAAAASaBcTce3/KF6Tet7qSze3gADAVmy7OtZGQXE8pCFxv2AAAAAAD+////AtPf9QUAAAAAGXapFNDFmQPFusKGh2DpD9UhpGZap2UgiKwA4fUFAAAAABepFDVF5uM7gyxHBQ8k0+65PJwDlIvHh7MuEwAAAQD9pQEBAAAAAAECiaPHHqtNIOA3G7ukzGmPopXJRjr6Ljl/hTPMti+VZ+UBAAAAFxYAFL4Y0VKpsBIDna89p95PUzSe7LmF/////4b4qkOnHf8USIk6UwpyN+9rRgi7st0tAXHmOuxqSJC0AQAAABcWABT+Pp7xp0XpdNkCxDVZQ6vLNL1TU/////8CAMLrCwAAAAAZdqkUhc/xCX/Z4Ai7NK9wnGIZeziXikiIrHL++E4sAAAAF6kUM5cluiHv1irHU6m80GfWx6ajnQWHAkcwRAIgJxK+IuAnDzlPVoMR3HyppolwuAJf3TskAinwf4pfOiQCIAGLONfc0xTnNMkna9b7QPZzMlvEuqFEyADS8vAtsnZcASED0uFWdJQbrUqZY3LLh+GFbTZSYG2YVi/jnF6efkE/IQUCSDBFAiEA0SuFLYXc2WHS9fSrZgZU327tzHlMDDPOXMMJ/7X85Y0CIGczio4OFyXBl/saiK9Z9R5E5CVbIBZ8hoQDHAXR8lkqASECI7cr7vCWXRC+B3jv7NYfysb3mk6haTkzgHNEZPhPKrMAAAAAAAAA"
+	// the same, but missing its output maps
+	missingOutputs = "cHNidP8BAHUCAAAAASaBcTce3/KF6Tet7qSze3gADAVmy7OtZGQXE8pCFxv2AAAAAAD+////AtPf9QUAAAAAGXapFNDFmQPFusKGh2DpD9UhpGZap2UgiKwA4fUFAAAAABepFDVF5uM7gyxHBQ8k0+65PJwDlIvHh7MuEwAAAQD9pQEBAAAAAAECiaPHHqtNIOA3G7ukzGmPopXJRjr6Ljl/hTPMti+VZ+UBAAAAFxYAFL4Y0VKpsBIDna89p95PUzSe7LmF/////4b4qkOnHf8USIk6UwpyN+9rRgi7st0tAXHmOuxqSJC0AQAAABcWABT+Pp7xp0XpdNkCxDVZQ6vLNL1TU/////8CAMLrCwAAAAAZdqkUhc/xCX/Z4Ai7NK9wnGIZeziXikiIrHL++E4sAAAAF6kUM5cluiHv1irHU6m80GfWx6ajnQWHAkcwRAIgJxK+IuAnDzlPVoMR3HyppolwuAJf3TskAinwf4pfOiQCIAGLONfc0xTnNMkna9b7QPZzMlvEuqFEyADS8vAtsnZcASED0uFWdJQbrUqZY3LLh+GFbTZSYG2YVi/jnF6efkE/IQUCSDBFAiEA0SuFLYXc2WHS9fSrZgZU327tzHlMDDPOXMMJ/7X85Y0CIGczio4OFyXBl/saiK9Z9R5E5CVbIBZ8hoQDHAXR8lkqASECI7cr7vCWXRC+B3jv7NYfysb3mk6haTkzgHNEZPhPKrMAAAAAAA=="
+	// an input with an unknown key type
+	unknownInputKey = "cHNidP8BAD8CAAAAAf//////////////////////////////////////////AAAAAAD/////AQAAAAAAAAAAA2oBAAAAAAAACg8BAgMEBQYHCAkPAQIDBAUGBwgJCgsMDQ4PAAA="
+	// an unsigned transaction with a signature script in it
+	signedUnsignedTx = "cHNidP8BAP0KAQIAAAACqwlJoIxa98SbghL0F+LxWrP1wz3PFTghqBOfh3pbe+QAAAAAakcwRAIgR1lmF5fAGwNrJZKJSGhiGDR9iYZLcZ4ff89X0eURZYcCIFMJ6r9Wqk2Ikf/REf3xM286KdqGbX+EhtdVRs7tr5MZASEDXNxh/HupccC1AaZGoqg7ECy0OIEhfKaC3Ibi1z+ogpL+////qwlJoIxa98SbghL0F+LxWrP1wz3PFTghqBOfh3pbe+QBAAAAAP7///8CYDvqCwAAAAAZdqkUdopAu9dAy+gdmI5x3ipNXHE5ax2IrI4kAAAAAAAAGXapFG9GILVT+glechue4O/p+gOcykWXiKwAAAAAAAABASAA4fUFAAAAABepFDVF5uM7gyxHBQ8k0+65PJwDlIvHhwEEFgAUhdE1N/LiZUBaNNuvqePdoB+4IwgAAAA="
+)
+
+// The pieces of unknownInputKey, for making invalid ones out of
+const (
+	psbtMagic  = "70736274ff"
+	globalTx   = "01003f0200000001ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff0000000000ffffffff010000000000000000036a010000000000"
+	unknownKV  = "0a0f0102030405060708090f0102030405060708090a0b0c0d0e0f"
+	separator  = "00"
+	witnessKV  = "0101" + "0d" + "a086010000000000" + "04" + "00020000" // a witness utxo of 100000 sats
+	networkTx  = "0200000001268171371edff285e937adeea4b37b78000c0566cbb3ad64641713ca42171bf60000000000feffffff0100e1f5050000000017a9143545e6e33b832c47050f24d3eeb93c9c03948bc78700000000"
+	hugeLength = "ffffffffffffffffff" // a varint of 2^64-1
+)
+
+func fromHex(t *testing.T, parts ...string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Join(parts, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestValidVectors(t *testing.T) {
+	for _, vector := range []string{p2pkhInput, unknownInputKey} {
+		p, err := Decode(vector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(p.Inputs) != len(p.UnsignedTx.TxIn) || len(p.Outputs) != len(p.UnsignedTx.TxOut) {
+			t.Errorf("%v inputs and %v outputs, for a transaction with %v and %v", len(p.Inputs), len(p.Outputs),
+				len(p.UnsignedTx.TxIn), len(p.UnsignedTx.TxOut))
+		}
+		// nothing we don't understand gets lost
+		if encoded, err := p.Encode(); err != nil || encoded != vector {
+			t.Errorf("didn't round trip: %v %v", encoded, err)
+		}
+	}
+
+	p, _ := Decode(p2pkhInput)
+	if utxo := p.Inputs[0].NonWitnessUtxo; utxo == nil || utxo.TxHash() != p.UnsignedTx.TxIn[0].PreviousOutPoint.Hash {
+		t.Error("non-witness utxo isn't the transaction the input spends")
+	}
+	if _, err := p.PrevOuts(); err != nil {
+		t.Error(err)
+	}
+
+	p, _ = Decode(unknownInputKey)
+	want := KeyValue{fromHex(t, "0f010203040506070809"), fromHex(t, "0102030405060708090a0b0c0d0e0f")}
+	if unknowns := p.Inputs[0].Unknowns; len(unknowns) != 1 || !bytes.Equal(unknowns[0].Key, want.Key) ||
+		!bytes.Equal(unknowns[0].Value, want.Value) {
+		t.Errorf("input's unknowns are %x, want %x", unknowns, want)
+	}
+}
+
+func TestWitnessUtxo(t *testing.T) {
+	p, err := Parse(fromHex(t, psbtMagic, globalTx, separator, witnessKV, separator, separator))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if utxo := p.Inputs[0].WitnessUtxo; utxo == nil || utxo.Value != 100000 || !bytes.Equal(utxo.PkScript, fromHex(t, "00020000")) {
+		t.Errorf("witness utxo is %+v", utxo)
+	}
+}
+
+func TestInvalidVectors(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		psbt []byte
+	}{
+		{"a network transaction", fromHex(t, networkTx)},
+		{"no unsigned transaction", fromHex(t, psbtMagic, separator, unknownKV, separator, separator)},
+		{"two unsigned transactions", fromHex(t, psbtMagic, globalTx, globalTx, separator, separator, separator)},
+		{"duplicate key in an input", fromHex(t, psbtMagic, globalTx, separator, unknownKV, unknownKV, separator, separator)},
+		{"duplicate known key", fromHex(t, psbtMagic, globalTx, separator, witnessKV, witnessKV, separator, separator)},
+		{"key data on the unsigned transaction", fromHex(t, psbtMagic, "020000"+globalTx[4:], separator, separator, separator)},
+		{"key data on a witness utxo", fromHex(t, psbtMagic, globalTx, separator, "020100"+witnessKV[4:], separator, separator)},
+		{"input map not finished", fromHex(t, psbtMagic, globalTx, separator, unknownKV)},
+		{"output maps missing", fromHex(t, psbtMagic, globalTx, separator, unknownKV, separator)},
+		{"value cut short", fromHex(t, psbtMagic, globalTx, separator, unknownKV[:30])},
+		{"key with an oversized length", fromHex(t, psbtMagic, globalTx, separator, hugeLength, separator, separator)},
+		{"value with an oversized length", fromHex(t, psbtMagic, globalTx, separator, "020f01", hugeLength, separator, separator)},
+		{"witness utxo too short", fromHex(t, psbtMagic, globalTx, separator, "010104a0860100", separator, separator)},
+		{"witness with too many items", fromHex(t, psbtMagic, globalTx, separator, "0108", "09", "ff00000000ffffffff", separator, separator)},
+	} {
+		if _, err := Parse(test.psbt); err == nil {
+			t.Errorf("parsed a psbt with %v", test.name)
+		}
+	}
+
+	for name, vector := range map[string]string{"missing outputs": missingOutputs, "signed unsigned transaction": signedUnsignedTx} {
+		if _, err := Decode(vector); err == nil {
+			t.Errorf("decoded the %v vector", name)
+		}
+	}
+}
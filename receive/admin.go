@@ -0,0 +1,280 @@
+package receive
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/rhavar/bustapay/util"
+)
+
+// The admin api is a small json api for inspecting and managing received payments. It listens separately from the
+// public bustapay endpoint (Config.AdminAddr) so it can be kept off the internet, and every request needs the header
+//    Authorization: Bearer $ADMIN_TOKEN
+//
+//    GET  /payments                       ?state=pending&since=2006-01-02T15:04:05Z&until=...&limit=50
+//    GET  /payments/{txid}                the payment with its transactions decoded
+//    POST /payments/{txid}/rebroadcast    broadcast the template transaction now (releasing our contribution)
+//    POST /payments/{txid}/resolve        stop watching the payment and mark it as resolved
+//    GET  /wallet                         what unspents we have available to contribute
+//    GET  /readyz                         see health.go
+//    GET  /metrics                        for prometheus, which can send the token with bearer_token
+//
+// With tenants, every request (but /readyz and /metrics, which cover all of them) needs ?tenant=<name> to say which
+// one it's about.
+
+type adminPayment struct {
+	FinalTxid    string    `json:"final_txid"`
+	TemplateTxid string    `json:"template_txid"`
+	PaymentId    string    `json:"payment_id"`
+	Amount       int64     `json:"amount"`
+	State        string    `json:"state"`
+	CreatedAt    time.Time `json:"created_at"`
+	FeeBumpTxid  string    `json:"fee_bump_txid,omitempty"`
+
+	Template *DecodedTransaction `json:"template,omitempty"`
+	Partial  *DecodedTransaction `json:"partial,omitempty"`
+}
+
+type adminWallet struct {
+	UnspentCount    int   `json:"unspent_count"`
+	ConfirmedCount  int   `json:"confirmed_count"`
+	TotalAmount     int64 `json:"total_amount"`
+	ConfirmedAmount int64 `json:"confirmed_amount"`
+	SmallestUnspent int64 `json:"smallest_unspent"`
+	LargestUnspent  int64 `json:"largest_unspent"`
+}
+
+func (s *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /payments", s.adminListPayments)
+	mux.HandleFunc("GET /payments/{txid}", s.adminShowPayment)
+	mux.HandleFunc("POST /payments/{txid}/rebroadcast", s.adminRebroadcast)
+	mux.HandleFunc("POST /payments/{txid}/resolve", s.adminResolve)
+	mux.HandleFunc("GET /wallet", s.adminWallet)
+	mux.HandleFunc("GET /readyz", s.readyz)
+	mux.Handle("GET /metrics", s.metrics.handler())
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, bearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !bearer || s.config.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AdminToken)) != 1 {
+			util.Logger.Warn("unauthorized admin request", "path", r.URL.Path, util.KeyClientIp, clientIp(r))
+			writeAdminError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) adminListPayments(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.adminTenant(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+
+	var since, until time.Time
+	var err error
+	if v := query.Get("since"); v != "" {
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			writeAdminError(w, http.StatusBadRequest, "since should be RFC3339")
+			return
+		}
+	}
+	if v := query.Get("until"); v != "" {
+		if until, err = time.Parse(time.RFC3339, v); err != nil {
+			writeAdminError(w, http.StatusBadRequest, "until should be RFC3339")
+			return
+		}
+	}
+	limit := 0
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+			writeAdminError(w, http.StatusBadRequest, "limit should be a positive integer")
+			return
+		}
+	}
+	state := query.Get("state")
+
+	payments, err := ListPayments(t.config.DataDir)
+	if err != nil {
+		util.Logger.Error("could not list payments", "err", err)
+		writeAdminError(w, http.StatusInternalServerError, "could not list payments")
+		return
+	}
+
+	results := []adminPayment{}
+	for _, payment := range payments {
+		if state != "" && payment.State != state {
+			continue
+		}
+		if !since.IsZero() && payment.CreatedAt.Before(since) {
+			continue
+		}
+		if !until.IsZero() && payment.CreatedAt.After(until) {
+			continue
+		}
+		if limit > 0 && len(results) >= limit {
+			break
+		}
+		results = append(results, toAdminPayment(payment, false, nil))
+	}
+
+	writeAdminJson(w, results)
+}
+
+func (s *Server) adminShowPayment(w http.ResponseWriter, r *http.Request) {
+	t, payment, ok := s.adminLoadPayment(w, r)
+	if !ok {
+		return
+	}
+
+	// addresses are nice to have, but not worth failing over
+	var chainParams *chaincfg.Params
+	if wallet, closeWallet, err := t.openWallet(); err == nil {
+		chainParams, _ = wallet.GetChainParams()
+		closeWallet()
+	}
+
+	writeAdminJson(w, toAdminPayment(payment, true, chainParams))
+}
+
+func (s *Server) adminRebroadcast(w http.ResponseWriter, r *http.Request) {
+	t, payment, ok := s.adminLoadPayment(w, r)
+	if !ok {
+		return
+	}
+	logger := util.Logger.With("payment_id", payment.PaymentId, "final_txid", payment.FinalTxid)
+
+	var relayCtx context.Context
+	if !t.config.DisableAutoRelay {
+		relayCtx = s.relayCtx
+	}
+	txid, err := t.relayer.rebroadcastTemplate(relayCtx, payment)
+	if err != nil {
+		logger.Warn("admin rebroadcast of template transaction failed", "err", err)
+		writeAdminError(w, http.StatusConflict, "could not broadcast template transaction: "+err.Error())
+		return
+	}
+	logger.Info("admin rebroadcast template transaction", "txid", txid.String())
+
+	writeAdminJson(w, map[string]string{"txid": txid.String()})
+}
+
+func (s *Server) adminResolve(w http.ResponseWriter, r *http.Request) {
+	t, payment, ok := s.adminLoadPayment(w, r)
+	if !ok {
+		return
+	}
+
+	if err := t.relayer.resolve(payment.FinalTxid); err != nil {
+		util.Logger.Error("could not resolve payment", "final_txid", payment.FinalTxid, "err", err)
+		writeAdminError(w, http.StatusInternalServerError, "could not resolve payment")
+		return
+	}
+	util.Logger.Info("admin resolved payment", "payment_id", payment.PaymentId, "final_txid", payment.FinalTxid)
+
+	payment.State = StateResolved
+	writeAdminJson(w, toAdminPayment(payment, false, nil))
+}
+
+func (s *Server) adminWallet(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.adminTenant(w, r)
+	if !ok {
+		return
+	}
+
+	wallet, closeWallet, err := t.openWallet()
+	if err != nil {
+		util.Logger.Error("could not open the wallet", "err", err)
+		writeAdminError(w, http.StatusInternalServerError, "could not open the wallet")
+		return
+	}
+	defer closeWallet()
+
+	unspents, err := wallet.ListUnspent()
+	if err != nil {
+		util.Logger.Error("could not list unspents", "err", err)
+		writeAdminError(w, http.StatusInternalServerError, "could not list unspents")
+		return
+	}
+
+	var result adminWallet
+	for i, unspent := range unspents {
+		amount := btcToSatoshis(unspent.Amount)
+		result.UnspentCount++
+		result.TotalAmount += amount
+		if unspent.Confirmations > 0 {
+			result.ConfirmedCount++
+			result.ConfirmedAmount += amount
+		}
+		if i == 0 || amount < result.SmallestUnspent {
+			result.SmallestUnspent = amount
+		}
+		if amount > result.LargestUnspent {
+			result.LargestUnspent = amount
+		}
+	}
+
+	writeAdminJson(w, result)
+}
+
+func (s *Server) adminLoadPayment(w http.ResponseWriter, r *http.Request) (*tenant, *Payment, bool) {
+	t, ok := s.adminTenant(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+	payment, err := LoadPayment(t.config.DataDir, r.PathValue("txid"))
+	if err != nil {
+		writeAdminError(w, http.StatusNotFound, "payment not found")
+		return nil, nil, false
+	}
+	return t, payment, true
+}
+
+// adminTenant is the tenant in the ?tenant= query, which can be left out if there's only one
+func (s *Server) adminTenant(w http.ResponseWriter, r *http.Request) (*tenant, bool) {
+	t := s.tenantNamed(r.URL.Query().Get("tenant"))
+	if t == nil {
+		writeAdminError(w, http.StatusNotFound, "unknown tenant")
+		return nil, false
+	}
+	return t, true
+}
+
+func toAdminPayment(payment *Payment, details bool, chainParams *chaincfg.Params) adminPayment {
+	result := adminPayment{
+		FinalTxid:    payment.FinalTxid,
+		TemplateTxid: payment.TemplateTxid(),
+		PaymentId:    payment.PaymentId,
+		Amount:       payment.Amount,
+		State:        payment.State,
+		CreatedAt:    payment.CreatedAt,
+		FeeBumpTxid:  payment.FeeBumpTxid,
+	}
+	if details {
+		template := DecodeTransaction(payment.Template, chainParams)
+		partial := DecodeTransaction(payment.Partial, chainParams)
+		result.Template = &template
+		result.Partial = &partial
+	}
+	return result
+}
+
+func writeAdminJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		util.Logger.Error("could not write admin response", "err", err)
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -0,0 +1,125 @@
+package receive
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testAdminServer(t *testing.T, bitcoind *fakeBitcoind) *Server {
+	config := DefaultConfig()
+	config.DataDir = t.TempDir()
+	config.Rpc = bitcoind.rpcConfig()
+	config.AdminAddr = "127.0.0.1:0"
+	config.AdminToken = "token"
+	config.Webhooks = WebhookConfig{Urls: []string{"http://127.0.0.1:1"}, Secret: "hunter2", OutboxDir: t.TempDir()}
+	return NewServer(config)
+}
+
+func adminRequest(t *testing.T, s *Server, method string, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, path, nil)
+	r.Header.Set("Authorization", "Bearer token")
+	w := httptest.NewRecorder()
+	s.adminHandler().ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminRebroadcast(t *testing.T) {
+	bitcoind := newFakeBitcoind(t)
+	s := testAdminServer(t, bitcoind)
+	dataDir := s.tenants[0].config.DataDir
+
+	contributed := testOutpoint(2, 1)
+	template, partial := testPayment(testOutpoint(1, 0), contributed)
+	finalTxId := writeTestPayment(t, dataDir, template, partial, contributed, StatePending)
+
+	w := adminRequest(t, s, "POST", "/payments/"+finalTxId+"/rebroadcast")
+	if w.Code != http.StatusOK {
+		t.Fatalf("rebroadcast got %v: %v", w.Code, w.Body.String())
+	}
+	var result map[string]string
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if result["txid"] != template.TxHash().String() {
+		t.Errorf("rebroadcast txid is %v, want the template's %v", result["txid"], template.TxHash())
+	}
+	if bitcoind.callCount("sendrawtransaction") != 1 {
+		t.Error("template wasn't broadcast")
+	}
+
+	// it's treated just like the relayer falling back to the template
+	payment, err := LoadPayment(dataDir, finalTxId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment.State != StateTemplateBroadcast {
+		t.Errorf("payment is %v after a rebroadcast, want %v", payment.State, StateTemplateBroadcast)
+	}
+	if unlocked := bitcoind.unlockedOutpoints(); len(unlocked) != 1 || unlocked[0] != contributed {
+		t.Errorf("unlocked %v, want just the contributed input %v", unlocked, contributed)
+	}
+	if events := outboxEvents(t, s.tenants[0].config.Webhooks.OutboxDir); len(events) != 1 || events[0] != EventTemplateBroadcast {
+		t.Errorf("queued webhooks %v, want just %v", events, EventTemplateBroadcast)
+	}
+	if metric := "bustapay_payments_fallback_total 1\n"; !strings.Contains(scrapeMetrics(t, s), metric) {
+		t.Errorf("metrics don't have %q", metric)
+	}
+
+	// doing it again just broadcasts it again
+	if w := adminRequest(t, s, "POST", "/payments/"+finalTxId+"/rebroadcast"); w.Code != http.StatusOK {
+		t.Fatalf("second rebroadcast got %v: %v", w.Code, w.Body.String())
+	}
+	if bitcoind.callCount("sendrawtransaction") != 2 {
+		t.Error("template wasn't broadcast again")
+	}
+	if events := outboxEvents(t, s.tenants[0].config.Webhooks.OutboxDir); len(events) != 1 {
+		t.Errorf("queued webhooks %v after rebroadcasting twice, want just one", events)
+	}
+	if metric := "bustapay_payments_fallback_total 1\n"; !strings.Contains(scrapeMetrics(t, s), metric) {
+		t.Errorf("metrics don't have %q after rebroadcasting twice", metric)
+	}
+}
+
+func TestAdminNeedsToken(t *testing.T) {
+	s := testAdminServer(t, newFakeBitcoind(t))
+
+	// the token alone, or with some other scheme, isn't enough
+	for _, authorization := range []string{"Bearer wrong", "token", "Basic token", ""} {
+		r := httptest.NewRequest("GET", "/payments", nil)
+		r.Header.Set("Authorization", authorization)
+		w := httptest.NewRecorder()
+		s.adminHandler().ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("authorization %q got %v, want %v", authorization, w.Code, http.StatusUnauthorized)
+		}
+	}
+
+	if w := adminRequest(t, s, "GET", "/payments"); w.Code != http.StatusOK {
+		t.Errorf("right token got %v: %v", w.Code, w.Body.String())
+	}
+}
+
+// outboxEvents is the type of every webhook event waiting in dir
+func outboxEvents(t *testing.T, dir string) []string {
+	t.Helper()
+	var events []string
+	for _, file := range outboxFiles(t, dir) {
+		var entry outboxEntry
+		if err := readOutboxEntry(file, &entry); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, entry.Event.Type)
+	}
+	return events
+}
+
+func scrapeMetrics(t *testing.T, s *Server) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	s.metrics.handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(w.Body)
+	return string(body)
+}
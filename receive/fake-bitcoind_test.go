@@ -0,0 +1,428 @@
+package receive
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/rhavar/bustapay/rpc-client"
+)
+
+// fakeBitcoind is a stand-in for the parts of bitcoind (and its wallet) the relayer, fee bumps and readiness checks
+// use: a mempool, which transactions have confirmed, unspent locks, and an empty (regtest) wallet that owns mine
+type fakeBitcoind struct {
+	*httptest.Server
+
+	mu            sync.Mutex
+	mempool       map[string]*wire.MsgTx
+	confirmed     map[string]bool
+	locked        []wire.OutPoint
+	unlocked      []wire.OutPoint
+	calls         map[string]int
+	wallets       map[string]int   // calls to each wallet, "/" for calls not to one
+	mine          map[string]bool  // addresses
+	encrypted     string           // the wallet's passphrase, if it's encrypted
+	unlockedUntil int64            // like getwalletinfo's unlocked_until
+	failing       map[string]bool  // methods that fail, like bitcoind having an internal error
+	rejecting     map[string]bool  // txids sendrawtransaction won't take
+	fees          map[string]int64 // in satoshis, what a mempool transaction pays, 1000 if it's not here
+	descendants   map[string]int64 // getmempoolentry's descendantcount, 1 (just itself) if it's not here
+	feeRate       float64          // estimatesmartfee's, in sat/vbyte. 0 if it can't estimate
+	holds         map[string]*hold // methods that don't answer until they're let go
+}
+
+// hold is a method being held up, like bitcoind taking its time
+type hold struct {
+	arrived chan struct{} // a call to it has come in
+	release chan struct{}
+}
+
+func newFakeBitcoind(t *testing.T) *fakeBitcoind {
+	b := &fakeBitcoind{
+		mempool:     make(map[string]*wire.MsgTx),
+		confirmed:   make(map[string]bool),
+		calls:       make(map[string]int),
+		wallets:     make(map[string]int),
+		mine:        make(map[string]bool),
+		failing:     make(map[string]bool),
+		rejecting:   make(map[string]bool),
+		fees:        make(map[string]int64),
+		descendants: make(map[string]int64),
+		holds:       make(map[string]*hold),
+	}
+	b.Server = httptest.NewServer(http.HandlerFunc(b.serve))
+	t.Cleanup(b.Close)
+	return b
+}
+
+func (b *fakeBitcoind) rpcConfig() rpc_client.Config {
+	return rpc_client.Config{Host: strings.TrimPrefix(b.URL, "http://"), User: "user", Pass: "pass"}
+}
+
+func (b *fakeBitcoind) addToMempool(tx *wire.MsgTx) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.mempool[tx.TxHash().String()] = tx
+}
+
+// confirm mines tx
+func (b *fakeBitcoind) confirm(tx *wire.MsgTx) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.mempool, tx.TxHash().String())
+	b.confirmed[tx.TxHash().String()] = true
+}
+
+func (b *fakeBitcoind) addAddress(address string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.mine[address] = true
+}
+
+// fail makes method fail (until it's called with false), with an error that isn't "not found"
+func (b *fakeBitcoind) fail(method string, fail bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failing[method] = fail
+}
+
+// hold makes calls to method wait until release is called. arrived gets something when the first one comes in
+func (b *fakeBitcoind) hold(method string) (arrived chan struct{}, release func()) {
+	h := &hold{arrived: make(chan struct{}, 1), release: make(chan struct{})}
+	b.mu.Lock()
+	b.holds[method] = h
+	b.mu.Unlock()
+	var once sync.Once
+	return h.arrived, func() { once.Do(func() { close(h.release) }) }
+}
+
+func (b *fakeBitcoind) callCount(method string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.calls[method]
+}
+
+func (b *fakeBitcoind) walletCalls(wallet string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.wallets[wallet]
+}
+
+func (b *fakeBitcoind) walletUnlockedUntil() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.unlockedUntil
+}
+
+func (b *fakeBitcoind) mempoolTx(txid string) *wire.MsgTx {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.mempool[txid]
+}
+
+func (b *fakeBitcoind) lockedOutpoints() []wire.OutPoint {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]wire.OutPoint(nil), b.locked...)
+}
+
+func (b *fakeBitcoind) unlockedOutpoints() []wire.OutPoint {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]wire.OutPoint(nil), b.unlocked...)
+}
+
+func (b *fakeBitcoind) serve(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Id     json.RawMessage   `json:"id"`
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	b.mu.Lock()
+	h := b.holds[request.Method]
+	b.mu.Unlock()
+	if h != nil {
+		select {
+		case h.arrived <- struct{}{}:
+		default:
+		}
+		<-h.release
+	}
+
+	b.mu.Lock()
+	b.calls[request.Method]++
+	b.wallets[strings.TrimPrefix(r.URL.Path, "/wallet/")]++
+	result, rpcErr := b.call(request.Method, request.Params)
+	b.mu.Unlock()
+
+	response := map[string]interface{}{"id": request.Id, "result": result, "error": nil}
+	if rpcErr != nil {
+		response["result"] = nil
+		response["error"] = rpcErr
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+type fakeRpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// call runs method, holding mu
+func (b *fakeBitcoind) call(method string, params []json.RawMessage) (interface{}, *fakeRpcError) {
+	param := func(i int, v interface{}) {
+		if i < len(params) {
+			json.Unmarshal(params[i], v)
+		}
+	}
+	notFound := &fakeRpcError{Code: -5, Message: "No such mempool or blockchain transaction"}
+	if b.failing[method] {
+		return nil, &fakeRpcError{Code: -1, Message: fmt.Sprintf("%v failed", method)}
+	}
+
+	switch method {
+	case "getnetworkinfo": // btcd wants to know the version before sendrawtransaction
+		return map[string]interface{}{"version": 220000, "subversion": "/Satoshi:22.0.0/"}, nil
+
+	case "getblockchaininfo":
+		return map[string]interface{}{"chain": "regtest", "blocks": 200, "headers": 200, "initialblockdownload": false}, nil
+
+	case "getwalletinfo":
+		info := map[string]interface{}{"walletname": "", "private_keys_enabled": true}
+		if b.encrypted != "" {
+			info["unlocked_until"] = b.unlockedUntil
+		}
+		return info, nil
+
+	case "walletpassphrase":
+		var passphrase string
+		var timeout int64
+		param(0, &passphrase)
+		param(1, &timeout)
+		if b.encrypted == "" {
+			return nil, &fakeRpcError{Code: -15, Message: "Error: running with an unencrypted wallet, but walletpassphrase was called."}
+		}
+		if passphrase != b.encrypted {
+			return nil, &fakeRpcError{Code: -14, Message: "Error: The wallet passphrase entered was incorrect."}
+		}
+		b.unlockedUntil = time.Now().Unix() + timeout
+		return nil, nil
+
+	case "walletlock":
+		b.unlockedUntil = 0
+		return nil, nil
+
+	case "listunspent", "listreceivedbyaddress":
+		return []interface{}{}, nil
+
+	case "getaddressinfo":
+		var address string
+		param(0, &address)
+		return map[string]interface{}{"address": address, "ismine": b.mine[address]}, nil
+
+	case "testmempoolaccept":
+		var txHexes []string
+		param(0, &txHexes)
+		var results []map[string]interface{}
+		for _, txHex := range txHexes {
+			txBytes, _ := hex.DecodeString(txHex)
+			var tx wire.MsgTx
+			err := tx.Deserialize(bytes.NewReader(txBytes))
+			results = append(results, map[string]interface{}{"txid": tx.TxHash().String(), "allowed": err == nil})
+		}
+		return results, nil
+
+	case "getmempoolentry":
+		var txid string
+		param(0, &txid)
+		tx, ok := b.mempool[txid]
+		if !ok {
+			return nil, notFound
+		}
+		fee, descendants := int64(1000), int64(1)
+		if f, ok := b.fees[txid]; ok {
+			fee = f
+		}
+		if d, ok := b.descendants[txid]; ok {
+			descendants = d
+		}
+		return map[string]interface{}{"vsize": vsize(tx), "descendantcount": descendants, "fees": map[string]float64{"base": float64(fee) / 1e8}}, nil
+
+	case "getrawtransaction":
+		var txid string
+		param(0, &txid)
+		tx, ok := b.mempool[txid]
+		if !ok {
+			return nil, notFound
+		}
+		return txHex(tx), nil
+
+	case "estimatesmartfee":
+		if b.feeRate == 0 {
+			return map[string]interface{}{"errors": []string{"Insufficient data or no feerate found"}, "blocks": 2}, nil
+		}
+		return map[string]interface{}{"feerate": b.feeRate * 1000 / 1e8, "blocks": 2}, nil
+
+	case "getnewaddress":
+		address, _ := btcutil.NewAddressWitnessPubKeyHash(bytes.Repeat([]byte{0xcd}, 20), &chaincfg.RegressionNetParams)
+		b.mine[address.EncodeAddress()] = true
+		return address.EncodeAddress(), nil
+
+	case "signrawtransactionwithwallet":
+		// signatures the size of a p2wpkh one, which is all the size of the transaction needs to be right for
+		var txHexParam string
+		param(0, &txHexParam)
+		txBytes, _ := hex.DecodeString(txHexParam)
+		var tx wire.MsgTx
+		if err := tx.Deserialize(bytes.NewReader(txBytes)); err != nil {
+			return nil, &fakeRpcError{Code: -22, Message: "TX decode failed"}
+		}
+		for _, txIn := range tx.TxIn {
+			txIn.Witness = wire.TxWitness{make([]byte, 72), make([]byte, 33)}
+		}
+		return map[string]interface{}{"hex": txHex(&tx), "complete": true}, nil
+
+	case "gettransaction":
+		var txid string
+		param(0, &txid)
+		if b.confirmed[txid] {
+			return map[string]interface{}{"confirmations": 1, "blockhash": strings.Repeat("00", 32)}, nil
+		}
+		if _, ok := b.mempool[txid]; ok {
+			return map[string]interface{}{"confirmations": 0}, nil
+		}
+		return nil, &fakeRpcError{Code: -5, Message: "Invalid or non-wallet transaction id"}
+
+	case "gettxout":
+		var txid string
+		var vout uint32
+		param(0, &txid)
+		param(1, &vout)
+		for _, tx := range b.mempool {
+			for _, txIn := range tx.TxIn {
+				if txIn.PreviousOutPoint.Hash.String() == txid && txIn.PreviousOutPoint.Index == vout {
+					return nil, nil // spent
+				}
+			}
+		}
+		return map[string]interface{}{
+			"bestblock":     strings.Repeat("00", 32),
+			"confirmations": 1,
+			"value":         0.001,
+			"scriptPubKey":  map[string]interface{}{"hex": ""},
+			"coinbase":      false,
+		}, nil
+
+	case "sendrawtransaction":
+		var txHex string
+		param(0, &txHex)
+		txBytes, _ := hex.DecodeString(txHex)
+		var tx wire.MsgTx
+		if err := tx.Deserialize(bytes.NewReader(txBytes)); err != nil {
+			return nil, &fakeRpcError{Code: -22, Message: "TX decode failed"}
+		}
+		if b.rejecting[tx.TxHash().String()] {
+			return nil, &fakeRpcError{Code: -26, Message: "insufficient fee"}
+		}
+		b.mempool[tx.TxHash().String()] = &tx
+		return tx.TxHash().String(), nil
+
+	case "abandontransaction":
+		return nil, &fakeRpcError{Code: -5, Message: "Invalid or non-wallet transaction id"}
+
+	case "lockunspent":
+		var unlock bool
+		var outpoints []struct {
+			Txid string `json:"txid"`
+			Vout uint32 `json:"vout"`
+		}
+		param(0, &unlock)
+		param(1, &outpoints)
+		for _, o := range outpoints {
+			hash, _ := chainhash.NewHashFromStr(o.Txid)
+			switch {
+			case hash == nil:
+			case unlock:
+				b.unlocked = append(b.unlocked, *wire.NewOutPoint(hash, o.Vout))
+			default:
+				b.locked = append(b.locked, *wire.NewOutPoint(hash, o.Vout))
+			}
+		}
+		return true, nil
+	}
+
+	return nil, &fakeRpcError{Code: -32601, Message: fmt.Sprintf("Method not found (%v)", method)}
+}
+
+// testPayment makes a template spending from, and a partial transaction adding contributed to it
+func testPayment(from wire.OutPoint, contributed wire.OutPoint) (template *wire.MsgTx, partial *wire.MsgTx) {
+	pkScript, _ := hex.DecodeString("0014" + strings.Repeat("ab", 20))
+
+	template = wire.NewMsgTx(2)
+	template.AddTxIn(wire.NewTxIn(&from, nil, [][]byte{{1}, {2}}))
+	template.AddTxOut(wire.NewTxOut(50000, pkScript))
+
+	partial = template.Copy()
+	partial.TxIn[0].Witness = nil
+	partial.AddTxIn(wire.NewTxIn(&contributed, nil, nil))
+	partial.TxOut[0].Value += 100000
+	return template, partial
+}
+
+func testOutpoint(n byte, vout uint32) wire.OutPoint {
+	var hash chainhash.Hash
+	hash[0] = n
+	return *wire.NewOutPoint(&hash, vout)
+}
+
+// writeTestPayment writes a payment's directory like createBustpayTransaction does, and returns the final txid
+func writeTestPayment(t *testing.T, dataDir string, template *wire.MsgTx, partial *wire.MsgTx, contributed wire.OutPoint, state string) string {
+	t.Helper()
+	finalTxId := partial.TxHash().String()
+	txDir := filepath.Join(dataDir, finalTxId)
+	if err := os.MkdirAll(txDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		amountFile:     "50000",
+		templateTxFile: txHex(template),
+		partialTxFile:  txHex(partial),
+		paymentIdFile:  "test-payment",
+		relayStateFile: state,
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(txDir, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writeContributedInput(txDir, contributed); err != nil {
+		t.Fatal(err)
+	}
+	return finalTxId
+}
+
+func txHex(tx *wire.MsgTx) string {
+	var buf bytes.Buffer
+	tx.Serialize(&buf)
+	return hex.EncodeToString(buf.Bytes())
+}
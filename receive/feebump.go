@@ -0,0 +1,169 @@
+package receive
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+	"github.com/rhavar/bustapay/rpc-client"
+	"github.com/rhavar/bustapay/util"
+)
+
+// If the final transaction sits in the mempool for too long (the sender didn't pay much of a fee) we can speed it up
+// ourselves: the output paying us is ours to spend, so we spend it back to ourselves with a fee big enough to bring
+// the pair up to what estimatesmartfee suggests (child pays for parent). We only ever do this once per payment.
+
+type FeeBumpConfig struct {
+	After      time.Duration // how long after the proposal an unconfirmed final transaction counts as stalled, 0 to never bump
+	ConfTarget int           // in blocks, what we ask estimatesmartfee for
+	MaxFeeRate float64       // sat/vbyte, never bump to more than this
+}
+
+const (
+	feeBumpFile = "fee_bump_txid.txt"
+
+	txOverheadVSize = 10.5 // version, locktime, counts and the segwit marker. The rest is estimated by script type
+	dustLimit       = 1000 // don't bother if this is all our output would be left with
+)
+
+// maybeBumpFee returns the txid of the child transaction, if it made one
+func (r *relayer) maybeBumpFee(rpcClient *rpc_client.RpcClient, p *watchedPayment) (string, error) {
+	if r.feeBump.After <= 0 || time.Since(p.createdAt) < r.feeBump.After {
+		return "", nil
+	}
+
+	txDir := filepath.Join(r.dataDir, p.finalTxId)
+	if _, err := os.Stat(filepath.Join(txDir, feeBumpFile)); err == nil {
+		return "", nil // already did
+	}
+
+	entry, err := rpcClient.GetMempoolEntry(p.finalTxId)
+	if err != nil {
+		return "", err
+	}
+	if entry.DescendantCount > 1 {
+		return "", nil // something already spends it, maybe it's being bumped already
+	}
+	parentFee := btcToSatoshis(entry.Fees.Base)
+
+	targetFeeRate, err := rpcClient.EstimateSmartFee(r.feeBump.ConfTarget)
+	if err != nil {
+		return "", err
+	}
+	if r.feeBump.MaxFeeRate > 0 && targetFeeRate > r.feeBump.MaxFeeRate {
+		targetFeeRate = r.feeBump.MaxFeeRate
+	}
+
+	parentFeeRate := float64(parentFee) / float64(entry.VSize)
+	if parentFeeRate >= targetFeeRate {
+		return "", nil // it's just slow, paying more won't help
+	}
+
+	finalTx, err := rpcClient.GetRawTransaction(&p.finalTxHash)
+	if err != nil {
+		return "", err
+	}
+
+	vout, err := ourOutput(rpcClient, finalTx)
+	if err != nil {
+		return "", err
+	}
+
+	address, err := rpcClient.GetNewAddress()
+	if err != nil {
+		return "", err
+	}
+	pkScript, err := util.PayToAddrScript(address)
+	if err != nil {
+		return "", err
+	}
+
+	// We need to sign to know exactly how big the child is, and then sign again with the right fee
+	inputType := util.ScriptType(finalTx.TxOut[vout].PkScript, nil)
+	childVSize := int64(math.Ceil(txOverheadVSize + util.InputVSize(inputType) + util.OutputVSize(pkScript)))
+	var child *wire.MsgTx
+	for i := 0; i < 2; i++ {
+		fee := int64(math.Ceil(targetFeeRate*float64(entry.VSize+childVSize))) - parentFee
+		if fee < childVSize {
+			fee = childVSize // at least 1 sat/vbyte for the child itself
+		}
+		value := finalTx.TxOut[vout].Value - fee
+		if value < dustLimit {
+			return "", errors.Errorf("our output of %v can't pay a fee of %v", finalTx.TxOut[vout].Value, fee)
+		}
+
+		child = wire.NewMsgTx(2)
+		txIn := wire.NewTxIn(wire.NewOutPoint(&p.finalTxHash, uint32(vout)), nil, nil)
+		txIn.Sequence = wire.MaxTxInSequenceNum - 2 // replaceable, in case it needs bumping again by hand
+		child.AddTxIn(txIn)
+		child.AddTxOut(wire.NewTxOut(value, pkScript))
+
+		var complete bool
+		err = r.unlocker.sign(rpcClient, func() error {
+			child, complete, err = rpcClient.SignRawTransactionWithWallet(child)
+			return err
+		})
+		if err != nil {
+			return "", err
+		}
+		if !complete {
+			return "", errors.New("wallet could not sign the fee bump transaction")
+		}
+
+		actualVSize := vsize(child)
+		if actualVSize <= childVSize {
+			break
+		}
+		childVSize = actualVSize
+	}
+
+	txid, err := rpcClient.SendRawTransaction(child)
+	if err != nil {
+		return "", err
+	}
+
+	err = ioutil.WriteFile(filepath.Join(txDir, feeBumpFile), []byte(txid.String()), 0600)
+	return txid.String(), errors.WithStack(err)
+}
+
+// ourOutput finds the output of tx paying our wallet, which in a bustapay transaction is the payment
+func ourOutput(rpcClient *rpc_client.RpcClient, tx *wire.MsgTx) (int, error) {
+	chainParams, err := rpcClient.GetChainParams()
+	if err != nil {
+		return 0, err
+	}
+
+	for vout, txOut := range tx.TxOut {
+		address, err := util.ExtractAddress(txOut.PkScript, chainParams)
+		if err != nil {
+			continue
+		}
+		info, err := rpcClient.GetAddressInfo(address.String())
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		if info.IsMine {
+			return vout, nil
+		}
+	}
+	return 0, errors.New("final transaction doesn't pay us")
+}
+
+func vsize(tx *wire.MsgTx) int64 {
+	weight := tx.SerializeSizeStripped()*3 + tx.SerializeSize()
+	return int64((weight + 3) / 4)
+}
+
+// readFeeBump is the txid of the child transaction, if we made one
+func readFeeBump(txDir string) string {
+	b, err := ioutil.ReadFile(filepath.Join(txDir, feeBumpFile))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
@@ -0,0 +1,156 @@
+package receive
+
+import (
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/rhavar/bustapay/rpc-client"
+	"github.com/rhavar/bustapay/util"
+)
+
+// newFeeBumpTest is a payment whose final transaction has been in the mempool long enough to be bumped, paying a
+// fee of 1000 sats to an output our wallet owns
+func newFeeBumpTest(t *testing.T, bitcoind *fakeBitcoind) (*relayTest, *rpc_client.RpcClient) {
+	t.Helper()
+	rt := newRelayTest(t, bitcoind)
+	rt.r.feeBump = FeeBumpConfig{After: time.Minute, ConfTarget: 6, MaxFeeRate: 100}
+	rt.r.unlocker = newUnlocker(nil, time.Second)
+	rt.p.createdAt = time.Now().Add(-time.Hour)
+	bitcoind.addToMempool(rt.final)
+
+	address, err := util.ExtractAddress(rt.final.TxOut[0].PkScript, &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bitcoind.addAddress(address.EncodeAddress())
+
+	rpcClient, err := rpc_client.NewRpcClient(bitcoind.rpcConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(rpcClient.Shutdown)
+	return rt, rpcClient
+}
+
+// packageFeeRate is what the final transaction and the child that bumped it pay together, in sat/vbyte
+func packageFeeRate(t *testing.T, bitcoind *fakeBitcoind, rt *relayTest, childTxId string) float64 {
+	t.Helper()
+	child := bitcoind.mempoolTx(childTxId)
+	if child == nil {
+		t.Fatalf("fee bump %v wasn't broadcast", childTxId)
+	}
+	if len(child.TxIn) != 1 || child.TxIn[0].PreviousOutPoint.Hash != rt.final.TxHash() {
+		t.Fatalf("fee bump doesn't spend the final transaction")
+	}
+	childFee := rt.final.TxOut[child.TxIn[0].PreviousOutPoint.Index].Value - child.TxOut[0].Value
+	return float64(1000+childFee) / float64(vsize(rt.final)+vsize(child))
+}
+
+func TestFeeBumpReachesTarget(t *testing.T) {
+	bitcoind := newFakeBitcoind(t)
+	rt, rpcClient := newFeeBumpTest(t, bitcoind)
+	bitcoind.feeRate = 20
+
+	childTxId, err := rt.r.maybeBumpFee(rpcClient, rt.p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// at least the target, and no more than rounding up (and the size estimate being a little over) would add
+	rate := packageFeeRate(t, bitcoind, rt, childTxId)
+	if rate < 20 || rate > 20.5 {
+		t.Errorf("final transaction and fee bump pay %v sat/vbyte together, want 20", rate)
+	}
+}
+
+func TestFeeBumpCapped(t *testing.T) {
+	bitcoind := newFakeBitcoind(t)
+	rt, rpcClient := newFeeBumpTest(t, bitcoind)
+	bitcoind.feeRate = 500
+
+	childTxId, err := rt.r.maybeBumpFee(rpcClient, rt.p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate := packageFeeRate(t, bitcoind, rt, childTxId); math.Abs(rate-100) > 0.5 {
+		t.Errorf("final transaction and fee bump pay %v sat/vbyte together, want the max of 100", rate)
+	}
+}
+
+func TestFeeBumpNotNeeded(t *testing.T) {
+	bitcoind := newFakeBitcoind(t)
+	rt, rpcClient := newFeeBumpTest(t, bitcoind)
+	bitcoind.feeRate = 1 // and the final transaction pays more than that already
+
+	if childTxId, err := rt.r.maybeBumpFee(rpcClient, rt.p); err != nil || childTxId != "" {
+		t.Errorf("bumped a transaction already paying enough: %v %v", childTxId, err)
+	}
+
+	rt.p.createdAt = time.Now()
+	bitcoind.feeRate = 20
+	if childTxId, err := rt.r.maybeBumpFee(rpcClient, rt.p); err != nil || childTxId != "" {
+		t.Errorf("bumped a transaction before FeeBump.After: %v %v", childTxId, err)
+	}
+	if bitcoind.callCount("sendrawtransaction") != 0 {
+		t.Error("broadcast a fee bump that wasn't needed")
+	}
+}
+
+// A final transaction that's already being spent (a descendant in the mempool) might be being bumped by the sender,
+// and ours couldn't replace theirs anyway
+func TestFeeBumpNotWithDescendants(t *testing.T) {
+	bitcoind := newFakeBitcoind(t)
+	rt, rpcClient := newFeeBumpTest(t, bitcoind)
+	bitcoind.feeRate = 20
+	bitcoind.descendants[rt.p.finalTxId] = 2
+
+	if childTxId, err := rt.r.maybeBumpFee(rpcClient, rt.p); err != nil || childTxId != "" {
+		t.Errorf("bumped a transaction with a descendant: %v %v", childTxId, err)
+	}
+	if bitcoind.callCount("sendrawtransaction") != 0 {
+		t.Error("broadcast a fee bump for a transaction with a descendant")
+	}
+}
+
+// Once is enough, even across checks (and restarts, it's on disk)
+func TestFeeBumpOnlyOnce(t *testing.T) {
+	bitcoind := newFakeBitcoind(t)
+	rt, rpcClient := newFeeBumpTest(t, bitcoind)
+	bitcoind.feeRate = 20
+
+	childTxId, err := rt.r.maybeBumpFee(rpcClient, rt.p)
+	if err != nil || childTxId == "" {
+		t.Fatalf("didn't bump: %v", err)
+	}
+	bitcoind.feeRate = 50 // even if it's not enough any more
+	if again, err := rt.r.maybeBumpFee(rpcClient, rt.p); err != nil || again != "" {
+		t.Errorf("bumped again: %v %v", again, err)
+	}
+	if bitcoind.callCount("sendrawtransaction") != 1 {
+		t.Errorf("broadcast %v fee bumps, want 1", bitcoind.callCount("sendrawtransaction"))
+	}
+	if readFeeBump(filepath.Join(rt.r.dataDir, rt.p.finalTxId)) != childTxId {
+		t.Error("didn't record the fee bump")
+	}
+}
+
+// Our output has to be worth more than the fee and the dust limit
+func TestFeeBumpTooSmall(t *testing.T) {
+	bitcoind := newFakeBitcoind(t)
+	rt, rpcClient := newFeeBumpTest(t, bitcoind)
+	bitcoind.feeRate = 100
+	rt.final.TxOut[0].Value = 10000
+	bitcoind.addToMempool(rt.final)
+	rt.p.finalTxId = rt.final.TxHash().String()
+	rt.p.finalTxHash = rt.final.TxHash()
+
+	if _, err := rt.r.maybeBumpFee(rpcClient, rt.p); err == nil || !strings.Contains(err.Error(), "can't pay a fee") {
+		t.Errorf("bumped with an output too small to pay for it: %v", err)
+	}
+	if bitcoind.callCount("sendrawtransaction") != 0 {
+		t.Error("broadcast a fee bump that leaves dust")
+	}
+}
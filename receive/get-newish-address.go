@@ -2,66 +2,60 @@ package receive
 
 import (
 	"net/http"
-	"github.com/rhavar/bustapay/rpc-client"
+	"github.com/rhavar/bustapay/util"
 	"fmt"
-	"github.com/btcsuite/btcutil"
-	"sync"
+	"github.com/btcsuite/btcd/btcutil"
 )
 
 // This is an insanely bad method designed for testing. Do not consider use anywhere near a production site..
 
 // Instead of always getting a new address, we only do so when the last one has been used
 // this is a pretty poorly designed function, but it's a quick hack to prevent a simple and
-// annoying DoS of requesting billions of addresses
+// annoying DoS of requesting billions of addresses. The last address is kept per tenant (see tenant.go)
 
+func (s *Server) getNewishAddress(t *tenant, w http.ResponseWriter, r *http.Request) {
 
-var lastNewishAddress btcutil.Address
-var newishMutex sync.Mutex // not scoped particularly well...
-
-
-func getNewishAddress(w http.ResponseWriter, r *http.Request) {
-
-	newishMutex.Lock()
-	defer newishMutex.Unlock()
+	t.newishMutex.Lock()
+	defer t.newishMutex.Unlock()
 
 	// keep error handling centralized
 	address, err := func() (btcutil.Address, error) {
 
-		rpcClient, err := rpc_client.NewRpcClient()
+		wallet, closeWallet, err := t.openWallet()
 		if err != nil {
 			return nil, err
 		}
-		defer rpcClient.Shutdown()
+		defer closeWallet()
 
 
 
-		if lastNewishAddress == nil {
-			lastNewishAddress, err = rpcClient.GetNewAddress()
+		if t.lastNewishAddress == nil {
+			t.lastNewishAddress, err = wallet.GetNewAddress()
 			if err != nil {
 				return nil, err
 			}
 		}
 
-		fresh, err := rpcClient.IsMyFreshMyAddress(lastNewishAddress.String())
+		fresh, err := wallet.IsMyFreshMyAddress(t.lastNewishAddress.String())
 		if err != nil {
 			return nil, err
 		}
 
 		if !fresh {
-			lastNewishAddress, err = rpcClient.GetNewAddress()
+			t.lastNewishAddress, err = wallet.GetNewAddress()
 			if err != nil {
 				return nil, err
 			}
 		}
 
-		return lastNewishAddress, nil
+		return t.lastNewishAddress, nil
 
 	}()
 
 	if err != nil {
 		w.WriteHeader(400)
 		fmt.Fprint(w, "internal error")
-		fmt.Println("[ERROR] get-newish-address error", err)
+		util.Logger.Error("get-newish-address error", "err", err)
 		return
 	}
 
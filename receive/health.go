@@ -0,0 +1,200 @@
+package receive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/rhavar/bustapay/rpc-client"
+)
+
+// For load balancers and orchestrators:
+//
+//    GET /healthz                200 while the process is up and serving
+//    GET /readyz                 200 if every tenant can make proposals right now, 503 (with what's wrong) if not
+//    GET /readyz?tenant=<name>   the same, for just one tenant
+//
+// /healthz is on the public listener, it says nothing about us. /readyz says what wallets we have, and how many
+// unspents, so it's on the admin listener and needs the admin token like the rest of the admin api.
+//
+// Being ready means bitcoind answers, has finished its initial block download, the wallet is loaded and can sign (or
+// there's a signer), it has at least Config.MinUnspents unspents to contribute, and the data dir is writable. While a
+// tenant isn't ready its proposals get a 503, telling senders to broadcast their templates (which we do too, if the
+// template pays us). Results are cached for a few seconds, so probes (and proposals) don't hammer bitcoind. An
+// encrypted wallet's passphrase is only tried by Start (and bustapay config check), not by every probe: unlocking
+// the wallet whenever something asks if we're ready would defeat keeping it locked. With the built-in wallet
+// (Config.DescriptorWallet) it's just whether it can sync with its chain, sign and has enough unspents
+
+const readinessMaxAge = 5 * time.Second
+
+// Check is one thing a tenant needs to be ready
+type Check struct {
+	Name   string `json:"name"`
+	Ok     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Readiness is whether a tenant can make proposals, and why not
+type Readiness struct {
+	Tenant    string    `json:"tenant,omitempty"`
+	Ready     bool      `json:"ready"`
+	Checks    []Check   `json:"checks"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// readiness is t's Readiness, from the last few seconds if we've checked recently
+func (t *tenant) readiness() *Readiness {
+	t.readyMutex.Lock()
+	defer t.readyMutex.Unlock()
+
+	if t.lastReadiness == nil || time.Since(t.lastReadiness.CheckedAt) > readinessMaxAge {
+		t.lastReadiness = t.checkReadiness()
+	}
+	return t.lastReadiness
+}
+
+func (t *tenant) checkReadiness() *Readiness {
+	r := &Readiness{Tenant: t.name, Ready: true, CheckedAt: time.Now()}
+	add := func(name string, ok bool, format string, a ...interface{}) {
+		r.Checks = append(r.Checks, Check{Name: name, Ok: ok, Detail: fmt.Sprintf(format, a...)})
+		r.Ready = r.Ready && ok
+	}
+
+	if err := checkWritable(t.config.DataDir); err != nil {
+		add("data_dir", false, "%v", err)
+	} else {
+		add("data_dir", true, "%v", t.config.DataDir)
+	}
+
+	if t.config.DescriptorWallet != nil {
+		t.checkDescriptorWallet(add)
+		return r
+	}
+
+	rpcClient, err := rpc_client.NewRpcClient(t.config.Rpc)
+	if err != nil {
+		add("bitcoind", false, "%v", err)
+		return r
+	}
+	defer rpcClient.Shutdown()
+
+	chain, err := rpcClient.GetBlockchainInfo()
+	if err != nil {
+		add("bitcoind", false, "%v", err)
+		return r
+	}
+	add("bitcoind", true, "")
+	add("synced", !chain.InitialBlockDownload, "block %v of %v on %v", chain.Blocks, chain.Headers, chain.Chain)
+
+	wallet, err := rpcClient.GetWalletInfo()
+	if err != nil {
+		add("wallet", false, "%v", err)
+		return r
+	}
+	encrypted := wallet.UnlockedUntil != nil
+	switch {
+	case t.config.Signer != nil:
+		add("wallet", true, "wallet %q is loaded, and the signer signs", wallet.WalletName)
+	case !wallet.PrivateKeysEnabled:
+		add("wallet", false, "wallet %q is watch-only, and there's no signer", wallet.WalletName)
+	case encrypted && t.config.WalletPassphrase != nil:
+		// its file could have gone away since Start tried it, which we can find out without unlocking anything
+		if _, err := t.config.WalletPassphrase(); err != nil {
+			add("wallet", false, "wallet %q is encrypted, and there's no passphrase to unlock it with: %v", wallet.WalletName, err)
+		} else {
+			add("wallet", true, "wallet %q is encrypted, and there's a passphrase to unlock it with", wallet.WalletName)
+		}
+	case !encrypted && t.config.WalletPassphrase != nil:
+		add("wallet", false, "wallet %q isn't encrypted, so there shouldn't be a passphrase", wallet.WalletName)
+	case encrypted && *wallet.UnlockedUntil == 0:
+		add("wallet", false, "wallet %q is encrypted and locked, and there's no passphrase", wallet.WalletName)
+	case encrypted:
+		add("wallet", true, "wallet %q is unlocked until %v", wallet.WalletName, time.Unix(*wallet.UnlockedUntil, 0).UTC())
+	default:
+		add("wallet", true, "wallet %q is loaded", wallet.WalletName)
+	}
+
+	unspents, err := rpcClient.ListUnspent()
+	if err != nil {
+		add("unspents", false, "%v", err)
+		return r
+	}
+	add("unspents", len(unspents) >= t.config.MinUnspents, "%v to contribute, at least %v needed", len(unspents), t.config.MinUnspents)
+	return r
+}
+
+func (t *tenant) checkDescriptorWallet(add func(name string, ok bool, format string, a ...interface{})) {
+	w, closeWallet, err := t.openWallet()
+	if err != nil {
+		add("wallet", false, "%v", err)
+		return
+	}
+	defer closeWallet()
+
+	switch {
+	case t.config.Signer != nil:
+		add("wallet", true, "the descriptor wallet is synced, and the signer signs")
+	case t.config.DescriptorWallet.WatchOnly():
+		add("wallet", false, "the descriptor wallet is watch-only, and there's no signer")
+	default:
+		add("wallet", true, "the descriptor wallet is synced")
+	}
+
+	unspents, err := w.ListUnspent()
+	if err != nil {
+		add("unspents", false, "%v", err)
+		return
+	}
+	add("unspents", len(unspents) >= t.config.MinUnspents, "%v to contribute, at least %v needed", len(unspents), t.config.MinUnspents)
+}
+
+// checkWritable makes sure we can create (and remove) a file in dir
+func checkWritable(dir string) error {
+	file, err := ioutil.TempFile(dir, ".readyz-")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealthJson(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyz is whether every tenant is ready, or just one if there's ?tenant=
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	tenants := s.tenants
+	if r.URL.Query().Get("tenant") != "" {
+		t, ok := s.adminTenant(w, r)
+		if !ok {
+			return
+		}
+		tenants = []*tenant{t}
+	}
+
+	result := struct {
+		Ready   bool         `json:"ready"`
+		Tenants []*Readiness `json:"tenants"`
+	}{Ready: true}
+	for _, t := range tenants {
+		readiness := t.readiness()
+		result.Ready = result.Ready && readiness.Ready
+		result.Tenants = append(result.Tenants, readiness)
+	}
+
+	status := http.StatusOK
+	if !result.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeHealthJson(w, status, result)
+}
+
+func writeHealthJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
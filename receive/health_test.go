@@ -0,0 +1,76 @@
+package receive
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func walletCheck(t *testing.T, readiness *Readiness) Check {
+	t.Helper()
+	for _, check := range readiness.Checks {
+		if check.Name == "wallet" {
+			return check
+		}
+	}
+	t.Fatalf("no wallet check in %+v", readiness.Checks)
+	return Check{}
+}
+
+// Being asked if we're ready doesn't unlock the wallet (Start tries the passphrase), but a passphrase that's gone
+// away still makes us not ready
+func TestReadinessDoesntUnlock(t *testing.T) {
+	bitcoind := newFakeBitcoind(t)
+	bitcoind.encrypted = "correct horse"
+
+	for _, test := range []struct {
+		passphrase PassphraseSource
+		ok         bool
+	}{
+		{func() (string, error) { return "correct horse", nil }, true},
+		{func() (string, error) { return "", errors.New("no such file") }, false},
+	} {
+		config := DefaultConfig()
+		config.DataDir = t.TempDir()
+		config.Rpc = bitcoind.rpcConfig()
+		config.WalletPassphrase = test.passphrase
+		s := NewServer(config)
+
+		if wallet := walletCheck(t, s.tenants[0].readiness()); wallet.Ok != test.ok {
+			t.Errorf("the wallet check is %+v, want ok to be %v", wallet, test.ok)
+		}
+	}
+	if bitcoind.callCount("walletpassphrase") != 0 {
+		t.Errorf("tried the passphrase %v times, want none", bitcoind.callCount("walletpassphrase"))
+	}
+}
+
+// /readyz and /metrics give away what wallets we have, so they're only on the admin listener, with the token
+func TestReadyzIsAdminOnly(t *testing.T) {
+	bitcoind := newFakeBitcoind(t)
+	s := testAdminServer(t, bitcoind)
+	s.tenants[0].config.MinUnspents = 0 // the fake wallet hasn't any
+
+	for _, path := range []string{"/readyz", "/metrics"} {
+		w := httptest.NewRecorder()
+		s.httpServer.Handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code == http.StatusOK {
+			t.Errorf("public %v is %v", path, w.Code)
+		}
+
+		w = httptest.NewRecorder()
+		s.adminHandler().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("admin %v without the token is %v", path, w.Code)
+		}
+
+		if w := adminRequest(t, s, "GET", path); w.Code != http.StatusOK {
+			t.Errorf("admin %v is %v: %v", path, w.Code, w.Body.String())
+		}
+	}
+
+	if w := adminRequest(t, s, "GET", "/readyz?tenant=nope"); w.Code != http.StatusNotFound {
+		t.Errorf("readyz for an unknown tenant is %v", w.Code)
+	}
+}
@@ -0,0 +1,172 @@
+package receive
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rhavar/bustapay/rpc-client"
+	"github.com/rhavar/bustapay/util"
+)
+
+// Prometheus metrics, served at /metrics. Each server has its own registry so a program can embed more than one
+
+type metrics struct {
+	registry *prometheus.Registry
+
+	proposalsReceived prometheus.Counter
+	proposalsRejected *prometheus.CounterVec
+	proposalsSigned   prometheus.Counter
+	proposalDuration  prometheus.Histogram
+
+	paymentsFinalized   prometheus.Counter // the sender's final transaction was seen in the mempool
+	paymentsFallback    prometheus.Counter // we broadcast the template transaction instead
+	paymentsDoubleSpent prometheus.Counter
+	paymentsFeeBumped   prometheus.Counter // we spent our output to speed up a stalled final transaction
+
+	rpcDuration *prometheus.HistogramVec
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+
+		proposalsReceived: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "bustapay_proposals_received_total",
+			Help: "Template transactions received from senders",
+		}),
+		proposalsRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bustapay_proposals_rejected_total",
+			Help: "Template transactions we did not create a proposal for, by reason",
+		}, []string{"reason"}),
+		proposalsSigned: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "bustapay_proposals_signed_total",
+			Help: "Proposals we signed and gave back to the sender",
+		}),
+		proposalDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "bustapay_proposal_duration_seconds",
+			Help:    "How long it took to create a proposal",
+			Buckets: prometheus.DefBuckets,
+		}),
+		paymentsFinalized: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "bustapay_payments_finalized_total",
+			Help: "Payments where the sender's final transaction was seen in the mempool",
+		}),
+		paymentsFallback: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "bustapay_payments_fallback_total",
+			Help: "Payments where the final transaction went missing and we broadcast the template instead",
+		}),
+		paymentsDoubleSpent: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "bustapay_payments_double_spent_total",
+			Help: "Payments where the sender double-spent the template transaction's inputs",
+		}),
+		paymentsFeeBumped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "bustapay_payments_fee_bumped_total",
+			Help: "Payments where we bumped the fee of a stalled final transaction with a child transaction",
+		}),
+		rpcDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "bustapay_rpc_duration_seconds",
+			Help:    "Latency of bitcoind rpc calls, by method",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method"}),
+	}
+
+	m.registry.MustRegister(
+		m.proposalsReceived,
+		m.proposalsRejected,
+		m.proposalsSigned,
+		m.proposalDuration,
+		m.paymentsFinalized,
+		m.paymentsFallback,
+		m.paymentsDoubleSpent,
+		m.paymentsFeeBumped,
+		m.rpcDuration,
+	)
+
+	return m
+}
+
+// How long a utxo pool size is good for. Listing unspents can be slow with a big wallet, so more than one scraper
+// (or a short scrape interval) shouldn't mean asking bitcoind every time
+const unspentsMaxAge = 30 * time.Second
+
+// watchUnspents adds a gauge of how many unspents a wallet has to contribute, labelled with the tenant if there is
+// one. It's checked on scrape, unless we've checked recently. NaN means we couldn't ask the wallet
+func (m *metrics) watchUnspents(tenantName string, openWallet walletOpener) {
+	var labels prometheus.Labels
+	if tenantName != "" {
+		labels = prometheus.Labels{"tenant": tenantName}
+	}
+
+	var (
+		mu        sync.Mutex
+		count     float64
+		checkedAt time.Time
+	)
+	// this only fails for tenants with the same name, which Start refuses anyway
+	m.registry.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "bustapay_utxo_pool_size",
+		Help:        "Number of wallet unspents available to contribute to proposals",
+		ConstLabels: labels,
+	}, func() float64 {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if time.Since(checkedAt) > unspentsMaxAge {
+			count = countUnspents(tenantName, openWallet)
+			checkedAt = time.Now()
+		}
+		return count
+	}))
+}
+
+func countUnspents(tenantName string, openWallet walletOpener) float64 {
+	w, closeWallet, err := openWallet()
+	if err != nil {
+		return math.NaN()
+	}
+	defer closeWallet()
+
+	unspents, err := w.ListUnspent()
+	if err != nil {
+		util.Logger.Warn("could not list unspents for metrics", "tenant", tenantName, "err", err)
+		return math.NaN()
+	}
+	return float64(len(unspents))
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *metrics) observeRpc(method string, duration time.Duration) {
+	m.rpcDuration.WithLabelValues(method).Observe(duration.Seconds())
+}
+
+func (m *metrics) rejected(reason string) {
+	m.proposalsRejected.WithLabelValues(reason).Inc()
+}
+
+// rejectReason turns an error from CreateProposal into a label
+func rejectReason(err error) string {
+	if clientError, ok := errors.Cause(err).(*ClientError); ok {
+		return clientError.Reason
+	}
+	if errors.Cause(err) == ErrNoUnspents {
+		return "no_unspents"
+	}
+	if errors.Cause(err) == ErrNoMatchingUnspents {
+		return "no_matching_unspents"
+	}
+	if errors.Cause(err) == rpc_client.ErrWalletLocked {
+		return "wallet_locked"
+	}
+	if _, ok := errors.Cause(err).(*SignerError); ok {
+		return "signer"
+	}
+	return "internal"
+}
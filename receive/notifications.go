@@ -0,0 +1,104 @@
+package receive
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/rhavar/bustapay/util"
+	"github.com/rhavar/bustapay/zmq"
+)
+
+// Listening to bitcoind's zmq notifications, so the relayer hears about payments straight away. This is only an
+// optimization: if we can't connect (or miss a notification) the relayer's polling still catches everything.
+//
+// bitcoind needs to be started with e.g.
+//    -zmqpubrawtx=tcp://127.0.0.1:28332 -zmqpubhashblock=tcp://127.0.0.1:28332
+
+const (
+	zmqTopicRawTx     = "rawtx"
+	zmqTopicHashBlock = "hashblock"
+
+	zmqReconnectInterval = 10 * time.Second
+)
+
+// listen subscribes to the configured notifications until ctx is cancelled
+func (r *relayer) listen(ctx context.Context) {
+	// bitcoind is usually configured to publish everything on the same endpoint
+	topics := make(map[string][]string)
+	if r.zmqRawTx != "" {
+		topics[r.zmqRawTx] = append(topics[r.zmqRawTx], zmqTopicRawTx)
+	}
+	if r.zmqHashBlock != "" {
+		topics[r.zmqHashBlock] = append(topics[r.zmqHashBlock], zmqTopicHashBlock)
+	}
+
+	for endpoint, endpointTopics := range topics {
+		r.wg.Add(1)
+		go func(endpoint string, endpointTopics []string) {
+			defer r.wg.Done()
+			r.subscribe(ctx, endpoint, endpointTopics)
+		}(endpoint, endpointTopics)
+	}
+}
+
+// subscribe stays subscribed to endpoint, reconnecting whenever it loses the connection
+func (r *relayer) subscribe(ctx context.Context, endpoint string, topics []string) {
+	logger := util.LoggerFrom(ctx).With("endpoint", endpoint, "topics", topics)
+
+	for {
+		subscriber, err := zmq.Subscribe(ctx, endpoint, topics...)
+		if err != nil {
+			logger.Warn("could not subscribe to zmq notifications, will retry", "err", err)
+		} else {
+			logger.Info("subscribed to zmq notifications")
+
+			// Receive only returns on error, so close the subscriber to stop it when we're done
+			stop := make(chan struct{})
+			go func() {
+				select {
+				case <-ctx.Done():
+					subscriber.Close()
+				case <-stop:
+				}
+			}()
+
+			err = r.receiveNotifications(subscriber)
+			close(stop)
+			subscriber.Close()
+
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Warn("lost zmq connection, will reconnect", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(zmqReconnectInterval):
+		}
+	}
+}
+
+func (r *relayer) receiveNotifications(subscriber *zmq.Subscriber) error {
+	for {
+		message, err := subscriber.Receive()
+		if err != nil {
+			return err
+		}
+
+		switch message.Topic {
+		case zmqTopicRawTx:
+			var tx wire.MsgTx
+			if err := tx.Deserialize(bytes.NewReader(message.Body)); err != nil {
+				util.Logger.Warn("could not decode rawtx notification", "err", err)
+				continue
+			}
+			r.pokeTx(&tx)
+		case zmqTopicHashBlock:
+			r.pokeAll() // might have confirmed something
+		}
+	}
+}
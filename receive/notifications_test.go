@@ -0,0 +1,102 @@
+package receive
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/rhavar/bustapay/zmq"
+)
+
+func testRelayer(t *testing.T, bitcoind *fakeBitcoind, checkInterval time.Duration, zmqEndpoint string) *relayer {
+	return &relayer{
+		dataDir:       t.TempDir(),
+		openWallet:    newWalletOpener(Config{Rpc: bitcoind.rpcConfig()}, nil),
+		checkInterval: checkInterval,
+		zmqRawTx:      zmqEndpoint,
+		zmqHashBlock:  zmqEndpoint,
+		metrics:       newMetrics(),
+		webhooks:      newWebhooks(WebhookConfig{}),
+	}
+}
+
+// watchTestPayment writes a pending payment and starts watching it, returning its final transaction
+func watchTestPayment(t *testing.T, ctx context.Context, r *relayer) *wire.MsgTx {
+	t.Helper()
+	contributed := testOutpoint(2, 1)
+	template, partial := testPayment(testOutpoint(1, 0), contributed)
+	finalTxId := writeTestPayment(t, r.dataDir, template, partial, contributed, StatePending)
+	r.watch(ctx, "test-payment", finalTxId, template, StatePending)
+	return partial
+}
+
+func waitForState(t *testing.T, r *relayer, finalTxId string, want string, within time.Duration) {
+	t.Helper()
+	var state string
+	for start := time.Now(); time.Since(start) < within; time.Sleep(10 * time.Millisecond) {
+		var err error
+		if state, err = readRelayState(filepath.Join(r.dataDir, finalTxId)); err != nil {
+			t.Fatal(err)
+		}
+		if state == want {
+			return
+		}
+	}
+	t.Fatalf("payment is still %v, want %v", state, want)
+}
+
+func TestNotificationsWakeRelayer(t *testing.T) {
+	pub, err := zmq.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	bitcoind := newFakeBitcoind(t)
+	r := testRelayer(t, bitcoind, time.Hour, pub.Addr()) // so only a notification could get it checked
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer r.wait()
+	defer cancel()
+	r.listen(ctx)
+	for start := time.Now(); pub.Subscribers(zmqTopicRawTx) == 0 || pub.Subscribers(zmqTopicHashBlock) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("relayer never subscribed")
+		}
+	}
+
+	final := watchTestPayment(t, ctx, r)
+	finalTxId := final.TxHash().String()
+
+	bitcoind.addToMempool(final)
+	var rawTx bytes.Buffer
+	final.Serialize(&rawTx)
+	pub.Publish(zmqTopicRawTx, rawTx.Bytes())
+	waitForState(t, r, finalTxId, StateInMempool, 5*time.Second)
+
+	bitcoind.confirm(final)
+	pub.Publish(zmqTopicHashBlock, make([]byte, 32))
+	waitForState(t, r, finalTxId, StateConfirmed, 5*time.Second)
+}
+
+func TestRelayerPollsWithoutNotifications(t *testing.T) {
+	bitcoind := newFakeBitcoind(t)
+	r := testRelayer(t, bitcoind, 50*time.Millisecond, "tcp://127.0.0.1:1") // nothing listens there
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer r.wait()
+	defer cancel()
+	r.listen(ctx)
+
+	final := watchTestPayment(t, ctx, r)
+	finalTxId := final.TxHash().String()
+
+	bitcoind.addToMempool(final)
+	waitForState(t, r, finalTxId, StateInMempool, 5*time.Second)
+
+	bitcoind.confirm(final)
+	waitForState(t, r, finalTxId, StateConfirmed, 5*time.Second)
+}
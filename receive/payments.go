@@ -0,0 +1,279 @@
+package receive
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+	"github.com/rhavar/bustapay/util"
+)
+
+// Reading back the payment records the server writes. Each payment is a directory named after the final txid
+// in the data directory, see the README for the files in it.
+
+const (
+	amountFile     = "amount.txt"
+	templateTxFile = "template_transaction.hex"
+	partialTxFile  = "partial_transaction.hex"
+	paymentIdFile  = "payment_id.txt"
+	relayStateFile = "relay_state.txt"
+
+	contributedInputFile = "contributed_input.txt"
+)
+
+// The states a payment goes through, as kept in relay_state.txt
+const (
+	StatePending           = "pending"            // we gave out a proposal, waiting for the final transaction
+	StateInMempool         = "in_mempool"         // the final transaction is in the mempool
+	StateTemplateBroadcast = "template_broadcast" // the final transaction never showed, we broadcast the template
+	StateConfirmed         = "confirmed"          // the final or template transaction confirmed
+	StateFailed            = "failed"             // neither transaction made it, and we couldn't broadcast the template
+	StateDoubleSpent       = "double_spent"       // the sender spent the template's inputs in some other transaction
+	StateResolved          = "resolved"           // an operator marked it as dealt with, we no longer watch it
+	StateDone              = "done"               // from before we tracked states (or relaying was disabled)
+)
+
+// watching is true for the states where the relayer is still keeping an eye on the payment
+func watching(state string) bool {
+	return state == StatePending || state == StateInMempool || state == StateTemplateBroadcast
+}
+
+// Payment is a payment record, as stored in the data directory
+type Payment struct {
+	FinalTxid string // also the name of its directory
+	PaymentId string // correlation id used in the logs
+	Amount    int64  // satoshis the sender is paying us
+	State     string
+	CreatedAt time.Time
+
+	FeeBumpTxid string // if we sped up the final transaction with a child transaction
+
+	Template *wire.MsgTx
+	Partial  *wire.MsgTx // our proposal, the final transaction is this once the sender signs it
+}
+
+func (p *Payment) TemplateTxid() string {
+	return p.Template.TxHash().String()
+}
+
+func LoadPayment(dataDir string, finalTxid string) (*Payment, error) {
+	if _, err := hex.DecodeString(finalTxid); err != nil || len(finalTxid) != 64 {
+		return nil, errors.New("not a valid txid: " + finalTxid)
+	}
+	txDir := filepath.Join(dataDir, finalTxid)
+
+	amountBytes, err := ioutil.ReadFile(filepath.Join(txDir, amountFile))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	amount, err := strconv.ParseInt(strings.TrimSpace(string(amountBytes)), 10, 64)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	info, err := os.Stat(filepath.Join(txDir, amountFile))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	template, err := readTransactionFile(filepath.Join(txDir, templateTxFile))
+	if err != nil {
+		return nil, err
+	}
+
+	partial, err := readTransactionFile(filepath.Join(txDir, partialTxFile))
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := readRelayState(txDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Payment{
+		FinalTxid:   finalTxid,
+		PaymentId:   readPaymentId(txDir),
+		Amount:      amount,
+		State:       state,
+		CreatedAt:   info.ModTime(),
+		FeeBumpTxid: readFeeBump(txDir),
+		Template:    template,
+		Partial:     partial,
+	}, nil
+}
+
+// ListPayments returns every payment in the data directory, newest first. Directories that can't be read
+// are skipped
+func ListPayments(dataDir string) ([]*Payment, error) {
+	entries, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var payments []*Payment
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		payment, err := LoadPayment(dataDir, entry.Name())
+		if err != nil {
+			continue
+		}
+		payments = append(payments, payment)
+	}
+
+	sort.Slice(payments, func(i, j int) bool {
+		return payments[i].CreatedAt.After(payments[j].CreatedAt)
+	})
+	return payments, nil
+}
+
+func writeRelayState(txDir string, state string) error {
+	return errors.WithStack(ioutil.WriteFile(filepath.Join(txDir, relayStateFile), []byte(state), 0600))
+}
+
+// Payments from before we tracked relay state don't have the file
+func readRelayState(txDir string) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(txDir, relayStateFile))
+	if os.IsNotExist(err) {
+		return StateDone, nil
+	}
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// Payments from before we had correlation ids don't have one
+func readPaymentId(txDir string) string {
+	b, err := ioutil.ReadFile(filepath.Join(txDir, paymentIdFile))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func writeContributedInput(txDir string, outpoint wire.OutPoint) error {
+	return errors.WithStack(ioutil.WriteFile(filepath.Join(txDir, contributedInputFile), []byte(outpoint.String()), 0600))
+}
+
+// readContributedInput reads back the "txid:vout" written by writeContributedInput
+func readContributedInput(txDir string) (*wire.OutPoint, error) {
+	b, err := ioutil.ReadFile(filepath.Join(txDir, contributedInputFile))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	parts := strings.Split(strings.TrimSpace(string(b)), ":")
+	if len(parts) != 2 {
+		return nil, errors.New("malformed contributed input: " + string(b))
+	}
+	hash, err := chainhash.NewHashFromStr(parts[0])
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	vout, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return wire.NewOutPoint(hash, uint32(vout)), nil
+}
+
+func readTransactionFile(path string) (*wire.MsgTx, error) {
+	hexBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	txBytes, err := hex.DecodeString(strings.TrimSpace(string(hexBytes)))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var msgTx wire.MsgTx
+	if err := msgTx.Deserialize(bytes.NewReader(txBytes)); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &msgTx, nil
+}
+
+// DecodedTransaction is a transaction in a json (and human) friendly form
+type DecodedTransaction struct {
+	Txid     string          `json:"txid"`
+	Version  int32           `json:"version"`
+	LockTime uint32          `json:"locktime"`
+	Inputs   []DecodedInput  `json:"inputs"`
+	Outputs  []DecodedOutput `json:"outputs"`
+	Hex      string          `json:"hex"`
+}
+
+type DecodedInput struct {
+	Txid      string   `json:"txid"`
+	Vout      uint32   `json:"vout"`
+	Sequence  uint32   `json:"sequence"`
+	ScriptSig string   `json:"script_sig,omitempty"`
+	Witness   []string `json:"witness,omitempty"`
+}
+
+type DecodedOutput struct {
+	Value        int64  `json:"value"`
+	ScriptPubKey string `json:"script_pubkey"`
+	Address      string `json:"address,omitempty"`
+}
+
+// DecodeTransaction decodes tx. chainParams is used for addresses, and can be nil to leave them out
+func DecodeTransaction(tx *wire.MsgTx, chainParams *chaincfg.Params) DecodedTransaction {
+	decoded := DecodedTransaction{
+		Txid:     tx.TxHash().String(),
+		Version:  tx.Version,
+		LockTime: tx.LockTime,
+		Inputs:   []DecodedInput{},
+		Outputs:  []DecodedOutput{},
+	}
+
+	var buf bytes.Buffer
+	if err := tx.Serialize(&buf); err == nil {
+		decoded.Hex = hex.EncodeToString(buf.Bytes())
+	}
+
+	for _, txIn := range tx.TxIn {
+		input := DecodedInput{
+			Txid:     txIn.PreviousOutPoint.Hash.String(),
+			Vout:     txIn.PreviousOutPoint.Index,
+			Sequence: txIn.Sequence,
+		}
+		if len(txIn.SignatureScript) > 0 {
+			input.ScriptSig = hex.EncodeToString(txIn.SignatureScript)
+		}
+		for _, w := range txIn.Witness {
+			input.Witness = append(input.Witness, hex.EncodeToString(w))
+		}
+		decoded.Inputs = append(decoded.Inputs, input)
+	}
+
+	for _, txOut := range tx.TxOut {
+		output := DecodedOutput{
+			Value:        txOut.Value,
+			ScriptPubKey: hex.EncodeToString(txOut.PkScript),
+		}
+		if chainParams != nil {
+			if address, err := util.ExtractAddress(txOut.PkScript, chainParams); err == nil {
+				output.Address = address.String()
+			}
+		}
+		decoded.Outputs = append(decoded.Outputs, output)
+	}
+
+	return decoded
+}
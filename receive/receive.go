@@ -2,165 +2,57 @@ package receive
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
 	"encoding/hex"
 	"fmt"
-	"github.com/btcsuite/btcd/btcjson"
-	"github.com/btcsuite/btcd/chaincfg/chainhash"
-	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
-	"github.com/btcsuite/btcutil/txsort"
-	"github.com/mitchellh/go-homedir"
 	"github.com/pkg/errors"
 	"github.com/rhavar/bustapay/rpc-client"
 	"github.com/rhavar/bustapay/util"
 	"io/ioutil"
-	"log"
-	"math"
-	"math/rand"
+	"net"
 	"net/http"
 	"os"
-	"sort"
 	"time"
-	"github.com/spf13/viper"
 )
 
-func createBustpayTransaction(templateTx *wire.MsgTx) ([]byte, error) {
+func (s *Server) createBustpayTransaction(ctx context.Context, t *tenant, paymentId string, templateTx *wire.MsgTx) ([]byte, error) {
 
-	for _, txIn := range templateTx.TxIn {
-		if len(txIn.Witness) == 0 {
-			return nil, newClientError("all inputs must be segwit and signed")
-		}
-	}
-
-	// Some sanity checking the transaction..
-	if len(templateTx.TxIn) == 0 {
-		return nil, newClientError("provided transaction isn't mempool eligible")
-	}
-
-	rpcClient, err := rpc_client.NewRpcClient()
+	w, closeWallet, err := t.openWallet()
 	if err != nil {
 		return nil, err
 	}
-	defer rpcClient.Shutdown()
-
-	// This is **essential** for preventing txid malleability
-	// otherwise we can be given invalid scriptSig's and then they get mallaeted to correct them
-	// which will change the txid, but not invalidate the signatures
-	acceptable, err := rpcClient.TestMempoolAccept(templateTx)
-
-	if err != nil {
-		return nil, err
-	}
-
-	if !acceptable {
-		return nil, newClientError("provided transaction isn't mempool eligible")
-	}
-
-	var paymentTargetAddress string
-	var paymentTargetAmount int64
-	var paymentTargetVout int
-
-
+	defer closeWallet()
 
-	chainParams, err := rpcClient.GetChainParams()
+	receiver := NewReceiver(w)
+	receiver.RequireMatchingInputs = t.config.RequireMatchingInputs
+	receiver.Signer = t.config.Signer
+	receiver.SignerTimeout = t.config.SignerTimeout
+	proposal, err := receiver.CreateProposal(ctx, templateTx)
 	if err != nil {
-		return nil, err
-	}
-
-	// We need to find which address of ours it's paying (if in fact it even is...)
-	// this is a super inefficient naive way of doing it
-	for vout, txout := range templateTx.TxOut {
-
-		_, addresses, _, err := txscript.ExtractPkScriptAddrs(txout.PkScript, chainParams)
-
-		if err != nil || len(addresses) != 1 {
-			log.Println("Warning: Could not exact address got: ", err, addresses)
-			continue
+		if cause := errors.Cause(err); cause == ErrNoUnspents || cause == ErrNoMatchingUnspents || cause == rpc_client.ErrWalletLocked {
+			// We've already checked the template is good, so we can still get paid, just not with a payjoin
+			s.broadcastTemplate(ctx, t, w, paymentId, templateTx)
 		}
-
-		address := addresses[0].String()
-
-		isMine, err := rpcClient.IsMyFreshMyAddress(address)
-		if err != nil {
-			return nil, err
-		}
-
-		if isMine {
-			paymentTargetAddress = address
-			paymentTargetAmount = txout.Value
-			paymentTargetVout = vout
-
-			break
-		}
-	}
-
-	if paymentTargetAddress == "" {
-		return nil, newClientError("transaction does not pay a wallet address")
-	}
-
-	// We're going to reveal one of our unspent, but we're going to base it off
-	// what they sent us. This means they can't keep querying us to find out our unspent
-	// because we'll keep giving them the same one back
-	contributingUnspent, err := getRandomUnspent(rpcClient, templateTx)
-	if err != nil {
 		return nil, err
 	}
-
-	// Now we're going to create the partially signed transaction
-	partialTransaction := templateTx.Copy()
-
-	// Since we're going to modify the transaction, we're going invalidate all signatures
-	for _, txin := range partialTransaction.TxIn {
-		txin.Witness = nil // clear the witness
-	}
-
-	contribAmount := int64(math.Round(contributingUnspent.Amount * 1e8))
-	partialTransaction.TxOut[paymentTargetVout].Value += contribAmount
-
-	inputHash, err := chainhash.NewHashFromStr(contributingUnspent.TxID)
-	if err != nil {
-		return nil, err
-	}
-	contribInputOutpoint := wire.NewOutPoint(inputHash, contributingUnspent.Vout)
-	contribTxIn := wire.NewTxIn(contribInputOutpoint, nil, nil)
-	contribTxIn.Sequence = templateTx.TxIn[0].Sequence // copy the first sequence number
-
-	// Now let's insert the txin
-	partialTransaction.TxIn = append(partialTransaction.TxIn, contribTxIn)
-
-	if txsort.IsSorted(templateTx) { // if it was originally bip69, we want to preserve this
-		txsort.InPlaceSort(partialTransaction)
-	} else {
-		// shuffle
-		for i := 0; i < len(partialTransaction.TxIn)-1; i++ {
-			moveTo := i + rand.Intn(len(partialTransaction.TxIn)-i)
-			partialTransaction.TxIn[moveTo], partialTransaction.TxIn[i] = partialTransaction.TxIn[i], partialTransaction.TxIn[moveTo]
-		}
-	}
-
-	contributedInputIndex := -1
-	for i, txIn := range partialTransaction.TxIn {
-		if txIn.PreviousOutPoint == *contribInputOutpoint {
-			contributedInputIndex = i
-			break
-		}
-	}
-	util.Assert(contributedInputIndex >= 0)
-
-	partialTransaction, _, err = rpcClient.SignRawTransactionWithWallet(partialTransaction)
-	if err != nil {
-		return nil, err
-	}
-
-	// Out of abundant paranoia, we're going to clear the witnesses for all inputs we should not have signed
-	for i, txIn := range partialTransaction.TxIn {
-		if i != contributedInputIndex {
-			txIn.Witness = nil
+	contributedOutpoint := proposal.ContributedOutpoint()
+
+	// Until the payment is written (and being watched) nothing else would unlock our unspent
+	written := false
+	defer func() {
+		if !written {
+			if err := w.UnlockUnspent(contributedOutpoint); err != nil {
+				util.LoggerFrom(ctx).Error("could not unlock contributed unspent", "err", err)
+			}
 		}
-	}
+	}()
+	partialTransaction := proposal.Partial
+	paymentTargetAmount := proposal.PaymentAmount
 
-	util.VerboseLog("Final partial transaction: ", util.HexifyTransaction(partialTransaction))
+	finalTxId := partialTransaction.TxHash().String()
+	logger := util.LoggerFrom(ctx).With("final_txid", finalTxId)
+	logger.Debug("created partial transaction", util.TxAttr(partialTransaction))
 
 	partialTransactionByteBuffer := bytes.Buffer{}
 	err = partialTransaction.Serialize(&partialTransactionByteBuffer)
@@ -176,8 +68,7 @@ func createBustpayTransaction(templateTx *wire.MsgTx) ([]byte, error) {
 
 	// Now we're going to create a dir  ~./bustapay/$finaltxid
 
-	finalTxId := partialTransaction.TxHash().String()
-	txDir := dataDirectory + "/" + finalTxId
+	txDir := t.config.DataDir + "/" + finalTxId
 	err = os.Mkdir(txDir, 0700)
 	if err != nil {
 		return nil, err
@@ -198,108 +89,85 @@ func createBustpayTransaction(templateTx *wire.MsgTx) ([]byte, error) {
 	fmt.Fprint(file, hex.EncodeToString(partialTransactionByteBuffer.Bytes()))
 	file.Close()
 
-	go func() {
-
-		if viper.GetString("disable_auto_relay") != "" {
-			return
-		}
-
-
-		// We're going to use this convoluted loop (instead of doing it directly) so we don't keep the bitcoinRpc connection
-		// open overly long
-		loop := func() bool {
-			rpcClient, err := rpc_client.NewRpcClient()
-			if err != nil {
-				fmt.Errorf("could not create bitcoin rpc client %v\n", err)
-				return false // dont keep going
-			}
-			defer rpcClient.Shutdown()
+	// Write the id that's in all the logs about this payment
+	file, err = os.Create(txDir + "/" + paymentIdFile)
+	fmt.Fprint(file, paymentId)
+	file.Close()
 
-			if rpcClient.MempoolHasEntry(partialTransaction.TxHash().String()) {
-				fmt.Errorf("Yay. Finalized transaction %v was found in mempool! Monitoring the situation\n", finalTxId)
-				// TODO: we should probably log it..
-				return true // keep looping
-			}
+	// Write which of our unspents we locked, so it can be unlocked (or locked again after a restart)
+	if err := writeContributedInput(txDir, contributedOutpoint); err != nil {
+		return nil, err
+	}
+	written = true
 
-			// The main two cases that the finalized transaction might not be in the mempool is because it's already confirmed
-			// or because it was never created. If we were smart we could differintiate the two, but really it doesn't matter.
-			// We'll just blindly try send the original and if the finalized one has already confirmed it will just conflict
-			// and be filtered out.
+	logger.Info("created proposal", "amount", paymentTargetAmount)
 
-			_, err = rpcClient.SendRawTransaction(templateTx)
-			util.VerboseLog("Blindly trying to send template transaction ", partialTransaction.TxHash().String(), " got error: ", err)
-			return false // we're all done
-		}
+	err = t.webhooks.notify(WebhookEvent{
+		Type:         EventProposalCreated,
+		PaymentId:    paymentId,
+		FinalTxid:    finalTxId,
+		TemplateTxid: templateTx.TxHash().String(),
+		Amount:       paymentTargetAmount,
+	})
+	if err != nil {
+		logger.Error("could not queue webhook", "event", EventProposalCreated, "err", err)
+	}
 
-		continueLooping := true
-		for continueLooping {
-			time.Sleep(5 * time.Minute)
-			continueLooping = loop()
-		}
-	}()
+	if !t.config.DisableAutoRelay {
+		t.relayer.watch(util.WithLogger(s.relayCtx, logger), paymentId, finalTxId, templateTx, StatePending)
+	}
 
 	return partialTransactionByteBuffer.Bytes(), nil
 }
 
-// We pick a random unspent, using seed. We intentionally make it very stable, so as long as the seed
-// is the same it'll almost always pick the same unspent (even if the unspent set considerably changes)
-func getRandomUnspent(rpcClient *rpc_client.RpcClient, templateTx *wire.MsgTx) (*btcjson.ListUnspentResult, error) {
-
-	var seed chainhash.Hash // zero initialized
-
-	for _, txIn := range templateTx.TxIn {
-		if bytes.Compare(seed[:], txIn.PreviousOutPoint.Hash[:]) < 1 {
-			seed = txIn.PreviousOutPoint.Hash
-		}
+// broadcastTemplate is for when we can't make a proposal, but the template itself is fine
+func (s *Server) broadcastTemplate(ctx context.Context, t *tenant, w serverWallet, paymentId string, templateTx *wire.MsgTx) {
+	if t.config.DisableAutoRelay {
+		return
 	}
-	util.Assert(!bytes.Equal(seed[:], new(chainhash.Hash)[:])) // seed shouldn't stay zero init..
+	logger := util.LoggerFrom(ctx)
 
-	unspents, err := rpcClient.ListUnspent()
+	txid, err := w.SendRawTransaction(templateTx)
 	if err != nil {
-		return nil, err
+		logger.Error("could not broadcast template transaction", "err", err)
+		return
 	}
+	logger.Info("could not contribute an input, so broadcast the template transaction")
 
-	// We are going to sort these elements by the hash of their  (txid,vout,seed)
-	// this ensures that it is very stable (as unspent changes, it'll rarely change)
-	// but if the seed changes, it's a totally different sort
-
-	sort.Slice(unspents, func(i, j int) bool {
-		a := util.Obfuhash([]byte(unspents[i].TxID), uintToByteSlice(unspents[i].Vout), seed[:])
-		b := util.Obfuhash([]byte(unspents[j].TxID), uintToByteSlice(unspents[j].Vout), seed[:])
-
-		return bytes.Compare(a, b) < 0
+	err = t.webhooks.notify(WebhookEvent{
+		Type:         EventTemplateBroadcast,
+		PaymentId:    paymentId,
+		TemplateTxid: txid.String(),
+		Txid:         txid.String(),
 	})
+	if err != nil {
+		logger.Error("could not queue webhook", "event", EventTemplateBroadcast, "err", err)
+	}
+}
 
-
-	// Just really for testing, when doing a bustapay to ourselves we
-	// never want to pick an unspent that is already in the bustapay transaction
-	for _, unspent := range unspents {
-
-		alreadyContains := false
-
-		for _, txIn := range templateTx.TxIn {
-			if txIn.PreviousOutPoint.String() == fmt.Sprintf("%v:%v", unspent.TxID, unspent.Vout) {
-				log.Println("Warning: Tried to pick an already used input. Skipping ", unspent.TxID, ":", unspent.Vout)
-				alreadyContains = true
-				break
-			}
-		}
-
-		if !alreadyContains {
-			return &unspent, nil
-		}
+// broadcastCheckedTemplate is for when we can't even try to make a proposal (e.g. we're not ready), so the template
+// hasn't been checked yet. It's only broadcast if it's one we'd have made a proposal for
+func (s *Server) broadcastCheckedTemplate(ctx context.Context, t *tenant, paymentId string, templateTx *wire.MsgTx) {
+	if t.config.DisableAutoRelay {
+		return
 	}
+	logger := util.LoggerFrom(ctx)
 
-	return nil, errors.New("no available unspents :/")
-}
+	w, closeWallet, err := t.openWallet()
+	if err != nil {
+		logger.Error("could not open the wallet to broadcast template transaction", "err", err)
+		return
+	}
+	defer closeWallet()
 
-func uintToByteSlice(x uint32) []byte {
-	bs := make([]byte, 4)
-	binary.LittleEndian.PutUint32(bs, x)
-	return bs
+	if _, err := NewReceiver(w).checkTemplate(ctx, templateTx); err != nil {
+		logger.Warn("not broadcasting template transaction", "err", err)
+		return
+	}
+	s.broadcastTemplate(ctx, t, w, paymentId, templateTx)
 }
 
-func handler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handler(t *tenant, w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		w.WriteHeader(400)
 		fmt.Fprint(w,  `
@@ -312,14 +180,23 @@ Newish addresses can get requested at /get-newish-address  and bustapay transact
 
 	w.Header().Add("Access-Control-Allow-Origin", "*")
 
+	paymentId := util.NewCorrelationId()
+	logger := util.Logger.With("payment_id", paymentId, util.KeyClientIp, clientIp(r))
+	if t.name != "" {
+		logger = logger.With("tenant", t.name)
+	}
+
+	s.metrics.proposalsReceived.Inc()
 
 	if r.ContentLength <= 0 {
+		s.metrics.rejected("invalid_request")
 		w.WriteHeader(400)
 		fmt.Fprint(w, "missing a content-length")
 		return
 	}
 
 	if r.ContentLength >= 100000 {
+		s.metrics.rejected("invalid_request")
 		w.WriteHeader(400)
 		fmt.Fprint(w, "lol, little big transaction you got there. no?")
 		return
@@ -327,6 +204,7 @@ Newish addresses can get requested at /get-newish-address  and bustapay transact
 
 	txBytes, err := ioutil.ReadAll(r.Body)
 	if err != nil {
+		s.metrics.rejected("invalid_request")
 		w.WriteHeader(400)
 		fmt.Fprint(w, "could not read all http body")
 		return
@@ -336,6 +214,7 @@ Newish addresses can get requested at /get-newish-address  and bustapay transact
 
 		txBytes, err = hex.DecodeString(string(txBytes))
 		if err != nil {
+			s.metrics.rejected("invalid_request")
 			w.WriteHeader(400)
 			fmt.Fprint(w, "http body doesn't appear to be hex-encoded, but content-type was text/plain")
 			return
@@ -345,54 +224,58 @@ Newish addresses can get requested at /get-newish-address  and bustapay transact
 
 	msgTx := &wire.MsgTx{}
 	if err := msgTx.Deserialize(bytes.NewBuffer(txBytes)); err != nil {
+		s.metrics.rejected("invalid_request")
 		w.WriteHeader(400)
 		fmt.Fprint(w, "http body was not a valid bitcoin transaction")
 		return
 	}
 
-	util.VerboseLog("Got a template transaction: ", msgTx.TxHash(), " hex: ", util.HexifyTransaction(msgTx))
+	logger = logger.With("template_txid", msgTx.TxHash().String())
+	logger.Debug("got a template transaction", util.TxAttr(msgTx))
 
-	templateTransaction, err := createBustpayTransaction(msgTx)
+	if readiness := t.readiness(); !readiness.Ready {
+		var failed []string
+		for _, check := range readiness.Checks {
+			if !check.Ok {
+				failed = append(failed, check.Name+": "+check.Detail)
+			}
+		}
+		s.metrics.rejected("not_ready")
+		logger.Warn("refused proposal, not ready", "failed_checks", failed)
+		s.broadcastCheckedTemplate(util.WithLogger(r.Context(), logger), t, paymentId, msgTx)
+		w.WriteHeader(503)
+		fmt.Fprint(w, "can't payjoin right now, just broadcast the template transaction")
+		return
+	}
+
+	s.proposals.Add(1)
+	start := time.Now()
+	templateTransaction, err := s.createBustpayTransaction(util.WithLogger(r.Context(), logger), t, paymentId, msgTx)
+	s.metrics.proposalDuration.Observe(time.Since(start).Seconds())
+	s.proposals.Done()
 
 	if err != nil {
+		s.metrics.rejected(rejectReason(err))
 		w.WriteHeader(400)
-		fmt.Fprint(w, "got an internal error")
-		fmt.Println("proxy transaction error: ", err)
+		if cause := errors.Cause(err); cause == ErrNoUnspents || cause == ErrNoMatchingUnspents || cause == rpc_client.ErrWalletLocked {
+			fmt.Fprint(w, "can't payjoin right now, just broadcast the template transaction")
+		} else {
+			fmt.Fprint(w, "got an internal error")
+		}
+		logger.Error("could not create proposal", "err", err)
 		return
 	}
 
 
+	s.metrics.proposalsSigned.Inc()
 	w.Write(templateTransaction)
 }
 
-func StartServer(port int32) {
-	log.Println("Listening on port: ", port)
-
-
-	http.HandleFunc("/", handler)
-
-
-	// This is extremely unsuitable for production. Just for development!
-	http.HandleFunc("/get-newish-address", getNewishAddress)
-
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%v", port), nil))
-}
-
-func newClientError(s string) error {
-	return errors.New(s)
-}
-
-var dataDirectory string
-
-func init() {
-	dir, err := homedir.Dir()
+// clientIp is the ip of whoever sent the request, for logging
+func clientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		panic(err)
+		return r.RemoteAddr
 	}
-
-	dataDirectory = dir + "/.bustapay"
-	os.Mkdir(dataDirectory, 0700)
-
-	dataDirectory = dataDirectory + "/data"
-	os.Mkdir(dataDirectory, 0700)
+	return host
 }
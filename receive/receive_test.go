@@ -0,0 +1,62 @@
+package receive
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/rhavar/bustapay/util"
+)
+
+func testServer(t *testing.T, bitcoind *fakeBitcoind) *Server {
+	config := DefaultConfig()
+	config.DataDir = t.TempDir()
+	config.Rpc = bitcoind.rpcConfig()
+	config.Webhooks = WebhookConfig{Urls: []string{"http://127.0.0.1:1"}, Secret: "hunter2", OutboxDir: t.TempDir()}
+	return NewServer(config)
+}
+
+func propose(t *testing.T, s *Server, template *wire.MsgTx) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/", strings.NewReader(txHex(template)))
+	r.Header.Set("Content-type", "text/plain")
+	w := httptest.NewRecorder()
+	s.handler(s.tenants[0], w, r)
+	return w
+}
+
+func TestNotReadyBroadcastsTemplate(t *testing.T) {
+	bitcoind := newFakeBitcoind(t)
+	s := testServer(t, bitcoind) // the wallet has no unspents, so it's never ready
+
+	template, _ := testPayment(testOutpoint(1, 0), testOutpoint(2, 1))
+	address, err := util.ExtractAddress(template.TxOut[0].PkScript, &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bitcoind.addAddress(address.String())
+
+	if w := propose(t, s, template); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("proposal while not ready got %v: %v", w.Code, w.Body.String())
+	}
+	if bitcoind.callCount("sendrawtransaction") != 1 {
+		t.Error("template wasn't broadcast")
+	}
+	if events := outboxEvents(t, s.tenants[0].config.Webhooks.OutboxDir); len(events) != 1 || events[0] != EventTemplateBroadcast {
+		t.Errorf("queued webhooks %v, want just %v", events, EventTemplateBroadcast)
+	}
+
+	// one that doesn't pay us is none of our business
+	other, _ := testPayment(testOutpoint(3, 0), testOutpoint(4, 1))
+	other.TxOut[0].PkScript, _ = hex.DecodeString("0014" + strings.Repeat("cd", 20))
+	if w := propose(t, s, other); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("proposal while not ready got %v: %v", w.Code, w.Body.String())
+	}
+	if bitcoind.callCount("sendrawtransaction") != 1 {
+		t.Error("broadcast a template that doesn't pay us")
+	}
+}
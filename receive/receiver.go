@@ -0,0 +1,438 @@
+// Package receive is the receiving side of bustapay. A Receiver turns a sender's template transaction into a
+// proposal using your wallet, and a Server wraps that up in an HTTP server which stores payments and relays
+// template transactions if the sender never finalizes.
+package receive
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil/txsort"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+	"github.com/rhavar/bustapay/psbt"
+	"github.com/rhavar/bustapay/util"
+	"log/slog"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Wallet is everything the Receiver needs from a wallet. *rpc_client.RpcClient implements it using bitcoin core
+type Wallet interface {
+	TestMempoolAccept(tx *wire.MsgTx) (bool, error)
+	GetChainParams() (*chaincfg.Params, error)
+	IsMyFreshMyAddress(address string) (bool, error)
+	ListUnspent() ([]btcjson.ListUnspentResult, error)
+	LockUnspent(outpoint wire.OutPoint) error
+	UnlockUnspent(outpoint wire.OutPoint) error
+	GetTxOut(txid *chainhash.Hash, vout uint32) (*btcjson.GetTxOutResult, error)
+	SignInputsWithWallet(tx *wire.MsgTx, inputs []int, prevOuts txscript.PrevOutputFetcher) (*wire.MsgTx, error)
+	WalletProcessPsbt(packet *psbt.Packet, sign bool) (*psbt.Packet, bool, error)
+}
+
+// Receiver creates bustapay proposals. It has no side effects other than the calls it makes to its Wallet (which
+// include locking the unspent it contributes)
+type Receiver struct {
+	Wallet Wallet
+
+	// A transaction where one input is obviously a different type from the rest is an obvious payjoin. We always
+	// prefer contributing an unspent of the same type as the template's inputs, but with this set we refuse
+	// (with ErrNoMatchingUnspents) rather than contribute one that doesn't match
+	RequireMatchingInputs bool
+
+	// If set, the contributed input is signed by Signer instead of the wallet, so the wallet can be watch-only.
+	// Proposals are rejected if it fails, or takes longer than SignerTimeout (if set)
+	Signer        Signer
+	SignerTimeout time.Duration
+}
+
+func NewReceiver(wallet Wallet) *Receiver {
+	return &Receiver{Wallet: wallet}
+}
+
+// Proposal is the result of a successful CreateProposal
+type Proposal struct {
+	Template         *wire.MsgTx // what the sender gave us
+	Partial          *wire.MsgTx // the template with our input added (and signed), for the sender to sign
+	PaymentAddress   string      // our address the template pays
+	PaymentAmount    int64       // the amount the sender is paying us in satoshis
+	ContributedInput int         // index of our input in Partial. It's locked in the wallet until you unlock it
+}
+
+// ContributedOutpoint is the unspent of ours the proposal spends
+func (p *Proposal) ContributedOutpoint() wire.OutPoint {
+	return p.Partial.TxIn[p.ContributedInput].PreviousOutPoint
+}
+
+// CreateProposal takes the template transaction a sender gave us, and returns a proposal which adds one of our
+// unspents (signed) and increases our payment output by the same amount. Nothing is stored or broadcast, that's up
+// to the caller. The unspent is locked so no other proposal (or the wallet itself) will spend it, it's up to the
+// caller to unlock it when the proposal is done with
+func (r *Receiver) CreateProposal(ctx context.Context, templateTx *wire.MsgTx) (proposal *Proposal, err error) {
+	logger := util.LoggerFrom(ctx)
+
+	payment, err := r.checkTemplate(ctx, templateTx)
+	if err != nil {
+		return nil, err
+	}
+	paymentTargetAddress, paymentTargetAmount, paymentTargetVout, sequence := payment.address, payment.amount, payment.vout, payment.sequence
+
+	// We're going to reveal one of our unspent, but we're going to base it off
+	// what they sent us. This means they can't keep querying us to find out our unspent
+	// because we'll keep giving them the same one back
+	contributingUnspent, err := lockRandomUnspent(logger, r.Wallet, templateTx, r.RequireMatchingInputs)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			r.unlock(logger, contributingUnspent)
+		}
+	}()
+
+	// Now we're going to create the partially signed transaction. It's a copy, so the version and locktime stay
+	// exactly what the sender's wallet picked (and with our sequence matching, an anti-fee-sniping locktime is
+	// still enforced, and rbf is signalled either by every input or none)
+	partialTransaction := templateTx.Copy()
+	antiFeeSniping := util.IsAntiFeeSniping(templateTx)
+	logger.Debug("template timelocks", "version", templateTx.Version, "locktime", templateTx.LockTime,
+		"sequence", sequence, "rbf", util.SignalsRbf(sequence), "anti_fee_sniping", antiFeeSniping)
+
+	// Since we're going to modify the transaction, we're going invalidate all signatures
+	for _, txin := range partialTransaction.TxIn {
+		txin.Witness = nil // clear the witness
+	}
+
+	contribAmount := btcToSatoshis(contributingUnspent.Amount)
+	partialTransaction.TxOut[paymentTargetVout].Value += contribAmount
+
+	contribInputOutpoint, err := unspentOutpoint(contributingUnspent)
+	if err != nil {
+		return nil, err
+	}
+	contribTxIn := wire.NewTxIn(contribInputOutpoint, nil, nil)
+	contribTxIn.Sequence = sequence
+
+	// Now let's insert the txin
+	partialTransaction.TxIn = append(partialTransaction.TxIn, contribTxIn)
+
+	// Copying the sequence should mean the locktime is enforced just like the template's was, but a proposal that
+	// turned anti-fee-sniping off (or on) would be a different transaction to the one the sender's wallet made, so
+	// make sure before signing anything
+	if util.IsAntiFeeSniping(partialTransaction) != antiFeeSniping {
+		return nil, errors.Errorf("our input would change whether the template's locktime (%v) is enforced", templateTx.LockTime)
+	}
+
+	if txsort.IsSorted(templateTx) { // if it was originally bip69, we want to preserve this
+		txsort.InPlaceSort(partialTransaction)
+	} else {
+		// shuffle
+		for i := 0; i < len(partialTransaction.TxIn)-1; i++ {
+			moveTo := i + rand.Intn(len(partialTransaction.TxIn)-i)
+			partialTransaction.TxIn[moveTo], partialTransaction.TxIn[i] = partialTransaction.TxIn[i], partialTransaction.TxIn[moveTo]
+		}
+	}
+
+	contributedInputIndex := -1
+	for i, txIn := range partialTransaction.TxIn {
+		if txIn.PreviousOutPoint == *contribInputOutpoint {
+			contributedInputIndex = i
+			break
+		}
+	}
+	util.Assert(contributedInputIndex >= 0)
+
+	// Only our input gets signed, even if the wallet could sign others (e.g. when paying ourselves), and the
+	// signature is checked before we hand it out. For taproot that needs what the sender's inputs spend too
+	contribPkScript, err := hex.DecodeString(contributingUnspent.ScriptPubKey)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	prevOuts, err := util.PrevOuts(templateTx, r.Wallet.GetTxOut)
+	if err != nil {
+		return nil, errors.Wrap(err, "template")
+	}
+	prevOuts.AddPrevOut(*contribInputOutpoint, wire.NewTxOut(contribAmount, contribPkScript))
+	if r.Signer != nil {
+		partialTransaction, err = r.signExternally(ctx, partialTransaction, contributedInputIndex, prevOuts)
+	} else {
+		partialTransaction, err = r.Wallet.SignInputsWithWallet(partialTransaction, []int{contributedInputIndex}, prevOuts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Proposal{
+		Template:         templateTx,
+		Partial:          partialTransaction,
+		PaymentAddress:   paymentTargetAddress,
+		PaymentAmount:    paymentTargetAmount,
+		ContributedInput: contributedInputIndex,
+	}, nil
+}
+
+// templatePayment is what checkTemplate found out about a template
+type templatePayment struct {
+	address  string // our address it pays
+	amount   int64
+	vout     int
+	sequence uint32 // what every input uses, so what ours has to
+}
+
+// checkTemplate makes sure templateTx is something we'd want broadcast: it's mempool eligible, and pays one of our
+// fresh addresses
+func (r *Receiver) checkTemplate(ctx context.Context, templateTx *wire.MsgTx) (*templatePayment, error) {
+	logger := util.LoggerFrom(ctx)
+
+	for _, txIn := range templateTx.TxIn {
+		if len(txIn.Witness) == 0 {
+			return nil, newClientError("not_segwit", "all inputs must be segwit and signed")
+		}
+	}
+
+	// Some sanity checking the transaction..
+	if len(templateTx.TxIn) == 0 {
+		return nil, newClientError("not_mempool_eligible", "provided transaction isn't mempool eligible")
+	}
+
+	// Our input has to use the same sequence as the sender's, so they need to agree on one. A relative locktime
+	// would apply to our input too, and our unspent might not be old enough
+	sequence, ok := util.UniformSequence(templateTx)
+	if !ok {
+		return nil, newClientError("mixed_sequences", "all inputs must have the same sequence")
+	}
+	if util.HasRelativeLockTime(templateTx.Version, sequence) {
+		return nil, newClientError("relative_locktime", "inputs must not have a relative locktime")
+	}
+
+	// This is **essential** for preventing txid malleability
+	// otherwise we can be given invalid scriptSig's and then they get mallaeted to correct them
+	// which will change the txid, but not invalidate the signatures
+	acceptable, err := r.Wallet.TestMempoolAccept(templateTx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !acceptable {
+		return nil, newClientError("not_mempool_eligible", "provided transaction isn't mempool eligible")
+	}
+
+	payment := &templatePayment{sequence: sequence}
+
+	chainParams, err := r.Wallet.GetChainParams()
+	if err != nil {
+		return nil, err
+	}
+
+	// We need to find which address of ours it's paying (if in fact it even is...)
+	// this is a super inefficient naive way of doing it
+	for vout, txout := range templateTx.TxOut {
+
+		extracted, err := util.ExtractAddress(txout.PkScript, chainParams)
+		if err != nil {
+			logger.Warn("could not extract address from output", "vout", vout, "err", err)
+			continue
+		}
+
+		address := extracted.String()
+
+		isMine, err := r.Wallet.IsMyFreshMyAddress(address)
+		if err != nil {
+			return nil, err
+		}
+
+		if isMine {
+			payment.address = address
+			payment.amount = txout.Value
+			payment.vout = vout
+
+			break
+		}
+	}
+
+	if payment.address == "" {
+		return nil, newClientError("no_payment_output", "transaction does not pay a wallet address")
+	}
+
+	return payment, nil
+}
+
+// we only retry when someone else locked the unspent we picked first, which should be rare
+const maxLockAttempts = 3
+
+// lockRandomUnspent picks an unspent with getRandomUnspent and locks it. Locking fails if a concurrent proposal
+// got to it first, in which case we pick again (it'll no longer be listed)
+func lockRandomUnspent(logger *slog.Logger, wallet Wallet, templateTx *wire.MsgTx, requireMatching bool) (*btcjson.ListUnspentResult, error) {
+	var lockErr error
+	for attempt := 0; attempt < maxLockAttempts; attempt++ {
+		unspent, err := getRandomUnspent(logger, wallet, templateTx, requireMatching)
+		if err != nil {
+			return nil, err
+		}
+
+		outpoint, err := unspentOutpoint(unspent)
+		if err != nil {
+			return nil, err
+		}
+		if lockErr = wallet.LockUnspent(*outpoint); lockErr == nil {
+			return unspent, nil
+		}
+		logger.Warn("could not lock unspent, picking another", "outpoint", outpoint.String(), "err", lockErr)
+	}
+	return nil, lockErr
+}
+
+func (r *Receiver) unlock(logger *slog.Logger, unspent *btcjson.ListUnspentResult) {
+	outpoint, err := unspentOutpoint(unspent)
+	if err == nil {
+		err = r.Wallet.UnlockUnspent(*outpoint)
+	}
+	if err != nil {
+		logger.Error("could not unlock unspent", "txid", unspent.TxID, "vout", unspent.Vout, "err", err)
+	}
+}
+
+func unspentOutpoint(unspent *btcjson.ListUnspentResult) (*wire.OutPoint, error) {
+	hash, err := chainhash.NewHashFromStr(unspent.TxID)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return wire.NewOutPoint(hash, unspent.Vout), nil
+}
+
+// We pick a random unspent, using seed. We intentionally make it very stable, so as long as the seed
+// is the same it'll almost always pick the same unspent (even if the unspent set considerably changes).
+// With requireMatching we only pick an unspent of the same script type as the template's inputs
+func getRandomUnspent(logger *slog.Logger, wallet Wallet, templateTx *wire.MsgTx, requireMatching bool) (*btcjson.ListUnspentResult, error) {
+
+	var seed chainhash.Hash // zero initialized
+
+	for _, txIn := range templateTx.TxIn {
+		if bytes.Compare(seed[:], txIn.PreviousOutPoint.Hash[:]) < 1 {
+			seed = txIn.PreviousOutPoint.Hash
+		}
+	}
+	util.Assert(!bytes.Equal(seed[:], new(chainhash.Hash)[:])) // seed shouldn't stay zero init..
+
+	unspents, err := wallet.ListUnspent()
+	if err != nil {
+		return nil, err
+	}
+
+	// We are going to sort these elements by the hash of their  (txid,vout,seed)
+	// this ensures that it is very stable (as unspent changes, it'll rarely change)
+	// but if the seed changes, it's a totally different sort
+
+	sort.Slice(unspents, func(i, j int) bool {
+		a := util.Obfuhash([]byte(unspents[i].TxID), uintToByteSlice(unspents[i].Vout), seed[:])
+		b := util.Obfuhash([]byte(unspents[j].TxID), uintToByteSlice(unspents[j].Vout), seed[:])
+
+		return bytes.Compare(a, b) < 0
+	})
+
+	// A transaction where one input is obviously different from the rest is an obvious payjoin, so we'd rather
+	// contribute the same type of input as the sender used (this keeps the order above otherwise)
+	templateType := templateInputType(templateTx)
+	if requireMatching {
+		if templateType == util.ScriptTypeUnknown {
+			return nil, ErrNoMatchingUnspents // mixed, or we can't tell, so nothing can match
+		}
+		matching := unspents[:0]
+		for _, unspent := range unspents {
+			if unspentScriptType(&unspent) == templateType {
+				matching = append(matching, unspent)
+			}
+		}
+		if len(matching) == 0 && len(unspents) > 0 {
+			logger.Info("no unspents match the template's inputs", "type", templateType)
+			return nil, ErrNoMatchingUnspents
+		}
+		unspents = matching
+	} else if templateType != util.ScriptTypeUnknown {
+		sort.SliceStable(unspents, func(i, j int) bool {
+			return unspentScriptType(&unspents[i]) == templateType && unspentScriptType(&unspents[j]) != templateType
+		})
+	}
+
+	// Just really for testing, when doing a bustapay to ourselves we
+	// never want to pick an unspent that is already in the bustapay transaction
+	for _, unspent := range unspents {
+
+		alreadyContains := false
+
+		for _, txIn := range templateTx.TxIn {
+			if txIn.PreviousOutPoint.String() == fmt.Sprintf("%v:%v", unspent.TxID, unspent.Vout) {
+				logger.Warn("tried to pick an already used input, skipping", "txid", unspent.TxID, "vout", unspent.Vout)
+				alreadyContains = true
+				break
+			}
+		}
+
+		if !alreadyContains {
+			return &unspent, nil
+		}
+	}
+
+	return nil, ErrNoUnspents
+}
+
+// templateInputType is the script type all the template's inputs spend, or unknown if they're mixed
+func templateInputType(templateTx *wire.MsgTx) string {
+	scriptType := util.ScriptTypeUnknown
+	for i, txIn := range templateTx.TxIn {
+		inputType := util.InputScriptType(txIn.SignatureScript, txIn.Witness)
+		if i > 0 && inputType != scriptType {
+			return util.ScriptTypeUnknown
+		}
+		scriptType = inputType
+	}
+	return scriptType
+}
+
+func unspentScriptType(unspent *btcjson.ListUnspentResult) string {
+	pkScript, _ := hex.DecodeString(unspent.ScriptPubKey)
+	redeemScript, _ := hex.DecodeString(unspent.RedeemScript)
+	return util.ScriptType(pkScript, redeemScript)
+}
+
+// bitcoind gives us amounts as floats
+func btcToSatoshis(amount float64) int64 {
+	return int64(math.Round(amount * 1e8))
+}
+
+func uintToByteSlice(x uint32) []byte {
+	bs := make([]byte, 4)
+	binary.LittleEndian.PutUint32(bs, x)
+	return bs
+}
+
+// ErrNoUnspents is returned by CreateProposal when the wallet has nothing we can contribute
+var ErrNoUnspents = errors.New("no available unspents :/")
+
+// ErrNoMatchingUnspents is returned by CreateProposal when RequireMatchingInputs is set, and the wallet has nothing
+// of the same script type as the template's inputs
+var ErrNoMatchingUnspents = errors.New("no unspents matching the template's input type")
+
+// ClientError is returned by CreateProposal when the template itself was unacceptable (as opposed to something
+// going wrong on our end). Reason is short and machine friendly, e.g. for metrics
+type ClientError struct {
+	Reason  string
+	Message string
+}
+
+func (e *ClientError) Error() string {
+	return e.Message
+}
+
+func newClientError(reason string, s string) error {
+	return &ClientError{Reason: reason, Message: s}
+}
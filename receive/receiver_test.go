@@ -0,0 +1,312 @@
+package receive
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+	"github.com/rhavar/bustapay/psbt"
+	"github.com/rhavar/bustapay/util"
+	"github.com/rhavar/bustapay/wallet"
+)
+
+// testWallet is a built-in wallet on chain with a confirmed unspent of each of values. kind is the descriptor's
+// function, e.g. "wpkh", "sh(wpkh" or "tr"
+func testWallet(t *testing.T, chain *wallet.MemoryChain, kind string, seed byte, values ...int64) *wallet.Wallet {
+	t.Helper()
+	master, err := hdkeychain.NewMaster(append(make([]byte, 31), seed), chain.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptor := kind + "(" + master.String() + "/0/*)"
+	if kind == "sh(wpkh" {
+		descriptor += ")"
+	}
+	w, err := wallet.New(wallet.Config{Descriptor: descriptor}, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, value := range values {
+		address, err := w.GetNewAddress()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkScript, err := txscript.PayToAddrScript(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain.Mine(wire.NewTxOut(value, pkScript))
+	}
+	if err := w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+// testTemplate is a signed transaction from sender paying amount to a fresh address of receiver's. change is called
+// with it before it's signed
+func testTemplate(t *testing.T, sender *wallet.Wallet, receiver *wallet.Wallet, amount int64, change func(*wire.MsgTx)) *wire.MsgTx {
+	t.Helper()
+	address, err := receiver.GetNewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawTx, err := sender.CreateRawTransaction(address.EncodeAddress(), amount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := sender.FundRawTransaction(rawTx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change != nil {
+		change(tx)
+	}
+	signed, complete, err := sender.SignRawTransactionWithWallet(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !complete {
+		t.Fatal("sender couldn't sign the template")
+	}
+	return signed
+}
+
+func TestProposalKeepsAntiFeeSniping(t *testing.T) {
+	chain := wallet.NewMemoryChain(&chaincfg.RegressionNetParams)
+	sender := testWallet(t, chain, "wpkh", 1, 500000, 500000) // one for each template
+	receiver := testWallet(t, chain, "wpkh", 2, 300000, 200000)
+
+	template := testTemplate(t, sender, receiver, 100000, nil)
+	if !util.IsAntiFeeSniping(template) {
+		t.Fatal("the wallet's template isn't anti-fee-sniping")
+	}
+	proposal, err := NewReceiver(receiver).CreateProposal(context.Background(), template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proposal.Partial.LockTime != template.LockTime || !util.IsAntiFeeSniping(proposal.Partial) {
+		t.Errorf("proposal's locktime %v isn't enforced like the template's %v", proposal.Partial.LockTime, template.LockTime)
+	}
+
+	// with every input final the locktime isn't enforced, and our input mustn't start enforcing it
+	template = testTemplate(t, sender, receiver, 100000, func(tx *wire.MsgTx) {
+		for _, txIn := range tx.TxIn {
+			txIn.Sequence = wire.MaxTxInSequenceNum
+		}
+	})
+	if util.IsAntiFeeSniping(template) {
+		t.Fatal("a template with only final inputs is anti-fee-sniping")
+	}
+	proposal, err = NewReceiver(receiver).CreateProposal(context.Background(), template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if util.IsAntiFeeSniping(proposal.Partial) {
+		t.Error("our input turned on the template's locktime")
+	}
+}
+
+// twoWallets is a receiver wallet with two kinds of unspents, one from each built-in wallet (which only have one
+// kind each). Addresses come from the first
+type twoWallets struct {
+	*wallet.Wallet
+	other *wallet.Wallet
+}
+
+func (w twoWallets) ListUnspent() ([]btcjson.ListUnspentResult, error) {
+	unspents, err := w.Wallet.ListUnspent()
+	if err != nil {
+		return nil, err
+	}
+	others, err := w.other.ListUnspent()
+	return append(unspents, others...), err
+}
+
+func (w twoWallets) LockUnspent(outpoint wire.OutPoint) error {
+	if err := w.Wallet.LockUnspent(outpoint); err != nil {
+		return w.other.LockUnspent(outpoint)
+	}
+	return nil
+}
+
+func (w twoWallets) UnlockUnspent(outpoint wire.OutPoint) error {
+	if err := w.Wallet.UnlockUnspent(outpoint); err != nil {
+		return w.other.UnlockUnspent(outpoint)
+	}
+	return nil
+}
+
+func (w twoWallets) SignInputsWithWallet(tx *wire.MsgTx, inputs []int, prevOuts txscript.PrevOutputFetcher) (*wire.MsgTx, error) {
+	if signed, err := w.Wallet.SignInputsWithWallet(tx, inputs, prevOuts); err == nil {
+		return signed, nil
+	}
+	return w.other.SignInputsWithWallet(tx, inputs, prevOuts)
+}
+
+func contributedType(proposal *Proposal) string {
+	txIn := proposal.Partial.TxIn[proposal.ContributedInput]
+	return util.InputScriptType(txIn.SignatureScript, txIn.Witness)
+}
+
+// Whatever the sender's inputs are, we contribute the same kind if we have one
+func TestContributesMatchingInput(t *testing.T) {
+	for _, kind := range []string{"wpkh", "tr"} {
+		chain := wallet.NewMemoryChain(&chaincfg.RegressionNetParams)
+		sender := testWallet(t, chain, kind, 1, 500000, 400000, 300000)
+		receiver := twoWallets{testWallet(t, chain, "wpkh", 2, 10000, 20000, 30000), testWallet(t, chain, "tr", 3, 40000, 50000, 60000)}
+
+		// different templates (so different seeds) pick different unspents, but always the right kind
+		for i := int64(0); i < 3; i++ {
+			template := testTemplate(t, sender, receiver.Wallet, 100000+i, nil)
+			proposal, err := NewReceiver(receiver).CreateProposal(context.Background(), template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := contributedType(proposal), templateInputType(template); got != want {
+				t.Errorf("contributed a %v input to a template spending %v", got, want)
+			}
+		}
+	}
+}
+
+func TestRequireMatchingInputs(t *testing.T) {
+	chain := wallet.NewMemoryChain(&chaincfg.RegressionNetParams)
+	sender := testWallet(t, chain, "sh(wpkh", 1, 500000)
+	receiver := twoWallets{testWallet(t, chain, "wpkh", 2, 10000), testWallet(t, chain, "tr", 3, 40000)}
+	template := testTemplate(t, sender, receiver.Wallet, 100000, nil)
+	if inputType := templateInputType(template); inputType != util.ScriptTypeP2SHP2WPKH {
+		t.Fatalf("template's inputs are %v", inputType)
+	}
+
+	r := NewReceiver(receiver)
+	r.RequireMatchingInputs = true
+	if _, err := r.CreateProposal(context.Background(), template); errors.Cause(err) != ErrNoMatchingUnspents {
+		t.Errorf("with nothing matching a p2sh-p2wpkh template, got %v", err)
+	}
+	unspents, _ := receiver.ListUnspent()
+	if len(unspents) != 2 {
+		t.Errorf("%v unspents left unlocked after refusing, want both", len(unspents))
+	}
+
+	// without requiring it, we'd rather contribute something than nothing
+	r.RequireMatchingInputs = false
+	proposal, err := r.CreateProposal(context.Background(), template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contributedType(proposal) == util.ScriptTypeP2SHP2WPKH {
+		t.Error("contributed a p2sh-p2wpkh input we don't have")
+	}
+}
+
+func TestTemplateInputType(t *testing.T) {
+	chain := wallet.NewMemoryChain(&chaincfg.RegressionNetParams)
+	wpkh := testWallet(t, chain, "wpkh", 1, 500000)
+	tr := testWallet(t, chain, "tr", 2, 500000)
+	receiver := testWallet(t, chain, "wpkh", 3)
+
+	wpkhTemplate := testTemplate(t, wpkh, receiver, 100000, nil)
+	trTemplate := testTemplate(t, tr, receiver, 100000, nil)
+	if inputType := templateInputType(wpkhTemplate); inputType != util.ScriptTypeP2WPKH {
+		t.Errorf("p2wpkh template's inputs are %v", inputType)
+	}
+	if inputType := templateInputType(trTemplate); inputType != util.ScriptTypeP2TR {
+		t.Errorf("p2tr template's inputs are %v", inputType)
+	}
+
+	mixed := wpkhTemplate.Copy()
+	mixed.TxIn = append(mixed.TxIn, trTemplate.TxIn...)
+	if inputType := templateInputType(mixed); inputType != util.ScriptTypeUnknown {
+		t.Errorf("mixed template's inputs are %v", inputType)
+	}
+}
+
+// stuckSigner never signs, it just waits to be given up on
+type stuckSigner struct{}
+
+func (stuckSigner) SignPsbt(ctx context.Context, packet *psbt.Packet, input int) (*psbt.Packet, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// A signer that takes too long gets the proposal refused, and what we'd have contributed is free for the next one
+func TestSignerTimeout(t *testing.T) {
+	chain := wallet.NewMemoryChain(&chaincfg.RegressionNetParams)
+	sender := testWallet(t, chain, "wpkh", 1, 500000)
+	receiver := testWallet(t, chain, "wpkh", 2, 300000)
+	template := testTemplate(t, sender, receiver, 100000, nil)
+
+	r := NewReceiver(receiver)
+	r.Signer = stuckSigner{}
+	r.SignerTimeout = 50 * time.Millisecond
+	start := time.Now()
+	_, err := r.CreateProposal(context.Background(), template)
+	if _, ok := errors.Cause(err).(*SignerError); !ok {
+		t.Fatalf("with a stuck signer, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("didn't give up on the signer after SignerTimeout")
+	}
+
+	if unspents, _ := receiver.ListUnspent(); len(unspents) != 1 {
+		t.Error("left our unspent locked after the signer timed out")
+	}
+}
+
+// staleWallet lists what was unspent before anything got locked the first time it's asked, like a proposal that
+// listed just before a concurrent one locked what it's about to pick
+type staleWallet struct {
+	*wallet.Wallet
+	stale []btcjson.ListUnspentResult
+}
+
+func (w *staleWallet) ListUnspent() ([]btcjson.ListUnspentResult, error) {
+	if stale := w.stale; stale != nil {
+		w.stale = nil
+		return stale, nil
+	}
+	return w.Wallet.ListUnspent()
+}
+
+// Proposals at the same time never contribute the same unspent, even for the same template (which picks the same
+// one first)
+func TestLockContention(t *testing.T) {
+	chain := wallet.NewMemoryChain(&chaincfg.RegressionNetParams)
+	sender := testWallet(t, chain, "wpkh", 1, 500000)
+	receiver := testWallet(t, chain, "wpkh", 2, 10000, 20000, 30000)
+	template := testTemplate(t, sender, receiver, 100000, nil)
+
+	// the second lists before the first locks, so sees the first's pick as unspent but can't lock it
+	unspents, err := receiver.ListUnspent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := NewReceiver(receiver).CreateProposal(context.Background(), template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewReceiver(&staleWallet{receiver, unspents}).CreateProposal(context.Background(), template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contributed := func(p *Proposal) wire.OutPoint { return p.Partial.TxIn[p.ContributedInput].PreviousOutPoint }
+	if contributed(first) == contributed(second) {
+		t.Errorf("both proposals contribute %v", contributed(first))
+	}
+
+	// and with everything locked there's nothing to contribute, rather than something locked
+	if _, err := NewReceiver(receiver).CreateProposal(context.Background(), template); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewReceiver(receiver).CreateProposal(context.Background(), template); errors.Cause(err) != ErrNoUnspents {
+		t.Errorf("with every unspent locked got %v", err)
+	}
+}
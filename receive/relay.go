@@ -0,0 +1,480 @@
+package receive
+
+import (
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+	"github.com/rhavar/bustapay/rpc-client"
+	"github.com/rhavar/bustapay/util"
+)
+
+// After we give out a partial transaction, we keep an eye on the mempool. If the sender never finalizes it
+// (or it gets evicted) we broadcast their template transaction instead so we still get paid. We keep watching
+// until one of them confirms.
+//
+// The state of this is kept in relay_state.txt in the payment's directory, so if we're restarted we can
+// pick up where we left off.
+//
+// If the sender double-spends the template's inputs instead, neither transaction can ever confirm. So we give up
+// on the payment, tell the wallet our contributed input is free again, and let the operator know.
+//
+// The unspent we contributed is locked in the wallet while we wait for the final transaction, and unlocked
+// once we're done with the payment (or fall back to the template). bitcoind forgets locks when it restarts (and the
+// built-in wallet starts afresh), so they're taken again when we resume.
+//
+// If bitcoind's zmq notifications are configured (see notifications.go) we also check a payment as soon as one of
+// its transactions shows up in the mempool or a block, instead of waiting for the next poll.
+
+const relayCheckInterval = 5 * time.Minute
+
+type relayer struct {
+	dataDir       string
+	openWallet    walletOpener
+	checkInterval time.Duration // how often we poll each payment, relayCheckInterval except in tests
+	zmqRawTx      string
+	zmqHashBlock  string
+	feeBump       FeeBumpConfig
+	metrics       *metrics
+	webhooks      *webhooks
+	unlocker      *unlocker
+	wg            sync.WaitGroup
+
+	mu       sync.Mutex // guards watching, and writing states
+	watching map[string]*watchedPayment
+}
+
+// watchedPayment is what the relayer knows about a payment it's watching
+type watchedPayment struct {
+	paymentId    string
+	finalTxId    string
+	finalTxHash  chainhash.Hash
+	createdAt    time.Time
+	templateTx   *wire.MsgTx
+	templateTxId string
+	logger       *slog.Logger
+	state        string
+
+	wake   chan struct{} // a notification says it's worth checking now
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// watch starts monitoring a payment in the background. It stops when the payment is resolved or ctx is cancelled
+func (r *relayer) watch(ctx context.Context, paymentId string, finalTxId string, templateTx *wire.MsgTx, state string) {
+	p := &watchedPayment{
+		paymentId:    paymentId,
+		finalTxId:    finalTxId,
+		templateTx:   templateTx,
+		templateTxId: templateTx.TxHash().String(),
+		logger:       util.LoggerFrom(ctx),
+		wake:         make(chan struct{}, 1),
+		createdAt:    time.Now(),
+	}
+	if hash, err := chainhash.NewHashFromStr(finalTxId); err == nil {
+		p.finalTxHash = *hash
+	}
+	if info, err := os.Stat(filepath.Join(r.dataDir, finalTxId, amountFile)); err == nil {
+		p.createdAt = info.ModTime() // we might be resuming
+	}
+	p.ctx, p.cancel = context.WithCancel(ctx)
+
+	r.mu.Lock()
+	if r.watching == nil {
+		r.watching = make(map[string]*watchedPayment)
+	}
+	r.watching[finalTxId] = p
+	r.mu.Unlock()
+
+	r.setState(p, state)
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer func() {
+			r.mu.Lock()
+			delete(r.watching, finalTxId)
+			r.mu.Unlock()
+		}()
+
+		timer := time.NewTimer(r.checkInterval)
+		defer timer.Stop()
+
+		for {
+			fallback := false
+			select {
+			case <-p.ctx.Done():
+				return // our state is on disk, we'll resume next time
+			case <-p.wake:
+			case <-timer.C:
+				fallback = true
+				timer.Reset(r.checkInterval)
+			}
+
+			if !r.check(p, fallback) {
+				return
+			}
+		}
+	}()
+}
+
+// check returns true if we should keep watching. Only when fallback is set (i.e. we've given the sender a whole
+// checkInterval) will it broadcast the template transaction. We're going to open the wallet each time (instead of
+// keeping it around) so we don't keep the bitcoinRpc connection open overly long
+func (r *relayer) check(p *watchedPayment, fallback bool) bool {
+	w, closeWallet, err := r.openWallet()
+	if err != nil {
+		p.logger.Error("could not open the wallet, will try again later", "err", err)
+		return true
+	}
+	defer closeWallet()
+
+	templateTxId := p.templateTxId
+	templateTxHash := p.templateTx.TxHash()
+
+	// Both transactions pay our wallet, so the wallet can tell us if either confirmed. If we can't ask bitcoind
+	// something we try again later, rather than take it as a no: that could look just like a double-spend
+	for _, txHash := range []chainhash.Hash{p.finalTxHash, templateTxHash} {
+		txid := txHash.String()
+		confirmed, err := w.confirmed(txHash)
+		if err != nil {
+			p.logger.Warn("could not check if the payment confirmed, will try again later", "txid", txid, "err", err)
+			return true
+		}
+		if confirmed {
+			p.logger.Info("payment confirmed", "txid", txid)
+			r.setState(p, StateConfirmed)
+			r.notify(p, EventPaymentConfirmed, txid)
+			if txid == templateTxId {
+				r.releaseContribution(w, p.finalTxId, p.logger)
+			}
+			return false
+		}
+	}
+
+	// the final transaction has the same outputs as the template, just with more paying us
+	finalInMempool, err := w.inMempool(p.finalTxHash, len(p.templateTx.TxOut))
+	if err != nil {
+		p.logger.Warn("could not check the mempool for the final transaction, will try again later", "err", err)
+		return true
+	}
+	if finalInMempool {
+		if p.state != StateInMempool {
+			p.logger.Info("finalized transaction found in mempool, monitoring the situation")
+			r.setState(p, StateInMempool)
+			r.metrics.paymentsFinalized.Inc()
+			r.notify(p, EventPaymentInMempool, p.finalTxId)
+		}
+
+		if bitcoindWallet, ok := w.(unlockingWallet); ok { // Validate doesn't allow fee bumping with the built-in wallet
+			childTxId, err := r.maybeBumpFee(bitcoindWallet.RpcClient, p)
+			if err != nil {
+				p.logger.Warn("could not bump the fee of the final transaction", "err", err)
+			} else if childTxId != "" {
+				p.logger.Info("bumped the fee of the final transaction", "child_txid", childTxId)
+				r.metrics.paymentsFeeBumped.Inc()
+				r.notify(p, EventFeeBumped, childTxId)
+			}
+		}
+		return true
+	}
+
+	templateInMempool, err := w.inMempool(templateTxHash, len(p.templateTx.TxOut))
+	if err != nil {
+		p.logger.Warn("could not check the mempool for the template transaction, will try again later", "err", err)
+		return true
+	}
+	if templateInMempool {
+		r.setState(p, StateTemplateBroadcast)
+		return true // waiting for it to confirm
+	}
+
+	// Neither is in the mempool or a block, so if the template's inputs are spent it's by something else
+	doubleSpent, err := r.doubleSpent(w, p)
+	if err != nil {
+		p.logger.Warn("could not check if the template's inputs are spent, will try again later", "err", err)
+		return true
+	}
+	if doubleSpent {
+		p.logger.Warn("template transaction's inputs were double-spent, giving up on the payment")
+		r.setState(p, StateDoubleSpent)
+		r.metrics.paymentsDoubleSpent.Inc()
+		r.notify(p, EventDoubleSpent, "")
+		r.releaseContribution(w, p.finalTxId, p.logger)
+		return false
+	}
+
+	if !fallback {
+		return true
+	}
+
+	// The finalized transaction isn't in the mempool and hasn't confirmed, so probably was never created (or got
+	// evicted). So we'll send the original.
+
+	_, err = w.SendRawTransaction(p.templateTx)
+	if err != nil && errors.Cause(err) != rpc_client.ErrTxRejected {
+		p.logger.Warn("could not broadcast the template transaction, will try again later", "err", err)
+		return true
+	}
+	if err != nil {
+		p.logger.Warn("finalized transaction not in mempool, and template transaction didn't send either", "err", err)
+		r.setState(p, StateFailed)
+		r.releaseContribution(w, p.finalTxId, p.logger)
+		return false // nothing more we can do
+	}
+
+	p.logger.Warn("finalized transaction not in mempool, broadcast the template transaction instead")
+	r.templateBroadcast(w, p)
+	return true // now wait for the template to confirm
+}
+
+// templateBroadcast is for once we've broadcast p's template transaction: the final transaction can no longer
+// happen, so our contribution is released, and we wait for the template to confirm instead
+func (r *relayer) templateBroadcast(w serverWallet, p *watchedPayment) {
+	r.releaseContribution(w, p.finalTxId, p.logger)
+	r.metrics.paymentsFallback.Inc()
+	r.setState(p, StateTemplateBroadcast)
+	r.notify(p, EventTemplateBroadcast, p.templateTxId)
+}
+
+// rebroadcastTemplate broadcasts payment's template transaction now, e.g. because an operator asked to, and from
+// then on it's treated just like when the relay loop falls back to the template. If we weren't watching the payment
+// we start again (until the template confirms), unless ctx is nil
+func (r *relayer) rebroadcastTemplate(ctx context.Context, payment *Payment) (*chainhash.Hash, error) {
+	w, closeWallet, err := r.openWallet()
+	if err != nil {
+		return nil, err
+	}
+	defer closeWallet()
+
+	txid, err := w.SendRawTransaction(payment.Template)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	p, ok := r.watching[payment.FinalTxid]
+	state := payment.State
+	if ok {
+		state = p.state
+	}
+	r.mu.Unlock()
+	if state == StateTemplateBroadcast {
+		return txid, nil // we already had, this was just to be sure it's in the mempool
+	}
+	if !ok {
+		p = &watchedPayment{
+			paymentId:    payment.PaymentId,
+			finalTxId:    payment.FinalTxid,
+			templateTx:   payment.Template,
+			templateTxId: txid.String(),
+			logger:       util.Logger.With("payment_id", payment.PaymentId, "final_txid", payment.FinalTxid),
+			state:        state,
+			ctx:          context.Background(),
+		}
+	}
+	r.templateBroadcast(w, p)
+
+	if !ok && ctx != nil {
+		r.watch(util.WithLogger(ctx, p.logger), payment.PaymentId, payment.FinalTxid, payment.Template, StateTemplateBroadcast)
+	}
+	return txid, nil
+}
+
+// doubleSpent is whether any of the template's inputs are spent, which (when neither transaction is in the mempool
+// or a block) means by something else
+func (r *relayer) doubleSpent(w serverWallet, p *watchedPayment) (bool, error) {
+	for _, txIn := range p.templateTx.TxIn {
+		spent, err := w.IsSpent(txIn.PreviousOutPoint)
+		if err != nil {
+			return false, errors.Wrapf(err, "input %v", txIn.PreviousOutPoint)
+		}
+		if spent {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// releaseContribution makes the input we contributed spendable again. If the wallet ever saw the final transaction
+// it'll consider the input spent until the transaction is abandoned
+func (r *relayer) releaseContribution(w serverWallet, finalTxId string, logger *slog.Logger) {
+	if err := w.abandon(finalTxId); err != nil {
+		logger.Debug("did not abandon final transaction", "err", err) // most likely the wallet never saw it
+	}
+
+	outpoint, err := readContributedInput(filepath.Join(r.dataDir, finalTxId))
+	if err != nil {
+		logger.Debug("no contributed input to unlock", "err", err) // from before we locked them
+		return
+	}
+	if err := w.UnlockUnspent(*outpoint); err != nil {
+		logger.Debug("could not unlock contributed input", "outpoint", outpoint.String(), "err", err) // e.g. bitcoind restarted
+		return
+	}
+	logger.Debug("unlocked contributed input", "outpoint", outpoint.String())
+}
+
+// setState persists the payment's state, unless we've since stopped watching it (e.g. it was resolved)
+func (r *relayer) setState(p *watchedPayment, state string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if p.ctx.Err() != nil || p.state == state {
+		return
+	}
+	p.state = state
+
+	if err := writeRelayState(filepath.Join(r.dataDir, p.finalTxId), state); err != nil {
+		p.logger.Error("could not persist relay state", "state", state, "err", err)
+	}
+}
+
+// resolve stops watching a payment (if we are), unlocks our contribution and marks it as resolved
+func (r *relayer) resolve(finalTxId string) error {
+	r.mu.Lock()
+	if p, ok := r.watching[finalTxId]; ok {
+		p.cancel()
+	}
+	err := writeRelayState(filepath.Join(r.dataDir, finalTxId), StateResolved)
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	w, closeWallet, err := r.openWallet()
+	if err != nil {
+		return err
+	}
+	defer closeWallet()
+
+	r.releaseContribution(w, finalTxId, util.Logger.With("final_txid", finalTxId))
+	return nil
+}
+
+func (r *relayer) notify(p *watchedPayment, eventType string, txid string) {
+	err := r.webhooks.notify(WebhookEvent{
+		Type:         eventType,
+		PaymentId:    p.paymentId,
+		FinalTxid:    p.finalTxId,
+		TemplateTxid: p.templateTxId,
+		Txid:         txid,
+	})
+	if err != nil {
+		p.logger.Error("could not queue webhook", "event", eventType, "err", err)
+	}
+}
+
+// pokeTx wakes up the watcher of any payment that tx belongs to, or conflicts with
+func (r *relayer) pokeTx(tx *wire.MsgTx) {
+	txid := tx.TxHash().String()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, p := range r.watching {
+		if p.finalTxId == txid || p.templateTxId == txid || spendsInputOf(tx, p.templateTx) {
+			p.logger.Debug("woken by notification", "txid", txid)
+			p.poke()
+		}
+	}
+}
+
+func spendsInputOf(tx *wire.MsgTx, other *wire.MsgTx) bool {
+	for _, txIn := range tx.TxIn {
+		for _, otherIn := range other.TxIn {
+			if txIn.PreviousOutPoint == otherIn.PreviousOutPoint {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pokeAll wakes up every watcher, e.g. when there's a new block
+func (r *relayer) pokeAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, p := range r.watching {
+		p.poke()
+	}
+}
+
+func (p *watchedPayment) poke() {
+	select {
+	case p.wake <- struct{}{}:
+	default: // already going to check
+	}
+}
+
+// resume starts watching every payment that was still pending when we were last running
+func (r *relayer) resume(ctx context.Context) error {
+	entries, err := ioutil.ReadDir(r.dataDir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	w, closeWallet, err := r.openWallet()
+	if err != nil {
+		util.LoggerFrom(ctx).Warn("could not open the wallet to relock contributed inputs", "err", err)
+	} else {
+		defer closeWallet()
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		txDir := filepath.Join(r.dataDir, entry.Name())
+
+		state, err := readRelayState(txDir)
+		if err != nil || !watching(state) {
+			continue
+		}
+
+		templateTx, err := readTransactionFile(filepath.Join(txDir, templateTxFile))
+		if err != nil {
+			util.LoggerFrom(ctx).Warn("could not read template transaction of pending payment", "final_txid", entry.Name(), "err", err)
+			continue
+		}
+
+		paymentId := readPaymentId(txDir)
+		logger := util.LoggerFrom(ctx).With("payment_id", paymentId, "final_txid", entry.Name())
+		logger.Debug("resuming relay of payment", "state", state)
+
+		// only while we're waiting for the final transaction, after that it's either spent or not ours to keep
+		if state == StatePending && w != nil {
+			r.relock(w, txDir, logger)
+		}
+		r.watch(util.WithLogger(ctx, logger), paymentId, entry.Name(), templateTx, state)
+	}
+
+	return nil
+}
+
+// relock takes the lock on a pending payment's contributed input again, which bitcoind forgets when it restarts
+func (r *relayer) relock(w serverWallet, txDir string, logger *slog.Logger) {
+	outpoint, err := readContributedInput(txDir)
+	if err != nil {
+		return // from before we locked them
+	}
+	spent, err := w.IsSpent(*outpoint)
+	if err != nil || spent {
+		return
+	}
+	if err := w.LockUnspent(*outpoint); err != nil {
+		logger.Debug("did not lock contributed input", "outpoint", outpoint.String(), "err", err) // probably still locked
+	}
+}
+
+func (r *relayer) wait() {
+	r.wg.Wait()
+}
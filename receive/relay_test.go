@@ -0,0 +1,173 @@
+package receive
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/rhavar/bustapay/util"
+)
+
+// relayTest is a pending payment, for calling relayer.check on directly
+type relayTest struct {
+	r           *relayer
+	p           *watchedPayment
+	template    *wire.MsgTx
+	final       *wire.MsgTx
+	contributed wire.OutPoint
+}
+
+func newRelayTest(t *testing.T, bitcoind *fakeBitcoind) *relayTest {
+	contributed := testOutpoint(2, 1)
+	template, partial := testPayment(testOutpoint(1, 0), contributed)
+	r := testRelayer(t, bitcoind, time.Hour, "")
+	finalTxId := writeTestPayment(t, r.dataDir, template, partial, contributed, StatePending)
+
+	p := &watchedPayment{
+		paymentId:    "test-payment",
+		finalTxId:    finalTxId,
+		finalTxHash:  partial.TxHash(),
+		templateTx:   template,
+		templateTxId: template.TxHash().String(),
+		logger:       util.Logger,
+		state:        StatePending,
+		ctx:          context.Background(),
+		createdAt:    time.Now(),
+	}
+	return &relayTest{r: r, p: p, template: template, final: partial, contributed: contributed}
+}
+
+// check runs a check (falling back to the template if it comes to that), and makes sure it's left in state
+func (rt *relayTest) check(t *testing.T, keepWatching bool, state string) {
+	t.Helper()
+	if rt.r.check(rt.p, true) != keepWatching {
+		t.Errorf("check says keep watching is %v", !keepWatching)
+	}
+	onDisk, err := readRelayState(filepath.Join(rt.r.dataDir, rt.p.finalTxId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if onDisk != state {
+		t.Errorf("payment is %v, want %v", onDisk, state)
+	}
+}
+
+func (rt *relayTest) released(bitcoind *fakeBitcoind) bool {
+	for _, outpoint := range bitcoind.unlockedOutpoints() {
+		if outpoint == rt.contributed {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRelayStillInMempool(t *testing.T) {
+	bitcoind := newFakeBitcoind(t)
+	rt := newRelayTest(t, bitcoind)
+	bitcoind.addToMempool(rt.final)
+
+	rt.check(t, true, StateInMempool)
+	rt.check(t, true, StateInMempool)
+	if bitcoind.callCount("sendrawtransaction") != 0 {
+		t.Error("broadcast the template while the final transaction is in the mempool")
+	}
+	if rt.released(bitcoind) {
+		t.Error("released our contribution while the final transaction is in the mempool")
+	}
+}
+
+func TestRelayTemplateConfirmed(t *testing.T) {
+	bitcoind := newFakeBitcoind(t)
+	rt := newRelayTest(t, bitcoind)
+	bitcoind.confirm(rt.template)
+
+	rt.check(t, false, StateConfirmed)
+	if !rt.released(bitcoind) {
+		t.Error("didn't release our contribution once the template confirmed")
+	}
+}
+
+func TestRelayDoubleSpent(t *testing.T) {
+	bitcoind := newFakeBitcoind(t)
+	rt := newRelayTest(t, bitcoind)
+
+	// something else spends the template's input
+	conflict := wire.NewMsgTx(2)
+	conflict.AddTxIn(wire.NewTxIn(&rt.template.TxIn[0].PreviousOutPoint, nil, nil))
+	conflict.AddTxOut(wire.NewTxOut(1000, []byte{0x51}))
+	bitcoind.addToMempool(conflict)
+
+	rt.check(t, false, StateDoubleSpent)
+	if bitcoind.callCount("sendrawtransaction") != 0 {
+		t.Error("broadcast a template that's been double-spent")
+	}
+	if !rt.released(bitcoind) {
+		t.Error("didn't release our contribution after a double-spend")
+	}
+}
+
+// With neither transaction anywhere we fall back to the template, and if bitcoind won't take that there's nothing
+// more to be done
+func TestRelayTemplateRejected(t *testing.T) {
+	bitcoind := newFakeBitcoind(t)
+	rt := newRelayTest(t, bitcoind)
+	bitcoind.rejecting[rt.template.TxHash().String()] = true
+
+	rt.check(t, false, StateFailed)
+	if !rt.released(bitcoind) {
+		t.Error("didn't release our contribution when the template was rejected")
+	}
+}
+
+// Not being able to ask bitcoind isn't the same as it saying no, so we don't fall back (or give up) until it answers
+func TestRelayRetriesRpcErrors(t *testing.T) {
+	for _, method := range []string{"gettransaction", "getmempoolentry", "gettxout", "sendrawtransaction"} {
+		bitcoind := newFakeBitcoind(t)
+		rt := newRelayTest(t, bitcoind)
+		bitcoind.fail(method, true)
+
+		rt.check(t, true, StatePending)
+		if bitcoind.callCount("sendrawtransaction") != 0 && method != "sendrawtransaction" {
+			t.Errorf("with %v failing, broadcast the template", method)
+		}
+		if rt.released(bitcoind) {
+			t.Errorf("with %v failing, released our contribution", method)
+		}
+
+		// and once it answers, it carries on as usual
+		bitcoind.fail(method, false)
+		rt.check(t, true, StateTemplateBroadcast)
+	}
+}
+
+// bitcoind forgets locks when it restarts, so the inputs of payments we're still waiting on are locked again when we
+// start back up. Not ones that are already spent, or that we've given up on
+func TestResumeRelocks(t *testing.T) {
+	bitcoind := newFakeBitcoind(t)
+	r := testRelayer(t, bitcoind, time.Hour, "")
+
+	pending := testOutpoint(2, 1)
+	template, partial := testPayment(testOutpoint(1, 0), pending)
+	writeTestPayment(t, r.dataDir, template, partial, pending, StatePending)
+
+	spent := testOutpoint(4, 0)
+	template, partial = testPayment(testOutpoint(3, 0), spent)
+	writeTestPayment(t, r.dataDir, template, partial, spent, StatePending)
+	bitcoind.addToMempool(partial)
+
+	broadcast := testOutpoint(6, 0)
+	template, partial = testPayment(testOutpoint(5, 0), broadcast)
+	writeTestPayment(t, r.dataDir, template, partial, broadcast, StateTemplateBroadcast)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer r.wait()
+	defer cancel()
+	if err := r.resume(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if locked := bitcoind.lockedOutpoints(); len(locked) != 1 || locked[0] != pending {
+		t.Errorf("relocked %v, want just %v", locked, pending)
+	}
+}
@@ -0,0 +1,313 @@
+package receive
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+	"github.com/rhavar/bustapay/rpc-client"
+	"github.com/rhavar/bustapay/util"
+	"github.com/rhavar/bustapay/wallet"
+)
+
+// Config is everything a Server needs to run. Use DefaultConfig() and override what you need
+type Config struct {
+	Addr    string // address to listen on, e.g. ":8080"
+	DataDir string // where payment records are stored, e.g. ~/.bustapay/data
+	Rpc     rpc_client.Config
+
+	// bustapay's own wallet to receive with, instead of bitcoind's (then Rpc is only used for zmq, if at all, and not
+	// even that if it's on an electrum server). It's shared by anything using it, so tenants can't inherit it
+	DescriptorWallet *wallet.Wallet
+
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration // needs to be long enough to cover signing with bitcoind
+	IdleTimeout  time.Duration
+
+	DisableAutoRelay bool // don't watch for, and broadcast, template transactions
+
+	// only contribute unspents of the same script type as the template's inputs, otherwise refuse the payjoin (and
+	// broadcast the template). See Receiver.RequireMatchingInputs
+	RequireMatchingInputs bool
+
+	// sign contributed inputs with this instead of the wallet (see Receiver.Signer). SignerTimeout needs to be less
+	// than WriteTimeout, or the sender will have gone by the time it's signed
+	Signer        Signer
+	SignerTimeout time.Duration
+
+	// how many unspents the wallet needs to have (to contribute) to be ready, see health.go
+	MinUnspents int
+
+	// if the wallet is encrypted, its passphrase, so it can be unlocked (for at most UnlockTimeout) whenever we sign.
+	// Without one an encrypted wallet needs a Signer, or Start fails
+	WalletPassphrase PassphraseSource
+	UnlockTimeout    time.Duration
+
+	// bitcoind's -zmqpubrawtx and -zmqpubhashblock endpoints, e.g. tcp://127.0.0.1:28332. Optional, but without them
+	// we only notice what happens to payments when we poll
+	ZmqRawTx     string
+	ZmqHashBlock string
+
+	FeeBump FeeBumpConfig
+
+	Webhooks WebhookConfig
+
+	AdminAddr  string // if set, where to serve the admin api, /readyz and /metrics. Keep this private!
+	AdminToken string // required for the admin api
+
+	// Tenants, if any, are the stores this server receives for (see tenant.go). Rpc's wallet and DataDir aren't
+	// used directly then, only by tenants that don't set their own
+	Tenants []TenantConfig
+}
+
+func DefaultConfig() Config {
+	bustapayDir := ".bustapay"
+	if home, err := homedir.Dir(); err == nil {
+		bustapayDir = filepath.Join(home, ".bustapay")
+	}
+
+	return Config{
+		Addr:          ":8080",
+		DataDir:       filepath.Join(bustapayDir, "data"),
+		ReadTimeout:   10 * time.Second,
+		WriteTimeout:  30 * time.Second,
+		IdleTimeout:   60 * time.Second,
+		SignerTimeout: 20 * time.Second,
+		UnlockTimeout: 10 * time.Second,
+		MinUnspents:   1,
+		FeeBump: FeeBumpConfig{
+			ConfTarget: 6,
+			MaxFeeRate: 100,
+		},
+		Webhooks: WebhookConfig{
+			OutboxDir:   filepath.Join(bustapayDir, "outbox"),
+			MaxAttempts: 20,
+		},
+	}
+}
+
+// Validate checks the config makes sense, with errors that say what to change. Start does this too
+func (c Config) Validate() error {
+	if c.AdminAddr != "" && c.AdminToken == "" {
+		return errors.New("an admin token is required to serve the admin api")
+	}
+	if err := validateTenants(c); err != nil {
+		return err
+	}
+
+	tenants := []Config{c}
+	if len(c.Tenants) > 0 {
+		tenants = nil
+		for _, tc := range c.Tenants {
+			tenants = append(tenants, tc.Apply(c))
+		}
+	}
+	for _, config := range tenants {
+		if config.DataDir == "" {
+			return errors.New("a data dir is required")
+		}
+		if config.MinUnspents < 0 {
+			return errors.New("the minimum number of unspents can't be negative")
+		}
+		if len(config.Webhooks.Urls) > 0 && config.Webhooks.Secret == "" {
+			return errors.New("a webhook secret is required when using webhooks")
+		}
+		if config.Signer != nil && config.WriteTimeout > 0 && config.SignerTimeout >= config.WriteTimeout {
+			return errors.Errorf("the signer timeout (%v) needs to be less than the write timeout (%v), or the sender will have given up by the time it's signed",
+				config.SignerTimeout, config.WriteTimeout)
+		}
+		if config.DescriptorWallet != nil {
+			if config.FeeBump.After > 0 {
+				return errors.New("fee bumping needs bitcoind's wallet, it can't be used with a descriptor wallet")
+			}
+			if config.WalletPassphrase != nil {
+				return errors.New("a descriptor wallet isn't encrypted, so there shouldn't be a wallet passphrase")
+			}
+		}
+		if config.FeeBump.After > 0 {
+			if config.FeeBump.ConfTarget < 1 {
+				return errors.New("the fee bump confirmation target needs to be at least 1 block")
+			}
+			if config.FeeBump.MaxFeeRate <= 0 {
+				return errors.New("the fee bump max feerate needs to be more than 0")
+			}
+		}
+	}
+	return nil
+}
+
+// Server is a bustapay receive server. Unlike the old StartServer it has its own mux, so it can be
+// embedded in another program, and can be stopped cleanly with Shutdown
+type Server struct {
+	config      Config
+	httpServer  *http.Server
+	adminServer *http.Server
+	tenants     []*tenant // just one, called "", if Config.Tenants is empty
+	metrics     *metrics
+
+	// proposals that are currently being created (and signed). Shutdown waits on these so we never
+	// leave a half written payment directory behind
+	proposals sync.WaitGroup
+
+	relayCtx     context.Context
+	cancelRelays context.CancelFunc
+}
+
+func NewServer(config Config) *Server {
+	m := newMetrics()
+	config.Rpc.Observer = m.observeRpc
+
+	s := &Server{
+		config:  config,
+		metrics: m,
+	}
+	if len(config.Tenants) == 0 {
+		s.tenants = []*tenant{newTenant("", "", config, m)}
+	}
+	for _, tc := range config.Tenants {
+		s.tenants = append(s.tenants, newTenant(tc.Name, tc.Host, tc.Apply(config), m))
+	}
+	// here rather than in Start, registering twice would panic
+	for _, t := range s.tenants {
+		m.watchUnspents(t.name, t.openWallet)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.route)
+	mux.HandleFunc("/healthz", s.healthz)
+
+	s.httpServer = &http.Server{
+		Addr:         config.Addr,
+		Handler:      mux,
+		ReadTimeout:  config.ReadTimeout,
+		WriteTimeout: config.WriteTimeout,
+		IdleTimeout:  config.IdleTimeout,
+	}
+
+	if config.AdminAddr != "" {
+		s.adminServer = &http.Server{
+			Addr:         config.AdminAddr,
+			Handler:      s.adminHandler(),
+			ReadTimeout:  config.ReadTimeout,
+			WriteTimeout: config.WriteTimeout,
+			IdleTimeout:  config.IdleTimeout,
+		}
+	}
+
+	return s
+}
+
+// Start binds the listening socket and serves in the background. It also resumes watching any payments
+// that were still pending relay when we were last shutdown. The relays run until ctx is cancelled
+// or Shutdown is called
+func (s *Server) Start(ctx context.Context) error {
+	if err := s.config.Validate(); err != nil {
+		return err
+	}
+	for _, t := range s.tenants {
+		if err := os.MkdirAll(t.config.DataDir, 0700); err != nil {
+			return errors.WithStack(err)
+		}
+		if err := t.checkWallet(); err != nil {
+			return err
+		}
+	}
+
+	listener, err := net.Listen("tcp", s.config.Addr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	util.Logger.Info("listening", "addr", listener.Addr().String())
+
+	var adminListener net.Listener
+	if s.adminServer != nil {
+		adminListener, err = net.Listen("tcp", s.config.AdminAddr)
+		if err != nil {
+			listener.Close()
+			return errors.WithStack(err)
+		}
+		util.Logger.Info("admin api listening", "addr", adminListener.Addr().String())
+	}
+
+	s.relayCtx, s.cancelRelays = context.WithCancel(ctx)
+
+	for _, t := range s.tenants {
+		if err := t.webhooks.start(s.relayCtx); err != nil {
+			s.cancelRelays()
+			listener.Close()
+			if adminListener != nil {
+				adminListener.Close()
+			}
+			return err
+		}
+	}
+
+	for _, t := range s.tenants {
+		if t.config.DisableAutoRelay {
+			continue
+		}
+		relayCtx := s.relayCtx
+		if t.name != "" {
+			relayCtx = util.WithLogger(relayCtx, util.Logger.With("tenant", t.name))
+		}
+		if err := t.relayer.resume(relayCtx); err != nil {
+			util.Logger.Warn("could not resume pending relays", "tenant", t.name, "err", err)
+		}
+		t.relayer.listen(relayCtx)
+	}
+
+	go func() {
+		if err := s.httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			util.Logger.Error("http server stopped", "err", err)
+		}
+	}()
+
+	if adminListener != nil {
+		go func() {
+			if err := s.adminServer.Serve(adminListener); err != nil && err != http.ErrServerClosed {
+				util.Logger.Error("admin http server stopped", "err", err)
+			}
+		}()
+	}
+
+	return nil
+}
+
+// Shutdown stops accepting new requests, waits for in-flight proposals to finish signing and then stops
+// the relay watchers. Their state is on disk, so they'll be picked back up by the next Start
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.httpServer.Shutdown(ctx)
+	if s.adminServer != nil {
+		if adminErr := s.adminServer.Shutdown(ctx); err == nil {
+			err = adminErr
+		}
+	}
+
+	if s.cancelRelays != nil {
+		s.cancelRelays()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.proposals.Wait()
+		for _, t := range s.tenants {
+			t.relayer.wait()
+			t.webhooks.wait()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return errors.New("timed out waiting for pending proposals and relays to finish")
+	}
+
+	return errors.WithStack(err)
+}
@@ -0,0 +1,97 @@
+package receive
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// startTestServer starts a server on bitcoind, returning where it's listening
+func startTestServer(t *testing.T, bitcoind *fakeBitcoind) (*Server, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	config := DefaultConfig()
+	config.Addr = addr
+	config.DataDir = t.TempDir()
+	config.Rpc = bitcoind.rpcConfig()
+	s := NewServer(config)
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return s, addr
+}
+
+// A request that's being handled when we're asked to shut down is finished first, and nothing new is taken
+func TestShutdownDrains(t *testing.T) {
+	bitcoind := newFakeBitcoind(t)
+	s, addr := startTestServer(t, bitcoind)
+	arrived, release := bitcoind.hold("getnewaddress")
+	t.Cleanup(release)
+
+	responded := make(chan int, 1)
+	go func() {
+		response, err := http.Get("http://" + addr + "/get-newish-address")
+		if err != nil {
+			t.Error(err)
+			responded <- 0
+			return
+		}
+		response.Body.Close()
+		responded <- response.StatusCode
+	}()
+	<-arrived
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		shutdown <- s.Shutdown(ctx)
+	}()
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shut down with a request still being handled: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Error("still taking connections while shutting down")
+	}
+
+	release()
+	if code := <-responded; code != http.StatusOK {
+		t.Errorf("the request being handled got %v", code)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("shutdown: %v", err)
+	}
+}
+
+// But not forever
+func TestShutdownTimesOut(t *testing.T) {
+	bitcoind := newFakeBitcoind(t)
+	s, addr := startTestServer(t, bitcoind)
+	arrived, release := bitcoind.hold("getnewaddress")
+	t.Cleanup(release)
+
+	go func() {
+		if response, err := http.Get("http://" + addr + "/get-newish-address"); err == nil {
+			response.Body.Close()
+		}
+	}()
+	<-arrived
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err == nil {
+		t.Error("shutdown says it's done with a request still being handled")
+	}
+}
@@ -0,0 +1,71 @@
+package receive
+
+import (
+	"context"
+	"time"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+	"github.com/rhavar/bustapay/psbt"
+	"github.com/rhavar/bustapay/util"
+)
+
+// Signer signs the contributed input when the wallet doesn't have its keys (e.g. a watch-only wallet). The signer
+// package has some ready made ones
+type Signer interface {
+	// SignPsbt returns packet with input signed and finalized. Anything else it signs is ignored
+	SignPsbt(ctx context.Context, packet *psbt.Packet, input int) (*psbt.Packet, error)
+}
+
+// SignerError is returned by CreateProposal when the Signer failed, or took too long
+type SignerError struct {
+	Err error
+}
+
+func (e *SignerError) Error() string {
+	return "external signer: " + e.Err.Error()
+}
+
+// signExternally is SignInputsWithWallet, for when it's a Signer doing the signing
+func (r *Receiver) signExternally(ctx context.Context, tx *wire.MsgTx, input int, prevOuts txscript.PrevOutputFetcher) (*wire.MsgTx, error) {
+	// what every input spends, not just ours, or the signer can't sign taproot
+	packet := psbt.New(tx)
+	for i, txIn := range tx.TxIn {
+		packet.Inputs[i].WitnessUtxo = prevOuts.FetchPrevOutput(txIn.PreviousOutPoint)
+	}
+
+	// A watch-only wallet still knows the input's derivation path (and redeem script), which signers need
+	packet, _, err := r.Wallet.WalletProcessPsbt(packet, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.SignerTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.SignerTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	signed, err := r.Signer.SignPsbt(ctx, packet, input)
+	if err != nil {
+		return nil, &SignerError{Err: err}
+	}
+	util.LoggerFrom(ctx).Debug("external signer signed", "duration", time.Since(start))
+
+	if signed.UnsignedTx.TxHash() != packet.UnsignedTx.TxHash() {
+		return nil, &SignerError{Err: errors.New("signer changed the transaction")}
+	}
+	if !signed.Inputs[input].IsFinalized() {
+		return nil, &SignerError{Err: errors.Errorf("signer didn't sign input %v", input)}
+	}
+
+	result := tx.Copy()
+	result.TxIn[input].SignatureScript = signed.Inputs[input].FinalScriptSig
+	result.TxIn[input].Witness = signed.Inputs[input].FinalScriptWitness
+	if err := util.VerifyInput(result, input, prevOuts); err != nil {
+		return nil, &SignerError{Err: err}
+	}
+	return result, nil
+}
@@ -0,0 +1,222 @@
+package receive
+
+import (
+	"net"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/pkg/errors"
+	"github.com/rhavar/bustapay/wallet"
+)
+
+// A server can receive for several stores (tenants) at once. Each has its own wallet (bitcoind's, or a descriptor
+// wallet), so they never contribute each other's unspents, its own data directory and webhooks, and can have stricter policies than the
+// server's. Requests are for a tenant if they're to its Host, or under /<Name>, e.g.
+//
+//    POST /store1                          a proposal for store1
+//    GET  /store1/get-newish-address
+//
+// Without any tenants configured the server is a single tenant, using Config as is and serving at /
+
+// TenantConfig is one store a multi-tenant server receives for. Anything not here comes from the server's Config
+type TenantConfig struct {
+	Name   string // letters, numbers, - and _, used in urls, logs and the default DataDir
+	Host   string // optional, e.g. pay.store1.com
+	Wallet string // bitcoind wallet to use, i.e. rpc calls go to /wallet/<Wallet>. Unique per tenant
+
+	// or bustapay's own wallet, see Config.DescriptorWallet. One of them is required
+	DescriptorWallet *wallet.Wallet
+
+	DataDir string // where its payments are stored, Config.DataDir/<Name> if empty
+
+	// these are on top of the server's, so Config can turn them on for everyone
+	RequireMatchingInputs bool
+	DisableAutoRelay      bool
+
+	FeeBump *FeeBumpConfig // nil to use Config.FeeBump
+
+	// Unlike the rest these aren't inherited from Config, a signer or webhook for one store shouldn't see another's
+	// payments (and each wallet has its own passphrase). Webhooks.OutboxDir is Config.Webhooks.OutboxDir/<Name> if
+	// empty
+	Signer           Signer
+	WalletPassphrase PassphraseSource
+	Webhooks         WebhookConfig
+}
+
+var tenantNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Apply is the Config to use for the tenant's requests and payments
+func (tc TenantConfig) Apply(config Config) Config {
+	config.Tenants = nil
+	config.Rpc.Wallet = tc.Wallet
+	config.DescriptorWallet = tc.DescriptorWallet
+
+	if tc.DataDir != "" {
+		config.DataDir = tc.DataDir
+	} else {
+		config.DataDir = filepath.Join(config.DataDir, tc.Name)
+	}
+
+	config.RequireMatchingInputs = config.RequireMatchingInputs || tc.RequireMatchingInputs
+	config.DisableAutoRelay = config.DisableAutoRelay || tc.DisableAutoRelay
+	if tc.FeeBump != nil {
+		config.FeeBump = *tc.FeeBump
+	}
+
+	config.Signer = tc.Signer
+	config.WalletPassphrase = tc.WalletPassphrase
+	webhooks := tc.Webhooks
+	if webhooks.OutboxDir == "" {
+		webhooks.OutboxDir = filepath.Join(config.Webhooks.OutboxDir, tc.Name)
+	}
+	if webhooks.MaxAttempts == 0 {
+		webhooks.MaxAttempts = config.Webhooks.MaxAttempts
+	}
+	config.Webhooks = webhooks
+	return config
+}
+
+// validateTenants checks tenants can't be confused with each other, or share anything
+func validateTenants(config Config) error {
+	names := make(map[string]bool)
+	hosts := make(map[string]bool)
+	wallets := make(map[string]bool)
+	dataDirs := make(map[string]bool)
+	descriptorWallets := make(map[*wallet.Wallet]bool)
+	for _, tc := range config.Tenants {
+		if !tenantNameRegexp.MatchString(tc.Name) {
+			return errors.Errorf("tenant name %q should only be letters, numbers, - and _", tc.Name)
+		}
+		if tc.Name == "get-newish-address" || tc.Name == "healthz" {
+			return errors.Errorf("tenant name %q is already a path", tc.Name)
+		}
+		if (tc.Wallet == "") == (tc.DescriptorWallet == nil) {
+			return errors.Errorf("tenant %v needs its own wallet, either a bitcoind wallet or a descriptor wallet", tc.Name)
+		}
+		if tc.DescriptorWallet != nil {
+			if descriptorWallets[tc.DescriptorWallet] {
+				return errors.Errorf("tenant %v has the same descriptor wallet as another tenant", tc.Name)
+			}
+			descriptorWallets[tc.DescriptorWallet] = true
+		}
+
+		dataDir := filepath.Clean(tc.Apply(config).DataDir)
+		for _, seen := range []struct {
+			what, value string
+			in          map[string]bool
+		}{{"name", tc.Name, names}, {"host", strings.ToLower(tc.Host), hosts}, {"wallet", tc.Wallet, wallets}, {"data dir", dataDir, dataDirs}} {
+			if seen.value == "" {
+				continue
+			}
+			if seen.in[seen.value] {
+				return errors.Errorf("tenant %v has the same %v as another tenant", tc.Name, seen.what)
+			}
+			seen.in[seen.value] = true
+		}
+	}
+	return nil
+}
+
+// tenant is a store being received for, and everything that's kept separately for it
+type tenant struct {
+	name     string // "" when the server isn't multi-tenant
+	host     string
+	config   Config
+	relayer  *relayer
+	webhooks *webhooks
+	unlocker *unlocker
+	// openWallet is how everything gets at the tenant's wallet, so it doesn't matter whose it is
+	openWallet walletOpener
+
+	newishMutex       sync.Mutex
+	lastNewishAddress btcutil.Address
+
+	readyMutex    sync.Mutex
+	lastReadiness *Readiness
+}
+
+func newTenant(name string, host string, config Config, m *metrics) *tenant {
+	wh := newWebhooks(config.Webhooks)
+	u := newUnlocker(config.WalletPassphrase, config.UnlockTimeout)
+	openWallet := newWalletOpener(config, u)
+	return &tenant{
+		name:   name,
+		host:   strings.ToLower(host),
+		config: config,
+		relayer: &relayer{
+			dataDir:       config.DataDir,
+			openWallet:    openWallet,
+			checkInterval: relayCheckInterval,
+			zmqRawTx:      config.ZmqRawTx,
+			zmqHashBlock:  config.ZmqHashBlock,
+			feeBump:       config.FeeBump,
+			metrics:       m,
+			webhooks:      wh,
+			unlocker:      u,
+		},
+		webhooks:   wh,
+		unlocker:   u,
+		openWallet: openWallet,
+	}
+}
+
+// tenantFor is who r is for, and the path within the tenant
+func (s *Server) tenantFor(r *http.Request) (*tenant, string) {
+	if len(s.config.Tenants) == 0 {
+		return s.tenants[0], r.URL.Path
+	}
+
+	host := strings.ToLower(r.Host)
+	if withoutPort, _, err := net.SplitHostPort(host); err == nil {
+		host = withoutPort
+	}
+	for _, t := range s.tenants {
+		if t.host != "" && t.host == host {
+			return t, r.URL.Path
+		}
+	}
+
+	name, path := strings.TrimPrefix(r.URL.Path, "/"), "/"
+	if i := strings.IndexByte(name, '/'); i >= 0 {
+		name, path = name[:i], name[i:]
+	}
+	for _, t := range s.tenants {
+		if t.name == name {
+			return t, path
+		}
+	}
+	return nil, ""
+}
+
+// tenantNamed is the tenant called name, or the only one if name is "" and there's only one
+func (s *Server) tenantNamed(name string) *tenant {
+	if name == "" && len(s.tenants) == 1 {
+		return s.tenants[0]
+	}
+	for _, t := range s.tenants {
+		if t.name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// route sends r to the handler for whoever it's for
+func (s *Server) route(w http.ResponseWriter, r *http.Request) {
+	t, path := s.tenantFor(r)
+	if t == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// This is extremely unsuitable for production. Just for development!
+	if path == "/get-newish-address" {
+		s.getNewishAddress(t, w, r)
+		return
+	}
+	s.handler(t, w, r)
+}
@@ -0,0 +1,126 @@
+package receive
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testTenantServer(t *testing.T, bitcoind *fakeBitcoind) *Server {
+	config := DefaultConfig()
+	config.DataDir = t.TempDir()
+	config.Rpc = bitcoind.rpcConfig()
+	config.Signer = stuckSigner{}
+	config.Webhooks = WebhookConfig{Urls: []string{"http://127.0.0.1:1"}, OutboxDir: t.TempDir()}
+	config.Tenants = []TenantConfig{
+		{Name: "store1", Host: "pay.store1.com", Wallet: "wallet1"},
+		{Name: "store2", Wallet: "wallet2", RequireMatchingInputs: true},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return NewServer(config)
+}
+
+func TestTenantFor(t *testing.T) {
+	s := testTenantServer(t, newFakeBitcoind(t))
+
+	for _, test := range []struct {
+		host, path   string
+		tenant, rest string
+	}{
+		{"bustapay.example.com", "/store1", "store1", "/"},
+		{"bustapay.example.com", "/store2/get-newish-address", "store2", "/get-newish-address"},
+		{"pay.store1.com", "/", "store1", "/"},
+		{"PAY.store1.com:8080", "/get-newish-address", "store1", "/get-newish-address"},
+		// the host wins over the path, one store can't be reached through another's
+		{"pay.store1.com", "/store2", "store1", "/store2"},
+	} {
+		r := httptest.NewRequest("POST", test.path, nil)
+		r.Host = test.host
+		tenant, rest := s.tenantFor(r)
+		if tenant == nil || tenant.name != test.tenant || rest != test.rest {
+			t.Errorf("%v%v went to %+v %v, want %v %v", test.host, test.path, tenant, rest, test.tenant, test.rest)
+		}
+	}
+
+	for _, path := range []string{"/", "/store3", "/store", "/get-newish-address"} {
+		w := httptest.NewRecorder()
+		s.httpServer.Handler.ServeHTTP(w, httptest.NewRequest("POST", path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%v isn't any tenant's, but got %v", path, w.Code)
+		}
+	}
+}
+
+// Each tenant's requests only use its wallet, and its payments and webhooks are stored apart
+func TestTenantIsolation(t *testing.T) {
+	bitcoind := newFakeBitcoind(t)
+	s := testTenantServer(t, bitcoind)
+
+	w := httptest.NewRecorder()
+	s.httpServer.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/store2/get-newish-address", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("get-newish-address is %v: %v", w.Code, w.Body.String())
+	}
+	if bitcoind.walletCalls("wallet2") == 0 || bitcoind.walletCalls("wallet1") != 0 || bitcoind.walletCalls("/") != 0 {
+		t.Errorf("store2's request called wallet1 %v times, wallet2 %v times and no wallet %v times",
+			bitcoind.walletCalls("wallet1"), bitcoind.walletCalls("wallet2"), bitcoind.walletCalls("/"))
+	}
+	if s.tenants[0].lastNewishAddress != nil {
+		t.Error("store2's address is store1's too")
+	}
+
+	store1, store2 := s.tenants[0].config, s.tenants[1].config
+	for _, dirs := range [][2]string{{store1.DataDir, store2.DataDir}, {store1.Webhooks.OutboxDir, store2.Webhooks.OutboxDir}} {
+		if dirs[0] == dirs[1] || strings.HasPrefix(dirs[1], dirs[0]+string(filepath.Separator)) ||
+			strings.HasPrefix(dirs[0], dirs[1]+string(filepath.Separator)) {
+			t.Errorf("stores share %v and %v", dirs[0], dirs[1])
+		}
+	}
+	if s.tenants[0].relayer.dataDir != store1.DataDir {
+		t.Error("store1's relayer isn't using store1's data dir")
+	}
+	store2Calls := bitcoind.walletCalls("wallet2")
+	relayerWallet, closeWallet, err := s.tenants[0].relayer.openWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayerWallet.IsSpent(testOutpoint(1, 0))
+	closeWallet()
+	if bitcoind.walletCalls("wallet1") == 0 || bitcoind.walletCalls("wallet2") != store2Calls {
+		t.Error("store1's relayer isn't using store1's wallet")
+	}
+
+	// a signer for the server isn't one for every store, but policies are the least they get
+	if store1.Signer != nil || store2.Signer != nil {
+		t.Error("a tenant inherited the server's signer")
+	}
+	if store1.RequireMatchingInputs || !store2.RequireMatchingInputs {
+		t.Error("one tenant's policy applies to the other")
+	}
+}
+
+func TestValidateTenants(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		tenants []TenantConfig
+	}{
+		{"same name", []TenantConfig{{Name: "a", Wallet: "w1"}, {Name: "a", Wallet: "w2"}}},
+		{"same wallet", []TenantConfig{{Name: "a", Wallet: "w"}, {Name: "b", Wallet: "w"}}},
+		{"same host", []TenantConfig{{Name: "a", Wallet: "w1", Host: "pay.example.com"}, {Name: "b", Wallet: "w2", Host: "PAY.example.com"}}},
+		{"same data dir", []TenantConfig{{Name: "a", Wallet: "w1"}, {Name: "b", Wallet: "w2", DataDir: "/data/a/"}}},
+		{"no wallet", []TenantConfig{{Name: "a"}}},
+		{"a path as a name", []TenantConfig{{Name: "healthz", Wallet: "w"}}},
+		{"a slash in the name", []TenantConfig{{Name: "a/b", Wallet: "w"}}},
+	} {
+		config := DefaultConfig()
+		config.DataDir = "/data"
+		config.Tenants = test.tenants
+		if err := validateTenants(config); err == nil {
+			t.Errorf("tenants with %v are valid", test.name)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package receive
+
+import (
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+	"github.com/rhavar/bustapay/psbt"
+	"github.com/rhavar/bustapay/rpc-client"
+	"github.com/rhavar/bustapay/util"
+)
+
+// An encrypted wallet can't sign until it's unlocked. Rather than leave it unlocked, we unlock it (with
+// walletpassphrase) just for as long as something is signing, and lock it again as soon as nothing is. The
+// passphrase is asked for each time, so it's only in memory while it's needed. If something else (e.g. the
+// operator) already had the wallet unlocked, it's left unlocked afterwards rather than locked out from under them
+
+// PassphraseSource gives the wallet's passphrase, e.g. by reading it from a file
+type PassphraseSource func() (string, error)
+
+// unlocker unlocks a tenant's wallet for signing, if it has a passphrase
+type unlocker struct {
+	passphrase PassphraseSource
+	timeout    time.Duration
+
+	mu            sync.Mutex
+	signing       int   // how many are signing right now, the last one out locks the wallet
+	unlockedUntil int64 // getwalletinfo's unlocked_until before the first of them unlocked it, 0 if it was locked
+}
+
+func newUnlocker(passphrase PassphraseSource, timeout time.Duration) *unlocker {
+	return &unlocker{passphrase: passphrase, timeout: timeout}
+}
+
+// sign calls sign with the wallet unlocked. Without a passphrase it's just called, which is fine if the wallet
+// isn't encrypted
+func (u *unlocker) sign(rpcClient *rpc_client.RpcClient, sign func() error) error {
+	if u.passphrase == nil {
+		return sign()
+	}
+
+	if err := u.unlock(rpcClient); err != nil {
+		return err
+	}
+	defer u.lock(rpcClient)
+	return sign()
+}
+
+func (u *unlocker) unlock(rpcClient *rpc_client.RpcClient) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	passphrase, err := u.passphrase()
+	if err != nil {
+		return errors.Wrap(err, "could not get the wallet passphrase")
+	}
+
+	// while we're signing it's unlocked because of us, so it's only what it was like before the first one that counts
+	unlockedUntil := u.unlockedUntil
+	if u.signing == 0 {
+		info, err := rpcClient.GetWalletInfo()
+		if err != nil {
+			return err
+		}
+		unlockedUntil = 0
+		if info.UnlockedUntil != nil {
+			unlockedUntil = *info.UnlockedUntil
+		}
+	}
+	// and however long it was unlocked for isn't cut short (walletpassphrase takes whole seconds, so round up)
+	timeout := u.timeout
+	if unlockedUntil != 0 {
+		if remaining := time.Until(time.Unix(unlockedUntil, 0)) + time.Second; remaining > timeout {
+			timeout = remaining
+		}
+	}
+
+	// even if someone else has it unlocked, this makes sure it stays unlocked long enough for us
+	if err := rpcClient.WalletPassphrase(passphrase, timeout); err != nil {
+		return err
+	}
+	u.signing++
+	u.unlockedUntil = unlockedUntil
+	return nil
+}
+
+func (u *unlocker) lock(rpcClient *rpc_client.RpcClient) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.signing--
+	if u.signing > 0 || u.unlockedUntil != 0 {
+		return
+	}
+	// if this fails it'll still lock itself after the timeout
+	if err := rpcClient.WalletLock(); err != nil {
+		util.Logger.Warn("could not lock the wallet after signing", "err", err)
+	}
+}
+
+// check makes sure the wallet will be able to sign when there's a proposal: it's not encrypted, or we can unlock it
+// (trying the passphrase now), or there's a signer to do the signing
+func (u *unlocker) check(rpcClient *rpc_client.RpcClient, hasSigner bool) error {
+	info, err := rpcClient.GetWalletInfo()
+	if err != nil {
+		return err
+	}
+
+	encrypted := info.UnlockedUntil != nil
+	switch {
+	case !encrypted && u.passphrase != nil:
+		return errors.Wrapf(rpc_client.ErrWalletNotEncrypted, "wallet %q", info.WalletName)
+	case !encrypted || hasSigner:
+		return nil
+	case u.passphrase != nil:
+		return u.sign(rpcClient, func() error { return nil })
+	case *info.UnlockedUntil == 0:
+		return errors.Wrapf(rpc_client.ErrWalletLocked, "wallet %q", info.WalletName)
+	default:
+		util.Logger.Warn("the wallet is unlocked for now, but there's no passphrase to unlock it with again once it locks itself",
+			"wallet", info.WalletName, "until", time.Unix(*info.UnlockedUntil, 0))
+		return nil
+	}
+}
+
+// unlockingWallet is a Wallet that unlocks itself to sign
+type unlockingWallet struct {
+	*rpc_client.RpcClient
+	unlocker *unlocker
+}
+
+func (w unlockingWallet) SignInputsWithWallet(tx *wire.MsgTx, inputs []int, prevOuts txscript.PrevOutputFetcher) (signed *wire.MsgTx, err error) {
+	err = w.unlocker.sign(w.RpcClient, func() error {
+		signed, err = w.RpcClient.SignInputsWithWallet(tx, inputs, prevOuts)
+		return err
+	})
+	return signed, err
+}
+
+func (w unlockingWallet) WalletProcessPsbt(packet *psbt.Packet, sign bool) (processed *psbt.Packet, complete bool, err error) {
+	if !sign {
+		return w.RpcClient.WalletProcessPsbt(packet, sign)
+	}
+	err = w.unlocker.sign(w.RpcClient, func() error {
+		processed, complete, err = w.RpcClient.WalletProcessPsbt(packet, sign)
+		return err
+	})
+	return processed, complete, err
+}
+
+// checkWallet is for Start, so a wallet that can't sign fails now rather than on every proposal. Not being able to
+// reach bitcoind isn't fatal though, it might just be starting
+func (t *tenant) checkWallet() error {
+	if w := t.config.DescriptorWallet; w != nil {
+		if w.WatchOnly() && t.config.Signer == nil {
+			err := errors.New("the descriptor wallet is watch-only (an xpub), and there's no signer")
+			if t.name != "" {
+				return errors.Wrapf(err, "tenant %v", t.name)
+			}
+			return err
+		}
+		return nil
+	}
+
+	rpcClient, err := rpc_client.NewRpcClient(t.config.Rpc)
+	if err != nil {
+		return err
+	}
+	defer rpcClient.Shutdown()
+
+	err = t.unlocker.check(rpcClient, t.config.Signer != nil)
+	switch errors.Cause(err) {
+	case nil:
+		return nil
+	case rpc_client.ErrWalletLocked, rpc_client.ErrWrongPassphrase, rpc_client.ErrWalletNotEncrypted:
+		if t.name != "" {
+			return errors.Wrapf(err, "tenant %v", t.name)
+		}
+		return err
+	default:
+		util.Logger.Warn("could not check the wallet can sign", "tenant", t.name, "err", err)
+		return nil
+	}
+}
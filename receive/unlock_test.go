@@ -0,0 +1,64 @@
+package receive
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rhavar/bustapay/rpc-client"
+)
+
+func testUnlocker(t *testing.T, bitcoind *fakeBitcoind) (*unlocker, *rpc_client.RpcClient) {
+	t.Helper()
+	rpcClient, err := rpc_client.NewRpcClient(bitcoind.rpcConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(rpcClient.Shutdown)
+	return newUnlocker(func() (string, error) { return bitcoind.encrypted, nil }, time.Minute), rpcClient
+}
+
+// A locked wallet is locked again once the last one signing is done, not before
+func TestUnlockerRelocks(t *testing.T) {
+	bitcoind := newFakeBitcoind(t)
+	bitcoind.encrypted = "correct horse"
+	u, rpcClient := testUnlocker(t, bitcoind)
+
+	err := u.sign(rpcClient, func() error {
+		return u.sign(rpcClient, func() error {
+			if bitcoind.walletUnlockedUntil() == 0 {
+				t.Error("signing with the wallet locked")
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bitcoind.callCount("walletlock") != 1 {
+		t.Errorf("locked the wallet %v times, want once", bitcoind.callCount("walletlock"))
+	}
+	if bitcoind.walletUnlockedUntil() != 0 {
+		t.Error("left the wallet unlocked")
+	}
+}
+
+// If something else has the wallet unlocked it stays that way, for at least as long as it was going to
+func TestUnlockerLeavesUnlocked(t *testing.T) {
+	bitcoind := newFakeBitcoind(t)
+	bitcoind.encrypted = "correct horse"
+	until := time.Now().Add(time.Hour).Unix()
+	bitcoind.unlockedUntil = until
+	u, rpcClient := testUnlocker(t, bitcoind)
+
+	for i := 0; i < 2; i++ {
+		if err := u.sign(rpcClient, func() error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bitcoind.callCount("walletlock") != 0 {
+		t.Error("locked a wallet that was already unlocked")
+	}
+	if bitcoind.walletUnlockedUntil() < until {
+		t.Errorf("unlocked until %v, but it was unlocked until %v", bitcoind.walletUnlockedUntil(), until)
+	}
+}
@@ -0,0 +1,117 @@
+package receive
+
+import (
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+	"github.com/rhavar/bustapay/rpc-client"
+	"github.com/rhavar/bustapay/wallet"
+)
+
+// A tenant's wallet is either bitcoind's (unlockingWallet, through a new rpc client each time it's opened, like
+// everything else that talks to bitcoind) or bustapay's own (builtinWallet, Config.DescriptorWallet) on bitcoind or
+// an electrum server. The built-in wallet can't bump fees or be unlocked with a passphrase, Validate refuses those
+
+// serverWallet is everything a Server does with a tenant's wallet, on top of what the Receiver does
+type serverWallet interface {
+	Wallet
+	GetNewAddress() (btcutil.Address, error)
+	// SendRawTransaction fails with rpc_client.ErrTxRejected if tx will never be accepted, as opposed to us not
+	// being able to send it right now
+	SendRawTransaction(tx *wire.MsgTx) (*chainhash.Hash, error)
+	IsSpent(outpoint wire.OutPoint) (bool, error)
+
+	// confirmed is whether txid, which pays us, is in a block
+	confirmed(txid chainhash.Hash) (bool, error)
+	// inMempool is whether txid (which has outputs outputs) is waiting to confirm
+	inMempool(txid chainhash.Hash, outputs int) (bool, error)
+	// abandon lets the wallet spend the inputs of txid again, now it's never going to confirm
+	abandon(txid string) error
+}
+
+// walletOpener gets a tenant's wallet, and something to call when done with it
+type walletOpener func() (serverWallet, func(), error)
+
+func newWalletOpener(config Config, u *unlocker) walletOpener {
+	if w := config.DescriptorWallet; w != nil {
+		return func() (serverWallet, func(), error) {
+			// catching up is cheap if nothing happened, and this way it's as up to date as the chain
+			if err := w.Sync(); err != nil {
+				return nil, nil, errors.Wrap(err, "could not sync the wallet")
+			}
+			return builtinWallet{w}, func() {}, nil
+		}
+	}
+	return func() (serverWallet, func(), error) {
+		rpcClient, err := rpc_client.NewRpcClient(config.Rpc)
+		if err != nil {
+			return nil, nil, err
+		}
+		return unlockingWallet{rpcClient, u}, rpcClient.Shutdown, nil
+	}
+}
+
+func (w unlockingWallet) confirmed(txid chainhash.Hash) (bool, error) {
+	tx, err := w.GetWalletTransaction(txid.String())
+	if errors.Cause(err) == rpc_client.ErrTxNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return tx.Confirmations > 0, nil
+}
+
+func (w unlockingWallet) inMempool(txid chainhash.Hash, outputs int) (bool, error) {
+	return w.MempoolHasEntry(txid.String())
+}
+
+func (w unlockingWallet) abandon(txid string) error {
+	return w.AbandonTransaction(txid)
+}
+
+type builtinWallet struct {
+	*wallet.Wallet
+}
+
+// SendRawTransaction checks tx first, as a chain saying no doesn't look any different from it not answering
+func (w builtinWallet) SendRawTransaction(tx *wire.MsgTx) (*chainhash.Hash, error) {
+	ok, err := w.TestMempoolAccept(tx)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.Wrap(rpc_client.ErrTxRejected, tx.TxHash().String())
+	}
+	return w.Wallet.SendRawTransaction(tx)
+}
+
+func (w builtinWallet) IsSpent(outpoint wire.OutPoint) (bool, error) {
+	txOut, err := w.GetTxOut(&outpoint.Hash, outpoint.Index)
+	return txOut == nil, err
+}
+
+func (w builtinWallet) confirmed(txid chainhash.Hash) (bool, error) {
+	return w.Confirmations(txid) > 0, nil
+}
+
+// inMempool can only go on whether any of txid's outputs exist. It's only asked once confirmed says no, and by then
+// nothing could have spent all of them
+func (w builtinWallet) inMempool(txid chainhash.Hash, outputs int) (bool, error) {
+	for vout := 0; vout < outputs; vout++ {
+		txOut, err := w.GetTxOut(&txid, uint32(vout))
+		if err != nil {
+			return false, err
+		}
+		if txOut != nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// abandon has nothing to do, the wallet only counts what it sent itself as spent
+func (w builtinWallet) abandon(txid string) error {
+	return nil
+}
@@ -0,0 +1,223 @@
+package receive
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/rhavar/bustapay/electrum"
+	"github.com/rhavar/bustapay/util"
+	"github.com/rhavar/bustapay/wallet"
+)
+
+// testChain is somewhere for descriptor wallets to live, and a way to mine a block paying outputs
+type testChain struct {
+	chain wallet.Chain
+	mine  func(outputs ...*wire.TxOut)
+}
+
+func memoryChain() testChain {
+	chain := wallet.NewMemoryChain(&chaincfg.RegressionNetParams)
+	return testChain{chain, func(outputs ...*wire.TxOut) { chain.Mine(outputs...) }}
+}
+
+// electrumChain is the stand-in electrum server, through a Redialer like bustapay receive uses
+func electrumChain(t *testing.T) testChain {
+	server, err := electrum.Listen("127.0.0.1:0", &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	client, err := electrum.DialRedialing(server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	coinbases := byte(0)
+	return testChain{client, func(outputs ...*wire.TxOut) {
+		if len(outputs) == 0 {
+			server.Mine()
+			return
+		}
+		coinbases++
+		coinbase := wire.NewMsgTx(2)
+		coinbase.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{coinbases}, 0), nil, nil))
+		for _, txOut := range outputs {
+			coinbase.AddTxOut(txOut)
+		}
+		server.Mine(coinbase)
+	}}
+}
+
+// eventually waits for check to be true. Electrum tells us about blocks with notifications, which can take a moment
+func eventually(t *testing.T, what string, check func() bool) {
+	t.Helper()
+	for start := time.Now(); !check(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal(what)
+		}
+	}
+}
+
+// newDescriptorWallet is a wallet on chain (its keys from seed) with a confirmed unspent of value
+func newDescriptorWallet(t *testing.T, chain testChain, seed byte, value int64) *wallet.Wallet {
+	t.Helper()
+	master, err := hdkeychain.NewMaster(bytes.Repeat([]byte{seed}, 32), &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := wallet.New(wallet.Config{
+		Descriptor:       "wpkh(" + master.String() + "/0/*)",
+		ChangeDescriptor: "wpkh(" + master.String() + "/1/*)",
+	}, chain.chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address, err := w.GetNewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkScript, err := util.PayToAddrScript(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.mine(wire.NewTxOut(value, pkScript))
+	eventually(t, "wallet never saw its unspent", func() bool {
+		unspents, err := w.ListUnspent()
+		return w.Sync() == nil && err == nil && len(unspents) > 0
+	})
+	return w
+}
+
+func hasUnspent(t *testing.T, w *wallet.Wallet, outpoint wire.OutPoint) bool {
+	t.Helper()
+	unspents, err := w.ListUnspent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, unspent := range unspents {
+		if unspent.TxID == outpoint.Hash.String() && unspent.Vout == outpoint.Index {
+			return true
+		}
+	}
+	return false
+}
+
+// A proposal from the built-in wallet, with no bitcoind anywhere, and the relayer falling back to the template and
+// seeing it confirm
+func TestDescriptorWalletServer(t *testing.T) {
+	t.Run("bitcoind", func(t *testing.T) { testDescriptorWalletServer(t, memoryChain()) })
+	t.Run("electrum", func(t *testing.T) { testDescriptorWalletServer(t, electrumChain(t)) })
+}
+
+func testDescriptorWalletServer(t *testing.T, chain testChain) {
+	receiver := newDescriptorWallet(t, chain, 1, 200000)
+	sender := newDescriptorWallet(t, chain, 2, 300000)
+
+	address, err := receiver.GetNewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawTx, err := sender.CreateRawTransaction(address.String(), 100000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template, err := sender.FundRawTransaction(rawTx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if template, _, err = sender.SignRawTransactionWithWallet(template); err != nil {
+		t.Fatal(err)
+	}
+
+	config := DefaultConfig()
+	config.DataDir = t.TempDir()
+	config.DescriptorWallet = receiver
+	config.DisableAutoRelay = true // the relayer is driven by hand below
+	config.Webhooks.OutboxDir = t.TempDir()
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(config)
+
+	w := propose(t, s, template)
+	if w.Code != http.StatusOK {
+		t.Fatalf("proposal got %v: %v", w.Code, w.Body.String())
+	}
+	var partial wire.MsgTx
+	if err := partial.Deserialize(w.Body); err != nil {
+		t.Fatal(err)
+	}
+	if len(partial.TxIn) != len(template.TxIn)+1 {
+		t.Fatalf("proposal has %v inputs, want one more than the template's %v", len(partial.TxIn), len(template.TxIn))
+	}
+	contributed, err := readContributedInput(filepath.Join(config.DataDir, partial.TxHash().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasUnspent(t, receiver, *contributed) {
+		t.Error("contributed unspent isn't locked")
+	}
+
+	// the sender never sends the final transaction
+	r := s.tenants[0].relayer
+	p := &watchedPayment{
+		paymentId:    "test-payment",
+		finalTxId:    partial.TxHash().String(),
+		finalTxHash:  partial.TxHash(),
+		templateTx:   template,
+		templateTxId: template.TxHash().String(),
+		logger:       util.Logger,
+		ctx:          context.Background(),
+		createdAt:    time.Now(),
+	}
+	if !r.check(p, true) || p.state != StateTemplateBroadcast {
+		t.Fatalf("payment is %v, want %v", p.state, StateTemplateBroadcast)
+	}
+	if !hasUnspent(t, receiver, *contributed) {
+		t.Error("contributed unspent wasn't released when falling back to the template")
+	}
+	if !r.check(p, true) || p.state != StateTemplateBroadcast {
+		t.Errorf("payment is %v while the template's in the mempool, want %v", p.state, StateTemplateBroadcast)
+	}
+
+	chain.mine()
+	eventually(t, "payment never confirmed", func() bool { return !r.check(p, true) })
+	if p.state != StateConfirmed {
+		t.Errorf("payment is %v once the template's mined, want %v", p.state, StateConfirmed)
+	}
+}
+
+func TestValidateDescriptorWallet(t *testing.T) {
+	chain := memoryChain()
+	w := newDescriptorWallet(t, chain, 1, 100000)
+
+	config := DefaultConfig()
+	config.DescriptorWallet = w
+	config.FeeBump.After = time.Hour
+	if err := config.Validate(); err == nil {
+		t.Error("fee bumping with a descriptor wallet")
+	}
+
+	config = DefaultConfig()
+	config.Tenants = []TenantConfig{{Name: "store1", DescriptorWallet: w}, {Name: "store2", DescriptorWallet: w}}
+	if err := config.Validate(); err == nil {
+		t.Error("two tenants sharing a descriptor wallet")
+	}
+	config.Tenants[1] = TenantConfig{Name: "store2", Wallet: "wallet2", DescriptorWallet: newDescriptorWallet(t, chain, 2, 100000)}
+	if err := config.Validate(); err == nil {
+		t.Error("a tenant with both a bitcoind wallet and a descriptor wallet")
+	}
+	config.Tenants[1].Wallet = ""
+	if err := config.Validate(); err != nil {
+		t.Error(err)
+	}
+}
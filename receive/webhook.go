@@ -0,0 +1,259 @@
+package receive
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rhavar/bustapay/util"
+)
+
+// Webhooks let the receiver's own payment processing find out about payments as they happen, instead of polling
+// the data directory. Every event is written to an outbox directory first (one file per event per url) and then
+// delivered in the background, retrying with backoff, so nothing is lost if the endpoint is down or we restart.
+//
+// Each request is a POST of the json event, with the header
+//    X-Bustapay-Signature: sha256=hex(hmac_sha256(secret, body))
+// which the endpoint should check before trusting it.
+
+const (
+	EventProposalCreated   = "proposal_created"     // we gave a partial transaction to a sender
+	EventPaymentInMempool  = "payment_in_mempool"   // the final transaction was seen in the mempool
+	EventPaymentConfirmed  = "payment_confirmed"    // the final (or template) transaction confirmed
+	EventTemplateBroadcast = "template_broadcast"   // the final transaction never showed up, so we broadcast the template
+	EventDoubleSpent       = "payment_double_spent" // the sender spent the template's inputs elsewhere, we won't get paid
+	EventFeeBumped         = "payment_fee_bumped"   // the final transaction was stalled, so we spent our output with a higher fee (see txid)
+)
+
+type WebhookConfig struct {
+	Urls        []string
+	Secret      string
+	OutboxDir   string // where undelivered events are kept, e.g. ~/.bustapay/outbox
+	MaxAttempts int    // after which the event is moved to OutboxDir/failed
+}
+
+// WebhookEvent is the body of every webhook request
+type WebhookEvent struct {
+	Id           string    `json:"id"`
+	Type         string    `json:"type"`
+	Time         time.Time `json:"time"`
+	PaymentId    string    `json:"payment_id"`
+	FinalTxid    string    `json:"final_txid"`
+	TemplateTxid string    `json:"template_txid"`
+	Txid         string    `json:"txid,omitempty"`   // the transaction the event is about (for confirmations, could be either)
+	Amount       int64     `json:"amount,omitempty"` // satoshis the sender is paying us, only on proposal_created
+}
+
+// an event waiting to be delivered to one url
+type outboxEntry struct {
+	Url         string       `json:"url"`
+	Event       WebhookEvent `json:"event"`
+	Attempts    int          `json:"attempts"`
+	NextAttempt time.Time    `json:"next_attempt"`
+}
+
+const webhookPollInterval = 5 * time.Second
+
+type webhooks struct {
+	config     WebhookConfig
+	httpClient *http.Client
+	wake       chan struct{}
+	wg         sync.WaitGroup
+}
+
+func newWebhooks(config WebhookConfig) *webhooks {
+	return &webhooks{
+		config:     config,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+func (wh *webhooks) enabled() bool {
+	return len(wh.config.Urls) > 0
+}
+
+// notify queues event for every configured url. It only fails if we can't write to the outbox
+func (wh *webhooks) notify(event WebhookEvent) error {
+	if !wh.enabled() {
+		return nil
+	}
+
+	event.Id = util.NewCorrelationId()
+	event.Time = time.Now().UTC()
+
+	for i, url := range wh.config.Urls {
+		entry := outboxEntry{Url: url, Event: event, NextAttempt: event.Time}
+		name := fmt.Sprintf("%v-%v-%v.json", event.Time.UnixNano(), event.Id, i)
+		if err := writeOutboxEntry(filepath.Join(wh.config.OutboxDir, name), &entry); err != nil {
+			return err
+		}
+	}
+
+	select {
+	case wh.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// start delivers events from the outbox until ctx is cancelled
+func (wh *webhooks) start(ctx context.Context) error {
+	if !wh.enabled() {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Join(wh.config.OutboxDir, "failed"), 0700); err != nil {
+		return errors.WithStack(err)
+	}
+
+	wh.wg.Add(1)
+	go func() {
+		defer wh.wg.Done()
+		for {
+			wh.deliverDue(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-wh.wake:
+			case <-time.After(webhookPollInterval):
+			}
+		}
+	}()
+	return nil
+}
+
+func (wh *webhooks) wait() {
+	wh.wg.Wait()
+}
+
+func (wh *webhooks) deliverDue(ctx context.Context) {
+	entries, err := ioutil.ReadDir(wh.config.OutboxDir)
+	if err != nil {
+		util.Logger.Error("could not read webhook outbox", "err", err)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() }) // oldest first
+
+	for _, file := range entries {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" || ctx.Err() != nil {
+			continue
+		}
+		path := filepath.Join(wh.config.OutboxDir, file.Name())
+
+		var entry outboxEntry
+		if err := readOutboxEntry(path, &entry); err != nil {
+			util.Logger.Error("could not read webhook outbox entry", "file", file.Name(), "err", err)
+			continue
+		}
+		if time.Now().Before(entry.NextAttempt) {
+			continue
+		}
+
+		logger := util.Logger.With("payment_id", entry.Event.PaymentId, "event", entry.Event.Type, "url", entry.Url)
+
+		err := wh.deliver(ctx, &entry)
+		if err == nil {
+			logger.Debug("delivered webhook")
+			if err := os.Remove(path); err != nil {
+				logger.Error("could not remove delivered webhook from outbox", "err", err)
+			}
+			continue
+		}
+
+		entry.Attempts++
+		if wh.config.MaxAttempts > 0 && entry.Attempts >= wh.config.MaxAttempts {
+			logger.Error("giving up on webhook", "attempts", entry.Attempts, "err", err)
+			if err := os.Rename(path, filepath.Join(wh.config.OutboxDir, "failed", file.Name())); err != nil {
+				logger.Error("could not move failed webhook", "err", err)
+			}
+			continue
+		}
+
+		entry.NextAttempt = time.Now().Add(webhookBackoff(entry.Attempts))
+		logger.Warn("webhook failed, will retry", "attempts", entry.Attempts, "next_attempt", entry.NextAttempt, "err", err)
+		if err := writeOutboxEntry(path, &entry); err != nil {
+			logger.Error("could not update webhook outbox entry", "err", err)
+		}
+	}
+}
+
+func (wh *webhooks) deliver(ctx context.Context, entry *outboxEntry) error {
+	body, err := json.Marshal(entry.Event)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	req, err := http.NewRequest("POST", entry.Url, bytes.NewReader(body))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Bustapay-Event", entry.Event.Type)
+	req.Header.Set("X-Bustapay-Signature", "sha256="+signWebhook(wh.config.Secret, body))
+
+	response, err := wh.httpClient.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer response.Body.Close()
+	ioutil.ReadAll(response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return errors.Errorf("got http status %v", response.StatusCode)
+	}
+	return nil
+}
+
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// 10s, 20s, 40s ... capped at an hour
+func webhookBackoff(attempts int) time.Duration {
+	backoff := 10 * time.Second
+	for i := 1; i < attempts && backoff < time.Hour; i++ {
+		backoff *= 2
+	}
+	if backoff > time.Hour {
+		backoff = time.Hour
+	}
+	return backoff
+}
+
+// written to a temp file first, so the dispatcher never sees half an entry
+func writeOutboxEntry(path string, entry *outboxEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp, path))
+}
+
+func readOutboxEntry(path string, entry *outboxEntry) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(json.Unmarshal(b, entry))
+}
@@ -0,0 +1,211 @@
+package receive
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// webhookEndpoint is a stand-in for the receiver's payment processing. It answers with statuses in order (then 200)
+type webhookEndpoint struct {
+	*httptest.Server
+	statuses []int
+	received chan webhookRequest
+}
+
+type webhookRequest struct {
+	signature string
+	body      []byte
+	event     WebhookEvent
+}
+
+func newWebhookEndpoint(t *testing.T, statuses ...int) *webhookEndpoint {
+	e := &webhookEndpoint{statuses: statuses, received: make(chan webhookRequest, 10)}
+	e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		request := webhookRequest{signature: r.Header.Get("X-Bustapay-Signature"), body: body}
+		if err := json.Unmarshal(body, &request.event); err != nil {
+			t.Errorf("webhook body isn't an event: %v", err)
+		}
+		e.received <- request
+
+		if len(e.statuses) > 0 {
+			w.WriteHeader(e.statuses[0])
+			e.statuses = e.statuses[1:]
+		}
+	}))
+	t.Cleanup(e.Close)
+	return e
+}
+
+func (e *webhookEndpoint) next(t *testing.T) webhookRequest {
+	t.Helper()
+	select {
+	case request := <-e.received:
+		return request
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was never delivered")
+		return webhookRequest{}
+	}
+}
+
+func testWebhookConfig(t *testing.T, url string) WebhookConfig {
+	return WebhookConfig{Urls: []string{url}, Secret: "hunter2", OutboxDir: t.TempDir(), MaxAttempts: 3}
+}
+
+func outboxFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// waitForDelivery waits for the outbox to be empty, i.e. everything was delivered
+func waitForDelivery(t *testing.T, dir string) {
+	t.Helper()
+	for start := time.Now(); len(outboxFiles(t, dir)) > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("delivered webhook is still in the outbox")
+		}
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	endpoint := newWebhookEndpoint(t)
+	config := testWebhookConfig(t, endpoint.URL)
+	wh := newWebhooks(config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer wh.wait()
+	defer cancel()
+	if err := wh.start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := wh.notify(WebhookEvent{Type: EventProposalCreated, PaymentId: "abc", Amount: 1234}); err != nil {
+		t.Fatal(err)
+	}
+
+	request := endpoint.next(t)
+	if want := "sha256=" + signWebhook("hunter2", request.body); request.signature != want {
+		t.Errorf("signature is %q, want %q", request.signature, want)
+	}
+	if signWebhook("hunter3", request.body) == signWebhook("hunter2", request.body) {
+		t.Error("signature doesn't depend on the secret")
+	}
+	if request.event.Type != EventProposalCreated || request.event.PaymentId != "abc" || request.event.Amount != 1234 {
+		t.Errorf("got event %+v", request.event)
+	}
+	waitForDelivery(t, config.OutboxDir)
+}
+
+func TestWebhookRetry(t *testing.T) {
+	endpoint := newWebhookEndpoint(t, http.StatusInternalServerError)
+	config := testWebhookConfig(t, endpoint.URL)
+	wh := newWebhooks(config)
+
+	if err := wh.notify(WebhookEvent{Type: EventPaymentInMempool, PaymentId: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+	wh.deliverDue(context.Background())
+	first := endpoint.next(t)
+
+	// it's still in the outbox, but not due yet
+	files := outboxFiles(t, config.OutboxDir)
+	if len(files) != 1 {
+		t.Fatalf("%v events in the outbox after a 500, want 1", len(files))
+	}
+	var entry outboxEntry
+	if err := readOutboxEntry(files[0], &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Attempts != 1 || time.Until(entry.NextAttempt) < 5*time.Second {
+		t.Fatalf("after a 500 it's had %v attempts and is next tried at %v", entry.Attempts, entry.NextAttempt)
+	}
+	wh.deliverDue(context.Background())
+	select {
+	case <-endpoint.received:
+		t.Fatal("retried before its backoff")
+	default:
+	}
+
+	// once it's due, it's delivered again (the same event) and removed
+	entry.NextAttempt = time.Now()
+	if err := writeOutboxEntry(files[0], &entry); err != nil {
+		t.Fatal(err)
+	}
+	wh.deliverDue(context.Background())
+	second := endpoint.next(t)
+	if second.event.Id != first.event.Id {
+		t.Errorf("retried event %v, want %v", second.event.Id, first.event.Id)
+	}
+	if files := outboxFiles(t, config.OutboxDir); len(files) != 0 {
+		t.Errorf("%v events still in the outbox after delivering", len(files))
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	endpoint := newWebhookEndpoint(t, 500, 500, 500)
+	config := testWebhookConfig(t, endpoint.URL)
+	wh := newWebhooks(config)
+	if err := os.MkdirAll(filepath.Join(config.OutboxDir, "failed"), 0700); err != nil { // start would make it
+		t.Fatal(err)
+	}
+
+	if err := wh.notify(WebhookEvent{Type: EventDoubleSpent}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < config.MaxAttempts; i++ {
+		for _, file := range outboxFiles(t, config.OutboxDir) {
+			var entry outboxEntry
+			readOutboxEntry(file, &entry)
+			entry.NextAttempt = time.Now()
+			writeOutboxEntry(file, &entry)
+		}
+		wh.deliverDue(context.Background())
+	}
+
+	if files := outboxFiles(t, config.OutboxDir); len(files) != 0 {
+		t.Errorf("%v events still in the outbox after %v attempts", len(files), config.MaxAttempts)
+	}
+	if files := outboxFiles(t, filepath.Join(config.OutboxDir, "failed")); len(files) != 1 {
+		t.Errorf("%v failed events, want 1", len(files))
+	}
+}
+
+func TestWebhookOutboxSurvivesRestart(t *testing.T) {
+	endpoint := newWebhookEndpoint(t)
+	config := testWebhookConfig(t, endpoint.URL)
+
+	// queued while nothing is delivering, like when we're stopped before getting to it
+	if err := newWebhooks(config).notify(WebhookEvent{Type: EventPaymentConfirmed, PaymentId: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-endpoint.received:
+		t.Fatal("delivered without being started")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	wh := newWebhooks(config)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer wh.wait()
+	defer cancel()
+	if err := wh.start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	request := endpoint.next(t)
+	if request.event.Type != EventPaymentConfirmed || request.event.PaymentId != "abc" {
+		t.Errorf("got event %+v", request.event)
+	}
+	waitForDelivery(t, config.OutboxDir)
+}
@@ -0,0 +1,123 @@
+package rpc_client
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/pkg/errors"
+)
+
+// Where bitcoind puts its .cookie, under -datadir, for each chain's default rpc port
+var cookieDirs = map[string]string{
+	"8332":  "",
+	"18332": "testnet3",
+	"48332": "testnet4",
+	"38332": "signet",
+	"18443": "regtest",
+}
+
+// FindCookie is where bitcoind, with -datadir=dataDir, writes its .cookie. The chain is worked out from host's port,
+// or if it's not a default port, whichever chain's .cookie is there. The file doesn't need to exist yet (bitcoind
+// might still be starting)
+func FindCookie(dataDir string, host string) (string, error) {
+	if _, port, err := net.SplitHostPort(host); err == nil {
+		if dir, ok := cookieDirs[port]; ok {
+			return filepath.Join(dataDir, dir, ".cookie"), nil
+		}
+	}
+
+	var found []string
+	for _, dir := range cookieDirs {
+		path := filepath.Join(dataDir, dir, ".cookie")
+		if _, err := os.Stat(path); err == nil {
+			found = append(found, path)
+		}
+	}
+	switch len(found) {
+	case 1:
+		return found[0], nil
+	case 0:
+		return "", errors.Errorf("there's no .cookie in %v (is bitcoind running with -datadir=%v?)", dataDir, dataDir)
+	default:
+		return "", errors.Errorf("there's a .cookie for more than one chain in %v, use the cookie file option to say which", dataDir)
+	}
+}
+
+// Errors for bitcoind (or its wallet) not being usable the way it's configured. Use errors.Cause to compare
+var (
+	ErrUnauthorized       = errors.New("bitcoind rejected the user and pass (or cookie)")
+	ErrWalletNotFound     = errors.New("isn't loaded in bitcoind (loadwallet it, or check the wallet name)")
+	ErrWalletNotSpecified = errors.New("isn't set, and bitcoind has more than one loaded")
+	ErrWalletLocked       = errors.New("is encrypted and locked, so it can't sign")
+	ErrWrongPassphrase    = errors.New("the passphrase is wrong")
+	ErrWalletNotEncrypted = errors.New("isn't encrypted, so doesn't need a passphrase")
+)
+
+// ErrTxNotFound is bitcoind saying there's no such transaction (in the mempool, or the wallet), rather than us not
+// being able to ask. Use errors.Cause to compare
+var ErrTxNotFound = errors.New("no such transaction")
+
+// ErrTxRejected is bitcoind refusing a transaction we sent it, e.g. because its inputs are already spent. Use
+// errors.Cause to compare
+var ErrTxRejected = errors.New("bitcoind rejected the transaction")
+
+// isNotFound is whether err (straight from btcd, before rpcError) is bitcoind's "no such transaction" (-5)
+func isNotFound(err error) bool {
+	rpcErr, ok := err.(*btcjson.RPCError)
+	return ok && rpcErr.Code == btcjson.ErrRPCInvalidAddressOrKey
+}
+
+// rpcError makes errors that mean we aren't set up right say so, instead of being bitcoind's code and message. Like
+// errors.WithStack it's nil for nil
+func (rc *RpcClient) rpcError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	wallet := "bitcoind's default wallet"
+	if rc.wallet != "" {
+		wallet = fmt.Sprintf("bitcoind wallet %q", rc.wallet)
+	}
+
+	if rpcErr, ok := err.(*btcjson.RPCError); ok {
+		switch rpcErr.Code {
+		case btcjson.ErrRPCWalletNotFound:
+			return errors.Wrap(ErrWalletNotFound, wallet)
+		case btcjson.ErrRPCWalletNotSpecified:
+			return errors.Wrap(ErrWalletNotSpecified, "the wallet to use")
+		case btcjson.ErrRPCWalletUnlockNeeded:
+			return errors.Wrap(ErrWalletLocked, wallet)
+		case btcjson.ErrRPCWalletPassphraseIncorrect:
+			return errors.Wrap(ErrWrongPassphrase, wallet)
+		case btcjson.ErrRPCWalletWrongEncState:
+			return errors.Wrap(ErrWalletNotEncrypted, wallet)
+		}
+	}
+	// btcd doesn't give us the status code, just this
+	if strings.HasPrefix(err.Error(), "status code: 401") || strings.HasPrefix(err.Error(), "status code: 403") {
+		return errors.Wrap(ErrUnauthorized, rc.host)
+	}
+	return errors.WithStack(err)
+}
+
+// WalletPassphrase unlocks an encrypted wallet for timeout (to the second, and at least 1). Calling it again while
+// it's unlocked just changes when it locks
+func (rc *RpcClient) WalletPassphrase(passphrase string, timeout time.Duration) error {
+	seconds := int64(timeout / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	var result interface{}
+	return rc.rawRequest("walletpassphrase", &result, passphrase, seconds)
+}
+
+// WalletLock locks an encrypted wallet again, before WalletPassphrase's timeout
+func (rc *RpcClient) WalletLock() error {
+	var result interface{}
+	return rc.rawRequest("walletlock", &result)
+}
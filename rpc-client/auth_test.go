@@ -0,0 +1,65 @@
+package rpc_client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeCookie(t *testing.T, dataDir string, chainDir string) string {
+	t.Helper()
+	path := filepath.Join(dataDir, chainDir, ".cookie")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("__cookie__:secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// A default port says which chain it is, whether or not bitcoind has written the cookie yet
+func TestFindCookieByPort(t *testing.T) {
+	dataDir := t.TempDir()
+	for host, chainDir := range map[string]string{
+		"127.0.0.1:8332":  "",
+		"127.0.0.1:18332": "testnet3",
+		"localhost:48332": "testnet4",
+		"localhost:38332": "signet",
+		"[::1]:18443":     "regtest",
+	} {
+		path, err := FindCookie(dataDir, host)
+		if err != nil {
+			t.Errorf("%v: %v", host, err)
+		} else if want := filepath.Join(dataDir, chainDir, ".cookie"); path != want {
+			t.Errorf("%v's cookie is %v, want %v", host, path, want)
+		}
+	}
+}
+
+// Otherwise it's whichever chain has one
+func TestFindCookieOtherPort(t *testing.T) {
+	dataDir := t.TempDir()
+	if _, err := FindCookie(dataDir, "127.0.0.1:9999"); err == nil || !strings.Contains(err.Error(), "no .cookie") {
+		t.Errorf("with no cookie got %v", err)
+	}
+
+	want := writeCookie(t, dataDir, "signet")
+	for _, host := range []string{"127.0.0.1:9999", "bitcoind"} {
+		if path, err := FindCookie(dataDir, host); err != nil || path != want {
+			t.Errorf("%v's cookie is %v (%v), want %v", host, path, err, want)
+		}
+	}
+
+	// with two it could be either
+	writeCookie(t, dataDir, "regtest")
+	if _, err := FindCookie(dataDir, "127.0.0.1:9999"); err == nil || !strings.Contains(err.Error(), "more than one") {
+		t.Errorf("with two cookies got %v", err)
+	}
+	// unless the port says
+	if path, err := FindCookie(dataDir, "127.0.0.1:18443"); err != nil || path != filepath.Join(dataDir, "regtest", ".cookie") {
+		t.Errorf("regtest's cookie is %v (%v)", path, err)
+	}
+}
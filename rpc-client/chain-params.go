@@ -0,0 +1,52 @@
+package rpc_client
+
+import (
+	"bytes"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+)
+
+// btcd doesn't know about testnet4 (BIP94) yet. For our purposes (addresses) it's the same as testnet3, other than
+// its name, magic, port and genesis
+var TestNet4Params = testNet4Params()
+
+func testNet4Params() chaincfg.Params {
+	params := chaincfg.TestNet3Params
+	params.Name = "testnet4"
+	params.Net = wire.BitcoinNet(0x283f161c)
+	params.DefaultPort = "48333"
+	params.DNSSeeds = []chaincfg.DNSSeed{
+		{Host: "seed.testnet4.bitcoin.sprovoost.nl", HasFiltering: true},
+		{Host: "seed.testnet4.wiz.biz", HasFiltering: true},
+	}
+	params.GenesisBlock = nil // we never need it, and testnet3's would be wrong
+	params.GenesisHash, _ = chainhash.NewHashFromStr("00000000da84f2bafbbc53dee25a72ae507ff4914b867c565be350b0da8bf043")
+	params.Checkpoints = nil
+	return params
+}
+
+// ChainParams maps the chain bitcoind reports in getblockchaininfo to its params. signetChallenge is only used for
+// signet, and can be nil for the default signet
+func ChainParams(chain string, signetChallenge []byte) (*chaincfg.Params, error) {
+	switch chain {
+	case "main":
+		return &chaincfg.MainNetParams, nil
+	case "test":
+		return &chaincfg.TestNet3Params, nil
+	case "testnet4":
+		return &TestNet4Params, nil
+	case "regtest":
+		return &chaincfg.RegressionNetParams, nil
+	case "signet":
+		if len(signetChallenge) == 0 || bytes.Equal(signetChallenge, chaincfg.DefaultSignetChallenge) {
+			return &chaincfg.SigNetParams, nil
+		}
+		params := chaincfg.CustomSignetParams(signetChallenge, nil)
+		return &params, nil
+	default:
+		return nil, errors.Errorf("unsupported chain %q", chain)
+	}
+}
@@ -0,0 +1,80 @@
+package rpc_client
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+)
+
+func TestChainParams(t *testing.T) {
+	// chain is what bitcoind's getblockchaininfo says, for each of the chains it has
+	for _, test := range []struct {
+		chain string
+		name  string
+		hrp   string
+		net   wire.BitcoinNet
+	}{
+		{"main", "mainnet", "bc", wire.MainNet},
+		{"test", "testnet3", "tb", wire.TestNet3},
+		{"testnet4", "testnet4", "tb", wire.BitcoinNet(0x283f161c)},
+		{"signet", "signet", "tb", chaincfg.SigNetParams.Net},
+		{"regtest", "regtest", "bcrt", wire.TestNet},
+	} {
+		params, err := ChainParams(test.chain, nil)
+		if err != nil {
+			t.Errorf("%v: %v", test.chain, err)
+			continue
+		}
+		if params.Name != test.name || params.Bech32HRPSegwit != test.hrp || params.Net != test.net {
+			t.Errorf("%v is %v (%v, %v), want %v (%v, %v)", test.chain, params.Name, params.Bech32HRPSegwit, params.Net,
+				test.name, test.hrp, test.net)
+		}
+	}
+
+	if _, err := ChainParams("testnet5", nil); err == nil {
+		t.Error("mapped a chain that doesn't exist")
+	}
+}
+
+// testnet4's addresses are testnet3's, so it's only its own where bitcoind would notice
+func TestTestNet4Params(t *testing.T) {
+	if TestNet4Params.DefaultPort != "48333" || TestNet4Params.GenesisHash == nil ||
+		TestNet4Params.GenesisHash.String() != "00000000da84f2bafbbc53dee25a72ae507ff4914b867c565be350b0da8bf043" {
+		t.Errorf("testnet4 is port %v, genesis %v", TestNet4Params.DefaultPort, TestNet4Params.GenesisHash)
+	}
+	if chaincfg.TestNet3Params.Name != "testnet3" {
+		t.Error("making testnet4's params changed testnet3's")
+	}
+
+	address, err := btcutil.NewAddressWitnessPubKeyHash(make([]byte, 20), &TestNet4Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := btcutil.DecodeAddress(address.EncodeAddress(), &TestNet4Params)
+	if err != nil || !decoded.IsForNet(&TestNet4Params) {
+		t.Errorf("testnet4 can't decode its own address %v: %v", address, err)
+	} else if decoded.IsForNet(&chaincfg.MainNetParams) {
+		t.Errorf("testnet4 address %v is a mainnet one", address)
+	}
+}
+
+// The default signet's challenge (given or not) is the default signet, any other is its own network
+func TestSignetParams(t *testing.T) {
+	params, err := ChainParams("signet", chaincfg.DefaultSignetChallenge)
+	if err != nil || params != &chaincfg.SigNetParams {
+		t.Errorf("the default challenge is %v (%v)", params.Name, err)
+	}
+
+	custom, err := ChainParams("signet", []byte{0x51})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if custom.Net == chaincfg.SigNetParams.Net {
+		t.Error("a custom signet has the default signet's magic")
+	}
+	if custom.Bech32HRPSegwit != "tb" {
+		t.Errorf("a custom signet's addresses are %v1...", custom.Bech32HRPSegwit)
+	}
+}
@@ -0,0 +1,64 @@
+package rpc_client
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// What bitcoind says about itself, for checking it's set up the way we need
+
+type BlockchainInfo struct {
+	Chain                string  `json:"chain"`
+	Blocks               int64   `json:"blocks"`
+	Headers              int64   `json:"headers"`
+	InitialBlockDownload bool    `json:"initialblockdownload"`
+	VerificationProgress float64 `json:"verificationprogress"`
+}
+
+type NetworkInfo struct {
+	Version    int    `json:"version"` // e.g. 270000 for 27.0
+	SubVersion string `json:"subversion"`
+}
+
+type WalletInfo struct {
+	WalletName         string `json:"walletname"`
+	PrivateKeysEnabled bool   `json:"private_keys_enabled"`
+	Descriptors        bool   `json:"descriptors"`
+	UnlockedUntil      *int64 `json:"unlocked_until"` // nil if the wallet isn't encrypted, 0 if it's locked
+}
+
+func (rc *RpcClient) GetBlockchainInfo() (*BlockchainInfo, error) {
+	var result BlockchainInfo
+	return &result, rc.rawRequest("getblockchaininfo", &result)
+}
+
+func (rc *RpcClient) GetNetworkInfo() (*NetworkInfo, error) {
+	var result NetworkInfo
+	return &result, rc.rawRequest("getnetworkinfo", &result)
+}
+
+// GetWalletInfo fails if there's no wallet loaded (or more than one, and Config.Wallet doesn't say which)
+func (rc *RpcClient) GetWalletInfo() (*WalletInfo, error) {
+	var result WalletInfo
+	return &result, rc.rawRequest("getwalletinfo", &result)
+}
+
+// rawRequest calls method with params, and unmarshals what it returns into result
+func (rc *RpcClient) rawRequest(method string, result interface{}, params ...interface{}) error {
+	var rawParams []json.RawMessage
+	for _, param := range params {
+		jsonData, err := json.Marshal(param)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		rawParams = append(rawParams, jsonData)
+	}
+
+	defer rc.timed(method)()
+	resultJson, err := rc.rpcClient.RawRequest(method, rawParams)
+	if err != nil {
+		return rc.rpcError(err)
+	}
+	return errors.WithStack(json.Unmarshal(resultJson, result))
+}
@@ -4,40 +4,87 @@ import (
 	"bytes"
 	"encoding/hex"
 	"encoding/json"
-	"fmt"
 	"github.com/btcsuite/btcd/btcjson"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
-	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcd/btcutil"
 	"github.com/pkg/errors"
-	"github.com/spf13/viper"
+	"github.com/rhavar/bustapay/psbt"
 	"github.com/rhavar/bustapay/util"
 	"github.com/btcsuite/btcd/chaincfg"
+	"io/ioutil"
+	"net/url"
 	"regexp"
+	"time"
 )
 
 // This is a wrapper around btcd/rpcclient to make it a bit easier to use
 type RpcClient struct {
 	rpcClient *rpcclient.Client
+	observer  func(method string, duration time.Duration)
+	host      string
+	wallet    string
+}
+
+// Config is how to connect to bitcoind
+type Config struct {
+	Host   string // host:port
+	User   string
+	Pass   string
+	Wallet string // if set, calls go to this wallet (/wallet/<Wallet>), for bitcoind's with more than one loaded
+
+	// bitcoind's .cookie file, used instead of User and Pass if Pass is empty. It's read again if it changes (bitcoind
+	// makes a new one every time it starts), checking at most every 30 seconds
+	CookiePath string
+	// bitcoind's -datadir, to find the .cookie in if there's no Pass or CookiePath (see FindCookie)
+	DataDir string
+
+	// bitcoind doesn't do TLS itself, but it can be behind something that does. TLSCert is a PEM certificate to
+	// trust, for self-signed ones
+	TLS     bool
+	TLSCert string
+
+	// If set, is called after every rpc call with how long it took (e.g. for metrics)
+	Observer func(method string, duration time.Duration)
 }
 
 /// The caller must always becareful to call client.Shutdown()!
-func NewRpcClient() (*RpcClient, error) {
+func NewRpcClient(config Config) (*RpcClient, error) {
 
-	host := viper.GetString("bitcoind_host") + ":" + viper.GetString("bitcoind_port")
-	user := viper.GetString("bitcoind_user")
-	pass := viper.GetString("bitcoind_pass")
+	if config.Pass == "" && config.CookiePath == "" && config.DataDir != "" {
+		cookiePath, err := FindCookie(config.DataDir, config.Host)
+		if err != nil {
+			return nil, err
+		}
+		config.CookiePath = cookiePath
+	}
+	if config.Pass == "" && config.CookiePath == "" {
+		return nil, errors.New("there's no pass, cookie file or datadir to log in to bitcoind with")
+	}
 
-	util.VerboseLog("Connecting to ", host, " with ", user, " and using pass ", pass != "")
+	util.Logger.Debug("connecting to bitcoind", "host", config.Host, "wallet", config.Wallet, util.KeyRpcUser, config.User, "using_pass", config.Pass != "", "cookie", config.CookiePath, "tls", config.TLS)
 
+	host := config.Host
+	if config.Wallet != "" {
+		host += "/wallet/" + url.PathEscape(config.Wallet)
+	}
 
 	cfg := &rpcclient.ConnConfig{
 		Host:         host,
-		User:         user,
-		Pass:         pass,
+		User:         config.User,
+		Pass:         config.Pass,
+		CookiePath:   config.CookiePath,
 		HTTPPostMode: true, // Bitcoin only supports HTTP POST mode
-		DisableTLS:   true, // Bitcoin does not provide TLS by default
+		DisableTLS:   !config.TLS,
+	}
+	if config.TLSCert != "" {
+		cert, err := ioutil.ReadFile(config.TLSCert)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read bitcoind's tls certificate")
+		}
+		cfg.Certificates = cert
 	}
 
 	rpcClient, err := rpcclient.New(cfg, nil)
@@ -45,7 +92,17 @@ func NewRpcClient() (*RpcClient, error) {
 		return nil, errors.WithStack(err)
 	}
 
-	return &RpcClient{rpcClient: rpcClient}, nil
+	return &RpcClient{rpcClient: rpcClient, observer: config.Observer, host: config.Host, wallet: config.Wallet}, nil
+}
+
+// timed reports how long an rpc call took to the observer. Use like:  defer rc.timed("getblockchaininfo")()
+func (rc *RpcClient) timed(method string) func() {
+	start := time.Now()
+	return func() {
+		if rc.observer != nil {
+			rc.observer(method, time.Since(start))
+		}
+	}
 }
 
 func (rc *RpcClient) Shutdown() {
@@ -59,41 +116,194 @@ func (rc *RpcClient) GetChainParams() (*chaincfg.Params, error) {
 		return memoizoidChain, nil
 	}
 
-	info, err := rc.rpcClient.GetBlockChainInfo()
+	// raw, because btcjson doesn't know about signet_challenge
+	defer rc.timed("getblockchaininfo")()
+	resultJson, err := rc.rpcClient.RawRequest("getblockchaininfo", nil)
+	if err != nil {
+		return nil, rc.rpcError(err)
+	}
+
+	var info struct {
+		Chain           string `json:"chain"`
+		SignetChallenge string `json:"signet_challenge"`
+	}
+	if err := json.Unmarshal(resultJson, &info); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	challenge, err := hex.DecodeString(info.SignetChallenge)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	switch chain := info.Chain; chain {
-	case "main":
-		memoizoidChain = &chaincfg.MainNetParams
-	case "test":
-		memoizoidChain = &chaincfg.TestNet3Params
-	case "regtest":
-		memoizoidChain = &chaincfg.SimNetParams
-	default:
-		panic("unexpected chain: " + chain)
+	params, err := ChainParams(info.Chain, challenge)
+	if err != nil {
+		return nil, err
 	}
 
+	memoizoidChain = params
 	return memoizoidChain, nil
 }
 
 
+// GetNewAddress gives an address of whatever type bitcoind is configured to give out (-addresstype)
 func (rc *RpcClient) GetNewAddress() (btcutil.Address, error) {
-	addr, err := rc.rpcClient.GetNewAddress("")
+	chainParams, err := rc.GetChainParams()
+	if err != nil {
+		return nil, err
+	}
+
+	// raw, so it's decoded for the chain bitcoind is on, rather than the params rpcclient was created with
+	defer rc.timed("getnewaddress")()
+	resultJson, err := rc.rpcClient.RawRequest("getnewaddress", nil)
 	if err != nil {
+		return nil, rc.rpcError(err)
+	}
+
+	var address string
+	if err := json.Unmarshal(resultJson, &address); err != nil {
 		return nil, errors.WithStack(err)
 	}
-	return addr, nil
+	return util.DecodeAddress(address, chainParams)
 }
 
-// hacky, eats errors...
-func (rc *RpcClient) MempoolHasEntry(txid string) bool {
+// MempoolHasEntry is false only if bitcoind says txid isn't in its mempool. Not being able to ask is an error, and
+// doesn't mean it's not there
+func (rc *RpcClient) MempoolHasEntry(txid string) (bool, error) {
+	defer rc.timed("getmempoolentry")()
 	entry, err := rc.rpcClient.GetMempoolEntry(txid)
-	return err == nil && entry != nil
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, rc.rpcError(err)
+	}
+	return entry != nil, nil
+}
+
+
+type MempoolEntryResult struct {
+	VSize           int64 `json:"vsize"`
+	DescendantCount int64 `json:"descendantcount"` // including itself
+	Fees            struct {
+		Base float64 `json:"base"` // in btc
+	} `json:"fees"`
+}
+
+func (rc *RpcClient) GetMempoolEntry(txid string) (*MempoolEntryResult, error) {
+	jsonData, err := json.Marshal(txid)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	defer rc.timed("getmempoolentry")()
+	resultJson, err := rc.rpcClient.RawRequest("getmempoolentry", []json.RawMessage{jsonData})
+	if err != nil {
+		return nil, rc.rpcError(err)
+	}
+
+	var result MempoolEntryResult
+	if err := json.Unmarshal(resultJson, &result); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &result, nil
+}
+
+// GetRawTransaction works for anything in the mempool (or any transaction at all with -txindex)
+func (rc *RpcClient) GetRawTransaction(txid *chainhash.Hash) (*wire.MsgTx, error) {
+	defer rc.timed("getrawtransaction")()
+	tx, err := rc.rpcClient.GetRawTransaction(txid)
+	if err != nil {
+		return nil, rc.rpcError(err)
+	}
+	return tx.MsgTx(), nil
+}
+
+func (rc *RpcClient) GetBlockCount() (int64, error) {
+	defer rc.timed("getblockcount")()
+	count, err := rc.rpcClient.GetBlockCount()
+	return count, rc.rpcError(err)
+}
+
+func (rc *RpcClient) GetBlockHash(height int64) (*chainhash.Hash, error) {
+	defer rc.timed("getblockhash")()
+	hash, err := rc.rpcClient.GetBlockHash(height)
+	return hash, rc.rpcError(err)
+}
+
+func (rc *RpcClient) GetBlock(hash *chainhash.Hash) (*wire.MsgBlock, error) {
+	defer rc.timed("getblock")()
+	block, err := rc.rpcClient.GetBlock(hash)
+	return block, rc.rpcError(err)
+}
+
+// EstimateSmartFee returns the feerate (in satoshis per vbyte) bitcoind thinks will confirm within confTarget blocks
+func (rc *RpcClient) EstimateSmartFee(confTarget int) (float64, error) {
+	jsonData, err := json.Marshal(confTarget)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	defer rc.timed("estimatesmartfee")()
+	resultJson, err := rc.rpcClient.RawRequest("estimatesmartfee", []json.RawMessage{jsonData})
+	if err != nil {
+		return 0, rc.rpcError(err)
+	}
 
+	var result struct {
+		FeeRate float64  `json:"feerate"` // btc per kvB
+		Errors  []string `json:"errors"`
+	}
+	if err := json.Unmarshal(resultJson, &result); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if result.FeeRate <= 0 {
+		return 0, errors.Errorf("bitcoind could not estimate a fee: %v", result.Errors)
+	}
+	return result.FeeRate * 1e8 / 1000, nil
+}
+
+type GetTransactionResult struct {
+	Confirmations int64  `json:"confirmations"`
+	BlockHash     string `json:"blockhash"`
+}
+
+// GetWalletTransaction only works for transactions that touch our wallet, it fails with ErrTxNotFound for any other.
+// Confirmations will be negative if it conflicts with a confirmed transaction
+func (rc *RpcClient) GetWalletTransaction(txid string) (*GetTransactionResult, error) {
+	jsonData, err := json.Marshal(txid)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	defer rc.timed("gettransaction")()
+	resultJson, err := rc.rpcClient.RawRequest("gettransaction", []json.RawMessage{jsonData})
+	if isNotFound(err) {
+		return nil, errors.Wrap(ErrTxNotFound, txid)
+	}
+	if err != nil {
+		return nil, rc.rpcError(err)
+	}
+
+	var result GetTransactionResult
+	if err := json.Unmarshal(resultJson, &result); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &result, nil
 }
 
+// AbandonTransaction tells the wallet a transaction that's not in the mempool (and never will be) is gone, so
+// its inputs can be spent again
+func (rc *RpcClient) AbandonTransaction(txid string) error {
+	jsonData, err := json.Marshal(txid)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	defer rc.timed("abandontransaction")()
+	_, err = rc.rpcClient.RawRequest("abandontransaction", []json.RawMessage{jsonData})
+	return rc.rpcError(err)
+}
 
 // return hexstring (isntead of a *tx to work around btcutil serialization bugs...
 func (rc *RpcClient) CreateRawTransaction(address string, amount int64) (string, error) {
@@ -108,9 +318,10 @@ func (rc *RpcClient) CreateRawTransaction(address string, amount int64) (string,
 	replaceable := []byte("true")
 
 
+	defer rc.timed("createrawtransaction")()
 	resp, err := rc.rpcClient.RawRequest("createrawtransaction", []json.RawMessage{ inputs, outputs, lockTime, replaceable })
 	if err != nil {
-		return "", errors.WithStack(err)
+		return "", rc.rpcError(err)
 	}
 
 	var hexString string
@@ -138,9 +349,10 @@ func (rc *RpcClient) FundRawTransaction(rawTx string) (*wire.MsgTx, error) {
 	}
 
 
+	defer rc.timed("fundrawtransaction")()
 	rm, err := rc.rpcClient.RawRequest("fundrawtransaction", []json.RawMessage{j})
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, rc.rpcError(err)
 	}
 
 	res := FRTResult{}
@@ -161,8 +373,17 @@ func (rc *RpcClient) FundRawTransaction(rawTx string) (*wire.MsgTx, error) {
 	return &msgTx, nil
 }
 
+// SendRawTransaction fails with ErrTxRejected if bitcoind won't take tx, as opposed to us not being able to ask
 func (rc *RpcClient) SendRawTransaction(tx *wire.MsgTx) (*chainhash.Hash, error) {
-	return rc.rpcClient.SendRawTransaction(tx, false)
+	defer rc.timed("sendrawtransaction")()
+	txid, err := rc.rpcClient.SendRawTransaction(tx, false)
+	if rpcErr, ok := err.(*btcjson.RPCError); ok {
+		switch rpcErr.Code {
+		case btcjson.ErrRPCTxError, btcjson.ErrRPCTxRejected, btcjson.ErrRPCTxAlreadyInChain, btcjson.ErrRPCDeserialization:
+			return nil, errors.Wrap(ErrTxRejected, rpcErr.Message)
+		}
+	}
+	return txid, rc.rpcError(err)
 }
 
 func (rc *RpcClient) SignRawTransactionWithWallet(tx *wire.MsgTx) (*wire.MsgTx, bool, error) {
@@ -177,9 +398,10 @@ func (rc *RpcClient) SignRawTransactionWithWallet(tx *wire.MsgTx) (*wire.MsgTx,
 		return nil, false, errors.WithStack(err)
 	}
 
+	defer rc.timed("signrawtransactionwithwallet")()
 	resultJson, err := rc.rpcClient.RawRequest("signrawtransactionwithwallet", []json.RawMessage{jsonData})
 	if err != nil {
-		return nil, false, errors.WithStack(err)
+		return nil, false, rc.rpcError(err)
 	}
 
 	var result SignRawTransactionResult
@@ -207,51 +429,109 @@ type SignRawTransactionResult struct {
 	Errors   []interface{} `json:"errors"`
 }
 
-// Note this is only segwit compatible. Don't use it to sign non-segwit inputs
-func (rc *RpcClient) SafeSignRawTransactionWithWallet(tx *wire.MsgTx, inputToSign int) (*wire.MsgTx, bool, error) {
-	res, complete, err := rc.SignRawTransactionWithWallet(tx)
+// WalletProcessPsbt has the wallet fill in what it knows about packet's inputs and outputs and, with sign, sign
+// (and finalize) every input it can. complete is whether every input is now signed
+func (rc *RpcClient) WalletProcessPsbt(packet *psbt.Packet, sign bool) (*psbt.Packet, bool, error) {
+	encoded, err := packet.Encode()
 	if err != nil {
-		return nil, false, errors.WithStack(err)
+		return nil, false, err
 	}
 
-	for i := 0; i < len(tx.TxIn); i++ {
-		originalTxIn := tx.TxIn[i]
-		newTxIn := res.TxIn[i]
+	params := make([]json.RawMessage, 3)
+	for i, param := range []interface{}{encoded, sign, "ALL"} {
+		if params[i], err = json.Marshal(param); err != nil {
+			return nil, false, errors.WithStack(err)
+		}
+	}
 
-		we := witnessEqual(originalTxIn.Witness, newTxIn.Witness)
+	defer rc.timed("walletprocesspsbt")()
+	resultJson, err := rc.rpcClient.RawRequest("walletprocesspsbt", params)
+	if err != nil {
+		return nil, false, rc.rpcError(err)
+	}
 
-		if i == inputToSign {
-			if we {
-				return nil, false, errors.New(fmt.Sprint("witness did not change for input ", i, " in tx ", tx.TxHash().String(), " that we should have signed"))
-			}
-		} else if !we {
-			return nil, false, errors.New(fmt.Sprint("witness changed for input ", i, " in tx ", tx.TxHash().String(), " but we should have only signed ", inputToSign))
-		} else if !bytes.Equal(originalTxIn.SignatureScript, newTxIn.SignatureScript) {
-			return nil, false, errors.New(fmt.Sprint("signature script changed for input ", i, " in tx ", tx.TxHash().String()))
-		}
+	var result struct {
+		Psbt     string `json:"psbt"`
+		Complete bool   `json:"complete"`
+	}
+	if err := json.Unmarshal(resultJson, &result); err != nil {
+		return nil, false, errors.WithStack(err)
 	}
 
-	return res, complete, nil
+	processed, err := psbt.Decode(result.Psbt)
+	if err != nil {
+		return nil, false, err
+	}
+	return processed, result.Complete, nil
 }
 
-func witnessEqual(w1 wire.TxWitness, w2 wire.TxWitness) bool {
-	if len(w1) != len(w2) {
-		return false
+// SignInputsWithWallet signs only inputs (by index) and leaves every other input exactly as it was. prevOuts has
+// to have the output every input spends, not just ours, or the wallet can't sign taproot
+func (rc *RpcClient) SignInputsWithWallet(tx *wire.MsgTx, inputs []int, prevOuts txscript.PrevOutputFetcher) (*wire.MsgTx, error) {
+	packet := psbt.New(tx)
+	for i, txIn := range tx.TxIn {
+		prevOut := prevOuts.FetchPrevOutput(txIn.PreviousOutPoint)
+		if prevOut == nil {
+			return nil, errors.Errorf("don't know the output input %v spends", i)
+		}
+		packet.Inputs[i].WitnessUtxo = prevOut
+	}
+	toSign := make(map[int]bool)
+	for _, i := range inputs {
+		if i < 0 || i >= len(tx.TxIn) {
+			return nil, errors.Errorf("transaction has no input %v", i)
+		}
+		toSign[i] = true
 	}
 
-	for i := 0; i < len(w1); i++ {
-		sw1 := w1[0]
-		sw2 := w2[1]
+	processed, _, err := rc.WalletProcessPsbt(packet, true)
+	if err != nil {
+		return nil, err
+	}
+	if processed.UnsignedTx.TxHash() != packet.UnsignedTx.TxHash() {
+		return nil, errors.New("wallet changed the transaction it was asked to sign")
+	}
 
-		if !bytes.Equal(sw1, sw2) {
-			return false
+	// The wallet can only sign an input if it has the key, so if it signed one of the others, one of the sender's
+	// coins is ours. Something is very wrong (or we're paying ourselves) so don't go on
+	for i, input := range processed.Inputs {
+		if !toSign[i] && input.IsFinalized() {
+			return nil, errors.Errorf("wallet signed input %v, which we didn't contribute", i)
 		}
 	}
-	return true
+
+	signed := tx.Copy()
+	for _, i := range inputs {
+		input := processed.Inputs[i]
+		if !input.IsFinalized() {
+			return nil, errors.Errorf("wallet could not sign input %v", i)
+		}
+		signed.TxIn[i].SignatureScript = input.FinalScriptSig
+		signed.TxIn[i].Witness = input.FinalScriptWitness
+
+		if err := util.VerifyInput(signed, i, prevOuts); err != nil {
+			return nil, err
+		}
+	}
+
+	return signed, nil
 }
 
+// GetTxOut is nil if the output is spent (including by something in the mempool), or never existed. Outputs of
+// transactions still in the mempool are found too
 func (rc *RpcClient) GetTxOut(txid *chainhash.Hash, vout uint32) (*btcjson.GetTxOutResult, error) {
-	return rc.rpcClient.GetTxOut(txid, vout, false)
+	defer rc.timed("gettxout")()
+	return rc.rpcClient.GetTxOut(txid, vout, true)
+}
+
+// IsSpent is true if outpoint has been spent, either in a block or by something in the mempool
+func (rc *RpcClient) IsSpent(outpoint wire.OutPoint) (bool, error) {
+	defer rc.timed("gettxout")()
+	result, err := rc.rpcClient.GetTxOut(&outpoint.Hash, outpoint.Index, true)
+	if err != nil {
+		return false, rc.rpcError(err)
+	}
+	return result == nil, nil
 }
 
 type MemPoolAcceptResult struct {
@@ -274,9 +554,10 @@ func (rc *RpcClient) TestMempoolAccept(tx *wire.MsgTx) (bool, error) {
 		return false, err
 	}
 
+	defer rc.timed("testmempoolaccept")()
 	resultJson, err := rc.rpcClient.RawRequest("testmempoolaccept", []json.RawMessage{jsonData})
 	if err != nil {
-		return false, err
+		return false, rc.rpcError(err)
 	}
 
 	var result []MemPoolAcceptResult
@@ -285,6 +566,9 @@ func (rc *RpcClient) TestMempoolAccept(tx *wire.MsgTx) (bool, error) {
 		return false, err
 	}
 
+	if !result[0].Allowed {
+		util.Logger.Debug("testmempoolaccept rejected transaction", "txid", result[0].Txid, "reason", result[0].RejectReason)
+	}
 	return result[0].Allowed, nil
 }
 
@@ -301,9 +585,10 @@ func (rc *RpcClient) IsMyFreshMyAddress(address string) (bool, error) {
 		return false, nil
 	}
 
+	defer rc.timed("listreceivedbyaddress")()
 	receives, err := rc.rpcClient.ListReceivedByAddressMinConf(0)
 	if err != nil {
-		return false, err
+		return false, rc.rpcError(err)
 	}
 
 	for _, receive := range receives {
@@ -317,18 +602,32 @@ func (rc *RpcClient) IsMyFreshMyAddress(address string) (bool, error) {
 }
 
 func (rc *RpcClient) ListUnspent() ([]btcjson.ListUnspentResult, error) {
+	defer rc.timed("listunspent")()
 	unspent, err := rc.rpcClient.ListUnspent()
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, rc.rpcError(err)
 	}
 	return unspent, nil
 }
 
+// LockUnspent stops the wallet from spending outpoint (or listing it in ListUnspent). It fails if it's
+// already locked, so it can be used to make sure only one caller gets an unspent. Locks don't survive
+// bitcoind restarting
+func (rc *RpcClient) LockUnspent(outpoint wire.OutPoint) error {
+	defer rc.timed("lockunspent")()
+	return rc.rpcError(rc.rpcClient.LockUnspent(false, []*wire.OutPoint{&outpoint}))
+}
+
+func (rc *RpcClient) UnlockUnspent(outpoint wire.OutPoint) error {
+	defer rc.timed("lockunspent")()
+	return rc.rpcError(rc.rpcClient.LockUnspent(true, []*wire.OutPoint{&outpoint}))
+}
+
 type AddressInfoResult struct {
 	Address   string `json:"address"`
 	IsMine    bool   `json:"ismine"`
 	HdKeyPath string `json:"hdkeypath"`
-	IsChange  bool
+	IsChange  bool   `json:"ischange"` // from newer bitcoinds, which we also work out ourselves for older ones
 }
 
 // hack to detect change. Change hdpath looks like  m/0'/1'/9999999'
@@ -341,9 +640,10 @@ func (rc *RpcClient) GetAddressInfo(address string) (*AddressInfoResult, error)
 		return nil, err
 	}
 
+	defer rc.timed("getaddressinfo")()
 	resultJson, err := rc.rpcClient.RawRequest("getaddressinfo", []json.RawMessage{jsonData})
 	if err != nil {
-		return nil, err
+		return nil, rc.rpcError(err)
 	}
 
 	var result AddressInfoResult
@@ -352,7 +652,7 @@ func (rc *RpcClient) GetAddressInfo(address string) (*AddressInfoResult, error)
 		return nil, err
 	}
 
-	result.IsChange = changeHdPathRegex.MatchString(result.HdKeyPath)
+	result.IsChange = result.IsChange || changeHdPathRegex.MatchString(result.HdKeyPath)
 
 	return &result, nil
 }
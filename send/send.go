@@ -1,100 +1,193 @@
+// Package send is the sending side of bustapay. A Sender walks through the protocol one step at a time
+// (BuildTemplate, RequestProposal, Validate, Finalize, Broadcast) so callers can inspect or store each stage,
+// or just call Send to do the lot.
 package send
 
 import (
 	"bytes"
 	"encoding/hex"
-	"fmt"
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/pkg/errors"
-	"github.com/rhavar/bustapay/rpc-client"
 	"github.com/rhavar/bustapay/util"
 	"io/ioutil"
 	"net/http"
 )
 
-func Send(address string, url string, amount int64) error {
-	util.VerboseLog("Sending ", amount, " satoshis to ", address, " via url ", url)
+// Wallet is everything the Sender needs from a wallet. *rpc_client.RpcClient implements it using bitcoin core
+type Wallet interface {
+	CreateRawTransaction(address string, amount int64) (string, error)
+	FundRawTransaction(rawTx string) (*wire.MsgTx, error)
+	SignRawTransactionWithWallet(tx *wire.MsgTx) (*wire.MsgTx, bool, error)
+	SendRawTransaction(tx *wire.MsgTx) (*chainhash.Hash, error)
+	GetTxOut(txid *chainhash.Hash, vout uint32) (*btcjson.GetTxOutResult, error)
+	TestMempoolAccept(tx *wire.MsgTx) (bool, error)
+}
+
+type Sender struct {
+	Wallet     Wallet
+	HttpClient *http.Client // used to talk to the receiver, http.DefaultClient if nil
+}
 
-	rpcClient, err := rpc_client.NewRpcClient()
+func NewSender(wallet Wallet) *Sender {
+	return &Sender{Wallet: wallet}
+}
+
+// Send does every step, and returns the txid of the broadcasted final transaction
+func (s *Sender) Send(address string, url string, amount int64) (*chainhash.Hash, error) {
+	util.Logger.Debug("sending", "amount", amount, "address", address, "url", url)
+
+	template, err := s.BuildTemplate(address, amount)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	partial, err := s.RequestProposal(template, url)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.Validate(template, partial)
+	if err != nil {
+		return nil, err
 	}
-	defer rpcClient.Shutdown()
 
+	final, err := s.Finalize(partial)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Broadcast(final)
+}
+
+// BuildTemplate creates a fully signed transaction paying amount to address. This is what we give the receiver,
+// and it's also what they'll broadcast if we never finalize their proposal
+func (s *Sender) BuildTemplate(address string, amount int64) (*wire.MsgTx, error) {
 	// Step 1. Create a transaction with correct output
-	unfunded, err := rpcClient.CreateRawTransaction(address, amount)
+	unfunded, err := s.Wallet.CreateRawTransaction(address, amount)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	util.VerboseLog("Created unfunded transaction: ", unfunded)
+	util.Logger.Debug("created unfunded transaction", util.KeyTxHex, unfunded)
 
 	// Step 2. Run coin selection, and add change (if applicable)
-	funded, err := rpcClient.FundRawTransaction(unfunded)
+	funded, err := s.Wallet.FundRawTransaction(unfunded)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	util.VerboseLog("Funded transaction: ", util.HexifyTransaction(funded))
+	util.Logger.Debug("funded transaction", util.TxAttr(funded))
 
 	// Step 3. Sign the transaction
-	template, _, err := rpcClient.SignRawTransactionWithWallet(funded)
+	template, _, err := s.Wallet.SignRawTransactionWithWallet(funded)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	util.VerboseLog("Template transaction: ", util.HexifyTransaction(template))
+	util.Logger.Debug("signed template transaction", "txid", template.TxHash().String(), util.TxAttr(template))
+
+	return template, nil
+}
 
-	// Step 4. Send transaction to receiver
-	partial, err := httpPost(template, url)
+// RequestProposal sends the template to the receiver and returns their partial transaction. It is *not*
+// validated, make sure to call Validate before signing it
+func (s *Sender) RequestProposal(template *wire.MsgTx, url string) (*wire.MsgTx, error) {
+	partial, err := s.httpPost(template, url)
 	if err != nil {
+		return nil, err
+	}
+	util.Logger.Debug("got partial transaction back", "txid", partial.TxHash().String(), util.TxAttr(partial))
+
+	return partial, nil
+}
+
+// Validate makes sure the receiver didn't give us anything funny, including that their inputs are properly signed
+func (s *Sender) Validate(template *wire.MsgTx, partial *wire.MsgTx) error {
+	if err := validate(template, partial); err != nil {
 		return err
 	}
-	util.VerboseLog("Got partial transaction back: ", util.HexifyTransaction(partial))
+	return s.verifyContributedInputs(template, partial)
+}
 
-	// Step 5. Validate the receiver didn't give us anything funny
-	err = validate(template, partial)
+// verifyContributedInputs runs the receiver's signatures through the script engine. Segwit signatures don't
+// cover the other inputs' witnesses, so they can be checked before we've signed ours. Taproot ones do cover every
+// input's amount and script though, so we look up all of them, not just the contributed ones
+func (s *Sender) verifyContributedInputs(template *wire.MsgTx, partial *wire.MsgTx) error {
+	templateOutpoints := make(map[wire.OutPoint]struct{})
+	for _, txIn := range template.TxIn {
+		templateOutpoints[txIn.PreviousOutPoint] = struct{}{}
+	}
+
+	prevOuts, err := util.PrevOuts(partial, s.Wallet.GetTxOut)
 	if err != nil {
-		return err
+		return errors.Wrap(err, "partial transaction")
 	}
+	for i, txIn := range partial.TxIn {
+		if _, ok := templateOutpoints[txIn.PreviousOutPoint]; ok {
+			continue
+		}
+		if err := util.VerifyInput(partial, i, prevOuts); err != nil {
+			return errors.Wrapf(err, "contributed input %v (%v)", i, txIn.PreviousOutPoint)
+		}
+	}
+	return nil
+}
 
-	// Step 6. sign the partial transaction
-	final, _, err := rpcClient.SignRawTransactionWithWallet(partial)
+// Finalize signs our inputs of the (validated!) partial transaction
+func (s *Sender) Finalize(partial *wire.MsgTx) (*wire.MsgTx, error) {
+	final, _, err := s.Wallet.SignRawTransactionWithWallet(partial)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	util.VerboseLog("Final transaction: ", util.HexifyTransaction(final))
+	util.Logger.Debug("signed final transaction", "txid", final.TxHash().String(), util.TxAttr(final))
+
+	return final, nil
+}
 
-	// Step 7. broadcast the raw transaction
-	_, err = rpcClient.SendRawTransaction(final)
+// Broadcast checks bitcoind would accept final before sending it, so a bad proposal leaves nothing half done
+// (the receiver will just broadcast the template)
+func (s *Sender) Broadcast(final *wire.MsgTx) (*chainhash.Hash, error) {
+	acceptable, err := s.Wallet.TestMempoolAccept(final)
 	if err != nil {
-		return err
+		return nil, errors.WithStack(err)
+	}
+	if !acceptable {
+		return nil, errors.Errorf("final transaction %v isn't mempool eligible", final.TxHash())
 	}
-	util.VerboseLog("Broadcasted final transaction")
 
-	fmt.Println(final.TxHash())
+	txid, err := s.Wallet.SendRawTransaction(final)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	util.Logger.Info("broadcast final transaction", "txid", txid.String())
 
-	return nil
+	return txid, nil
 }
 
-func httpPost(tx *wire.MsgTx, url string) (*wire.MsgTx, error) {
+func (s *Sender) httpPost(tx *wire.MsgTx, url string) (*wire.MsgTx, error) {
+	httpClient := s.HttpClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
 
 	byteBuffer := bytes.Buffer{}
 	if err := tx.Serialize(&byteBuffer); err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	util.VerboseLog("HTTP POSTing template transaction to ", url)
-	response, err := http.Post(url, "application/binary", &byteBuffer)
+	util.Logger.Debug("posting template transaction", "url", url)
+	response, err := httpClient.Post(url, "application/binary", &byteBuffer)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
+	defer response.Body.Close()
 
 	if response.StatusCode != 200 {
-		util.VerboseLog("Got http status code: ", response.StatusCode)
 
 		body, err := ioutil.ReadAll(response.Body)
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
-		util.VerboseLog("Http response body: ", string(body))
+		util.Logger.Warn("receiver returned an error", "status", response.StatusCode, "body", string(body))
 		return nil, errors.New("got http error from server")
 	}
 
@@ -139,6 +232,13 @@ func validate(template *wire.MsgTx, partial *wire.MsgTx) error {
 	}
 	util.Assert(len(templateTxIns) == len(template.TxIn))
 
+	// Our wallet uses the same sequence for every input, so a contributed input with a different one stands out
+	// (and could opt us out of rbf, or stop our locktime being enforced)
+	templateSequence, uniform := util.UniformSequence(template)
+	if !uniform {
+		return errors.New("template inputs have different sequences")
+	}
+
 	for _, txIn := range partial.TxIn {
 
 		templateTxIn, contains := templateTxIns[txIn.PreviousOutPoint]
@@ -160,13 +260,17 @@ func validate(template *wire.MsgTx, partial *wire.MsgTx) error {
 			usedTemplateInputs[txIn.PreviousOutPoint] = struct{}{}
 
 		} else {
-			// No need to validate, (if it's invalid, the transaction won't propagate..)
+			// The signature is checked against the output it spends in verifyContributedInputs,
 			// but we can sanity check that it has witnesses
 
 			if len(txIn.Witness) == 0 {
 				return errors.New("found contributed input, but without witness")
 			}
 
+			if txIn.Sequence != templateSequence {
+				return errors.New("contributed input has a different sequence")
+			}
+
 			usedContributedInputs[txIn.PreviousOutPoint] = struct{}{}
 		}
 	}
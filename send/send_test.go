@@ -0,0 +1,196 @@
+package send
+
+import (
+	"context"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/rhavar/bustapay/receive"
+	"github.com/rhavar/bustapay/util"
+	"github.com/rhavar/bustapay/wallet"
+)
+
+// testWallet is a built-in wallet on chain, with one confirmed unspent of value. kind is the descriptor's function,
+// e.g. "wpkh" or "tr"
+func testWallet(t *testing.T, chain *wallet.MemoryChain, kind string, seed byte, value int64) *wallet.Wallet {
+	t.Helper()
+	master, err := hdkeychain.NewMaster(append(make([]byte, 31), seed), chain.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := wallet.New(wallet.Config{Descriptor: kind + "(" + master.String() + "/0/*)"}, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	address, err := w.GetNewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkScript, err := txscript.PayToAddrScript(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.Mine(wire.NewTxOut(value, pkScript))
+	if err := w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+// A p2wpkh sender paying a receiver that contributes a taproot input: the receiver's signature commits to the
+// sender's input too, so this only works if both sides look up every input's output
+func TestTaprootContribution(t *testing.T) {
+	chain := wallet.NewMemoryChain(&chaincfg.RegressionNetParams)
+	senderWallet := testWallet(t, chain, "wpkh", 1, 500000)
+	receiverWallet := testWallet(t, chain, "tr", 2, 300000)
+
+	address, err := receiverWallet.GetNewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := NewSender(senderWallet)
+	template, err := sender.BuildTemplate(address.EncodeAddress(), 100000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proposal, err := receive.NewReceiver(receiverWallet).CreateProposal(context.Background(), template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contributed := proposal.Partial.TxIn[proposal.ContributedInput]
+	if inputType := util.InputScriptType(contributed.SignatureScript, contributed.Witness); inputType != util.ScriptTypeP2TR {
+		t.Fatalf("contributed a %v input", inputType)
+	}
+
+	if err := sender.Validate(template, proposal.Partial); err != nil {
+		t.Fatal(err)
+	}
+	final, err := sender.Finalize(proposal.Partial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sender.Broadcast(final); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A contributed taproot signature that's been tampered with is refused, not just passed on to bitcoind
+func TestRefusesBadTaprootSignature(t *testing.T) {
+	chain := wallet.NewMemoryChain(&chaincfg.RegressionNetParams)
+	senderWallet := testWallet(t, chain, "wpkh", 1, 500000)
+	receiverWallet := testWallet(t, chain, "tr", 2, 300000)
+
+	address, err := receiverWallet.GetNewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := NewSender(senderWallet)
+	template, err := sender.BuildTemplate(address.EncodeAddress(), 100000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proposal, err := receive.NewReceiver(receiverWallet).CreateProposal(context.Background(), template)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signature := proposal.Partial.TxIn[proposal.ContributedInput].Witness[0]
+	signature[len(signature)-1] ^= 1
+	if err := sender.Validate(template, proposal.Partial); err == nil {
+		t.Error("accepted a proposal with a bad taproot signature")
+	}
+}
+
+// testProposal is a p2wpkh sender's template, and the receiver's (p2wpkh too) proposal for it
+func testProposal(t *testing.T, chain *wallet.MemoryChain) (*Sender, *wire.MsgTx, *receive.Proposal) {
+	t.Helper()
+	senderWallet := testWallet(t, chain, "wpkh", 1, 500000)
+	receiverWallet := testWallet(t, chain, "wpkh", 2, 300000)
+
+	address, err := receiverWallet.GetNewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := NewSender(senderWallet)
+	template, err := sender.BuildTemplate(address.EncodeAddress(), 100000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proposal, err := receive.NewReceiver(receiverWallet).CreateProposal(context.Background(), template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sender, template, proposal
+}
+
+// The receiver's signature has to be good for exactly the transaction we're going to sign
+func TestRefusesBadContributedInputs(t *testing.T) {
+	tests := map[string]func(partial *wire.MsgTx, contributed int){
+		"tampered signature": func(partial *wire.MsgTx, contributed int) {
+			signature := partial.TxIn[contributed].Witness[0]
+			signature[10] ^= 1
+		},
+		"signed for another key": func(partial *wire.MsgTx, contributed int) {
+			pubKey := partial.TxIn[contributed].Witness[1]
+			pubKey[len(pubKey)-1] ^= 1
+		},
+		"inputs reordered after signing": func(partial *wire.MsgTx, contributed int) {
+			partial.TxIn[0], partial.TxIn[1] = partial.TxIn[1], partial.TxIn[0]
+		},
+		"unsigned": func(partial *wire.MsgTx, contributed int) {
+			partial.TxIn[contributed].Witness = nil
+		},
+		"spends an output that doesn't exist": func(partial *wire.MsgTx, contributed int) {
+			partial.TxIn[contributed].PreviousOutPoint.Index += 100
+		},
+	}
+
+	for name, change := range tests {
+		chain := wallet.NewMemoryChain(&chaincfg.RegressionNetParams)
+		sender, template, proposal := testProposal(t, chain)
+		if err := sender.Validate(template, proposal.Partial); err != nil {
+			t.Fatalf("%v: the untouched proposal is refused: %v", name, err)
+		}
+
+		change(proposal.Partial, proposal.ContributedInput)
+		if err := sender.Validate(template, proposal.Partial); err == nil {
+			t.Errorf("%v: accepted", name)
+		}
+	}
+}
+
+// Broadcast makes sure the final transaction would be accepted first, so a bad one is never half sent
+func TestBroadcastTestsFirst(t *testing.T) {
+	chain := wallet.NewMemoryChain(&chaincfg.RegressionNetParams)
+	sender, template, proposal := testProposal(t, chain)
+	if err := sender.Validate(template, proposal.Partial); err != nil {
+		t.Fatal(err)
+	}
+
+	// not signed by us yet
+	if _, err := sender.Broadcast(proposal.Partial); err == nil {
+		t.Fatal("broadcast a final transaction without our signatures")
+	}
+	for _, txIn := range proposal.Partial.TxIn {
+		if result, _ := chain.GetTxOut(&txIn.PreviousOutPoint.Hash, txIn.PreviousOutPoint.Index); result == nil {
+			t.Errorf("%v was spent by a transaction that should never have been sent", txIn.PreviousOutPoint)
+		}
+	}
+
+	final, err := sender.Finalize(proposal.Partial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txid, err := sender.Broadcast(final)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *txid != final.TxHash() {
+		t.Errorf("broadcast %v, not the final transaction %v", txid, final.TxHash())
+	}
+}
@@ -0,0 +1,65 @@
+package signer
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rhavar/bustapay/psbt"
+	"github.com/rhavar/bustapay/util"
+)
+
+// FileSigner writes the psbt to Dir/<txid>.psbt (base64), and waits for whoever does the signing to write the
+// signed psbt to Dir/<txid>.signed.psbt (base64 or binary). Both files are removed when it's done, or gives up.
+//
+// The signed psbt is read as soon as that name exists, so it has to appear all at once: write it somewhere else in
+// Dir (e.g. <txid>.signed.psbt.tmp) and rename it into place, which is atomic. Otherwise we could read half of it
+type FileSigner struct {
+	Dir          string
+	PollInterval time.Duration // how often to look for the signed psbt, a second if 0
+}
+
+func (f *FileSigner) SignPsbt(ctx context.Context, packet *psbt.Packet, input int) (*psbt.Packet, error) {
+	pollInterval := f.PollInterval
+	if pollInterval <= 0 {
+		pollInterval = time.Second
+	}
+
+	encoded, err := packet.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	txid := packet.UnsignedTx.TxHash().String()
+	unsignedPath := filepath.Join(f.Dir, txid+".psbt")
+	signedPath := filepath.Join(f.Dir, txid+".signed.psbt")
+
+	if err := ioutil.WriteFile(unsignedPath, []byte(encoded), 0600); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer os.Remove(unsignedPath)
+	defer os.Remove(signedPath)
+
+	util.LoggerFrom(ctx).Info("waiting for psbt to be signed", "path", unsignedPath, "input", input)
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		b, err := ioutil.ReadFile(signedPath)
+		if err == nil {
+			return readPsbt(b)
+		}
+		if !os.IsNotExist(err) {
+			return nil, errors.WithStack(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, errors.WithStack(ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
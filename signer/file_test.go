@@ -0,0 +1,84 @@
+package signer
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/rhavar/bustapay/psbt"
+)
+
+// signFiles does what someone signing air-gapped would: waits for a psbt to show up in dir, signs it with key, and
+// renames the signed one into place
+func signFiles(t *testing.T, ctx context.Context, dir string, key *btcec.PrivateKey) {
+	for ctx.Err() == nil {
+		matches, _ := filepath.Glob(filepath.Join(dir, "*.psbt"))
+		for _, path := range matches {
+			if strings.HasSuffix(path, ".signed.psbt") {
+				continue
+			}
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				continue
+			}
+			packet, err := psbt.Decode(string(b))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			signed, err := (&KeySigner{Key: key}).SignPsbt(ctx, packet, 1)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			encoded, _ := signed.Encode()
+			signedPath := strings.TrimSuffix(path, ".psbt") + ".signed.psbt"
+			ioutil.WriteFile(signedPath+".tmp", []byte(encoded), 0600)
+			os.Rename(signedPath+".tmp", signedPath)
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestFileSigner(t *testing.T) {
+	key, _ := btcec.NewPrivateKey()
+	dir := t.TempDir()
+	packet := testPsbt(t, wire.NewTxOut(100000, p2wpkh(key)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go signFiles(t, ctx, dir, key)
+
+	signed, err := (&FileSigner{Dir: dir, PollInterval: 10 * time.Millisecond}).SignPsbt(ctx, packet, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSigned(t, packet, signed)
+
+	if left, _ := ioutil.ReadDir(dir); len(left) != 0 {
+		t.Errorf("left %v files behind", len(left))
+	}
+}
+
+// Nobody signing is given up on when the context is done, and the psbt is taken away again
+func TestFileSignerTimeout(t *testing.T) {
+	key, _ := btcec.NewPrivateKey()
+	dir := t.TempDir()
+	packet := testPsbt(t, wire.NewTxOut(100000, p2wpkh(key)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := (&FileSigner{Dir: dir, PollInterval: 10 * time.Millisecond}).SignPsbt(ctx, packet, 1); err == nil {
+		t.Error("signed without anyone signing")
+	}
+	if left, _ := ioutil.ReadDir(dir); len(left) != 0 {
+		t.Errorf("left %v files behind", len(left))
+	}
+}
@@ -0,0 +1,66 @@
+package signer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rhavar/bustapay/psbt"
+)
+
+// a psbt for one proposal is a few kilobytes, a response much bigger than this isn't one
+const maxResponseSize = 1 << 20
+
+// HttpSigner POSTs the psbt (base64, as text/plain) to Url with the input to sign as ?input=n, and expects the
+// signed psbt back in the response body (base64 or binary)
+type HttpSigner struct {
+	Url    string
+	Client *http.Client // http.DefaultClient if nil
+}
+
+func (h *HttpSigner) SignPsbt(ctx context.Context, packet *psbt.Packet, input int) (*psbt.Packet, error) {
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	encoded, err := packet.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	separator := "?"
+	if strings.Contains(h.Url, "?") {
+		separator = "&"
+	}
+	url := fmt.Sprintf("%v%vinput=%v", h.Url, separator, input)
+
+	request, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(encoded))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	request.Header.Set("Content-Type", "text/plain")
+
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, maxResponseSize+1))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(body) > maxResponseSize {
+		return nil, errors.Errorf("signer's response is over %v bytes", maxResponseSize)
+	}
+	if response.StatusCode != 200 {
+		return nil, errors.Errorf("signer returned %v: %v", response.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return readPsbt(body)
+}
@@ -0,0 +1,109 @@
+package signer
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/rhavar/bustapay/psbt"
+)
+
+// keySigningServer is a signing service that signs with key, answering in binary if binary is set (base64 if not)
+func keySigningServer(t *testing.T, key *btcec.PrivateKey, binary bool) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "text/plain" || r.URL.Query().Get("input") != "1" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		packet, err := psbt.Decode(string(body))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		signed, err := (&KeySigner{Key: key}).SignPsbt(r.Context(), packet, 1)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if binary {
+			b, _ := signed.Serialize()
+			w.Write(b)
+		} else {
+			encoded, _ := signed.Encode()
+			w.Write([]byte(encoded + "\n"))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestHttpSigner(t *testing.T) {
+	key, _ := btcec.NewPrivateKey()
+	for _, binary := range []bool{false, true} {
+		server := keySigningServer(t, key, binary)
+		packet := testPsbt(t, wire.NewTxOut(100000, p2wpkh(key)))
+
+		signed, err := (&HttpSigner{Url: server.URL}).SignPsbt(context.Background(), packet, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSigned(t, packet, signed)
+
+		// and with a query string of its own
+		if _, err := (&HttpSigner{Url: server.URL + "?wallet=store1"}).SignPsbt(context.Background(), packet, 1); err != nil {
+			t.Errorf("with a query string: %v", err)
+		}
+	}
+}
+
+func TestHttpSignerErrors(t *testing.T) {
+	key, _ := btcec.NewPrivateKey()
+	other, _ := btcec.NewPrivateKey()
+	server := keySigningServer(t, key, false)
+
+	// the service's error is passed on
+	packet := testPsbt(t, wire.NewTxOut(100000, p2wpkh(other)))
+	if _, err := (&HttpSigner{Url: server.URL}).SignPsbt(context.Background(), packet, 1); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("signing for someone else's key got %v", err)
+	}
+
+	huge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("A", maxResponseSize+1)))
+	}))
+	defer huge.Close()
+	packet = testPsbt(t, wire.NewTxOut(100000, p2wpkh(key)))
+	if _, err := (&HttpSigner{Url: huge.URL}).SignPsbt(context.Background(), packet, 1); err == nil || !strings.Contains(err.Error(), "bytes") {
+		t.Errorf("a response that's too big got %v", err)
+	}
+}
+
+// A signer that never answers is given up on when the context is done
+func TestHttpSignerTimeout(t *testing.T) {
+	answer := make(chan struct{})
+	stuck := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-answer
+	}))
+	defer stuck.Close()
+	defer close(answer)
+
+	key, _ := btcec.NewPrivateKey()
+	packet := testPsbt(t, wire.NewTxOut(100000, p2wpkh(key)))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := (&HttpSigner{Url: stuck.URL}).SignPsbt(ctx, packet, 1); err == nil {
+		t.Error("signed without an answer")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("didn't give up when the context was done")
+	}
+}
@@ -0,0 +1,71 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+	"github.com/rhavar/bustapay/psbt"
+)
+
+// KeySigner signs with a private key it holds. It's meant for testing, and only knows how to sign p2wpkh inputs, and
+// p2tr ones with the key path (the output key being the key tweaked with no script tree, like bitcoind's tr(KEY))
+type KeySigner struct {
+	Key *btcec.PrivateKey
+}
+
+// NewKeySigner takes the key in wallet import format, like bitcoind's dumpprivkey gives out
+func NewKeySigner(wif string) (*KeySigner, error) {
+	decoded, err := btcutil.DecodeWIF(wif)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &KeySigner{Key: decoded.PrivKey}, nil
+}
+
+func (k *KeySigner) SignPsbt(ctx context.Context, packet *psbt.Packet, input int) (*psbt.Packet, error) {
+	if input < 0 || input >= len(packet.Inputs) {
+		return nil, errors.Errorf("psbt has no input %v", input)
+	}
+	prevOut := packet.Inputs[input].WitnessUtxo
+	if prevOut == nil {
+		return nil, errors.Errorf("psbt doesn't say what input %v spends", input)
+	}
+
+	// a taproot sighash commits to every input's amount and script, so the psbt has to say what they all spend
+	prevOuts, err := packet.PrevOuts()
+	if err != nil {
+		return nil, err
+	}
+	tx := packet.UnsignedTx
+	sigHashes := txscript.NewTxSigHashes(tx, prevOuts)
+
+	var witness wire.TxWitness
+	pubKeyHash := btcutil.Hash160(k.Key.PubKey().SerializeCompressed())
+	p2wpkh := append([]byte{txscript.OP_0, txscript.OP_DATA_20}, pubKeyHash...)
+	outputKey := txscript.ComputeTaprootKeyNoScript(k.Key.PubKey())
+	p2tr := append([]byte{txscript.OP_1, txscript.OP_DATA_32}, schnorr.SerializePubKey(outputKey)...)
+	switch {
+	case bytes.Equal(prevOut.PkScript, p2wpkh):
+		witness, err = txscript.WitnessSignature(tx, sigHashes, input, prevOut.Value, prevOut.PkScript,
+			txscript.SigHashAll, k.Key, true)
+	case bytes.Equal(prevOut.PkScript, p2tr):
+		witness, err = txscript.TaprootWitnessSignature(tx, sigHashes, input, prevOut.Value, prevOut.PkScript,
+			txscript.SigHashDefault, k.Key)
+	default:
+		return nil, errors.Errorf("input %v isn't a p2wpkh or p2tr output of our key", input)
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	signed := *packet
+	signed.Inputs = append([]psbt.Input(nil), packet.Inputs...)
+	signed.Inputs[input].FinalScriptWitness = witness
+	return &signed, nil
+}
@@ -0,0 +1,130 @@
+package signer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/rhavar/bustapay/psbt"
+	"github.com/rhavar/bustapay/util"
+)
+
+// testPsbt spends prevOut (as input 1, after someone else's p2wpkh input)
+func testPsbt(t *testing.T, prevOut *wire.TxOut) *psbt.Packet {
+	t.Helper()
+	other, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx := wire.NewMsgTx(2)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{1}, 0), nil, nil))
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{2}, 1), nil, nil))
+	tx.AddTxOut(wire.NewTxOut(90000, prevOut.PkScript))
+
+	packet := psbt.New(tx)
+	packet.Inputs[0].WitnessUtxo = wire.NewTxOut(50000, p2wpkh(other))
+	packet.Inputs[1].WitnessUtxo = prevOut
+	return packet
+}
+
+func p2wpkh(key *btcec.PrivateKey) []byte {
+	pubKeyHash := btcutil.Hash160(key.PubKey().SerializeCompressed())
+	return append([]byte{txscript.OP_0, txscript.OP_DATA_20}, pubKeyHash...)
+}
+
+func p2tr(key *btcec.PrivateKey) []byte {
+	outputKey := txscript.ComputeTaprootKeyNoScript(key.PubKey())
+	return append([]byte{txscript.OP_1, txscript.OP_DATA_32}, schnorr.SerializePubKey(outputKey)...)
+}
+
+// checkSigned is that the key signer signed input 1 of packet, and only that, and the signature verifies
+func checkSigned(t *testing.T, packet *psbt.Packet, signed *psbt.Packet) {
+	t.Helper()
+	if !signed.Inputs[1].IsFinalized() {
+		t.Fatal("input isn't finalized")
+	}
+	if signed.Inputs[0].IsFinalized() || packet.Inputs[1].IsFinalized() {
+		t.Error("signed more than it was asked to")
+	}
+
+	prevOuts, err := packet.PrevOuts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := packet.UnsignedTx.Copy()
+	tx.TxIn[1].Witness = signed.Inputs[1].FinalScriptWitness
+	if err := util.VerifyInput(tx, 1, prevOuts); err != nil {
+		t.Errorf("signature doesn't verify: %v", err)
+	}
+}
+
+func TestKeySignerSignsP2wpkh(t *testing.T) {
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wif, err := btcutil.NewWIF(key, &chaincfg.RegressionNetParams, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := NewKeySigner(wif.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet := testPsbt(t, wire.NewTxOut(100000, p2wpkh(key)))
+	signed, err := k.SignPsbt(context.Background(), packet, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSigned(t, packet, signed)
+}
+
+func TestKeySignerSignsP2tr(t *testing.T) {
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet := testPsbt(t, wire.NewTxOut(100000, p2tr(key)))
+	signed, err := (&KeySigner{Key: key}).SignPsbt(context.Background(), packet, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSigned(t, packet, signed)
+
+	// the signature commits to the other input's amount, so it's no good if that's not what it really spends
+	prevOuts, _ := packet.PrevOuts()
+	prevOuts.AddPrevOut(packet.UnsignedTx.TxIn[0].PreviousOutPoint, wire.NewTxOut(50001, packet.Inputs[0].WitnessUtxo.PkScript))
+	tx := packet.UnsignedTx.Copy()
+	tx.TxIn[1].Witness = signed.Inputs[1].FinalScriptWitness
+	if err := util.VerifyInput(tx, 1, prevOuts); err == nil {
+		t.Error("taproot signature verified against the wrong amount for another input")
+	}
+}
+
+func TestKeySignerRefusesOtherOutputs(t *testing.T) {
+	key, _ := btcec.NewPrivateKey()
+	other, _ := btcec.NewPrivateKey()
+	packet := testPsbt(t, wire.NewTxOut(100000, p2wpkh(other)))
+
+	if _, err := (&KeySigner{Key: key}).SignPsbt(context.Background(), packet, 1); err == nil {
+		t.Error("signed an output of another key")
+	}
+	if _, err := (&KeySigner{Key: key}).SignPsbt(context.Background(), packet, 0); err == nil {
+		t.Error("signed an input that isn't ours")
+	}
+
+	packet = testPsbt(t, wire.NewTxOut(100000, p2wpkh(key)))
+	packet.Inputs[0].WitnessUtxo = nil
+	if _, err := (&KeySigner{Key: key}).SignPsbt(context.Background(), packet, 1); err == nil {
+		t.Error("signed without knowing what every input spends")
+	}
+}
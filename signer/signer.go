@@ -0,0 +1,22 @@
+// Package signer has ways for a receiver to sign its contributed input when the keys aren't in bitcoind (e.g. a
+// watch-only wallet). They all implement receive.Signer: each is given a psbt, and returns it with the input signed
+// and finalized.
+//
+//   - HttpSigner posts the psbt to a signing service
+//   - FileSigner drops the psbt in a directory, and waits for a signed one to show up (e.g. for air-gapped signing)
+//   - KeySigner signs with a private key it holds, for testing
+package signer
+
+import (
+	"bytes"
+
+	"github.com/rhavar/bustapay/psbt"
+)
+
+// readPsbt takes a psbt either as binary or base64, since signers can give back either
+func readPsbt(b []byte) (*psbt.Packet, error) {
+	if bytes.HasPrefix(b, []byte("psbt\xff")) {
+		return psbt.Parse(b)
+	}
+	return psbt.Decode(string(bytes.TrimSpace(b)))
+}
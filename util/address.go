@@ -0,0 +1,134 @@
+package util
+
+import (
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/pkg/errors"
+)
+
+// DecodeAddress is btcutil.DecodeAddress (which understands bech32m taproot addresses), that also fails if the
+// address is for another network. btcutil only uses params to tell base58 addresses apart
+func DecodeAddress(address string, params *chaincfg.Params) (btcutil.Address, error) {
+	decoded, err := btcutil.DecodeAddress(address, params)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if !decoded.IsForNet(params) {
+		return nil, errors.Errorf("address %v is not for %v", address, params.Name)
+	}
+	return decoded, nil
+}
+
+// ExtractAddress returns the address pkScript pays, if it's a single address (including taproot)
+func ExtractAddress(pkScript []byte, params *chaincfg.Params) (btcutil.Address, error) {
+	_, addresses, _, err := txscript.ExtractPkScriptAddrs(pkScript, params)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(addresses) != 1 {
+		return nil, errors.Errorf("script pays %v addresses", len(addresses))
+	}
+	return addresses[0], nil
+}
+
+// PayToAddrScript is txscript.PayToAddrScript with a stack trace
+func PayToAddrScript(address btcutil.Address) ([]byte, error) {
+	script, err := txscript.PayToAddrScript(address)
+	return script, errors.WithStack(err)
+}
+
+// Script types, for working out what kind of inputs a transaction has
+const (
+	ScriptTypeP2PKH      = "p2pkh"
+	ScriptTypeP2SH       = "p2sh" // that we can't see inside of
+	ScriptTypeP2SHP2WPKH = "p2sh-p2wpkh"
+	ScriptTypeP2SHP2WSH  = "p2sh-p2wsh"
+	ScriptTypeP2WPKH     = "p2wpkh"
+	ScriptTypeP2WSH      = "p2wsh"
+	ScriptTypeP2TR       = "p2tr"
+	ScriptTypeUnknown    = "unknown"
+)
+
+// ScriptType is the type of an output script. redeemScript is optional, and only used to see inside p2sh
+func ScriptType(pkScript []byte, redeemScript []byte) string {
+	switch {
+	case txscript.IsPayToTaproot(pkScript):
+		return ScriptTypeP2TR
+	case len(pkScript) == 22 && pkScript[0] == txscript.OP_0 && pkScript[1] == txscript.OP_DATA_20:
+		return ScriptTypeP2WPKH
+	case len(pkScript) == 34 && pkScript[0] == txscript.OP_0 && pkScript[1] == txscript.OP_DATA_32:
+		return ScriptTypeP2WSH
+	case txscript.IsPayToScriptHash(pkScript):
+		switch ScriptType(redeemScript, nil) {
+		case ScriptTypeP2WPKH:
+			return ScriptTypeP2SHP2WPKH
+		case ScriptTypeP2WSH:
+			return ScriptTypeP2SHP2WSH
+		}
+		return ScriptTypeP2SH
+	case txscript.GetScriptClass(pkScript) == txscript.PubKeyHashTy:
+		return ScriptTypeP2PKH
+	}
+	return ScriptTypeUnknown
+}
+
+// InputScriptType works out the type of output a signed input spends, from what it was signed with
+func InputScriptType(signatureScript []byte, witness [][]byte) string {
+	if len(signatureScript) > 0 {
+		if len(witness) == 0 {
+			return ScriptTypeUnknown // p2pkh, or any sort of p2sh
+		}
+		// for nested segwit the signature script just pushes the redeem script
+		if len(signatureScript) > 1 && int(signatureScript[0]) == len(signatureScript)-1 {
+			switch ScriptType(signatureScript[1:], nil) {
+			case ScriptTypeP2WPKH:
+				return ScriptTypeP2SHP2WPKH
+			case ScriptTypeP2WSH:
+				return ScriptTypeP2SHP2WSH
+			}
+		}
+		return ScriptTypeUnknown
+	}
+
+	// a taproot witness might have an annex on the end
+	if len(witness) > 1 && len(witness[len(witness)-1]) > 0 && witness[len(witness)-1][0] == 0x50 {
+		witness = witness[:len(witness)-1]
+	}
+
+	switch {
+	case len(witness) == 1 && (len(witness[0]) == 64 || len(witness[0]) == 65):
+		return ScriptTypeP2TR // key path spend
+	case len(witness) == 2 && len(witness[1]) == 33 && (witness[1][0] == 2 || witness[1][0] == 3):
+		return ScriptTypeP2WPKH
+	case len(witness) >= 2 && isControlBlock(witness[len(witness)-1]):
+		return ScriptTypeP2TR // script path spend
+	case len(witness) >= 1:
+		return ScriptTypeP2WSH
+	}
+	return ScriptTypeUnknown
+}
+
+func isControlBlock(b []byte) bool {
+	return len(b) >= 33 && (len(b)-33)%32 == 0 && b[0]&0xfe == 0xc0
+}
+
+// InputVSize is roughly how many vbytes spending an output of scriptType takes (with a single signature, and
+// taproot using the key path). Unknown types are assumed to be p2pkh, which is the biggest
+func InputVSize(scriptType string) float64 {
+	switch scriptType {
+	case ScriptTypeP2TR:
+		return 57.5 // 41 bytes + a 64 byte schnorr signature in the witness
+	case ScriptTypeP2WPKH:
+		return 68
+	case ScriptTypeP2SHP2WPKH:
+		return 91
+	default:
+		return 148
+	}
+}
+
+// OutputVSize is how many vbytes an output paying pkScript takes
+func OutputVSize(pkScript []byte) float64 {
+	return float64(8 + 1 + len(pkScript))
+}
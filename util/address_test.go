@@ -0,0 +1,111 @@
+package util
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+func paramsFor(address string) *chaincfg.Params {
+	if strings.HasPrefix(strings.ToLower(address), "tb1") {
+		return &chaincfg.TestNet3Params
+	}
+	return &chaincfg.MainNetParams
+}
+
+// BIP350's valid segwit addresses, and the scripts they pay. btcutil only knows how to pay witness v0 and v1 (with
+// a 32 byte program, i.e. taproot), so the others have to be refused rather than paid some other way
+func TestDecodeAddressBip350Valid(t *testing.T) {
+	tests := []struct {
+		address     string
+		pkScript    string
+		scriptType  string
+		unsupported bool
+	}{
+		{"BC1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KV8F3T4", "0014751e76e8199196d454941c45d1b3a323f1433bd6", ScriptTypeP2WPKH, false},
+		{"tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3q0sl5k7", "00201863143c14c5166804bd19203356da136c985678cd4d27a1b8c6329604903262", ScriptTypeP2WSH, false},
+		{"bc1pw508d6qejxtdg4y5r3zarvary0c5xw7kw508d6qejxtdg4y5r3zarvary0c5xw7kt5nd6y", "5128751e76e8199196d454941c45d1b3a323f1433bd6751e76e8199196d454941c45d1b3a323f1433bd6", "", true},
+		{"BC1SW50QGDZ25J", "6002751e", "", true},
+		{"bc1zw508d6qejxtdg4y5r3zarvaryvaxxpcs", "5210751e76e8199196d454941c45d1b3a323", "", true},
+		{"tb1qqqqqp399et2xygdj5xreqhjjvcmzhxw4aywxecjdzew6hylgvsesrxh6hy", "0020000000c4a5cad46221b2a187905e5266362b99d5e91c6ce24d165dab93e86433", ScriptTypeP2WSH, false},
+		{"tb1pqqqqp399et2xygdj5xreqhjjvcmzhxw4aywxecjdzew6hylgvsesf3hn0c", "5120000000c4a5cad46221b2a187905e5266362b99d5e91c6ce24d165dab93e86433", ScriptTypeP2TR, false},
+		{"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0", "512079be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798", ScriptTypeP2TR, false},
+	}
+
+	for _, test := range tests {
+		params := paramsFor(test.address)
+		decoded, err := DecodeAddress(test.address, params)
+		if test.unsupported {
+			if err == nil {
+				t.Errorf("%v: decoded an address of a witness version we can't pay", test.address)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.address, err)
+			continue
+		}
+
+		pkScript, err := PayToAddrScript(decoded)
+		if err != nil {
+			t.Errorf("%v: %v", test.address, err)
+			continue
+		}
+		if hex.EncodeToString(pkScript) != test.pkScript {
+			t.Errorf("%v: pays %x, not %v", test.address, pkScript, test.pkScript)
+		}
+		if scriptType := ScriptType(pkScript, nil); scriptType != test.scriptType {
+			t.Errorf("%v: script type is %v, not %v", test.address, scriptType, test.scriptType)
+		}
+
+		// and back again, always lower case
+		extracted, err := ExtractAddress(pkScript, params)
+		if err != nil {
+			t.Errorf("%v: %v", test.address, err)
+		} else if extracted.EncodeAddress() != strings.ToLower(test.address) {
+			t.Errorf("%v: extracted as %v", test.address, extracted.EncodeAddress())
+		}
+	}
+}
+
+// BIP350's invalid addresses, each of which has to be refused
+func TestDecodeAddressBip350Invalid(t *testing.T) {
+	tests := []struct {
+		address string
+		reason  string
+	}{
+		{"tc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vq5zuyut", "invalid human-readable part"},
+		{"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqh2y7hd", "invalid checksum (bech32 instead of bech32m)"},
+		{"tb1z0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqglt7rf", "invalid checksum (bech32 instead of bech32m)"},
+		{"BC1S0XLXVLHEMJA6C4DQV22UAPCTQUPFHLXM9H8Z3K2E72Q4K9HCZ7VQ54WELL", "invalid checksum (bech32 instead of bech32m)"},
+		{"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kemeawh", "invalid checksum (bech32m instead of bech32)"},
+		{"tb1q0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vq24jc47", "invalid checksum (bech32m instead of bech32)"},
+		{"bc1p38j9r5y49hruaue7wxjce0updqjuyyx0kh56v8s25huc6995vvpql3jow4", "invalid character in checksum"},
+		{"BC130XLXVLHEMJA6C4DQV22UAPCTQUPFHLXM9H8Z3K2E72Q4K9HCZ7VQ7ZWS8R", "invalid witness version"},
+		{"bc1pw5dgrnzv", "invalid program length (1 byte)"},
+		{"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7v8n0nx0muaewav253zgeav", "invalid program length (41 bytes)"},
+		{"BC1QR508D6QEJXTDG4Y5R3ZARVARYV98GJ9P", "invalid program length for witness version 0"},
+		{"tb1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vq47Zagq", "mixed case"},
+		{"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7v07qwwzcrf", "zero padding of more than 4 bits"},
+		{"tb1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vpggkg4j", "non-zero padding in 8-to-5 conversion"},
+		{"bc1gmk9yu", "empty data section"},
+	}
+
+	for _, test := range tests {
+		if decoded, err := DecodeAddress(test.address, paramsFor(test.address)); err == nil {
+			t.Errorf("%v (%v): decoded as %v", test.address, test.reason, decoded)
+		}
+	}
+}
+
+// A taproot address is only good on the network it's for
+func TestDecodeAddressWrongNetwork(t *testing.T) {
+	if _, err := DecodeAddress("bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0", &chaincfg.TestNet3Params); err == nil {
+		t.Error("decoded a mainnet taproot address for testnet")
+	}
+	if _, err := DecodeAddress("tb1pqqqqp399et2xygdj5xreqhjjvcmzhxw4aywxecjdzew6hylgvsesf3hn0c", &chaincfg.MainNetParams); err == nil {
+		t.Error("decoded a testnet taproot address for mainnet")
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !go1.22
+// +build !go1.22
+
+package util
+
+// bustapay needs go 1.22 or newer. log/slog is from 1.21, and the admin api's routes (e.g. "GET /payments/{id}")
+// need 1.22, older versions quietly treat them as literal paths. This stops it building at all, with this name in
+// the error, rather than serving an admin api that 404s
+var _ = bustapayNeedsGo1_22OrNewer
@@ -1,12 +1,116 @@
 package util
 
 import (
-	"github.com/spf13/viper"
-	"log"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+)
+
+// Logger is what everything in bustapay logs to. Library users can replace it, or call ConfigureLogging
+var Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{ReplaceAttr: plainErrors}))
+
+// Attribute keys that can be redacted. Anything logged under these keys goes through the redaction settings,
+// so make sure to use them (e.g. via TxAttr) instead of putting the values in the message.
+const (
+	KeyTxHex    = "tx_hex"
+	KeyRpcUser  = "rpc_user"
+	KeyRpcPass  = "rpc_pass"
+	KeyClientIp = "client_ip"
 )
 
-func VerboseLog(vals ...interface{}) {
-	if viper.GetBool("verbose") {
-		log.Println(vals...)
+// Things that can be redacted from logs, e.g.  --log_redact=tx,credentials,ips
+const (
+	RedactTransactions = "tx"
+	RedactCredentials  = "credentials"
+	RedactIps          = "ips"
+)
+
+type LogConfig struct {
+	Level  string   // debug, info, warn or error
+	JSON   bool     // otherwise logfmt style text
+	Redact []string // any of RedactTransactions, RedactCredentials, RedactIps
+}
+
+func ConfigureLogging(w io.Writer, config LogConfig) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.Level)); err != nil {
+		return errors.Errorf("unknown log level %q, expected one of debug, info, warn, error", config.Level)
+	}
+
+	redactedKeys := make(map[string]bool)
+	for _, r := range config.Redact {
+		switch strings.TrimSpace(r) {
+		case RedactTransactions:
+			redactedKeys[KeyTxHex] = true
+		case RedactCredentials:
+			redactedKeys[KeyRpcUser] = true
+			redactedKeys[KeyRpcPass] = true
+		case RedactIps:
+			redactedKeys[KeyClientIp] = true
+		case "":
+		default:
+			return errors.Errorf("unknown log redaction %q, expected one of tx, credentials, ips", r)
+		}
+	}
+
+	opts := &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if redactedKeys[a.Key] {
+				return slog.String(a.Key, "[redacted]")
+			}
+			return plainErrors(groups, a)
+		},
+	}
+
+	if config.JSON {
+		Logger = slog.New(slog.NewJSONHandler(w, opts))
+	} else {
+		Logger = slog.New(slog.NewTextHandler(w, opts))
+	}
+	return nil
+}
+
+// errors from github.com/pkg/errors would otherwise be logged with their whole stack trace
+func plainErrors(groups []string, a slog.Attr) slog.Attr {
+	if err, ok := a.Value.Any().(error); ok {
+		return slog.String(a.Key, err.Error())
+	}
+	return a
+}
+
+// TxAttr logs a transaction as hex (which can be redacted)
+func TxAttr(tx *wire.MsgTx) slog.Attr {
+	return slog.String(KeyTxHex, HexifyTransaction(tx))
+}
+
+// NewCorrelationId is a random id used to tie together all the log lines (and records) of a single payment
+func NewCorrelationId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+type loggerKey struct{}
+
+// WithLogger returns a context carrying logger, so it can be picked up further down with LoggerFrom
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// LoggerFrom returns the logger carried by ctx, or Logger if there isn't one
+func LoggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
 	}
+	return Logger
 }
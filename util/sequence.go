@@ -0,0 +1,49 @@
+package util
+
+import (
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// Wallets use the same sequence for every input, and it decides a lot: whether the transaction signals rbf, whether
+// its locktime (e.g. anti-fee-sniping) is enforced at all, and with version 2 whether there's a relative locktime.
+// Anyone adding an input needs to copy it, or the transaction stands out (or worse, means something different).
+
+// UniformSequence is the sequence all of tx's inputs use, ok is false if they don't all use the same one
+func UniformSequence(tx *wire.MsgTx) (sequence uint32, ok bool) {
+	if len(tx.TxIn) == 0 {
+		return 0, false
+	}
+	sequence = tx.TxIn[0].Sequence
+	for _, txIn := range tx.TxIn[1:] {
+		if txIn.Sequence != sequence {
+			return 0, false
+		}
+	}
+	return sequence, true
+}
+
+// SignalsRbf is whether sequence opts in to replace-by-fee (BIP125)
+func SignalsRbf(sequence uint32) bool {
+	return sequence < wire.MaxTxInSequenceNum-1
+}
+
+// IsAntiFeeSniping is whether tx's locktime looks like a wallet's anti-fee-sniping: a block height that's actually
+// enforced (because an input isn't final)
+func IsAntiFeeSniping(tx *wire.MsgTx) bool {
+	if tx.LockTime == 0 || tx.LockTime >= txscript.LockTimeThreshold {
+		return false
+	}
+	for _, txIn := range tx.TxIn {
+		if txIn.Sequence != wire.MaxTxInSequenceNum {
+			return true
+		}
+	}
+	return false
+}
+
+// HasRelativeLockTime is whether sequence, in a transaction of version, locks its input for a while after the
+// output it spends confirmed (BIP68)
+func HasRelativeLockTime(version int32, sequence uint32) bool {
+	return version >= 2 && sequence&wire.SequenceLockTimeDisabled == 0 && sequence&wire.SequenceLockTimeMask != 0
+}
@@ -0,0 +1,51 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+func sequenceTx(lockTime uint32, sequences ...uint32) *wire.MsgTx {
+	tx := wire.NewMsgTx(2)
+	tx.LockTime = lockTime
+	for _, sequence := range sequences {
+		txIn := wire.NewTxIn(&wire.OutPoint{}, nil, nil)
+		txIn.Sequence = sequence
+		tx.AddTxIn(txIn)
+	}
+	return tx
+}
+
+func TestIsAntiFeeSniping(t *testing.T) {
+	tests := []struct {
+		tx   *wire.MsgTx
+		want bool
+	}{
+		{sequenceTx(800000, wire.MaxTxInSequenceNum-2, wire.MaxTxInSequenceNum-2), true},
+		{sequenceTx(800000, wire.MaxTxInSequenceNum-1), true},                           // no rbf, still enforced
+		{sequenceTx(800000, wire.MaxTxInSequenceNum, wire.MaxTxInSequenceNum-1), true},  // one non-final input is enough
+		{sequenceTx(800000, wire.MaxTxInSequenceNum, wire.MaxTxInSequenceNum), false},   // not enforced
+		{sequenceTx(0, wire.MaxTxInSequenceNum-2), false},                               // no locktime
+		{sequenceTx(txscript.LockTimeThreshold, wire.MaxTxInSequenceNum-2), false},      // a time, not a height
+		{sequenceTx(txscript.LockTimeThreshold+1000, wire.MaxTxInSequenceNum-2), false}, // likewise
+	}
+	for i, test := range tests {
+		if got := IsAntiFeeSniping(test.tx); got != test.want {
+			t.Errorf("%v: locktime %v is anti-fee-sniping is %v", i, test.tx.LockTime, got)
+		}
+	}
+}
+
+func TestUniformSequence(t *testing.T) {
+	if sequence, ok := UniformSequence(sequenceTx(0, 5, 5, 5)); !ok || sequence != 5 {
+		t.Errorf("got %v %v for the same sequence everywhere", sequence, ok)
+	}
+	if _, ok := UniformSequence(sequenceTx(0, 5, 6)); ok {
+		t.Error("mixed sequences are uniform")
+	}
+	if _, ok := UniformSequence(sequenceTx(0)); ok {
+		t.Error("no inputs is uniform")
+	}
+}
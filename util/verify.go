@@ -0,0 +1,75 @@
+package util
+
+import (
+	"encoding/hex"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+)
+
+// ErrMissingPrevOut is why PrevOuts fails when an input spends an output that doesn't exist, or is already spent.
+// Use errors.Cause to compare
+var ErrMissingPrevOut = errors.New("spends an output that doesn't exist, or is already spent")
+
+// VerifyInput runs input i of tx through the script engine, with the same standardness flags bitcoind relays with.
+// prevOuts needs the output every input spends, not just input i's: a taproot signature commits to all of them
+func VerifyInput(tx *wire.MsgTx, i int, prevOuts txscript.PrevOutputFetcher) error {
+	if i < 0 || i >= len(tx.TxIn) {
+		return errors.Errorf("transaction has no input %v", i)
+	}
+	for j, txIn := range tx.TxIn {
+		if prevOuts.FetchPrevOutput(txIn.PreviousOutPoint) == nil {
+			return errors.Errorf("don't know the output input %v spends", j)
+		}
+	}
+
+	prevOut := prevOuts.FetchPrevOutput(tx.TxIn[i].PreviousOutPoint)
+	engine, err := txscript.NewEngine(prevOut.PkScript, tx, i, txscript.StandardVerifyFlags, nil,
+		txscript.NewTxSigHashes(tx, prevOuts), prevOut.Value, prevOuts)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := engine.Execute(); err != nil {
+		return errors.Wrapf(err, "input %v has an invalid signature", i)
+	}
+	return nil
+}
+
+// PrevOuts looks up the output every input of tx spends with getTxOut (a wallet or chain's GetTxOut), for
+// VerifyInput or signing. It fails with ErrMissingPrevOut if one's spent or doesn't exist
+func PrevOuts(tx *wire.MsgTx, getTxOut func(*chainhash.Hash, uint32) (*btcjson.GetTxOutResult, error)) (*txscript.MultiPrevOutFetcher, error) {
+	prevOuts := txscript.NewMultiPrevOutFetcher(nil)
+	for i, txIn := range tx.TxIn {
+		outpoint := txIn.PreviousOutPoint
+		result, err := getTxOut(&outpoint.Hash, outpoint.Index)
+		if err != nil {
+			return nil, errors.Wrapf(err, "input %v (%v)", i, outpoint)
+		}
+		if result == nil {
+			return nil, errors.Wrapf(ErrMissingPrevOut, "input %v (%v)", i, outpoint)
+		}
+		prevOut, err := TxOut(result)
+		if err != nil {
+			return nil, errors.Wrapf(err, "input %v (%v)", i, outpoint)
+		}
+		prevOuts.AddPrevOut(outpoint, prevOut)
+	}
+	return prevOuts, nil
+}
+
+// TxOut is the output a gettxout result describes
+func TxOut(result *btcjson.GetTxOutResult) (*wire.TxOut, error) {
+	pkScript, err := hex.DecodeString(result.ScriptPubKey.Hex)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	value, err := btcutil.NewAmount(result.Value)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return wire.NewTxOut(int64(value), pkScript), nil
+}
@@ -0,0 +1,217 @@
+package wallet
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/pkg/errors"
+	"github.com/rhavar/bustapay/util"
+)
+
+// descriptor is the small part of output descriptors (see bitcoin core's doc/descriptors.md) we support:
+//
+//	wpkh(KEY/path/*)  and  sh(wpkh(KEY/path/*))  and  tr(KEY/path/*)
+//
+// where KEY is an xprv (or xpub, but then we can't sign) optionally prefixed with its origin, e.g.
+// wpkh([d34db33f/84h/0h/0h]xprv.../0/*). tr() is key path only, so no script tree after the key. The checksum on the
+// end is optional, but checked if it's there
+type descriptor struct {
+	scriptType string // util.ScriptTypeP2WPKH, util.ScriptTypeP2SHP2WPKH or util.ScriptTypeP2TR
+	key        *hdkeychain.ExtendedKey
+	path       []uint32 // after the key, and before the *
+}
+
+// derivedKey is everything about one index of a descriptor
+type derivedKey struct {
+	index        uint32
+	pkScript     []byte
+	redeemScript []byte // for p2sh-p2wpkh
+	address      btcutil.Address
+	pubKey       *btcec.PublicKey
+	privKey      *btcec.PrivateKey // nil if the descriptor has an xpub
+}
+
+const hardened = hdkeychain.HardenedKeyStart
+
+func parseDescriptor(s string) (*descriptor, error) {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '#'); i >= 0 {
+		if descriptorChecksum(s[:i]) != s[i+1:] {
+			return nil, errors.New("descriptor has a bad checksum")
+		}
+		s = s[:i]
+	}
+
+	d := &descriptor{}
+	switch {
+	case strings.HasPrefix(s, "sh(wpkh(") && strings.HasSuffix(s, "))"):
+		d.scriptType = util.ScriptTypeP2SHP2WPKH
+		s = s[len("sh(wpkh(") : len(s)-2]
+	case strings.HasPrefix(s, "wpkh(") && strings.HasSuffix(s, ")"):
+		d.scriptType = util.ScriptTypeP2WPKH
+		s = s[len("wpkh(") : len(s)-1]
+	case strings.HasPrefix(s, "tr(") && strings.HasSuffix(s, ")"):
+		d.scriptType = util.ScriptTypeP2TR
+		s = s[len("tr(") : len(s)-1]
+		if strings.Contains(s, ",") {
+			return nil, errors.New("tr(...) descriptors with a script tree aren't supported")
+		}
+	default:
+		return nil, errors.New("only wpkh(...), sh(wpkh(...)) and tr(...) descriptors are supported")
+	}
+
+	// the key origin is just informational, we don't need it
+	if strings.HasPrefix(s, "[") {
+		end := strings.IndexByte(s, ']')
+		if end < 0 {
+			return nil, errors.New("descriptor has an unterminated key origin")
+		}
+		s = s[end+1:]
+	}
+
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || parts[len(parts)-1] != "*" {
+		return nil, errors.New("descriptor must end in /* (hardened wildcards aren't supported)")
+	}
+
+	key, err := hdkeychain.NewKeyFromString(parts[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "descriptor key")
+	}
+	d.key = key
+
+	for _, part := range parts[1 : len(parts)-1] {
+		index, err := parsePathElement(part)
+		if err != nil {
+			return nil, err
+		}
+		if index >= hardened && !key.IsPrivate() {
+			return nil, errors.New("can't derive a hardened path from an xpub")
+		}
+		d.path = append(d.path, index)
+	}
+	return d, nil
+}
+
+func parsePathElement(s string) (uint32, error) {
+	offset := uint32(0)
+	if strings.HasSuffix(s, "'") || strings.HasSuffix(s, "h") {
+		offset = hardened
+		s = s[:len(s)-1]
+	}
+	index, err := strconv.ParseUint(s, 10, 31)
+	if err != nil {
+		return 0, errors.Errorf("bad descriptor path element %q", s)
+	}
+	return uint32(index) + offset, nil
+}
+
+func (d *descriptor) derive(index uint32, params *chaincfg.Params) (*derivedKey, error) {
+	key := d.key
+	var err error
+	path := append(append([]uint32(nil), d.path...), index)
+	for _, i := range path {
+		if key, err = key.Derive(i); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	derived := &derivedKey{index: index}
+	if derived.pubKey, err = key.ECPubKey(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if key.IsPrivate() {
+		if derived.privKey, err = key.ECPrivKey(); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	if d.scriptType == util.ScriptTypeP2TR {
+		// the output key commits to there being no script tree, like bitcoind's tr(KEY)
+		outputKey := txscript.ComputeTaprootKeyNoScript(derived.pubKey)
+		if derived.address, err = btcutil.NewAddressTaproot(schnorr.SerializePubKey(outputKey), params); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if derived.pkScript, err = txscript.PayToAddrScript(derived.address); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return derived, nil
+	}
+
+	witnessAddress, err := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(derived.pubKey.SerializeCompressed()), params)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	witnessProgram, err := txscript.PayToAddrScript(witnessAddress)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if d.scriptType == util.ScriptTypeP2WPKH {
+		derived.address = witnessAddress
+		derived.pkScript = witnessProgram
+		return derived, nil
+	}
+
+	derived.redeemScript = witnessProgram
+	if derived.address, err = btcutil.NewAddressScriptHash(witnessProgram, params); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if derived.pkScript, err = txscript.PayToAddrScript(derived.address); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return derived, nil
+}
+
+// descriptorChecksum is the 8 character checksum bitcoin core puts after the #, from its descriptor.cpp
+func descriptorChecksum(s string) string {
+	const inputCharset = "0123456789()[],'/*abcdefgh@:$%{}" +
+		"IJKLMNOPQRSTUVWXYZ&+-.;<=>?!^_|~" +
+		"ijklmnopqrstuvwxyzABCDEFGH`#\"\\ "
+	const checksumCharset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+	polymod := func(c uint64, value int) uint64 {
+		top := c >> 35
+		c = (c&0x7ffffffff)<<5 ^ uint64(value)
+		for i, generator := range []uint64{0xf5dee51989, 0xa9fdca3312, 0x1bab10e32d, 0x3706b1677a, 0x644d626ffd} {
+			if (top>>uint(i))&1 == 1 {
+				c ^= generator
+			}
+		}
+		return c
+	}
+
+	c := uint64(1)
+	cls, clsCount := 0, 0
+	for _, ch := range []byte(s) {
+		pos := strings.IndexByte(inputCharset, ch)
+		if pos < 0 {
+			return ""
+		}
+		c = polymod(c, pos&31)
+		cls = cls*3 + pos>>5
+		if clsCount++; clsCount == 3 {
+			c = polymod(c, cls)
+			cls, clsCount = 0, 0
+		}
+	}
+	if clsCount > 0 {
+		c = polymod(c, cls)
+	}
+	for i := 0; i < 8; i++ {
+		c = polymod(c, 0)
+	}
+	c ^= 1
+
+	checksum := make([]byte, 8)
+	for i := range checksum {
+		checksum[i] = checksumCharset[(c>>uint(5*(7-i)))&31]
+	}
+	return string(checksum)
+}
@@ -0,0 +1,163 @@
+package wallet
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+// The "abandon abandon ... about" mnemonic's master key, which BIP49, BIP84 and BIP86 all use for their vectors
+const (
+	abandonXprv = "xprv9s21ZrQH143K3GJpoapnV8SFfukcVBSfeCficPSGfubmSFDxo1kuHnLisriDvSnRRuL2Qrg5ggqHKNVpxR86QEC8w35uxmGoggxtQTPvfUu"
+	abandonTprv = "tprv8ZgxMBicQKsPe5YMU9gHen4Ez3ApihUfykaqUorj9t6FDqy3nP6eoXiAo2ssvpAjoLroQxHqr3R5nE3a5dU3DHTjTgJDd7zrbniJr6nrCzd"
+	// from BIP382's
+	bip382Xprv = "xprv9vHkqa6EV4sPZHYqZznhT2NPtPCjKuDKGY38FBWLvgaDx45zo9WQRUT3dKYnjwih2yJD9mkrocEZXo1ex8G81dwSM1fwqWpWkeS3v86pgKt"
+)
+
+// BIP380's, and bitcoin core's descriptor_tests
+func TestDescriptorChecksum(t *testing.T) {
+	for descriptor, checksum := range map[string]string{
+		"raw(deadbeef)": "89f8spxm",
+		"sh(multi(2,[00000000/111'/222]xprvA1RpRA33e1JQ7ifknakTFpgNXPmW2YvmhqLQYMmrj4xJXXWYpDPS3xz7iAxn8L39njGVyuoseXzU6rcxFLJ8HFsTjSyQbLYnMpCqE2VbFWc,xprv9uPDJpEQgRQfDcW7BkF7eTya6RPxXeJCqCJGHuCJ4GiRVLzkTXBAJMu2qaMWPrS7AANYqdq6vcBcBUdJCVVFceUvJFjaPdGZ2y9WACViL4L/0))": "ggrsrxfy",
+		"sh(multi(2,[00000000/111'/222]xpub6ERApfZwUNrhLCkDtcHTcxd75RbzS1ed54G1LkBUHQVHQKqhMkhgbmJbZRkrgZw4koxb5JaHWkY4ALHY2grBGRjaDMzQLcgJvLJuZZvRcEL,xpub68NZiKmJWnxxS6aaHmn81bvJeTESw724CRDs6HbuccFQN9Ku14VQrADWgqbhhTHBaohPX4CjNLf9fq9MYo6oDaPPLPxSb7gwQN3ih19Zm4Y/0))": "tjg09x5t",
+	} {
+		if got := descriptorChecksum(descriptor); got != checksum {
+			t.Errorf("checksum of %v is %v, want %v", descriptor, got, checksum)
+		}
+	}
+	if got := descriptorChecksum("raw(Ü)"); got != "" {
+		t.Errorf("checksum of a descriptor with a character outside the charset is %v", got)
+	}
+
+	descriptor := "wpkh(" + bip382Xprv + "/1/2/*)"
+	checksum := descriptorChecksum(descriptor)
+	if _, err := parseDescriptor(descriptor + "#" + checksum); err != nil {
+		t.Errorf("with its checksum: %v", err)
+	}
+	flipped := "q"
+	if checksum[0] == 'q' {
+		flipped = "p"
+	}
+	// BIP380's invalid cases, on a descriptor we support
+	for what, bad := range map[string]string{
+		"missing checksum":     descriptor + "#",
+		"checksum too long":    descriptor + "#" + checksum + "q",
+		"checksum too short":   descriptor + "#" + checksum[:7],
+		"error in the payload": strings.Replace(descriptor, "/1/2/", "/1/3/", 1) + "#" + checksum,
+		"error in checksum":    descriptor + "#" + flipped + checksum[1:],
+		"two checksums":        descriptor + "#" + checksum + "#" + checksum,
+	} {
+		if _, err := parseDescriptor(bad); err == nil {
+			t.Errorf("parsed a descriptor with a %v", what)
+		}
+	}
+}
+
+func TestDescriptorDerivation(t *testing.T) {
+	for _, test := range []struct {
+		descriptor string
+		params     *chaincfg.Params
+		want       []string // addresses, or scripts as hex, from index 0
+	}{
+		// BIP382
+		{"wpkh([ffffffff/13']" + bip382Xprv + "/1/2/*)", &chaincfg.MainNetParams, []string{
+			"0014326b2249e3a25d5dc60935f044ee835d090ba859",
+			"0014af0bd98abc2f2cae66e36896a39ffe2d32984fb7",
+			"00141fa798efd1cbf95cebf912c031b8a4a6e9fb9f27",
+		}},
+		// BIP84
+		{"wpkh(" + abandonXprv + "/84h/0h/0h/0/*)", &chaincfg.MainNetParams, []string{
+			"bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu",
+			"bc1qnjg0jd8228aq7egyzacy8cys3knf9xvrerkf9g",
+		}},
+		{"wpkh(" + abandonXprv + "/84'/0'/0'/1/*)", &chaincfg.MainNetParams, []string{
+			"bc1q8c6fshw2dlwun7ekn9qwf37cu2rn755upcp6el",
+		}},
+		// BIP86
+		{"tr(" + abandonXprv + "/86h/0h/0h/0/*)", &chaincfg.MainNetParams, []string{
+			"bc1p5cyxnuxmeuwuvkwfem96lqzszd02n6xdcjrs20cac6yqjjwudpxqkedrcr",
+			"bc1p4qhjn9zdvkux4e44uhx8tc55attvtyu358kutcqkudyccelu0was9fqzwh",
+		}},
+		{"tr(" + abandonXprv + "/86h/0h/0h/1/*)", &chaincfg.MainNetParams, []string{
+			"bc1p3qkhfews2uk44qtvauqyr2ttdsw7svhkl9nkm9s9c3x4ax5h60wqwruhk7",
+		}},
+		// BIP49
+		{"sh(wpkh(" + abandonTprv + "/49h/1h/0h/0/*))", &chaincfg.TestNet3Params, []string{
+			"2Mww8dCYPUpKHofjgcXcBCEGmniw9CoaiD2",
+		}},
+	} {
+		d, err := parseDescriptor(test.descriptor)
+		if err != nil {
+			t.Errorf("%v: %v", test.descriptor, err)
+			continue
+		}
+		for i, want := range test.want {
+			derived, err := d.derive(uint32(i), test.params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := derived.address.EncodeAddress(); got != want && hex.EncodeToString(derived.pkScript) != want {
+				t.Errorf("%v at %v is %v (%x), want %v", test.descriptor, i, got, derived.pkScript, want)
+			}
+			if derived.privKey == nil {
+				t.Errorf("%v at %v has no private key", test.descriptor, i)
+			}
+		}
+	}
+}
+
+// An xpub gives the same scripts as its xprv, just without being able to sign
+func TestDescriptorXpub(t *testing.T) {
+	xprv, err := hdkeychain.NewKeyFromString(bip382Xprv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xpub, err := xprv.Neuter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	private, err := parseDescriptor("wpkh(" + bip382Xprv + "/1/2/*)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := parseDescriptor("wpkh(" + xpub.String() + "/1/2/*)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fromPrivate, _ := private.derive(0, &chaincfg.MainNetParams)
+	fromPublic, err := public.derive(0, &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(fromPublic.pkScript) != hex.EncodeToString(fromPrivate.pkScript) || fromPublic.privKey != nil {
+		t.Errorf("xpub derived %x (private key %v), want %x and none", fromPublic.pkScript, fromPublic.privKey, fromPrivate.pkScript)
+	}
+
+	if _, err := parseDescriptor("wpkh(" + xpub.String() + "/1h/*)"); err == nil {
+		t.Error("parsed a hardened path from an xpub")
+	}
+}
+
+func TestParseDescriptorErrors(t *testing.T) {
+	for what, bad := range map[string]string{
+		"unsupported function":   "pkh(" + bip382Xprv + "/0/*)",
+		"multisig":               "wsh(multi(1," + bip382Xprv + "/0/*))",
+		"script tree":            "tr(" + bip382Xprv + "/0/*,pk(" + bip382Xprv + "/1/*))",
+		"no wildcard":            "wpkh(" + bip382Xprv + "/0/0)",
+		"hardened wildcard":      "wpkh(" + bip382Xprv + "/0/*h)",
+		"just a key":             "wpkh(" + bip382Xprv + ")",
+		"unterminated origin":    "wpkh([ffffffff/13'" + bip382Xprv + "/0/*)",
+		"bad key":                "wpkh(" + bip382Xprv[:len(bip382Xprv)-1] + "u/0/*)",
+		"bad path":               "wpkh(" + bip382Xprv + "/x/*)",
+		"path element too big":   "wpkh(" + bip382Xprv + "/2147483648/*)",
+		"unbalanced parenthesis": "sh(wpkh(" + bip382Xprv + "/0/*)",
+	} {
+		if _, err := parseDescriptor(bad); err == nil {
+			t.Errorf("parsed a descriptor with a %v", what)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"math/rand"
+	"sort"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+	"github.com/rhavar/bustapay/util"
+)
+
+const (
+	txOverheadVSize = 10.5 // version, locktime, counts and the segwit marker
+	dustLimit       = 1000 // change smaller than this goes to the fee instead
+	minFeeRate      = 1.0  // sat/vbyte, what we use if the chain can't estimate
+)
+
+// CreateRawTransaction is an unfunded transaction paying amount to address, as hex like bitcoind's
+func (w *Wallet) CreateRawTransaction(address string, amount int64) (string, error) {
+	decoded, err := util.DecodeAddress(address, w.params)
+	if err != nil {
+		return "", err
+	}
+	pkScript, err := util.PayToAddrScript(decoded)
+	if err != nil {
+		return "", err
+	}
+
+	tx := wire.NewMsgTx(2)
+	tx.AddTxOut(wire.NewTxOut(amount, pkScript))
+
+	var b bytes.Buffer
+	if err := tx.Serialize(&b); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return hex.EncodeToString(b.Bytes()), nil
+}
+
+// FundRawTransaction adds inputs (biggest first) to pay for rawTx's outputs, and a change output if it's worth it.
+// Like bitcoind it signals rbf, and sets the locktime to the current height to discourage fee sniping. The inputs
+// are locked, like fundrawtransaction's lockUnspents, so a concurrent proposal can't contribute them; they're
+// released when it's sent, or by UnlockUnspent if it never is
+func (w *Wallet) FundRawTransaction(rawTx string) (*wire.MsgTx, error) {
+	txBytes, err := hex.DecodeString(rawTx)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	tx := wire.NewMsgTx(2)
+	if err := tx.DeserializeNoWitness(bytes.NewReader(txBytes)); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	feeRate, err := w.chain.EstimateSmartFee(w.config.ConfTarget)
+	if err != nil || feeRate < minFeeRate {
+		util.Logger.Debug("using the minimum feerate", "estimate", feeRate, "err", err)
+		feeRate = minFeeRate
+	}
+
+	// Every key on the change branch has the same kind of script, so the first one will do for sizing the change
+	// output. We only take a fresh key if we end up adding it, so change-less payments don't leave gaps
+	changeShape, err := w.branches[1].descriptor.derive(0, w.params)
+	if err != nil {
+		return nil, err
+	}
+
+	var target int64
+	vsize := txOverheadVSize + util.OutputVSize(changeShape.pkScript)
+	for _, txOut := range tx.TxOut {
+		target += txOut.Value
+		vsize += util.OutputVSize(txOut.PkScript)
+	}
+
+	// held until what we pick is locked
+	w.mu.Lock()
+	candidates := w.spendable()
+	height := w.height
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].txOut.Value > candidates[j].txOut.Value
+	})
+
+	var total int64
+	var fee int64
+	funded := false
+	for _, c := range candidates {
+		txIn := wire.NewTxIn(&c.outpoint, nil, nil)
+		txIn.Sequence = wire.MaxTxInSequenceNum - 2
+		tx.AddTxIn(txIn)
+		total += c.txOut.Value
+		vsize += util.InputVSize(c.script.scriptType())
+
+		fee = int64(math.Ceil(vsize * feeRate))
+		if total >= target+fee {
+			funded = true
+			break
+		}
+	}
+	if !funded {
+		w.mu.Unlock()
+		return nil, errors.Errorf("insufficient funds: need %v satoshis plus fees, have %v", target, total)
+	}
+	for _, txIn := range tx.TxIn {
+		w.locked[txIn.PreviousOutPoint] = struct{}{}
+	}
+	w.mu.Unlock()
+
+	if changeValue := total - target - fee; changeValue >= dustLimit {
+		change, err := w.nextKey(w.branches[1])
+		if err != nil {
+			for _, txIn := range tx.TxIn {
+				w.UnlockUnspent(txIn.PreviousOutPoint)
+			}
+			return nil, err
+		}
+		position := rand.Intn(len(tx.TxOut) + 1)
+		tx.TxOut = append(tx.TxOut, nil)
+		copy(tx.TxOut[position+1:], tx.TxOut[position:])
+		tx.TxOut[position] = wire.NewTxOut(changeValue, change.pkScript)
+	}
+
+	if height > 0 {
+		tx.LockTime = uint32(height)
+	}
+	return tx, nil
+}
+
+type candidate struct {
+	outpoint wire.OutPoint
+	*utxo
+}
+
+// spendable is every unspent we can sign for that isn't locked or already spent. Must hold mu
+func (w *Wallet) spendable() []candidate {
+	var candidates []candidate
+	for outpoint, u := range w.utxos {
+		_, locked := w.locked[outpoint]
+		_, spent := w.spent[outpoint]
+		if !locked && !spent && u.script.privKey != nil {
+			candidates = append(candidates, candidate{outpoint, u})
+		}
+	}
+	return candidates
+}
+
+func (s *ownedScript) scriptType() string {
+	return util.ScriptType(s.pkScript, s.redeemScript)
+}
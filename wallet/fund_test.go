@@ -0,0 +1,202 @@
+package wallet
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/rhavar/bustapay/util"
+)
+
+// newTestWallet is a wallet on chain, with change on its own branch, and a confirmed unspent of each of values.
+// kind is the descriptor's function, e.g. "wpkh", "sh(wpkh" or "tr"
+func newTestWallet(t *testing.T, chain *MemoryChain, kind string, values ...int64) *Wallet {
+	t.Helper()
+	master, err := hdkeychain.NewMaster(make([]byte, 32), chain.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closing := ")"
+	if kind == "sh(wpkh" {
+		closing = "))"
+	}
+	w, err := New(Config{
+		Descriptor:       kind + "(" + master.String() + "/0/*" + closing,
+		ChangeDescriptor: kind + "(" + master.String() + "/1/*" + closing,
+	}, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, value := range values {
+		address, err := w.GetNewAddress()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkScript, err := util.PayToAddrScript(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain.Mine(wire.NewTxOut(value, pkScript))
+	}
+	if err := w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+// fund is a transaction from w paying amount to an address that isn't w's
+func fund(t *testing.T, w *Wallet, amount int64) (*wire.MsgTx, error) {
+	t.Helper()
+	rawTx, err := w.CreateRawTransaction("bcrt1qw508d6qejxtdg4y5r3zarvary0c5xw7kygt080", amount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w.FundRawTransaction(rawTx)
+}
+
+// change is tx's outputs that pay to w's change branch
+func change(w *Wallet, tx *wire.MsgTx) []*wire.TxOut {
+	var outputs []*wire.TxOut
+	for _, txOut := range tx.TxOut {
+		if script := w.ownScript(txOut.PkScript); script != nil && script.branch.change {
+			outputs = append(outputs, txOut)
+		}
+	}
+	return outputs
+}
+
+func TestFundChange(t *testing.T) {
+	chain := NewMemoryChain(&chaincfg.RegressionNetParams)
+	chain.FeeRate = 10
+	w := newTestWallet(t, chain, "wpkh", 500000)
+
+	tx, err := fund(t, w, 100000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changeOutputs := change(w, tx)
+	if len(tx.TxIn) != 1 || len(tx.TxOut) != 2 || len(changeOutputs) != 1 {
+		t.Fatalf("%v inputs and %v outputs (%v change), want 1 and 2 (1 change)", len(tx.TxIn), len(tx.TxOut), len(changeOutputs))
+	}
+
+	// the fee is what's left, and pays the feerate on the signed transaction's size (give or take a vbyte, signatures
+	// vary in length)
+	fee := 500000 - 100000 - changeOutputs[0].Value
+	signed, complete, err := w.SignRawTransactionWithWallet(tx)
+	if err != nil || !complete {
+		t.Fatalf("couldn't sign: %v", err)
+	}
+	if size := vsize(signed); float64(fee) < 10*(size-1) || float64(fee) > 10*(size+2) {
+		t.Errorf("fee is %v for %v vbytes, want 10 sat/vbyte", fee, size)
+	}
+
+	if tx.TxIn[0].Sequence != wire.MaxTxInSequenceNum-2 {
+		t.Errorf("sequence is %x, doesn't signal rbf", tx.TxIn[0].Sequence)
+	}
+	if height, _ := chain.GetBlockCount(); int64(tx.LockTime) != height {
+		t.Errorf("locktime is %v, want the height %v", tx.LockTime, height)
+	}
+}
+
+// Change that's not worth having goes to the fee instead
+func TestFundDustChange(t *testing.T) {
+	chain := NewMemoryChain(&chaincfg.RegressionNetParams)
+	w := newTestWallet(t, chain, "wpkh", 100500)
+
+	tx, err := fund(t, w, 100000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.TxOut) != 1 || len(change(w, tx)) != 0 {
+		t.Errorf("%v outputs, want just the payment", len(tx.TxOut))
+	}
+
+	if _, err := fund(t, newTestWallet(t, NewMemoryChain(&chaincfg.RegressionNetParams), "wpkh", 100000), 100000); err == nil ||
+		!strings.Contains(err.Error(), "insufficient funds") {
+		t.Errorf("funded a payment of everything there is, with nothing for the fee: %v", err)
+	}
+}
+
+// What's picked stays locked until it's sent, so two payments (or proposals) at once never spend the same unspent
+func TestFundLocks(t *testing.T) {
+	chain := NewMemoryChain(&chaincfg.RegressionNetParams)
+	w := newTestWallet(t, chain, "wpkh", 200000)
+
+	tx, err := fund(t, w, 100000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unspents, _ := w.ListUnspent(); len(unspents) != 0 {
+		t.Errorf("listed %v unspents while they're funding a payment", len(unspents))
+	}
+	if _, err := fund(t, w, 100000); err == nil {
+		t.Error("funded a second payment with the first's input")
+	}
+
+	// given up on, it can be used again
+	if err := w.UnlockUnspent(tx.TxIn[0].PreviousOutPoint); err != nil {
+		t.Fatal(err)
+	}
+	if tx, err = fund(t, w, 100000); err != nil {
+		t.Fatal(err)
+	}
+
+	// sent, it's spent rather than locked
+	signed, _, err := w.SignRawTransactionWithWallet(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.SendRawTransaction(signed); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.UnlockUnspent(tx.TxIn[0].PreviousOutPoint); err == nil {
+		t.Error("input is still locked after being sent")
+	}
+	if _, err := fund(t, w, 100000); err == nil {
+		t.Error("funded a payment with an input that's already spent")
+	}
+}
+
+func TestFundConcurrently(t *testing.T) {
+	chain := NewMemoryChain(&chaincfg.RegressionNetParams)
+	values := make([]int64, 10)
+	for i := range values {
+		values[i] = 150000
+	}
+	w := newTestWallet(t, chain, "wpkh", values...)
+
+	var mu sync.Mutex
+	spent := make(map[wire.OutPoint]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tx, err := fund(t, w, 100000)
+			if err != nil {
+				return // once they've all gone
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, txIn := range tx.TxIn {
+				if spent[txIn.PreviousOutPoint] {
+					t.Errorf("%v funded two payments", txIn.PreviousOutPoint)
+				}
+				spent[txIn.PreviousOutPoint] = true
+			}
+		}()
+	}
+	wg.Wait()
+	if len(spent) != len(values) {
+		t.Errorf("used %v of the %v unspents", len(spent), len(values))
+	}
+}
+
+func vsize(tx *wire.MsgTx) float64 {
+	return math.Ceil(float64(tx.SerializeSizeStripped()*3+tx.SerializeSize()) / 4)
+}
@@ -0,0 +1,173 @@
+package wallet
+
+import (
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+	"github.com/rhavar/bustapay/util"
+)
+
+// MemoryChain is a stand-in for bitcoind, for tests. There's no proof of work or consensus rules beyond
+// signatures and amounts: transactions sent to it sit in the mempool until Mine puts them in a block
+type MemoryChain struct {
+	Params  *chaincfg.Params
+	FeeRate float64 // sat/vbyte, what EstimateSmartFee says
+
+	mu      sync.Mutex
+	blocks  []*wire.MsgBlock
+	mempool []*wire.MsgTx
+	utxos   map[wire.OutPoint]*wire.TxOut // including the mempool's
+}
+
+// NewMemoryChain starts with just a genesis block
+func NewMemoryChain(params *chaincfg.Params) *MemoryChain {
+	c := &MemoryChain{
+		Params:  params,
+		FeeRate: minFeeRate,
+		utxos:   make(map[wire.OutPoint]*wire.TxOut),
+	}
+	c.Mine()
+	return c
+}
+
+// Mine makes a block out of the mempool, and a coinbase paying each of outputs
+func (c *MemoryChain) Mine(outputs ...*wire.TxOut) *wire.MsgBlock {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	coinbase := wire.NewMsgTx(2)
+	coinbase.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex), []byte{byte(len(c.blocks)), 0}, nil))
+	for _, txOut := range outputs {
+		coinbase.AddTxOut(txOut)
+	}
+	c.addUtxos(coinbase)
+
+	var prevBlock chainhash.Hash
+	if len(c.blocks) > 0 {
+		prevBlock = c.blocks[len(c.blocks)-1].BlockHash()
+	}
+	block := wire.NewMsgBlock(wire.NewBlockHeader(1, &prevBlock, &chainhash.Hash{}, 0, uint32(len(c.blocks))))
+	block.Header.Timestamp = time.Unix(int64(1231006505+600*len(c.blocks)), 0)
+	block.AddTransaction(coinbase)
+	for _, tx := range c.mempool {
+		block.AddTransaction(tx)
+	}
+	c.mempool = nil
+
+	c.blocks = append(c.blocks, block)
+	return block
+}
+
+func (c *MemoryChain) addUtxos(tx *wire.MsgTx) {
+	txid := tx.TxHash()
+	for vout, txOut := range tx.TxOut {
+		c.utxos[*wire.NewOutPoint(&txid, uint32(vout))] = txOut
+	}
+}
+
+func (c *MemoryChain) GetChainParams() (*chaincfg.Params, error) {
+	return c.Params, nil
+}
+
+func (c *MemoryChain) GetBlockCount() (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return int64(len(c.blocks) - 1), nil
+}
+
+func (c *MemoryChain) GetBlockHash(height int64) (*chainhash.Hash, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if height < 0 || height >= int64(len(c.blocks)) {
+		return nil, errors.Errorf("no block at height %v", height)
+	}
+	hash := c.blocks[height].BlockHash()
+	return &hash, nil
+}
+
+func (c *MemoryChain) GetBlock(hash *chainhash.Hash) (*wire.MsgBlock, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, block := range c.blocks {
+		if block.BlockHash() == *hash {
+			return block, nil
+		}
+	}
+	return nil, errors.Errorf("no block %v", hash)
+}
+
+// GetTxOut is nil if the output is spent, or never existed
+func (c *MemoryChain) GetTxOut(txid *chainhash.Hash, vout uint32) (*btcjson.GetTxOutResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	txOut, ok := c.utxos[*wire.NewOutPoint(txid, vout)]
+	if !ok {
+		return nil, nil
+	}
+	return &btcjson.GetTxOutResult{
+		Value:        btcutil.Amount(txOut.Value).ToBTC(),
+		ScriptPubKey: btcjson.ScriptPubKeyResult{Hex: hex.EncodeToString(txOut.PkScript)},
+	}, nil
+}
+
+func (c *MemoryChain) TestMempoolAccept(tx *wire.MsgTx) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.check(tx) == nil, nil
+}
+
+func (c *MemoryChain) SendRawTransaction(tx *wire.MsgTx) (*chainhash.Hash, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.check(tx); err != nil {
+		return nil, err
+	}
+	for _, txIn := range tx.TxIn {
+		delete(c.utxos, txIn.PreviousOutPoint)
+	}
+	c.addUtxos(tx)
+	c.mempool = append(c.mempool, tx)
+
+	txid := tx.TxHash()
+	return &txid, nil
+}
+
+func (c *MemoryChain) EstimateSmartFee(confTarget int) (float64, error) {
+	return c.FeeRate, nil
+}
+
+// check is whether tx spends unspent outputs, with valid signatures, and doesn't create money. Must hold mu
+func (c *MemoryChain) check(tx *wire.MsgTx) error {
+	prevOuts := txscript.NewMultiPrevOutFetcher(nil)
+	for i, txIn := range tx.TxIn {
+		prevOut := c.utxos[txIn.PreviousOutPoint]
+		if prevOut == nil {
+			return errors.Errorf("input %v spends a missing or spent output", i)
+		}
+		prevOuts.AddPrevOut(txIn.PreviousOutPoint, prevOut)
+	}
+
+	var in, out int64
+	for i, txIn := range tx.TxIn {
+		if err := util.VerifyInput(tx, i, prevOuts); err != nil {
+			return err
+		}
+		in += prevOuts.FetchPrevOutput(txIn.PreviousOutPoint).Value
+	}
+	for _, txOut := range tx.TxOut {
+		out += txOut.Value
+	}
+	if out > in {
+		return errors.New("outputs are worth more than the inputs")
+	}
+	return nil
+}
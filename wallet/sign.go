@@ -0,0 +1,179 @@
+package wallet
+
+import (
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+	"github.com/rhavar/bustapay/psbt"
+	"github.com/rhavar/bustapay/util"
+)
+
+// SignRawTransactionWithWallet signs every unsigned input spending one of our unspents. complete is whether
+// every input is now signed
+func (w *Wallet) SignRawTransactionWithWallet(tx *wire.MsgTx) (*wire.MsgTx, bool, error) {
+	signed := tx.Copy()
+	var prevOuts *txscript.MultiPrevOutFetcher
+	var hashes *txscript.TxSigHashes
+
+	complete := true
+	for i, txIn := range signed.TxIn {
+		// everything we can sign is segwit, so a signature script on its own (e.g. pushing a p2sh-p2wpkh redeem
+		// script) doesn't mean it's signed
+		prevOut, script := w.ownPrevOut(txIn.PreviousOutPoint)
+		if len(txIn.Witness) == 0 && script != nil && script.privKey != nil {
+			if hashes == nil {
+				var err error
+				if prevOuts, err = w.prevOuts(signed, nil); err != nil {
+					return nil, false, err
+				}
+				hashes = txscript.NewTxSigHashes(signed, prevOuts)
+			}
+			if err := signInput(signed, hashes, prevOuts, i, prevOut, script); err != nil {
+				return nil, false, err
+			}
+		}
+		complete = complete && (len(txIn.Witness) > 0 || len(txIn.SignatureScript) > 0)
+	}
+	return signed, complete, nil
+}
+
+// SignInputsWithWallet signs only inputs (by index) and leaves every other input exactly as it was. Like
+// util.VerifyInput, prevOuts has to have the output every input spends, not just ours
+func (w *Wallet) SignInputsWithWallet(tx *wire.MsgTx, inputs []int, prevOuts txscript.PrevOutputFetcher) (*wire.MsgTx, error) {
+	signed := tx.Copy()
+	for i, txIn := range signed.TxIn {
+		if prevOuts.FetchPrevOutput(txIn.PreviousOutPoint) == nil {
+			return nil, errors.Errorf("don't know the output input %v spends", i)
+		}
+	}
+	hashes := txscript.NewTxSigHashes(signed, prevOuts)
+
+	for _, i := range inputs {
+		if i < 0 || i >= len(signed.TxIn) {
+			return nil, errors.Errorf("transaction has no input %v", i)
+		}
+		prevOut := prevOuts.FetchPrevOutput(signed.TxIn[i].PreviousOutPoint)
+		script := w.ownScript(prevOut.PkScript)
+		if script == nil || script.privKey == nil {
+			return nil, errors.Errorf("wallet can't sign input %v", i)
+		}
+		if err := signInput(signed, hashes, prevOuts, i, prevOut, script); err != nil {
+			return nil, err
+		}
+	}
+	return signed, nil
+}
+
+// WalletProcessPsbt fills in what we know about packet's inputs and, with sign, signs and finalizes the ones
+// that are ours. complete is whether every input is now signed
+func (w *Wallet) WalletProcessPsbt(packet *psbt.Packet, sign bool) (*psbt.Packet, bool, error) {
+	processed := *packet
+	processed.Inputs = append([]psbt.Input(nil), packet.Inputs...)
+
+	tx := packet.UnsignedTx.Copy()
+	var prevOuts *txscript.MultiPrevOutFetcher
+	var hashes *txscript.TxSigHashes
+
+	complete := true
+	for i := range processed.Inputs {
+		input := &processed.Inputs[i]
+
+		prevOut, script := w.ownPrevOut(tx.TxIn[i].PreviousOutPoint)
+		if script == nil && input.WitnessUtxo != nil {
+			prevOut, script = input.WitnessUtxo, w.ownScript(input.WitnessUtxo.PkScript)
+		}
+		if script != nil {
+			input.WitnessUtxo = prevOut
+			input.RedeemScript = script.redeemScript
+		}
+
+		if sign && !input.IsFinalized() && script != nil && script.privKey != nil {
+			if hashes == nil {
+				known := make(map[int]*wire.TxOut)
+				for j, input := range packet.Inputs {
+					if input.WitnessUtxo != nil {
+						known[j] = input.WitnessUtxo
+					}
+				}
+				var err error
+				if prevOuts, err = w.prevOuts(tx, known); err != nil {
+					return nil, false, err
+				}
+				hashes = txscript.NewTxSigHashes(tx, prevOuts)
+			}
+			if err := signInput(tx, hashes, prevOuts, i, prevOut, script); err != nil {
+				return nil, false, err
+			}
+			input.FinalScriptSig = tx.TxIn[i].SignatureScript
+			input.FinalScriptWitness = tx.TxIn[i].Witness
+		}
+		complete = complete && input.IsFinalized()
+	}
+	return &processed, complete, nil
+}
+
+// prevOuts is the output every input of tx spends, for signing. known (by input index) is used first, then our
+// own unspents, then the chain
+func (w *Wallet) prevOuts(tx *wire.MsgTx, known map[int]*wire.TxOut) (*txscript.MultiPrevOutFetcher, error) {
+	prevOuts := txscript.NewMultiPrevOutFetcher(nil)
+	for i, txIn := range tx.TxIn {
+		outpoint := txIn.PreviousOutPoint
+		prevOut := known[i]
+		if prevOut == nil {
+			prevOut, _ = w.ownPrevOut(outpoint)
+		}
+		if prevOut == nil {
+			result, err := w.chain.GetTxOut(&outpoint.Hash, outpoint.Index)
+			if err != nil {
+				return nil, errors.Wrapf(err, "input %v (%v)", i, outpoint)
+			}
+			if result == nil {
+				return nil, errors.Wrapf(util.ErrMissingPrevOut, "input %v (%v)", i, outpoint)
+			}
+			if prevOut, err = util.TxOut(result); err != nil {
+				return nil, err
+			}
+		}
+		prevOuts.AddPrevOut(outpoint, prevOut)
+	}
+	return prevOuts, nil
+}
+
+// signInput signs input i of tx, which spends prevOut with script's key, and checks the signature
+func signInput(tx *wire.MsgTx, hashes *txscript.TxSigHashes, prevOuts txscript.PrevOutputFetcher, i int,
+	prevOut *wire.TxOut, script *ownedScript) error {
+
+	if util.ScriptType(prevOut.PkScript, nil) == util.ScriptTypeP2TR {
+		// key path only, the output key being the derived key tweaked with no script tree
+		witness, err := txscript.TaprootWitnessSignature(tx, hashes, i, prevOut.Value, prevOut.PkScript,
+			txscript.SigHashDefault, script.privKey)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		tx.TxIn[i].Witness = witness
+		return util.VerifyInput(tx, i, prevOuts)
+	}
+
+	// for p2sh-p2wpkh it's the redeem script that's signed for
+	witnessProgram := prevOut.PkScript
+	if script.redeemScript != nil {
+		witnessProgram = script.redeemScript
+	}
+
+	witness, err := txscript.WitnessSignature(tx, hashes, i, prevOut.Value, witnessProgram, txscript.SigHashAll,
+		script.privKey, true)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tx.TxIn[i].Witness = witness
+
+	if script.redeemScript != nil {
+		sigScript, err := txscript.NewScriptBuilder().AddData(script.redeemScript).Script()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		tx.TxIn[i].SignatureScript = sigScript
+	}
+
+	return util.VerifyInput(tx, i, prevOuts)
+}
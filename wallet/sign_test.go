@@ -0,0 +1,120 @@
+package wallet
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/rhavar/bustapay/psbt"
+	"github.com/rhavar/bustapay/util"
+)
+
+// spending two unspents, so each input's signature has to commit to the right one
+func TestSignRoundTrip(t *testing.T) {
+	for _, kind := range []string{"wpkh", "sh(wpkh", "tr"} {
+		chain := NewMemoryChain(&chaincfg.RegressionNetParams)
+		w := newTestWallet(t, chain, kind, 60000, 70000)
+
+		tx, err := fund(t, w, 100000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prevOuts := txscript.NewMultiPrevOutFetcher(nil)
+		for _, txIn := range tx.TxIn {
+			prevOut, _ := w.ownPrevOut(txIn.PreviousOutPoint)
+			prevOuts.AddPrevOut(txIn.PreviousOutPoint, prevOut)
+		}
+
+		signed, complete, err := w.SignRawTransactionWithWallet(tx)
+		if err != nil || !complete || len(signed.TxIn) != 2 {
+			t.Fatalf("%v: signed %v inputs, complete %v: %v", kind, len(signed.TxIn), complete, err)
+		}
+		for i := range signed.TxIn {
+			if err := util.VerifyInput(signed, i, prevOuts); err != nil {
+				t.Errorf("%v: input %v: %v", kind, i, err)
+			}
+		}
+		if len(tx.TxIn[0].Witness) != 0 {
+			t.Errorf("%v: signing changed the transaction it was given", kind)
+		}
+
+		if _, err := w.SendRawTransaction(signed); err != nil {
+			t.Errorf("%v: chain rejected it: %v", kind, err)
+		}
+	}
+}
+
+// For a payjoin we sign just our input, and leave the sender's exactly as it is
+func TestSignInputs(t *testing.T) {
+	chain := NewMemoryChain(&chaincfg.RegressionNetParams)
+	w := newTestWallet(t, chain, "wpkh", 60000)
+	theirs := wire.OutPoint{Index: 7}
+	theirPrevOut := wire.NewTxOut(50000, []byte{0x00, 0x14, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20})
+
+	w.mu.Lock()
+	ours := &w.spendable()[0].outpoint
+	w.mu.Unlock()
+	tx := wire.NewMsgTx(2)
+	tx.AddTxIn(wire.NewTxIn(&theirs, nil, wire.TxWitness{{1, 2, 3}}))
+	tx.AddTxIn(wire.NewTxIn(ours, nil, nil))
+	tx.AddTxOut(wire.NewTxOut(100000, theirPrevOut.PkScript))
+
+	prevOuts := txscript.NewMultiPrevOutFetcher(nil)
+	prevOuts.AddPrevOut(theirs, theirPrevOut)
+	ourPrevOut, _ := w.ownPrevOut(*ours)
+	prevOuts.AddPrevOut(*ours, ourPrevOut)
+
+	signed, err := w.SignInputsWithWallet(tx, []int{1}, prevOuts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := util.VerifyInput(signed, 1, prevOuts); err != nil {
+		t.Error(err)
+	}
+	if len(signed.TxIn[0].Witness) != 1 || len(signed.TxIn[0].SignatureScript) != 0 {
+		t.Error("changed the sender's input")
+	}
+
+	if _, err := w.SignInputsWithWallet(tx, []int{0}, prevOuts); err == nil {
+		t.Error("signed an input that isn't ours")
+	}
+	if _, err := w.SignInputsWithWallet(tx, []int{1}, txscript.NewMultiPrevOutFetcher(nil)); err == nil {
+		t.Error("signed without knowing every input's output")
+	}
+}
+
+func TestProcessPsbt(t *testing.T) {
+	chain := NewMemoryChain(&chaincfg.RegressionNetParams)
+	w := newTestWallet(t, chain, "sh(wpkh", 200000)
+
+	tx, err := fund(t, w, 100000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without signing it's just filled in
+	filled, complete, err := w.WalletProcessPsbt(psbt.New(tx), false)
+	if err != nil || complete {
+		t.Fatalf("complete %v without signing: %v", complete, err)
+	}
+	if input := filled.Inputs[0]; input.WitnessUtxo == nil || input.RedeemScript == nil || input.IsFinalized() {
+		t.Errorf("input wasn't filled in: %+v", input)
+	}
+
+	signed, complete, err := w.WalletProcessPsbt(filled, true)
+	if err != nil || !complete {
+		t.Fatalf("complete %v: %v", complete, err)
+	}
+	prevOuts, err := signed.PrevOuts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	final := signed.Extract()
+	if err := util.VerifyInput(final, 0, prevOuts); err != nil {
+		t.Error(err)
+	}
+	if filled.Inputs[0].IsFinalized() {
+		t.Error("signing changed the psbt it was given")
+	}
+}
@@ -0,0 +1,506 @@
+// Package wallet is a small wallet built into bustapay, for running without bitcoin core's wallet. Keys come from
+// an output descriptor, and unspents are found either by scanning blocks (bitcoind's non-wallet rpcs are enough), or
+// by asking an electrum server about each of our scripts. *Wallet implements both send.Wallet and receive.Wallet, so
+// it plugs straight into a Sender or Receiver, and a receive.Server can use it (Config.DescriptorWallet) instead of
+// bitcoind's wallet.
+//
+// It's deliberately simple: it only knows about confirmed transactions (plus what it spent itself), keeps
+// everything in memory, and rescans from Config.Birthday every time it's created.
+package wallet
+
+import (
+	"encoding/hex"
+	"sync"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+	"github.com/rhavar/bustapay/util"
+)
+
+// Chain is what the wallet needs from the outside world. It also has to be either a BlockSource or a ScriptSource,
+// for finding our unspents
+type Chain interface {
+	GetChainParams() (*chaincfg.Params, error)
+	GetBlockCount() (int64, error)
+	GetTxOut(txid *chainhash.Hash, vout uint32) (*btcjson.GetTxOutResult, error)
+	TestMempoolAccept(tx *wire.MsgTx) (bool, error)
+	SendRawTransaction(tx *wire.MsgTx) (*chainhash.Hash, error)
+	EstimateSmartFee(confTarget int) (float64, error)
+}
+
+// BlockSource is a Chain we can scan blocks from. *rpc_client.RpcClient is one without using bitcoind's wallet, and
+// MemoryChain is a stand-in for tests
+type BlockSource interface {
+	GetBlockHash(height int64) (*chainhash.Hash, error)
+	GetBlock(hash *chainhash.Hash) (*wire.MsgBlock, error)
+}
+
+// ScriptSource is a Chain that can tell us about a script without us scanning everything, like *electrum.Client
+type ScriptSource interface {
+	// ScriptStatus changes whenever anything pays to or spends from pkScript, and is "" if nothing ever has
+	ScriptStatus(pkScript []byte) (string, error)
+	ListScriptUnspent(pkScript []byte) ([]btcjson.ListUnspentResult, error)
+}
+
+type Config struct {
+	Descriptor       string // e.g. wpkh(xprv.../84h/0h/0h/0/*), see parseDescriptor
+	ChangeDescriptor string // e.g. wpkh(xprv.../84h/0h/0h/1/*), Descriptor is used for change too if empty
+	Birthday         int64  // the height to start scanning from, nothing before it is seen
+	GapLimit         uint32 // how many unused addresses to look ahead, 20 if 0
+	ConfTarget       int    // blocks, for the feerate when funding, 6 if 0
+}
+
+type Wallet struct {
+	config Config
+	chain  Chain
+	params *chaincfg.Params
+
+	mu        sync.Mutex
+	branches  [2]*branch // receive, change
+	scripts   map[string]*ownedScript
+	utxos     map[wire.OutPoint]*utxo
+	locked    map[wire.OutPoint]struct{}
+	spent     map[wire.OutPoint]struct{} // by transactions we sent, that haven't confirmed
+	txHeights map[chainhash.Hash]int64   // where transactions paying us (or spending from us) confirmed
+	height    int64                      // the last block scanned
+	lastHash  chainhash.Hash
+}
+
+// branch is one of the descriptors, and how far along it we are
+type branch struct {
+	descriptor *descriptor
+	change     bool
+	derived    uint32 // how many keys we're watching
+	used       uint32 // one more than the highest index that's received something
+	issued     uint32 // one more than the highest index handed out by GetNewAddress
+}
+
+type ownedScript struct {
+	*derivedKey
+	branch   *branch
+	received bool
+	status   string // the ScriptSource's, when we last listed its unspents
+}
+
+type utxo struct {
+	txOut  *wire.TxOut
+	height int64
+	script *ownedScript
+}
+
+// New creates a wallet and scans the chain up to its tip, which can take a while for an old Birthday
+func New(config Config, chain Chain) (*Wallet, error) {
+	if config.GapLimit == 0 {
+		config.GapLimit = 20
+	}
+	if config.ConfTarget == 0 {
+		config.ConfTarget = 6
+	}
+
+	_, isBlockSource := chain.(BlockSource)
+	_, isScriptSource := chain.(ScriptSource)
+	if !isBlockSource && !isScriptSource {
+		return nil, errors.New("wallet's chain can't scan blocks or look up scripts")
+	}
+
+	params, err := chain.GetChainParams()
+	if err != nil {
+		return nil, err
+	}
+
+	receiveDescriptor, err := parseDescriptor(config.Descriptor)
+	if err != nil {
+		return nil, err
+	}
+	changeDescriptor := receiveDescriptor
+	if config.ChangeDescriptor != "" {
+		if changeDescriptor, err = parseDescriptor(config.ChangeDescriptor); err != nil {
+			return nil, errors.Wrap(err, "change descriptor")
+		}
+	}
+
+	w := &Wallet{
+		config:  config,
+		chain:   chain,
+		params:  params,
+		scripts: make(map[string]*ownedScript),
+	}
+	w.branches[0] = &branch{descriptor: receiveDescriptor}
+	w.branches[1] = &branch{descriptor: changeDescriptor, change: true}
+	if changeDescriptor == receiveDescriptor {
+		w.branches[1] = w.branches[0]
+	}
+
+	w.reset()
+	if err := w.Sync(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// reset forgets everything we've scanned. Must hold mu (or not be shared yet)
+func (w *Wallet) reset() {
+	w.utxos = make(map[wire.OutPoint]*utxo)
+	w.locked = make(map[wire.OutPoint]struct{})
+	w.spent = make(map[wire.OutPoint]struct{})
+	w.txHeights = make(map[chainhash.Hash]int64)
+	w.height = w.config.Birthday - 1
+	w.lastHash = chainhash.Hash{}
+	for _, script := range w.scripts {
+		script.received = false
+		script.status = ""
+	}
+}
+
+// Sync catches up with the chain: scanning any blocks since the last Sync (starting again from the birthday if the
+// last block we scanned was reorged out), or looking up any of our scripts whose status changed
+func (w *Wallet) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.lookAhead(); err != nil {
+		return err
+	}
+
+	if source, ok := w.chain.(ScriptSource); ok {
+		return w.syncScripts(source)
+	}
+	return w.syncBlocks(w.chain.(BlockSource))
+}
+
+// syncBlocks is Sync for a BlockSource. Must hold mu
+func (w *Wallet) syncBlocks(source BlockSource) error {
+	tip, err := w.chain.GetBlockCount()
+	if err != nil {
+		return err
+	}
+
+	if w.height >= w.config.Birthday {
+		hash, err := source.GetBlockHash(w.height)
+		if err != nil {
+			return err
+		}
+		if *hash != w.lastHash {
+			util.Logger.Warn("wallet's last scanned block was reorged out, rescanning", "height", w.height)
+			w.reset()
+		}
+	}
+
+	for height := w.height + 1; height <= tip; height++ {
+		hash, err := source.GetBlockHash(height)
+		if err != nil {
+			return err
+		}
+		block, err := source.GetBlock(hash)
+		if err != nil {
+			return err
+		}
+		for _, tx := range block.Transactions {
+			if err := w.addTransaction(tx, height); err != nil {
+				return err
+			}
+		}
+		w.height = height
+		w.lastHash = *hash
+	}
+	return nil
+}
+
+// syncScripts is Sync for a ScriptSource. Reorgs take care of themselves, as the status of any script they touch
+// changes. Birthday doesn't matter, the server has already indexed everything. Must hold mu
+func (w *Wallet) syncScripts(source ScriptSource) error {
+	tip, err := w.chain.GetBlockCount()
+	if err != nil {
+		return err
+	}
+
+	// Finding a used script derives more, which need checking too
+	checked := make(map[*ownedScript]bool)
+	for len(checked) < len(w.scripts) {
+		for _, script := range w.scripts {
+			if checked[script] {
+				continue
+			}
+			checked[script] = true
+			if err := w.syncScript(source, script, tip); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Anything we locked or spent that's gone from our unspents has been spent
+	for outpoint := range w.locked {
+		if _, ok := w.utxos[outpoint]; !ok {
+			delete(w.locked, outpoint)
+		}
+	}
+	for outpoint := range w.spent {
+		if _, ok := w.utxos[outpoint]; !ok {
+			delete(w.spent, outpoint)
+		}
+	}
+	w.height = tip
+	return nil
+}
+
+// syncScript replaces what we know about script's unspents, if its status has changed. Must hold mu
+func (w *Wallet) syncScript(source ScriptSource, script *ownedScript, tip int64) error {
+	status, err := source.ScriptStatus(script.pkScript)
+	if err != nil {
+		return err
+	}
+	if status == script.status {
+		return nil
+	}
+
+	unspents, err := source.ListScriptUnspent(script.pkScript)
+	if err != nil {
+		return err
+	}
+	for outpoint, u := range w.utxos {
+		if u.script == script {
+			delete(w.utxos, outpoint)
+		}
+	}
+	for _, unspent := range unspents {
+		if unspent.Confirmations < 1 {
+			continue // we only know about confirmed transactions
+		}
+		txid, err := chainhash.NewHashFromStr(unspent.TxID)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		value, err := btcutil.NewAmount(unspent.Amount)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		w.utxos[*wire.NewOutPoint(txid, unspent.Vout)] = &utxo{
+			txOut:  wire.NewTxOut(int64(value), script.pkScript),
+			height: tip - unspent.Confirmations + 1,
+			script: script,
+		}
+		w.txHeights[*txid] = tip - unspent.Confirmations + 1
+	}
+
+	script.status = status
+	script.received = status != ""
+	if script.received && script.index >= script.branch.used {
+		script.branch.used = script.index + 1
+		return w.lookAhead()
+	}
+	return nil
+}
+
+// addTransaction records what tx does to our unspents. Must hold mu
+func (w *Wallet) addTransaction(tx *wire.MsgTx, height int64) error {
+	txid := tx.TxHash()
+	for _, txIn := range tx.TxIn {
+		if _, ok := w.utxos[txIn.PreviousOutPoint]; ok {
+			w.txHeights[txid] = height
+		}
+		delete(w.utxos, txIn.PreviousOutPoint)
+		delete(w.locked, txIn.PreviousOutPoint)
+		delete(w.spent, txIn.PreviousOutPoint)
+	}
+
+	for vout, txOut := range tx.TxOut {
+		script, ok := w.scripts[string(txOut.PkScript)]
+		if !ok {
+			continue
+		}
+		w.utxos[*wire.NewOutPoint(&txid, uint32(vout))] = &utxo{txOut: txOut, height: height, script: script}
+		w.txHeights[txid] = height
+		script.received = true
+		if script.index >= script.branch.used {
+			script.branch.used = script.index + 1
+			if err := w.lookAhead(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// lookAhead derives keys until every branch has GapLimit unused ones. Must hold mu
+func (w *Wallet) lookAhead() error {
+	for _, b := range w.branches {
+		next := b.used
+		if b.issued > next {
+			next = b.issued
+		}
+		for b.derived < next+w.config.GapLimit {
+			derived, err := b.descriptor.derive(b.derived, w.params)
+			if err != nil {
+				return err
+			}
+			w.scripts[string(derived.pkScript)] = &ownedScript{derivedKey: derived, branch: b}
+			b.derived++
+		}
+	}
+	return nil
+}
+
+// GetNewAddress hands out the next address nobody has been given
+func (w *Wallet) GetNewAddress() (btcutil.Address, error) {
+	derived, err := w.nextKey(w.branches[0])
+	if err != nil {
+		return nil, err
+	}
+	return derived.address, nil
+}
+
+// nextKey is the next unused key on a branch. Must not hold mu
+func (w *Wallet) nextKey(b *branch) (*derivedKey, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	index := b.issued
+	if b.used > index {
+		index = b.used
+	}
+	b.issued = index + 1
+	if err := w.lookAhead(); err != nil {
+		return nil, err
+	}
+	return b.descriptor.derive(index, w.params)
+}
+
+// WatchOnly is whether the descriptor has an xpub, so the wallet can't sign
+func (w *Wallet) WatchOnly() bool {
+	return !w.branches[0].descriptor.key.IsPrivate()
+}
+
+func (w *Wallet) GetChainParams() (*chaincfg.Params, error) {
+	return w.params, nil
+}
+
+// IsMyFreshMyAddress is true for one of our receive addresses that hasn't been paid yet
+func (w *Wallet) IsMyFreshMyAddress(address string) (bool, error) {
+	decoded, err := util.DecodeAddress(address, w.params)
+	if err != nil {
+		return false, nil
+	}
+	pkScript, err := util.PayToAddrScript(decoded)
+	if err != nil {
+		return false, nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	script, ok := w.scripts[string(pkScript)]
+	return ok && !script.branch.change && !script.received, nil
+}
+
+// ListUnspent is every unspent we could spend right now (so not locked, or already spent by us)
+func (w *Wallet) ListUnspent() ([]btcjson.ListUnspentResult, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var results []btcjson.ListUnspentResult
+	for outpoint, u := range w.utxos {
+		if _, ok := w.locked[outpoint]; ok {
+			continue
+		}
+		if _, ok := w.spent[outpoint]; ok {
+			continue
+		}
+		results = append(results, btcjson.ListUnspentResult{
+			TxID:          outpoint.Hash.String(),
+			Vout:          outpoint.Index,
+			Address:       u.script.address.EncodeAddress(),
+			ScriptPubKey:  hex.EncodeToString(u.txOut.PkScript),
+			RedeemScript:  hex.EncodeToString(u.script.redeemScript),
+			Amount:        btcutil.Amount(u.txOut.Value).ToBTC(),
+			Confirmations: w.height - u.height + 1,
+			Spendable:     u.script.privKey != nil,
+		})
+	}
+	return results, nil
+}
+
+// LockUnspent fails if outpoint is already locked, or isn't ours, like bitcoind
+func (w *Wallet) LockUnspent(outpoint wire.OutPoint) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.utxos[outpoint]; !ok {
+		return errors.Errorf("unknown unspent %v", outpoint)
+	}
+	if _, ok := w.locked[outpoint]; ok {
+		return errors.Errorf("unspent %v is already locked", outpoint)
+	}
+	w.locked[outpoint] = struct{}{}
+	return nil
+}
+
+func (w *Wallet) UnlockUnspent(outpoint wire.OutPoint) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.locked[outpoint]; !ok {
+		return errors.Errorf("unspent %v isn't locked", outpoint)
+	}
+	delete(w.locked, outpoint)
+	return nil
+}
+
+func (w *Wallet) GetTxOut(txid *chainhash.Hash, vout uint32) (*btcjson.GetTxOutResult, error) {
+	return w.chain.GetTxOut(txid, vout)
+}
+
+func (w *Wallet) TestMempoolAccept(tx *wire.MsgTx) (bool, error) {
+	return w.chain.TestMempoolAccept(tx)
+}
+
+// SendRawTransaction broadcasts tx, and remembers which of our unspents it spent (which don't need locking any more)
+func (w *Wallet) SendRawTransaction(tx *wire.MsgTx) (*chainhash.Hash, error) {
+	txid, err := w.chain.SendRawTransaction(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, txIn := range tx.TxIn {
+		if _, ok := w.utxos[txIn.PreviousOutPoint]; ok {
+			w.spent[txIn.PreviousOutPoint] = struct{}{}
+			delete(w.locked, txIn.PreviousOutPoint)
+		}
+	}
+	return txid, nil
+}
+
+// Confirmations is how many confirmations txid has, if it pays us (or spends from us) and Sync has seen it in a
+// block, or 0. With a ScriptSource only transactions that paid us are seen, not what spent them
+func (w *Wallet) Confirmations(txid chainhash.Hash) int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	height, ok := w.txHeights[txid]
+	if !ok {
+		return 0
+	}
+	return w.height - height + 1
+}
+
+// ownScript is the key for pkScript, if it's ours
+func (w *Wallet) ownScript(pkScript []byte) *ownedScript {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.scripts[string(pkScript)]
+}
+
+// ownPrevOut is the output outpoint spends, and its key, if it's one of our unspents
+func (w *Wallet) ownPrevOut(outpoint wire.OutPoint) (*wire.TxOut, *ownedScript) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if u, ok := w.utxos[outpoint]; ok {
+		return u.txOut, u.script
+	}
+	return nil, nil
+}
@@ -0,0 +1,141 @@
+package zmq
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Publisher is a stand-in for bitcoind's zmq notifications, for testing and local development without a node.
+// It publishes messages the same way bitcoind does, with a sequence number per topic
+type Publisher struct {
+	listener net.Listener
+
+	mu          sync.Mutex
+	subscribers map[*conn][][]byte // with their subscribed prefixes
+	sequences   map[string]uint32
+	wg          sync.WaitGroup
+}
+
+// Listen starts a publisher on addr, e.g. "127.0.0.1:0"
+func Listen(addr string) (*Publisher, error) {
+	listener, err := net.Listen("tcp", TrimScheme(addr))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	p := &Publisher{
+		listener:    listener,
+		subscribers: make(map[*conn][][]byte),
+		sequences:   make(map[string]uint32),
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for {
+			netConn, err := listener.Accept()
+			if err != nil {
+				return // closed
+			}
+			p.wg.Add(1)
+			go func() {
+				defer p.wg.Done()
+				p.serve(netConn)
+			}()
+		}
+	}()
+
+	return p, nil
+}
+
+// Addr is what subscribers should connect to
+func (p *Publisher) Addr() string {
+	return "tcp://" + p.listener.Addr().String()
+}
+
+// serve handshakes with a subscriber, then keeps track of its subscriptions until it goes away
+func (p *Publisher) serve(netConn net.Conn) {
+	defer netConn.Close()
+
+	c, err := handshake(netConn, "PUB", "SUB")
+	if err != nil {
+		return
+	}
+
+	p.mu.Lock()
+	p.subscribers[c] = nil
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		delete(p.subscribers, c)
+		p.mu.Unlock()
+	}()
+
+	for {
+		parts, err := c.readMessage()
+		if err != nil {
+			return
+		}
+		if len(parts) != 1 || len(parts[0]) == 0 || parts[0][0] != 1 {
+			continue // we only care about subscribing
+		}
+		p.mu.Lock()
+		p.subscribers[c] = append(p.subscribers[c], parts[0][1:])
+		p.mu.Unlock()
+	}
+}
+
+// Publish sends body to every subscriber subscribed to topic. Like zmq, it's fire and forget: subscribers that
+// haven't finished subscribing yet miss out
+func (p *Publisher) Publish(topic string, body []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sequence := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sequence, p.sequences[topic])
+	p.sequences[topic]++
+
+	for c, prefixes := range p.subscribers {
+		for _, prefix := range prefixes {
+			if bytes.HasPrefix([]byte(topic), prefix) {
+				c.writeMessage([]byte(topic), body, sequence)
+				break
+			}
+		}
+	}
+}
+
+// Subscribers is how many subscribers would get a message on topic, which is handy for waiting until they're ready
+func (p *Publisher) Subscribers(topic string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	count := 0
+	for _, prefixes := range p.subscribers {
+		for _, prefix := range prefixes {
+			if bytes.HasPrefix([]byte(topic), prefix) {
+				count++
+				break
+			}
+		}
+	}
+	return count
+}
+
+func (p *Publisher) Close() error {
+	err := p.listener.Close()
+
+	p.mu.Lock()
+	for c := range p.subscribers {
+		c.Close()
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+	return errors.WithStack(err)
+}
@@ -0,0 +1,63 @@
+package zmq
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// Subscriber is a SUB socket connected to a single publisher. It doesn't reconnect, if Receive fails the caller
+// should Close it and Subscribe again
+type Subscriber struct {
+	conn *conn
+}
+
+// Subscribe connects to the publisher at addr (host:port) and subscribes to topics, e.g. "rawtx" and "hashblock"
+func Subscribe(ctx context.Context, addr string, topics ...string) (*Subscriber, error) {
+	var dialer net.Dialer
+	netConn, err := dialer.DialContext(ctx, "tcp", TrimScheme(addr))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	c, err := handshake(netConn, "SUB", "PUB")
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	// in zmtp 3.0 a subscription is a message of 0x01 followed by the topic prefix
+	for _, topic := range topics {
+		if err := c.writeMessage(append([]byte{1}, topic...)); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+
+	return &Subscriber{conn: c}, nil
+}
+
+// Receive blocks until the next message arrives. Close the subscriber to unblock it
+func (s *Subscriber) Receive() (*Message, error) {
+	for {
+		parts, err := s.conn.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) < 2 {
+			continue // not something bitcoind would send
+		}
+
+		message := &Message{Topic: string(parts[0]), Body: parts[1]}
+		if len(parts) > 2 && len(parts[2]) == 4 {
+			message.Sequence = binary.LittleEndian.Uint32(parts[2])
+		}
+		return message, nil
+	}
+}
+
+func (s *Subscriber) Close() error {
+	return s.conn.Close()
+}
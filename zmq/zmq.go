@@ -0,0 +1,200 @@
+// Package zmq is just enough of ZMTP 3.0 (the zeromq wire protocol) to subscribe to bitcoind's zmq notifications,
+// without needing libzmq and cgo. Only PUB/SUB over tcp with the NULL mechanism is supported.
+//
+// bitcoind publishes multipart messages of [topic, body, 4 byte little endian sequence number], e.g. with
+// -zmqpubrawtx=tcp://127.0.0.1:28332 the body of "rawtx" messages is a serialized transaction.
+package zmq
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	flagMore    = 0x01
+	flagLong    = 0x02
+	flagCommand = 0x04
+
+	maxFrameSize = 64 * 1024 * 1024 // more than enough for a block, which bitcoind can publish with rawblock
+)
+
+// Message is a notification, as published by bitcoind
+type Message struct {
+	Topic    string
+	Body     []byte
+	Sequence uint32
+}
+
+// conn is a zmtp connection that has done its handshake
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// TrimScheme turns bitcoind's tcp://127.0.0.1:28332 style endpoints into an address we can dial
+func TrimScheme(endpoint string) string {
+	return strings.TrimPrefix(endpoint, "tcp://")
+}
+
+// handshake exchanges greetings and READY commands, and checks the peer is the socket type we expect
+func handshake(netConn net.Conn, socketType string, peerType string) (*conn, error) {
+	c := &conn{Conn: netConn, r: bufio.NewReader(netConn)}
+
+	greeting := make([]byte, 64)
+	greeting[0] = 0xff
+	greeting[9] = 0x7f
+	greeting[10] = 3 // version 3.0
+	greeting[11] = 0
+	copy(greeting[12:32], "NULL")
+	if _, err := c.Write(greeting); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	peerGreeting := make([]byte, 64)
+	if _, err := io.ReadFull(c.r, peerGreeting); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if peerGreeting[0] != 0xff || peerGreeting[9] != 0x7f || peerGreeting[10] < 3 {
+		return nil, errors.New("peer does not speak zmtp 3")
+	}
+	if mechanism := string(bytes.TrimRight(peerGreeting[12:32], "\x00")); mechanism != "NULL" {
+		return nil, errors.Errorf("unsupported zmtp security mechanism %q", mechanism)
+	}
+
+	ready := []byte{5}
+	ready = append(ready, "READY"...)
+	ready = appendProperty(ready, "Socket-Type", socketType)
+	if err := c.writeFrame(ready, flagCommand); err != nil {
+		return nil, err
+	}
+
+	body, flags, err := c.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	if flags&flagCommand == 0 || len(body) < 6 || string(body[1:6]) != "READY" {
+		return nil, errors.New("expected a zmtp READY command")
+	}
+	properties, err := parseProperties(body[6:])
+	if err != nil {
+		return nil, err
+	}
+	if properties["socket-type"] != peerType {
+		return nil, errors.Errorf("expected a %v socket, peer is %q", peerType, properties["socket-type"])
+	}
+
+	return c, nil
+}
+
+func appendProperty(b []byte, name string, value string) []byte {
+	b = append(b, byte(len(name)))
+	b = append(b, name...)
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(value)))
+	b = append(b, size[:]...)
+	return append(b, value...)
+}
+
+// property names are case insensitive, so they're lowercased
+func parseProperties(b []byte) (map[string]string, error) {
+	properties := make(map[string]string)
+	for len(b) > 0 {
+		nameSize := int(b[0])
+		if len(b) < 1+nameSize+4 {
+			return nil, errors.New("malformed zmtp property")
+		}
+		name := strings.ToLower(string(b[1 : 1+nameSize]))
+		valueSize := int(binary.BigEndian.Uint32(b[1+nameSize:]))
+		b = b[1+nameSize+4:]
+		if len(b) < valueSize {
+			return nil, errors.New("malformed zmtp property")
+		}
+		properties[name] = string(b[:valueSize])
+		b = b[valueSize:]
+	}
+	return properties, nil
+}
+
+func (c *conn) writeFrame(body []byte, flags byte) error {
+	var header []byte
+	if len(body) > 255 {
+		header = make([]byte, 9)
+		header[0] = flags | flagLong
+		binary.BigEndian.PutUint64(header[1:], uint64(len(body)))
+	} else {
+		header = []byte{flags, byte(len(body))}
+	}
+
+	if _, err := c.Write(append(header, body...)); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (c *conn) readFrame() ([]byte, byte, error) {
+	flags, err := c.r.ReadByte()
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+
+	var size uint64
+	if flags&flagLong != 0 {
+		var b [8]byte
+		if _, err := io.ReadFull(c.r, b[:]); err != nil {
+			return nil, 0, errors.WithStack(err)
+		}
+		size = binary.BigEndian.Uint64(b[:])
+	} else {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return nil, 0, errors.WithStack(err)
+		}
+		size = uint64(b)
+	}
+	if size > maxFrameSize {
+		return nil, 0, errors.Errorf("zmtp frame of %v bytes is too big", size)
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	return body, flags, nil
+}
+
+// readMessage reads all the frames of the next message, skipping any commands (like PING)
+func (c *conn) readMessage() ([][]byte, error) {
+	var parts [][]byte
+	for {
+		body, flags, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		if flags&flagCommand != 0 {
+			continue
+		}
+		parts = append(parts, body)
+		if flags&flagMore == 0 {
+			return parts, nil
+		}
+	}
+}
+
+func (c *conn) writeMessage(parts ...[]byte) error {
+	for i, part := range parts {
+		var flags byte
+		if i < len(parts)-1 {
+			flags = flagMore
+		}
+		if err := c.writeFrame(part, flags); err != nil {
+			return err
+		}
+	}
+	return nil
+}